@@ -4,19 +4,23 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/MG-RAST/AWE/lib/audit"
 	"github.com/MG-RAST/AWE/lib/auth"
 	"github.com/MG-RAST/AWE/lib/conf"
 	"github.com/MG-RAST/AWE/lib/controller"
 	"github.com/MG-RAST/AWE/lib/core"
 	"github.com/MG-RAST/AWE/lib/db"
+	"github.com/MG-RAST/AWE/lib/group"
 	"github.com/MG-RAST/AWE/lib/logger"
 	"github.com/MG-RAST/AWE/lib/logger/event"
+	"github.com/MG-RAST/AWE/lib/request"
 	"github.com/MG-RAST/AWE/lib/user"
 	"github.com/MG-RAST/AWE/lib/versions"
 	"github.com/MG-RAST/golib/go-uuid/uuid"
 	"github.com/MG-RAST/golib/goweb"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"runtime"
@@ -125,12 +129,28 @@ func launchSite(control chan int, port int) {
 func launchAPI(control chan int, port int) {
 	c := controller.NewServerController()
 	//goweb.ConfigureDefaultFormatters()
-	r := &goweb.RouteManager{}
+	// the API uses the default route manager so that its handler can be wrapped by the rate limits
+	r := goweb.DefaultRouteManager
+	r.Map("/job/bulk/{bid}", c.JobBulk)
+	r.Map("/job/bulk", c.JobBulk)
 	r.Map("/job/{jid}/acl/{type}", c.JobAcl["typed"])
 	r.Map("/job/{jid}/acl", c.JobAcl["base"])
 	r.Map("/cgroup/{cgid}/acl/{type}", c.ClientGroupAcl["typed"])
 	r.Map("/cgroup/{cgid}/acl", c.ClientGroupAcl["base"])
 	r.Map("/cgroup/{cgid}/token", c.ClientGroupToken)
+	r.Map("/cgroup/{cgid}/registry", c.ClientGroupRegistry)
+	r.Map("/work/{wid}/files", c.WorkFiles)
+	r.Map("/group/{name}/{type}", c.GroupTyped)
+	r.Map("/user/{uid}/token/{tid}", c.UserToken)
+	r.Map("/user/{uid}/token", c.UserToken)
+	r.Map("/ga4gh/wes/v1/service-info", c.Wes["service-info"])
+	r.Map("/ga4gh/wes/v1/runs/{run_id}/status", c.Wes["status"])
+	r.Map("/ga4gh/wes/v1/runs/{run_id}/cancel", c.Wes["cancel"])
+	r.Map("/ga4gh/wes/v1/runs/{run_id}", c.Wes["run"])
+	r.Map("/ga4gh/wes/v1/runs", c.Wes["runs"])
+	r.Map("/ga4gh/tes/v1/service-info", c.Tes["service-info"])
+	r.Map("/ga4gh/tes/v1/tasks/{id}", c.Tes["task"])
+	r.Map("/ga4gh/tes/v1/tasks", c.Tes["tasks"])
 	r.MapRest("/job", c.Job)
 	r.MapRest("/work", c.Work)
 	r.MapRest("/cgroup", c.ClientGroup)
@@ -138,15 +158,19 @@ func launchAPI(control chan int, port int) {
 	r.MapRest("/queue", c.Queue)
 	r.MapRest("/logger", c.Logger)
 	r.MapRest("/awf", c.Awf)
+	r.MapRest("/group", c.Group)
+	r.MapRest("/user", c.User)
+	r.MapRest("/audit", c.Audit)
 	r.MapFunc("*", controller.ResourceDescription, goweb.GetMethod)
+	handler := request.RateLimit(goweb.DefaultHttpHandler)
 	if conf.SSL_ENABLED {
-		err := goweb.ListenAndServeRoutesTLS(fmt.Sprintf(":%d", conf.API_PORT), conf.SSL_CERT_FILE, conf.SSL_KEY_FILE, r)
+		err := http.ListenAndServeTLS(fmt.Sprintf(":%d", conf.API_PORT), conf.SSL_CERT_FILE, conf.SSL_KEY_FILE, handler)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "ERROR: api: %v\n", err)
 			logger.Error("ERROR: api: " + err.Error())
 		}
 	} else {
-		err := goweb.ListenAndServeRoutes(fmt.Sprintf(":%d", conf.API_PORT), r)
+		err := http.ListenAndServe(fmt.Sprintf(":%d", conf.API_PORT), handler)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "ERROR: api: %v\n", err)
 			logger.Error("ERROR: api: " + err.Error())
@@ -206,6 +230,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	//init keys for secrets at rest
+	if err := core.InitSecrets(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR initializing secrets: %s\n", err.Error())
+		os.Exit(1)
+	}
+
 	//init versions
 	if err := versions.Initialize(); err != nil {
 		fmt.Fprintf(os.Stderr, "Err@versions.Initialize: %v\n", err)
@@ -222,6 +252,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	//init db collection for groups, ACL checks resolve memberships from here on
+	if err := group.Initialize(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR initializing group database: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	//init db collection for the audit log
+	if err := audit.Initialize(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR initializing audit database: %s\n", err.Error())
+		os.Exit(1)
+	}
+
 	logger.Info("init resource manager...")
 
 	//init resource manager
@@ -239,6 +281,7 @@ func main() {
 	logger.Info("init auth...")
 	//init auth
 	auth.Initialize()
+	request.InitRateLimits()
 
 	controller.PrintLogo()
 	conf.Print("server")
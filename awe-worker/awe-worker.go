@@ -27,7 +27,10 @@ func main() {
 	}
 
 	worker.Client_mode = "online"
-	if conf.CWL_TOOL != "" || conf.CWL_JOB != "" {
+	if conf.LOCAL_RUNNER {
+		worker.Client_mode = "local"
+		conf.LOG_OUTPUT = "console"
+	} else if conf.CWL_TOOL != "" || conf.CWL_JOB != "" {
 		worker.Client_mode = "offline"
 		conf.LOG_OUTPUT = "console"
 	}
@@ -127,6 +130,18 @@ func main() {
 
 	worker.InitWorkers()
 
+	if worker.Client_mode == "local" {
+		err = worker.RunLocalWorkflow(conf.CWL_TOOL, conf.CWL_JOB)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err.Error())
+			logger.Error("(worker.main) RunLocalWorkflow returned: %s", err.Error())
+			time.Sleep(time.Second)
+			os.Exit(1)
+		}
+		time.Sleep(time.Second)
+		os.Exit(0)
+	}
+
 	if worker.Client_mode == "offline" {
 		if conf.CWL_JOB == "" {
 			logger.Error("cwl job file missing")
@@ -166,6 +181,7 @@ func main() {
 		cmd.Name = "/usr/bin/cwl-runner"
 
 		cmd.ArgsArray = []string{"--leave-outputs", "--leave-tmpdir", "--tmp-outdir-prefix", "./tmp/", "--tmpdir-prefix", "./tmp/", "--disable-pull", "--rm-container", "--on-error", "stop", workunit.CWL_workunit.Tool_filename, workunit.CWL_workunit.Job_input_filename}
+		cmd.ArgsArray = append(worker.CWLRunnerContainerArgs(), cmd.ArgsArray...)
 		if conf.CWL_RUNNER_ARGS != "" {
 			cwl_runner_args_array := strings.Split(conf.CWL_RUNNER_ARGS, " ")
 			cmd.ArgsArray = append(cwl_runner_args_array, cmd.ArgsArray...)
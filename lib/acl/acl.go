@@ -12,6 +12,25 @@ type Acl struct {
 
 type Rights map[string]bool
 
+// ACL lists contain user uuids, "public", groups as "group:<name>" and groups asserted by an
+// identity provider as "idp-group:<name>", the two never match each other
+const GROUP_PREFIX = "group:"
+const CLAIMED_GROUP_PREFIX = "idp-group:"
+
+// Memberships returns the groups (as "group:<name>") a user belongs to. It is set by the
+// group package, without it ACLs only match users.
+var Memberships func(uuid string) []string
+
+// Principals returns the ids under which a user can appear in ACL lists
+func Principals(uuid string) (ids []string) {
+	ids = []string{uuid}
+	if Memberships == nil || uuid == "public" {
+		return
+	}
+	ids = append(ids, Memberships(uuid)...)
+	return
+}
+
 func (a *Acl) SetOwner(str string) {
 	a.Owner = str
 	return
@@ -43,18 +62,26 @@ func (a *Acl) Set(str string, r Rights) {
 	return
 }
 
+// Check returns the rights of a user, directly or through one of its groups
 func (a *Acl) Check(str string) (r Rights) {
 	r = Rights{"read": false, "write": false, "delete": false}
 	acls := map[string][]string{"read": a.Read, "write": a.Write, "delete": a.Delete}
+	principals := Principals(str)
 	for k, v := range acls {
-		for _, id := range v {
-			if str == id {
-				r[k] = true
-				break
+		r[k] = containsAny(v, principals)
+	}
+	return
+}
+
+func containsAny(arr []string, ids []string) bool {
+	for _, item := range arr {
+		for _, id := range ids {
+			if item == id {
+				return true
 			}
 		}
 	}
-	return
+	return false
 }
 
 func del(arr []string, s string) (narr []string) {
@@ -0,0 +1,112 @@
+// Package audit keeps an append-only record of administrative and destructive API calls
+package audit
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/db"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const collection = "Audit"
+
+// set by Initialize, services without the database (e.g. the proxy) do not record anything
+var enabled bool
+
+// Entry is one API call, entries are only ever inserted
+type Entry struct {
+	Time         time.Time         `bson:"time" json:"time"`
+	Actor        string            `bson:"actor" json:"actor"` // user uuid, empty if the request was not authenticated
+	Username     string            `bson:"username" json:"username"`
+	Action       string            `bson:"action" json:"action"` // <resource>.<operation>, e.g. job.suspend
+	Target       string            `bson:"target" json:"target"`
+	Params       map[string]string `bson:"params" json:"params"`
+	Status       int               `bson:"status" json:"status"` // HTTP status of the response
+	Success      bool              `bson:"success" json:"success"`
+	Error        string            `bson:"error,omitempty" json:"error,omitempty"`
+	SourceIP     string            `bson:"source_ip" json:"source_ip"`
+	ForwardedFor string            `bson:"forwarded_for,omitempty" json:"forwarded_for,omitempty"`
+}
+
+type Entries []Entry
+
+// Filter selects entries, empty fields match everything
+type Filter struct {
+	From   time.Time
+	To     time.Time
+	Actor  string
+	Action string // an action or a resource prefix like "job."
+	Target string
+}
+
+func Initialize() (err error) {
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C(collection)
+	if err = c.EnsureIndex(mgo.Index{Key: []string{"time"}, Background: true}); err != nil {
+		return
+	}
+	if err = c.EnsureIndex(mgo.Index{Key: []string{"actor", "time"}, Background: true}); err != nil {
+		return
+	}
+	if err = c.EnsureIndex(mgo.Index{Key: []string{"target", "time"}, Background: true}); err != nil {
+		return
+	}
+	enabled = true
+	return
+}
+
+func Insert(entry *Entry) (err error) {
+	if !enabled {
+		return
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C(collection)
+	err = c.Insert(entry)
+	return
+}
+
+// Find returns the matching entries, newest first, and the number of all matching entries
+func Find(filter Filter, limit int, offset int) (entries Entries, total int, err error) {
+	q := bson.M{}
+	if !filter.From.IsZero() || !filter.To.IsZero() {
+		time_query := bson.M{}
+		if !filter.From.IsZero() {
+			time_query["$gte"] = filter.From
+		}
+		if !filter.To.IsZero() {
+			time_query["$lt"] = filter.To
+		}
+		q["time"] = time_query
+	}
+	if filter.Actor != "" {
+		q["$or"] = []bson.M{bson.M{"actor": filter.Actor}, bson.M{"username": filter.Actor}}
+	}
+	if strings.HasSuffix(filter.Action, ".") {
+		q["action"] = bson.M{"$regex": "^" + regexp.QuoteMeta(filter.Action)}
+	} else if filter.Action != "" {
+		q["action"] = filter.Action
+	}
+	if filter.Target != "" {
+		q["target"] = filter.Target
+	}
+
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C(collection)
+	query := c.Find(q)
+	if total, err = query.Count(); err != nil {
+		return
+	}
+	entries = Entries{}
+	err = query.Sort("-time").Skip(offset).Limit(limit).All(&entries)
+	return
+}
@@ -3,9 +3,12 @@ package auth
 
 import (
 	"errors"
+	"github.com/MG-RAST/AWE/lib/auth/basic"
 	"github.com/MG-RAST/AWE/lib/auth/clientgroup"
 	"github.com/MG-RAST/AWE/lib/auth/globus"
+	"github.com/MG-RAST/AWE/lib/auth/jwt"
 	"github.com/MG-RAST/AWE/lib/auth/oauth"
+	"github.com/MG-RAST/AWE/lib/auth/token"
 	"github.com/MG-RAST/AWE/lib/conf"
 	"github.com/MG-RAST/AWE/lib/core"
 	e "github.com/MG-RAST/AWE/lib/errors"
@@ -20,6 +23,18 @@ var authMethods []func(string) (*user.User, error)
 func Initialize() {
 	authCache = cache{m: make(map[string]cacheValue)}
 	authMethods = []func(string) (*user.User, error){}
+	// local methods first, they ignore headers they do not know
+	authMethods = append(authMethods, token.Auth)
+	if conf.JWT_JWKS != "" {
+		// keys that can not be loaded now are picked up once the files are fixed
+		if err := jwt.Initialize(); err != nil {
+			logger.Error("(auth.Initialize) %s", err.Error())
+		}
+		authMethods = append(authMethods, jwt.Auth)
+	}
+	if conf.BASIC_AUTH {
+		authMethods = append(authMethods, basic.Auth)
+	}
 	if len(conf.AUTH_OAUTH) > 0 {
 		authMethods = append(authMethods, oauth.Auth)
 	}
@@ -52,6 +67,16 @@ func Authenticate(header string) (u *user.User, err error) {
 	return nil, errors.New(e.InvalidAuth)
 }
 
+// InvalidateToken removes a deleted token from the cache
+func InvalidateToken(id string) {
+	authCache.remove(func(u *user.User) bool { return u.TokenId == id })
+}
+
+// InvalidateUser removes all cached logins and tokens of a user, e.g. after a password change
+func InvalidateUser(uuid string) {
+	authCache.remove(func(u *user.User) bool { return u.Uuid == uuid })
+}
+
 func AuthenticateClientGroup(header string) (cg *core.ClientGroup, err error) {
 	if cg, err = clientgroup.Auth(header); err != nil {
 		return nil, err
@@ -13,9 +13,16 @@ import (
 // DecodeHeader takes the request authorization header and returns
 // username and password if it is correctly encoded.
 func DecodeHeader(header string) (username string, password string, err error) {
-	if strings.ToLower(strings.Split(header, " ")[0]) == "basic" {
-		if val, err := base64.URLEncoding.DecodeString(strings.Split(header, " ")[1]); err == nil {
-			tmp := strings.Split(string(val), ":")
+	if strings.ToLower(strings.Split(header, " ")[0]) == "basic" && len(strings.Split(header, " ")) > 1 {
+		encoded := strings.Split(header, " ")[1]
+		val, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			// older clients used URL encoding
+			val, err = base64.URLEncoding.DecodeString(encoded)
+		}
+		if err == nil {
+			// passwords may contain colons
+			tmp := strings.SplitN(string(val), ":", 2)
 			if len(tmp) >= 2 {
 				return tmp[0], tmp[1], nil
 			} else {
@@ -30,8 +37,11 @@ func DecodeHeader(header string) (username string, password string, err error) {
 }
 
 // Auth takes the request authorization header and returns
-// user
+// the local user, headers of other auth methods are ignored
 func Auth(header string) (u *user.User, err error) {
+	if strings.ToLower(strings.Split(header, " ")[0]) != "basic" {
+		return nil, nil
+	}
 	username, password, err := DecodeHeader(header)
 	if err == nil {
 		return user.FindByUsernamePassword(username, password)
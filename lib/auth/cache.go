@@ -17,12 +17,12 @@ type cacheValue struct {
 }
 
 func (c *cache) lookup(header string) *user.User {
+	c.Lock()
+	defer c.Unlock()
 	if v, ok := c.m[header]; ok {
 		if time.Now().Before(v.expires) {
 			return v.user
 		} else {
-			c.Lock()
-			defer c.Unlock()
 			delete(c.m, header)
 		}
 	}
@@ -32,9 +32,24 @@ func (c *cache) lookup(header string) *user.User {
 func (c *cache) add(header string, u *user.User) {
 	c.Lock()
 	defer c.Unlock()
+	expires := time.Now().Add(1 * time.Hour)
+	if !u.TokenExpires.IsZero() && u.TokenExpires.Before(expires) {
+		expires = u.TokenExpires
+	}
 	c.m[header] = cacheValue{
-		expires: time.Now().Add(1 * time.Hour),
+		expires: expires,
 		user:    u,
 	}
 	return
 }
+
+func (c *cache) remove(match func(*user.User) bool) {
+	c.Lock()
+	defer c.Unlock()
+	for header, v := range c.m {
+		if match(v.user) {
+			delete(c.m, header)
+		}
+	}
+	return
+}
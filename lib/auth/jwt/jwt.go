@@ -0,0 +1,313 @@
+// Package jwt implements authentication with JWT bearer tokens (e.g. OIDC access or ID
+// tokens) that are validated with local keys, without asking the identity provider
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/group"
+	"github.com/MG-RAST/AWE/lib/user"
+)
+
+var keys *keySet
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// Claims of a validated token
+type Claims map[string]interface{}
+
+// Initialize loads the keys of conf.JWT_JWKS
+func Initialize() (err error) {
+	keys, err = newKeySet(conf.JWT_JWKS)
+	return
+}
+
+// Auth takes the request authorization header ("Bearer <jwt>" or "jwt <jwt>") and returns
+// the user of a valid token. Headers that do not carry a JWT are ignored.
+func Auth(header string) (u *user.User, err error) {
+	tmp := strings.Fields(header)
+	if len(tmp) != 2 || strings.Count(tmp[1], ".") != 2 {
+		return nil, nil
+	}
+	switch strings.ToLower(tmp[0]) {
+	case "bearer", "jwt":
+	default:
+		return nil, nil
+	}
+	if keys == nil {
+		return nil, errors.New("(jwt.Auth) no keys loaded")
+	}
+
+	claims, err := Validate(tmp[1])
+	if err != nil {
+		return nil, fmt.Errorf("(jwt.Auth) %s", err.Error())
+	}
+	u, err = claims.user()
+	if err != nil {
+		return nil, fmt.Errorf("(jwt.Auth) %s", err.Error())
+	}
+	return
+}
+
+// Validate checks the signature and the registered claims (exp, nbf, iat, iss, aud) of a
+// token and returns its claims
+func Validate(token string) (claims Claims, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		err = errors.New("malformed token")
+		return
+	}
+
+	h := header{}
+	data, err := decodeSegment(parts[0])
+	if err != nil {
+		err = fmt.Errorf("malformed token header: %s", err.Error())
+		return
+	}
+	if err = json.Unmarshal(data, &h); err != nil {
+		err = fmt.Errorf("malformed token header: %s", err.Error())
+		return
+	}
+	signature, err := decodeSegment(parts[2])
+	if err != nil {
+		err = fmt.Errorf("malformed token signature: %s", err.Error())
+		return
+	}
+	if err = verify(h, parts[0]+"."+parts[1], signature); err != nil {
+		return
+	}
+
+	data, err = decodeSegment(parts[1])
+	if err != nil {
+		err = fmt.Errorf("malformed token payload: %s", err.Error())
+		return
+	}
+	claims = Claims{}
+	if err = json.Unmarshal(data, &claims); err != nil {
+		err = fmt.Errorf("malformed token payload: %s", err.Error())
+		return
+	}
+	if err = claims.validate(time.Now()); err != nil {
+		claims = nil
+	}
+	return
+}
+
+// verify checks the signature with the keys that match the key id and algorithm, "none"
+// and the HMAC algorithms are not accepted
+func verify(h header, signed string, signature []byte) (err error) {
+	var hash crypto.Hash
+	switch h.Alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	case "EdDSA":
+	default:
+		return fmt.Errorf("unsupported algorithm %q", h.Alg)
+	}
+	var digest []byte
+	if hash != 0 {
+		hasher := hash.New()
+		hasher.Write([]byte(signed))
+		digest = hasher.Sum(nil)
+	}
+
+	candidates := keys.find(h.Kid, h.Alg)
+	if len(candidates) == 0 {
+		return fmt.Errorf("no key for kid %q and algorithm %s", h.Kid, h.Alg)
+	}
+	for _, k := range candidates {
+		switch key := k.key.(type) {
+		case *rsa.PublicKey:
+			if strings.HasPrefix(h.Alg, "RS") && rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+				return nil
+			}
+			if strings.HasPrefix(h.Alg, "PS") && rsa.VerifyPSS(key, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			if !strings.HasPrefix(h.Alg, "ES") || len(signature) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(key, digest, r, s) {
+				return nil
+			}
+		case ed25519.PublicKey:
+			if h.Alg == "EdDSA" && ed25519.Verify(key, []byte(signed), signature) {
+				return nil
+			}
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+func (claims Claims) validate(now time.Time) (err error) {
+	skew := time.Duration(conf.JWT_CLOCK_SKEW) * time.Second
+
+	exp, ok := claims.time("exp")
+	if !ok {
+		return errors.New("token has no exp claim")
+	}
+	if now.After(exp.Add(skew)) {
+		return fmt.Errorf("token expired at %s", exp.Format(time.RFC3339))
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(skew).Before(nbf) {
+		return fmt.Errorf("token not valid before %s", nbf.Format(time.RFC3339))
+	}
+	if iat, ok := claims.time("iat"); ok && now.Add(skew).Before(iat) {
+		return errors.New("token issued in the future")
+	}
+
+	// tokens of other issuers or for other services are never accepted, Init_conf refuses
+	// a configuration without them
+	if conf.JWT_ISSUER == "" || conf.JWT_AUDIENCE == "" {
+		return errors.New("jwt_issuer and jwt_audience are not configured")
+	}
+	if iss, _ := claims["iss"].(string); iss != conf.JWT_ISSUER {
+		return fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return errors.New("token has no sub claim")
+	}
+	audiences := claims.strings("aud")
+	found := false
+	for _, aud := range strings.Split(conf.JWT_AUDIENCE, ",") {
+		if aud = strings.TrimSpace(aud); aud != "" && contains(audiences, aud) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("unexpected audience %v", audiences)
+	}
+	return
+}
+
+// user maps the token to the user with the same iss and sub claims, the user is created on
+// first login. The username claim only names a new user, it never selects an existing one.
+func (claims Claims) user() (u *user.User, err error) {
+	username, _ := claims.get(conf.JWT_CLAIM_USERNAME).(string)
+	if username == "" {
+		return nil, fmt.Errorf("claim %s is missing", conf.JWT_CLAIM_USERNAME)
+	}
+	issuer, _ := claims["iss"].(string)
+	subject, _ := claims["sub"].(string)
+	u, err = user.FindOrCreateByIdentity(user.Identity{Issuer: issuer, Subject: subject}, username)
+	if err != nil {
+		return nil, fmt.Errorf("MongoDB: %s", err.Error())
+	}
+	if name, ok := claims.get(conf.JWT_CLAIM_NAME).(string); ok {
+		u.Fullname = name
+	}
+	if email, ok := claims.get(conf.JWT_CLAIM_EMAIL).(string); ok {
+		u.Email = email
+	}
+	if claims.isAdmin() {
+		u.Admin = true
+	}
+
+	// cached logins must not outlive the token
+	u.TokenExpires, _ = claims.time("exp")
+	if conf.JWT_CLAIM_GROUPS != "" {
+		names := []string{}
+		for _, name := range claims.strings(conf.JWT_CLAIM_GROUPS) {
+			// group paths like "/team" refer to the group "team"
+			names = append(names, strings.TrimPrefix(name, "/"))
+		}
+		group.SetClaimedGroups(u.Uuid, names, u.TokenExpires)
+	}
+	return
+}
+
+// isAdmin is true if the admin claim is true or, with conf.JWT_ADMIN_VALUE, contains that value
+func (claims Claims) isAdmin() bool {
+	if conf.JWT_CLAIM_ADMIN == "" {
+		return false
+	}
+	if conf.JWT_ADMIN_VALUE == "" {
+		switch v := claims.get(conf.JWT_CLAIM_ADMIN).(type) {
+		case bool:
+			return v
+		case string:
+			return v == "true"
+		}
+		return false
+	}
+	return contains(claims.strings(conf.JWT_CLAIM_ADMIN), conf.JWT_ADMIN_VALUE)
+}
+
+// get returns a claim, nested claims can be addressed as "a.b" (e.g. realm_access.roles)
+func (claims Claims) get(name string) interface{} {
+	if name == "" {
+		return nil
+	}
+	if v, ok := claims[name]; ok {
+		return v
+	}
+	var v interface{} = map[string]interface{}(claims)
+	for _, key := range strings.Split(name, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if v, ok = m[key]; !ok {
+			return nil
+		}
+	}
+	return v
+}
+
+// strings returns a claim that is a string, a list of strings or a space or comma separated
+// list (like scope)
+func (claims Claims) strings(name string) (values []string) {
+	switch v := claims.get(name).(type) {
+	case string:
+		values = strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	return
+}
+
+func (claims Claims) time(name string) (t time.Time, ok bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return
+	}
+	sec := int64(v)
+	t = time.Unix(sec, int64((v-float64(sec))*1e9))
+	return
+}
+
+func contains(arr []string, s string) bool {
+	for _, item := range arr {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package jwt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+)
+
+func TestClaimsValidate(t *testing.T) {
+	now := time.Now()
+	exp := float64(now.Add(time.Hour).Unix())
+	valid := func() Claims {
+		return Claims{"iss": "https://idp", "sub": "1234", "aud": []interface{}{"other", "awe"}, "exp": exp}
+	}
+	with := func(name string, value interface{}) Claims {
+		claims := valid()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name     string
+		issuer   string
+		audience string
+		claims   Claims
+		fails    bool
+	}{
+		{"valid", "https://idp", "awe", valid(), false},
+		{"one of several audiences", "https://idp", "x, awe", valid(), false},
+		{"no issuer configured", "", "awe", valid(), true},
+		{"no audience configured", "https://idp", "", valid(), true},
+		{"empty audience entry", "https://idp", " ,", with("aud", ""), true},
+		{"other issuer", "https://idp", "awe", with("iss", "https://evil"), true},
+		{"no issuer", "https://idp", "awe", with("iss", nil), true},
+		{"other audience", "https://idp", "awe", with("aud", "other"), true},
+		{"no subject", "https://idp", "awe", with("sub", nil), true},
+		{"expired", "https://idp", "awe", with("exp", float64(now.Add(-time.Hour).Unix())), true},
+		{"no exp", "https://idp", "awe", with("exp", nil), true},
+	}
+
+	issuer, audience, skew := conf.JWT_ISSUER, conf.JWT_AUDIENCE, conf.JWT_CLOCK_SKEW
+	defer func() { conf.JWT_ISSUER, conf.JWT_AUDIENCE, conf.JWT_CLOCK_SKEW = issuer, audience, skew }()
+	conf.JWT_CLOCK_SKEW = 0
+
+	for _, test := range tests {
+		conf.JWT_ISSUER = test.issuer
+		conf.JWT_AUDIENCE = test.audience
+		err := test.claims.validate(now)
+		if (err != nil) != test.fails {
+			t.Errorf("%s: error=%v, expected failure %t", test.name, err, test.fails)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/logger"
+)
+
+const (
+	// how often the JWKS files are checked for changes
+	reloadInterval = 30 * time.Second
+	// minimal time between reloads triggered by an unknown key id
+	forcedReloadInterval = 5 * time.Second
+)
+
+// jwk is a JSON Web Key (RFC 7517) with the RSA, EC and OKP parameters
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type publicKey struct {
+	kid string
+	alg string // empty if the key does not restrict the algorithm
+	key crypto.PublicKey
+}
+
+// keySet holds the keys of the configured JWKS file or directory and reloads them when
+// the files change
+type keySet struct {
+	sync.RWMutex
+	path    string
+	keys    []publicKey
+	files   map[string]time.Time // file -> modification time of the loaded keys
+	checked time.Time
+	forced  time.Time
+}
+
+func newKeySet(path string) (ks *keySet, err error) {
+	ks = &keySet{path: path}
+	err = ks.load()
+	return
+}
+
+// find returns the keys that can verify a token with the key id and algorithm
+func (ks *keySet) find(kid string, alg string) (keys []publicKey) {
+	ks.reload(false)
+	keys = ks.match(kid, alg)
+	if len(keys) == 0 && kid != "" {
+		// the identity provider may have rotated its keys
+		ks.reload(true)
+		keys = ks.match(kid, alg)
+	}
+	return
+}
+
+func (ks *keySet) match(kid string, alg string) (keys []publicKey) {
+	ks.RLock()
+	defer ks.RUnlock()
+	for _, k := range ks.keys {
+		if kid != "" && k.kid != kid {
+			continue
+		}
+		if k.alg != "" && k.alg != alg {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return
+}
+
+// reload loads the keys again if a file changed, at most every reloadInterval
+// (forcedReloadInterval if force is set)
+func (ks *keySet) reload(force bool) {
+	ks.Lock()
+	now := time.Now()
+	if force {
+		if now.Sub(ks.forced) < forcedReloadInterval {
+			ks.Unlock()
+			return
+		}
+		ks.forced = now
+	} else if now.Sub(ks.checked) < reloadInterval {
+		ks.Unlock()
+		return
+	}
+	ks.checked = now
+	ks.Unlock()
+
+	files, err := ks.modTimes()
+	if err != nil {
+		logger.Error("(jwt.reload) %s", err.Error())
+		return
+	}
+	ks.RLock()
+	changed := len(files) != len(ks.files)
+	for file, mtime := range files {
+		if loaded, ok := ks.files[file]; !ok || !loaded.Equal(mtime) {
+			changed = true
+		}
+	}
+	ks.RUnlock()
+	if !changed {
+		return
+	}
+
+	// keep the old keys if the new files are broken
+	if err = ks.load(); err != nil {
+		logger.Error("(jwt.reload) %s", err.Error())
+		return
+	}
+	logger.Info("(jwt.reload) reloaded keys from %s", ks.path)
+}
+
+// modTimes lists the JWKS files, the path itself or the *.json files of a directory
+func (ks *keySet) modTimes() (files map[string]time.Time, err error) {
+	info, err := os.Stat(ks.path)
+	if err != nil {
+		return
+	}
+	files = make(map[string]time.Time)
+	if !info.IsDir() {
+		files[ks.path] = info.ModTime()
+		return
+	}
+	matches, err := filepath.Glob(filepath.Join(ks.path, "*.json"))
+	if err != nil {
+		return
+	}
+	for _, file := range matches {
+		if info, err = os.Stat(file); err != nil {
+			return
+		}
+		files[file] = info.ModTime()
+	}
+	return
+}
+
+func (ks *keySet) load() (err error) {
+	files, err := ks.modTimes()
+	if err != nil {
+		return fmt.Errorf("(jwt.load) %s", err.Error())
+	}
+	names := []string{}
+	for file := range files {
+		names = append(names, file)
+	}
+	sort.Strings(names)
+
+	keys := []publicKey{}
+	for _, file := range names {
+		var file_keys []publicKey
+		file_keys, err = readKeys(file)
+		if err != nil {
+			return fmt.Errorf("(jwt.load) %s: %s", file, err.Error())
+		}
+		keys = append(keys, file_keys...)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("(jwt.load) no keys found in %s", ks.path)
+	}
+
+	ks.Lock()
+	ks.keys = keys
+	ks.files = files
+	ks.Unlock()
+	return
+}
+
+// readKeys reads a JWKS ({"keys": [...]}) or a single JWK, keys that are not meant for
+// signatures or have an unsupported type are skipped
+func readKeys(file string) (keys []publicKey, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	set := jwks{}
+	if err = json.Unmarshal(data, &set); err != nil {
+		return
+	}
+	if set.Keys == nil {
+		single := jwk{}
+		if err = json.Unmarshal(data, &single); err != nil {
+			return
+		}
+		set.Keys = []jwk{single}
+	}
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, xerr := k.publicKey()
+		if xerr != nil {
+			logger.Warning("(jwt.readKeys) %s: skipping key %q: %s", file, k.Kid, xerr.Error())
+			continue
+		}
+		keys = append(keys, publicKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	return
+}
+
+func (k *jwk) publicKey() (key crypto.PublicKey, err error) {
+	switch k.Kty {
+	case "RSA":
+		var n, e []byte
+		if n, err = decodeSegment(k.N); err != nil {
+			return
+		}
+		if e, err = decodeSegment(k.E); err != nil {
+			return
+		}
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			err = errors.New("invalid RSA key")
+			return
+		}
+		key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			err = fmt.Errorf("unsupported curve %s", k.Crv)
+			return
+		}
+		var x, y []byte
+		if x, err = decodeSegment(k.X); err != nil {
+			return
+		}
+		if y, err = decodeSegment(k.Y); err != nil {
+			return
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			err = errors.New("invalid EC key")
+			return
+		}
+		key = pub
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			err = fmt.Errorf("unsupported curve %s", k.Crv)
+			return
+		}
+		var x []byte
+		if x, err = decodeSegment(k.X); err != nil {
+			return
+		}
+		if len(x) != ed25519.PublicKeySize {
+			err = errors.New("invalid Ed25519 key")
+			return
+		}
+		key = ed25519.PublicKey(x)
+	default:
+		err = fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	return
+}
+
+// decodeSegment decodes base64url, with or without padding
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,22 @@
+// Package token implements authentication with personal access tokens
+package token
+
+import (
+	"strings"
+
+	"github.com/MG-RAST/AWE/lib/user"
+)
+
+// Auth takes the request authorization header ("Bearer awe_..." or "token awe_...") and
+// returns the user with the scopes of the token. Other headers are ignored.
+func Auth(header string) (u *user.User, err error) {
+	tmp := strings.Fields(header)
+	if len(tmp) != 2 || !strings.HasPrefix(tmp[1], user.TOKEN_PREFIX) {
+		return nil, nil
+	}
+	switch strings.ToLower(tmp[0]) {
+	case "bearer", "token":
+		return user.FindByToken(tmp[1])
+	}
+	return nil, nil
+}
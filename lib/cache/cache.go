@@ -19,7 +19,7 @@ import (
 	"path"
 	"reflect"
 	"strings"
-	"time"
+	"sync/atomic"
 )
 
 func getCacheDir(id string) string {
@@ -57,9 +57,18 @@ func MoveInputIO(work *core.Workunit, io *core.IO, work_path string) (size int64
 
 		// create symlink if file has been cached
 		if work.Rank == 0 && conf.CACHE_ENABLED && io.Node != "" {
-			var file_path string
-			file_path, err = StatCacheFilePath(io.Node)
-			if err == nil {
+			var work_str string
+			work_str, err = work.Workunit_Unique_Identifier.String()
+			if err != nil {
+				return
+			}
+			file_path := getCacheFilePath(io.Node)
+			var cached bool
+			cached, err = Manager.Use(file_path, io.Node, work_str)
+			if err != nil {
+				return
+			}
+			if cached {
 				//make a link in work dir from cached file
 				linkname := fmt.Sprintf("%s/%s", work_path, io.FileName)
 				//fmt.Printf("input found in cache, making link: " + file_path + " -> " + linkname + "\n")
@@ -74,34 +83,23 @@ func MoveInputIO(work *core.Workunit, io *core.IO, work_path string) (size int64
 		}
 
 		// only get file Part based on work.Partition
+		expected_md5 := io.MD5
 		if (work.Rank > 0) && (work.Partition != nil) && (work.Partition.Input == io.FileName) {
 			dataUrl = fmt.Sprintf("%s&index=%s&part=%s", dataUrl, work.Partition.Index, work.Part())
+			expected_md5 = "" // the checksum is the one of the whole file
 		}
 		logger.Debug(2, "mover: fetching input file from url:"+dataUrl)
 		logger.Event(event.FILE_IN, "workid="+work.Id+";url="+dataUrl)
 
-		// download file
-		retry := 1
-		for true {
-			datamoved, _, err := shock.FetchFile(inputFilePath, dataUrl, work.Info.DataToken, io.Uncompress, false)
-			if err != nil {
-				if !strings.Contains(err.Error(), "Node has no file") {
-					logger.Debug(3, "(MoveInputData) got: %s", err.Error())
-					return size, err
-				}
-				logger.Debug(3, "(MoveInputData) got: Node has no file")
-				if retry >= 3 {
-					return size, err
-				}
-				logger.Warning("(MoveInputData) Will retry download, got this error: %s", err.Error())
-				time.Sleep(time.Second * 20)
-				retry += 1
-				continue
-			}
-
-			size += datamoved
-			break
+		// download file, retried and resumed on transient errors (including "Node has no file")
+		datamoved, sums, xerr := FetchFileVerified(inputFilePath, dataUrl, work.Info.DataToken, io.Uncompress, "md5", expected_md5, NewInputTransferStats(work.WorkPerf))
+		if xerr != nil {
+			logger.Debug(3, "(MoveInputData) got: %s", xerr.Error())
+			err = xerr
+			return
 		}
+		size += datamoved
+		io.Checksum = sums
 		logger.Event(event.FILE_READY, "workid="+work.Id+";url="+dataUrl)
 	}
 
@@ -183,12 +181,26 @@ func UploadFile(file *cwl.File, inputfile_path string, shock_client *shock.Shock
 		file_path = path.Join(inputfile_path, file_path)
 	}
 
+	sums, err := FileChecksums(file_path)
+	if err != nil {
+		err = fmt.Errorf("(UploadFile) %s", err.Error())
+		return
+	}
+
+	// not retried, every attempt would create a new node
 	nodeid, err := shock_client.PostFile(file_path, "")
 	if err != nil {
 		err = fmt.Errorf("(UploadFile) %s", err.Error())
 		return
 	}
 
+	err = VerifyUpload(shock_client.Host, nodeid, shock_client.Token, sums)
+	if err != nil {
+		err = fmt.Errorf("(UploadFile) %s", err.Error())
+		return
+	}
+	file.Checksum = "sha1$" + sums["sha1"]
+
 	file.Location_url, err = url.Parse(shock_client.Host + "/node/" + nodeid + "?download")
 	if err != nil {
 		err = fmt.Errorf("(UploadFile) url.Parse returned: %s", err.Error())
@@ -236,10 +248,21 @@ func DownloadFile(file *cwl.File, download_path string) (err error) {
 
 	//fmt.Printf("Using path %s\n", file_path)
 
-	_, _, err = shock.FetchFile(file_path, file.Location, "", "", false)
+	algo := "sha1"
+	expected := ""
+	if file.Checksum != "" {
+		algo, expected, err = ParseCWLChecksum(file.Checksum)
+		if err != nil {
+			return
+		}
+	}
+	_, sums, err := FetchFileVerified(file_path, file.Location, "", "", algo, expected, &TransferStats{})
 	if err != nil {
 		return
 	}
+	if file.Checksum == "" {
+		file.Checksum = "sha1$" + sums["sha1"]
+	}
 	file.Location = "file://" + file_path
 	file.Path = file_path
 
@@ -249,6 +272,52 @@ func DownloadFile(file *cwl.File, download_path string) (err error) {
 	return
 }
 
+// LocateLocalFile resolves a file on the local file system (local runner), nothing is copied.
+// Relative paths are relative to base_path.
+func LocateLocalFile(file *cwl.File, base_path string) (err error) {
+	file_path, err := localPath(file.Location, file.Path, base_path)
+	if err != nil {
+		err = fmt.Errorf("(LocateLocalFile) %s", err.Error())
+		return
+	}
+	_, err = os.Stat(file_path)
+	if err != nil {
+		err = fmt.Errorf("(LocateLocalFile) %s", err.Error())
+		return
+	}
+	file.Location = "file://" + file_path
+	file.Path = file_path
+	if file.Basename == "" {
+		file.Basename = path.Base(file_path)
+	}
+	return
+}
+
+func localPath(location string, file_path string, base_path string) (local_path string, err error) {
+	if location != "" {
+		location_url, xerr := url.Parse(location)
+		if xerr != nil {
+			err = fmt.Errorf("(localPath) url.Parse returned: %s", xerr.Error())
+			return
+		}
+		if location_url.Scheme != "" && location_url.Scheme != "file" {
+			err = fmt.Errorf("(localPath) %s is not a local file", location)
+			return
+		}
+		file_path = location_url.Path
+	}
+	if file_path == "" {
+		err = fmt.Errorf("(localPath) location and path are empty")
+		return
+	}
+	if !path.IsAbs(file_path) {
+		file_path = path.Join(base_path, file_path)
+	}
+	local_path = file_path
+	return
+}
+
+// io_type is "upload" (to Shock), "download" (from Shock) or "local" (files are used in place, see LocateLocalFile)
 func ProcessIOData(native interface{}, path string, io_type string, shock_client *shock.ShockClient) (count int, err error) {
 
 	//fmt.Printf("(processIOData) start\n")
@@ -339,6 +408,12 @@ func ProcessIOData(native interface{}, path string, io_type string, shock_client
 				return
 			}
 			count += 1
+		} else if io_type == "local" {
+			err = LocateLocalFile(file, path)
+			if err != nil {
+				err = fmt.Errorf("(ProcessIOData) LocateLocalFile returned: %s (file: %s)", err.Error(), file)
+				return
+			}
 		} else {
 
 			// download
@@ -417,6 +492,15 @@ func ProcessIOData(native interface{}, path string, io_type string, shock_client
 		if io_type == "upload" {
 			dir.Path = strings.TrimPrefix(dir.Path, path)
 			dir.Path = strings.TrimPrefix(dir.Path, "/")
+		} else if io_type == "local" && (dir.Location != "" || dir.Path != "") {
+			var dir_path string
+			dir_path, err = localPath(dir.Location, dir.Path, path)
+			if err != nil {
+				err = fmt.Errorf("(ProcessIOData) localPath for Directory returned: %s", err.Error())
+				return
+			}
+			dir.Location = "file://" + dir_path
+			dir.Path = dir_path
 		}
 		logger.Debug(3, "dir.Path: %s", dir.Path)
 
@@ -536,17 +620,17 @@ func MoveInputData(work *core.Workunit) (size int64, err error) {
 		return
 	}
 
-	for _, io := range work.Inputs {
+	// inputs are downloaded concurrently, up to conf.TRANSFER_CONCURRENCY at a time
+	err = runConcurrently(len(work.Inputs), func(i int) (xerr error) {
 		// skip if NoFile == true
-		var io_size int64
-		io_size, err = MoveInputIO(work, io, work_path)
-		if err != nil {
-			err = fmt.Errorf("(MoveInputData) MoveInputIO returns %s", err.Error())
+		io_size, xerr := MoveInputIO(work, work.Inputs[i], work_path)
+		if xerr != nil {
+			xerr = fmt.Errorf("(MoveInputData) MoveInputIO returns %s", xerr.Error())
 			return
 		}
-
-		size += io_size
-	}
+		atomic.AddInt64(&size, io_size)
+		return
+	})
 	return
 }
 
@@ -562,6 +646,7 @@ func UploadOutputIO(work *core.Workunit, io *core.IO) (size int64, new_node_id s
 	name := io.FileName
 	var local_filepath string //local file name generated by the cmd
 	var file_path string      //file name to be uploaded to shock
+	var file_size int64
 
 	work_path, err := work.Path()
 	if err != nil {
@@ -616,7 +701,14 @@ func UploadOutputIO(work *core.Workunit, io *core.IO) (size int64, new_node_id s
 			return
 		}
 		size += fi.Size()
+		file_size = fi.Size()
 
+		io.Checksum, err = FileChecksums(file_path)
+		if err != nil {
+			err = fmt.Errorf("(UploadOutputIO) %s", err.Error())
+			return
+		}
+		io.MD5 = io.Checksum["md5"]
 	}
 	logger.Debug(1, "(UploadOutputIO) deliverer: push output to shock, filename="+name)
 	logger.Event(event.FILE_OUT,
@@ -645,22 +737,52 @@ func UploadOutputIO(work *core.Workunit, io *core.IO) (size int64, new_node_id s
 	sc := shock.ShockClient{Host: io.Host, Token: work.Info.DataToken}
 	sc.Debug = true
 
-	new_node_id, err = sc.PutOrPostFile(file_path, io.Node, work.Rank, attrfile_path, io.Type, io.FormOptions, io.NodeAttr)
-	if err != nil {
-
-		time.Sleep(3 * time.Second) //wait for 3 seconds and try again
-		new_node_id, err = sc.PutOrPostFile(file_path, io.Node, work.Rank, attrfile_path, io.Type, io.FormOptions, io.NodeAttr)
-		if err != nil {
-			err = fmt.Errorf("push file error: %s", err.Error())
-			logger.Error("op=pushfile,err=" + err.Error())
+	stats := NewOutputTransferStats(work.WorkPerf)
+	chunk_size := int64(conf.UPLOAD_CHUNK_MB) * 1024 * 1024
+	// large files are uploaded in parts into the node created by the server, if nothing but the file is set
+	if file_path != "" && work.Rank == 0 && chunk_size > 0 && file_size > chunk_size && io.Node != "" && io.Node != "-" &&
+		attrfile_path == "" && len(io.FormOptions) == 0 && len(io.NodeAttr) == 0 {
+		err = uploadParts(io.Host, io.Node, work.Info.DataToken, file_path, file_size, stats)
+	} else {
+		upload := func() (xerr error) {
+			new_node_id, xerr = sc.PutOrPostFile(file_path, io.Node, work.Rank, attrfile_path, io.Type, io.FormOptions, io.NodeAttr)
 			return
 		}
+		if io.Node == "" || io.Node == "-" {
+			// not retried, every attempt would create a new node
+			err = upload()
+		} else if work.Rank == 0 && file_path != "" {
+			// the file of a node can only be set once
+			has_file := func() (bool, error) {
+				return ShockNodeHasFile(io.Host, io.Node, work.Info.DataToken, io.Checksum)
+			}
+			err = withRetryUnlessDone("upload of "+name, stats, has_file, upload)
+		} else {
+			err = withRetry("upload of "+name, stats, upload)
+		}
+		if err == nil {
+			addCounter(stats.moved, file_size)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("push file error: %s", err.Error())
+		logger.Error("op=pushfile,err=%s", err.Error())
+		return
 	}
 
 	if new_node_id != "" {
 		io.Node = new_node_id
 	}
 
+	// parts of a parts node have no checksum of their own
+	if file_path != "" && work.Rank == 0 {
+		err = VerifyUpload(io.Host, io.Node, work.Info.DataToken, io.Checksum)
+		if err != nil {
+			err = fmt.Errorf("(UploadOutputIO) %s", err.Error())
+			return
+		}
+	}
+
 	// worker only index if not parts node, otherwise server is responsible
 	if (io.ShockIndex != "") && (work.Rank == 0) {
 		sc := shock.ShockClient{Host: io.Host, Token: work.Info.DataToken}
@@ -684,6 +806,8 @@ func UploadOutputIO(work *core.Workunit, io *core.IO) (size int64, new_node_id s
 		//fmt.Printf("moving file from %s to %s\n", file_path, cacheFilePath)
 		if err := os.Rename(file_path, cacheFilePath); err != nil {
 			logger.Error("cache os.Rename():" + err.Error())
+		} else if err := Manager.Add(cacheFilePath, io.Node, "", ""); err != nil {
+			logger.Error("cache Manager.Add(): %s", err.Error())
 		}
 	}
 	return
@@ -778,15 +902,15 @@ func UploadOutputData(work *core.Workunit, shock_client *shock.ShockClient) (siz
 		outputs = work.Outputs
 		logger.Info("Processing %d outputs for uploading", len(outputs))
 
-		for _, io := range outputs {
-			var io_size int64
-			io_size, _, err = UploadOutputIO(work, io)
-			if err != nil {
-				err = fmt.Errorf("(UploadOutputData) UploadOutputIO returned: %s", err.Error())
-				break
+		err = runConcurrently(len(outputs), func(i int) (xerr error) {
+			io_size, _, xerr := UploadOutputIO(work, outputs[i])
+			if xerr != nil {
+				xerr = fmt.Errorf("(UploadOutputData) UploadOutputIO returned: %s", xerr.Error())
+				return
 			}
-			size += io_size
-		}
+			atomic.AddInt64(&size, io_size)
+			return
+		})
 	}
 
 	return
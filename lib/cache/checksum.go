@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	shock "github.com/MG-RAST/go-shock-client"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// number of downloads of a file before a checksum mismatch is an error
+const CHECKSUM_ATTEMPTS = 3
+
+// Checksums computes md5, sha1 and sha256 of the data written to it
+type Checksums struct {
+	hashes map[string]hash.Hash
+}
+
+func NewChecksums() *Checksums {
+	return &Checksums{hashes: map[string]hash.Hash{"md5": md5.New(), "sha1": sha1.New(), "sha256": sha256.New()}}
+}
+
+func (c *Checksums) Write(p []byte) (n int, err error) {
+	for _, h := range c.hashes {
+		h.Write(p) // never returns an error
+	}
+	return len(p), nil
+}
+
+// Map returns the hex encoded checksums by algorithm, the keys are those of Shock nodes
+func (c *Checksums) Map() (sums map[string]string) {
+	sums = make(map[string]string)
+	for algo, h := range c.hashes {
+		sums[algo] = hex.EncodeToString(h.Sum(nil))
+	}
+	return
+}
+
+// FileChecksums reads the file once and returns md5, sha1 and sha256
+func FileChecksums(file_path string) (sums map[string]string, err error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	checksums := NewChecksums()
+	_, err = io.Copy(checksums, file)
+	if err != nil {
+		err = fmt.Errorf("(FileChecksums) reading %s: %s", file_path, err.Error())
+		return
+	}
+	sums = checksums.Map()
+	return
+}
+
+// ParseCWLChecksum splits the checksum of a CWL File, e.g. "sha1$ab12..."
+func ParseCWLChecksum(checksum string) (algo string, value string, err error) {
+	fields := strings.SplitN(checksum, "$", 2)
+	if len(fields) != 2 || fields[1] == "" {
+		err = fmt.Errorf("(ParseCWLChecksum) invalid checksum \"%s\", expected <algorithm>$<value>", checksum)
+		return
+	}
+	algo = strings.ToLower(fields[0])
+	value = strings.ToLower(fields[1])
+	return
+}
+
+// CompareChecksum checks the expected value of algo (md5, sha1 or sha256), empty expected values are not checked
+func CompareChecksum(sums map[string]string, algo string, expected string) (err error) {
+	if expected == "" {
+		return
+	}
+	actual, ok := sums[algo]
+	if !ok {
+		err = fmt.Errorf("unsupported checksum algorithm \"%s\"", algo)
+		return
+	}
+	if actual != strings.ToLower(expected) {
+		err = fmt.Errorf("%s checksum mismatch: expected %s, got %s", algo, expected, actual)
+	}
+	return
+}
+
+// VerifyUpload compares the md5 of an uploaded file with the checksum Shock computed for the node
+func VerifyUpload(host string, node_id string, token string, sums map[string]string) (err error) {
+	node, err := shock.ShockGet(host, node_id, token)
+	if err != nil {
+		err = fmt.Errorf("(VerifyUpload) shock.ShockGet returned: %s", err.Error())
+		return
+	}
+	if node == nil {
+		return
+	}
+	err = CompareChecksum(sums, "md5", node.File.Checksum["md5"])
+	if err != nil {
+		err = fmt.Errorf("(VerifyUpload) node %s: %s", node_id, err.Error())
+	}
+	return
+}
@@ -0,0 +1,370 @@
+package cache
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CacheEntry is a file in the data cache of the worker, predata (DATA_PATH/predata) or a
+// Shock node cached with cache_enabled (see getCacheFilePath)
+type CacheEntry struct {
+	Path     string          `json:"path"`
+	Ids      []string        `json:"ids"` // Shock node ids (or urls) of the content
+	Size     int64           `json:"size"`
+	MD5      string          `json:"md5,omitempty"`
+	LastUsed time.Time       `json:"last_used"`
+	Uses     int             `json:"uses"`
+	pinned   map[string]bool // workunits using the file
+}
+
+// CacheManager keeps the data cache within the size budget (conf.CACHE_MAX_MB). Files used by
+// workunits are pinned until the workunit is delivered, the others are evicted in the order
+// of conf.CACHE_POLICY. The index is saved in DATA_PATH/cache_index.json.
+type CacheManager struct {
+	core.RWMutex
+	_map  map[string]*CacheEntry // by file path
+	total int64
+}
+
+var Manager = NewCacheManager()
+
+func NewCacheManager() (cm *CacheManager) {
+	cm = &CacheManager{_map: make(map[string]*CacheEntry)}
+	cm.RWMutex.Init("CacheManager")
+	return
+}
+
+func (cm *CacheManager) indexFile() string {
+	return path.Join(conf.DATA_PATH, "cache_index.json")
+}
+
+// Load reads the index, drops files that are missing or changed in size and adds cached
+// files that are not in the index (e.g. from older versions of the worker)
+func (cm *CacheManager) Load() (err error) {
+	err = cm.LockNamed("CacheManager/Load")
+	if err != nil {
+		return
+	}
+	defer cm.Unlock()
+
+	cm._map = make(map[string]*CacheEntry)
+	cm.total = 0
+
+	index_bytes, xerr := ioutil.ReadFile(cm.indexFile())
+	if xerr == nil {
+		var entries []*CacheEntry
+		xerr = json.Unmarshal(index_bytes, &entries)
+		if xerr != nil {
+			logger.Error("(CacheManager/Load) could not parse %s, rebuilding the index: %s", cm.indexFile(), xerr.Error())
+		}
+		for _, entry := range entries {
+			fi, yerr := os.Stat(entry.Path)
+			if yerr != nil {
+				continue
+			}
+			if fi.Size() != entry.Size {
+				logger.Warning("(CacheManager/Load) size of %s has changed (%d -> %d bytes), removing it", entry.Path, entry.Size, fi.Size())
+				removeCacheFile(entry.Path)
+				continue
+			}
+			entry.pinned = make(map[string]bool)
+			cm._map[entry.Path] = entry
+			cm.total += entry.Size
+		}
+	}
+
+	predata_files, _ := filepath.Glob(path.Join(conf.DATA_PATH, "predata", "*"))
+	node_files, _ := filepath.Glob(path.Join(conf.DATA_PATH, "*", "*", "*", "*", "*.data"))
+	for _, file_path := range append(predata_files, node_files...) {
+		if _, ok := cm._map[file_path]; ok {
+			continue
+		}
+		if strings.HasSuffix(file_path, ".part") || strings.HasSuffix(file_path, ".access") {
+			// interrupted download or access timestamp of older versions
+			os.Remove(file_path)
+			continue
+		}
+		fi, yerr := os.Stat(file_path)
+		if yerr != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		entry := &CacheEntry{Path: file_path, Size: fi.Size(), LastUsed: fi.ModTime(), pinned: make(map[string]bool)}
+		// shock predata is named by its md5, but the file may have been uncompressed, so the md5 is not used
+		name := path.Base(file_path)
+		if strings.HasSuffix(name, ".data") {
+			entry.Ids = []string{strings.TrimSuffix(name, ".data")}
+		}
+		cm._map[file_path] = entry
+		cm.total += entry.Size
+	}
+	logger.Info("(CacheManager/Load) %d cached files, %d bytes", len(cm._map), cm.total)
+
+	cm.evict(0)
+	err = cm.save()
+	return
+}
+
+// Use checks if the file is cached and intact, and pins it for the workunit. A file that
+// fails the integrity check is removed and has to be downloaded again.
+func (cm *CacheManager) Use(file_path string, id string, work_str string) (ok bool, err error) {
+	read_lock, err := cm.RLockNamed("CacheManager/Use")
+	if err != nil {
+		return
+	}
+	entry, found := cm._map[file_path]
+	var size int64
+	var md5sum string
+	if found {
+		size = entry.Size
+		md5sum = entry.MD5
+	}
+	cm.RUnlockNamed(read_lock)
+	if !found {
+		return
+	}
+
+	// the checksum of large files takes a while, verify without holding the lock
+	verify_err := verifyCacheFile(file_path, size, md5sum)
+
+	err = cm.LockNamed("CacheManager/Use")
+	if err != nil {
+		return
+	}
+	defer cm.Unlock()
+
+	entry, found = cm._map[file_path]
+	if !found {
+		return
+	}
+	if verify_err != nil {
+		logger.Warning("(CacheManager/Use) %s failed the integrity check, removing it: %s", file_path, verify_err.Error())
+		cm.remove(entry)
+		err = cm.save()
+		return
+	}
+	entry.addId(id)
+	entry.LastUsed = time.Now()
+	entry.Uses += 1
+	entry.pinned[work_str] = true
+	ok = true
+	err = cm.save()
+	return
+}
+
+// Add registers a downloaded or uploaded file, pinned for the workunit, and evicts other
+// files if the budget is exceeded
+func (cm *CacheManager) Add(file_path string, id string, md5sum string, work_str string) (err error) {
+	fi, err := os.Stat(file_path)
+	if err != nil {
+		err = fmt.Errorf("(CacheManager/Add) os.Stat returned: %s", err.Error())
+		return
+	}
+
+	err = cm.LockNamed("CacheManager/Add")
+	if err != nil {
+		return
+	}
+	defer cm.Unlock()
+
+	entry, ok := cm._map[file_path]
+	if ok {
+		cm.total -= entry.Size
+	} else {
+		entry = &CacheEntry{Path: file_path, pinned: make(map[string]bool)}
+		cm._map[file_path] = entry
+	}
+	entry.Size = fi.Size()
+	entry.addId(id)
+	if md5sum != "" {
+		entry.MD5 = md5sum
+	}
+	entry.LastUsed = time.Now()
+	entry.Uses += 1
+	if work_str != "" {
+		entry.pinned[work_str] = true
+	}
+	cm.total += entry.Size
+
+	cm.evict(0)
+	err = cm.save()
+	return
+}
+
+// MakeRoom evicts files to fit a download of size bytes into the budget
+func (cm *CacheManager) MakeRoom(size int64) (err error) {
+	err = cm.LockNamed("CacheManager/MakeRoom")
+	if err != nil {
+		return
+	}
+	defer cm.Unlock()
+	if cm.evict(size) > 0 {
+		err = cm.save()
+	}
+	return
+}
+
+// UnpinWork releases the files used by the workunit
+func (cm *CacheManager) UnpinWork(work_str string) (err error) {
+	err = cm.LockNamed("CacheManager/UnpinWork")
+	if err != nil {
+		return
+	}
+	defer cm.Unlock()
+	for _, entry := range cm._map {
+		delete(entry.pinned, work_str)
+	}
+	if cm.evict(0) > 0 {
+		err = cm.save()
+	}
+	return
+}
+
+// Inventory returns the ids and sizes of the cached files, reported to the server in the heartbeat.
+// Files without id (predata found on disk but not in the index) are not listed.
+func (cm *CacheManager) Inventory() (list []core.CachedObject, err error) {
+	read_lock, err := cm.RLockNamed("CacheManager/Inventory")
+	if err != nil {
+		return
+	}
+	defer cm.RUnlockNamed(read_lock)
+	list = []core.CachedObject{}
+	for _, entry := range cm._map {
+		for _, id := range entry.Ids {
+			list = append(list, core.CachedObject{Id: id, Size: entry.Size})
+		}
+	}
+	return
+}
+
+// evict removes unpinned files until incoming bytes fit into the budget and returns the
+// number of removed files, the caller holds the lock
+func (cm *CacheManager) evict(incoming int64) (count int) {
+	if conf.CACHE_MAX_MB <= 0 {
+		return
+	}
+	max_bytes := int64(conf.CACHE_MAX_MB) * 1024 * 1024
+	if cm.total+incoming <= max_bytes {
+		return
+	}
+
+	candidates := []*CacheEntry{}
+	for _, entry := range cm._map {
+		if len(entry.pinned) == 0 {
+			candidates = append(candidates, entry)
+		}
+	}
+	if conf.CACHE_POLICY == "lfu" {
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].Uses != candidates[j].Uses {
+				return candidates[i].Uses < candidates[j].Uses
+			}
+			return candidates[i].LastUsed.Before(candidates[j].LastUsed)
+		})
+	} else {
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].LastUsed.Before(candidates[j].LastUsed) })
+	}
+
+	for _, entry := range candidates {
+		if cm.total+incoming <= max_bytes {
+			break
+		}
+		logger.Debug(1, "(CacheManager) evicting %s (%d bytes, used %d times)", entry.Path, entry.Size, entry.Uses)
+		cm.remove(entry)
+		count += 1
+	}
+	if cm.total+incoming > max_bytes {
+		logger.Warning("(CacheManager) cache_max_mb exceeded, remaining files are used by workunits (%d bytes cached, %d bytes incoming)", cm.total, incoming)
+	}
+	return
+}
+
+func (cm *CacheManager) remove(entry *CacheEntry) {
+	delete(cm._map, entry.Path)
+	cm.total -= entry.Size
+	removeCacheFile(entry.Path)
+}
+
+// save writes the index, the caller holds the lock
+func (cm *CacheManager) save() (err error) {
+	entries := []*CacheEntry{}
+	for _, entry := range cm._map {
+		entries = append(entries, entry)
+	}
+	index_bytes, err := json.Marshal(entries)
+	if err != nil {
+		err = fmt.Errorf("(CacheManager/save) json.Marshal returned: %s", err.Error())
+		return
+	}
+	tmp_file := cm.indexFile() + ".tmp"
+	err = ioutil.WriteFile(tmp_file, index_bytes, 0644)
+	if err != nil {
+		err = fmt.Errorf("(CacheManager/save) ioutil.WriteFile returned: %s", err.Error())
+		return
+	}
+	err = os.Rename(tmp_file, cm.indexFile())
+	return
+}
+
+func (entry *CacheEntry) addId(id string) {
+	if id == "" || id == "-" {
+		return
+	}
+	for _, existing := range entry.Ids {
+		if existing == id {
+			return
+		}
+	}
+	entry.Ids = append(entry.Ids, id)
+}
+
+// removeCacheFile removes the file and the directory of a cached Shock node
+func removeCacheFile(file_path string) {
+	if xerr := os.Remove(file_path); xerr != nil && !os.IsNotExist(xerr) {
+		logger.Error("(CacheManager) could not remove %s: %s", file_path, xerr.Error())
+	}
+	if strings.HasSuffix(file_path, ".data") {
+		os.Remove(path.Dir(file_path)) // only if empty
+	}
+}
+
+// verifyCacheFile compares size and, with conf.CACHE_VERIFY, the md5 checksum of the file
+func verifyCacheFile(file_path string, size int64, md5sum string) (err error) {
+	fi, err := os.Stat(file_path)
+	if err != nil {
+		return
+	}
+	if fi.Size() != size {
+		err = fmt.Errorf("size is %d bytes, expected %d", fi.Size(), size)
+		return
+	}
+	if !conf.CACHE_VERIFY || md5sum == "" {
+		return
+	}
+	file, err := os.Open(file_path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	hash := md5.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != md5sum {
+		err = fmt.Errorf("md5 is %s, expected %s", actual, md5sum)
+	}
+	return
+}
@@ -0,0 +1,395 @@
+package cache
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/logger"
+	shock "github.com/MG-RAST/go-shock-client"
+	"github.com/MG-RAST/golib/httpclient"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// transferError is an error of a download or upload, transient errors are retried
+type transferError struct {
+	message   string
+	transient bool
+}
+
+func (te *transferError) Error() string { return te.message }
+
+// httpTransferError classifies an error response, server errors and
+// "Node has no file" (upload of an input not yet finished) are transient
+func httpTransferError(res *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	message := fmt.Sprintf("%s returned %s: %s", res.Request.URL.String(), res.Status, strings.TrimSpace(string(body)))
+	transient := res.StatusCode >= 500 || res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests ||
+		strings.Contains(string(body), "Node has no file")
+	return &transferError{message: message, transient: transient}
+}
+
+// isTransient: errors that are not classified (e.g. from the Shock client) are retried
+func isTransient(err error) bool {
+	if te, ok := err.(*transferError); ok {
+		return te.transient
+	}
+	return true
+}
+
+// TransferStats points to the counters of the WorkPerf of a workunit that are updated
+// while data is transferred, a nil counter is not updated
+type TransferStats struct {
+	moved   *int64
+	resumed *int64
+	retries *int64
+}
+
+func NewInputTransferStats(perf *core.WorkPerf) *TransferStats {
+	if perf == nil {
+		return &TransferStats{}
+	}
+	return &TransferStats{moved: &perf.InFileMoved, resumed: &perf.ResumedSize, retries: &perf.TransferRetries}
+}
+
+func NewOutputTransferStats(perf *core.WorkPerf) *TransferStats {
+	if perf == nil {
+		return &TransferStats{}
+	}
+	return &TransferStats{moved: &perf.OutFileMoved, retries: &perf.TransferRetries}
+}
+
+func addCounter(counter *int64, n int64) {
+	if counter != nil {
+		atomic.AddInt64(counter, n)
+	}
+}
+
+// BandwidthLimiter shares conf.TRANSFER_MAX_MB_PER_SEC between all transfers of the worker
+type BandwidthLimiter struct {
+	sync.Mutex
+	next time.Time // when the bytes reserved so far have been transferred
+}
+
+var bandwidth = &BandwidthLimiter{}
+
+// Wait blocks until n more bytes may be transferred
+func (bl *BandwidthLimiter) Wait(n int) {
+	if conf.TRANSFER_MAX_MB_PER_SEC <= 0 || n <= 0 {
+		return
+	}
+	duration := time.Duration(float64(n) / float64(conf.TRANSFER_MAX_MB_PER_SEC*1024*1024) * float64(time.Second))
+	bl.Lock()
+	now := time.Now()
+	if bl.next.Before(now) {
+		bl.next = now
+	}
+	wait := bl.next.Sub(now)
+	bl.next = bl.next.Add(duration)
+	bl.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// transferReader applies the bandwidth cap and counts the progress
+type transferReader struct {
+	reader io.Reader
+	moved  *int64
+}
+
+func (tr *transferReader) Read(p []byte) (n int, err error) {
+	n, err = tr.reader.Read(p)
+	if n > 0 {
+		bandwidth.Wait(n)
+		addCounter(tr.moved, int64(n))
+	}
+	return
+}
+
+// withRetry calls transfer until it succeeds, transient errors are retried conf.TRANSFER_RETRIES
+// times with exponential backoff (2s, 4s, ... up to a minute)
+func withRetry(name string, stats *TransferStats, transfer func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = transfer()
+		if err == nil || !isTransient(err) || attempt > conf.TRANSFER_RETRIES {
+			return
+		}
+		wait := time.Duration(1<<uint(attempt)) * time.Second
+		if wait > time.Minute {
+			wait = time.Minute
+		}
+		logger.Warning("(withRetry) %s failed (attempt %d), retrying in %s: %s", name, attempt, wait, err.Error())
+		addCounter(stats.retries, 1)
+		time.Sleep(wait)
+	}
+}
+
+// withRetryUnlessDone is withRetry for requests that are not idempotent: before a retry, done
+// tells if the earlier attempt succeeded although its response was lost
+func withRetryUnlessDone(name string, stats *TransferStats, done func() (bool, error), transfer func() error) (err error) {
+	attempted := false
+	err = withRetry(name, stats, func() error {
+		if attempted {
+			ok, xerr := done()
+			if xerr != nil {
+				return xerr
+			}
+			if ok {
+				logger.Debug(1, "(withRetryUnlessDone) %s had succeeded, not retried", name)
+				return nil
+			}
+		}
+		attempted = true
+		return transfer()
+	})
+	return
+}
+
+// ShockNodeHasFile tells if the node has a file with the md5 checksum of sums
+func ShockNodeHasFile(host string, node_id string, token string, sums map[string]string) (ok bool, err error) {
+	node, err := shock.ShockGet(host, node_id, token)
+	if err != nil {
+		err = fmt.Errorf("(ShockNodeHasFile) shock.ShockGet returned: %s", err.Error())
+		return
+	}
+	ok = node != nil && sums["md5"] != "" && node.File.Checksum["md5"] == sums["md5"]
+	return
+}
+
+// runConcurrently calls f for 0..count-1 with at most conf.TRANSFER_CONCURRENCY calls at a time
+// and returns the first error
+func runConcurrently(count int, f func(i int) error) (err error) {
+	var wg sync.WaitGroup
+	var err_lock sync.Mutex
+	semaphore := make(chan bool, conf.TRANSFER_CONCURRENCY)
+	for i := 0; i < count; i++ {
+		semaphore <- true
+		wg.Add(1)
+		go func(i int) {
+			defer func() { <-semaphore; wg.Done() }()
+			if xerr := f(i); xerr != nil {
+				err_lock.Lock()
+				if err == nil {
+					err = xerr
+				}
+				err_lock.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return
+}
+
+func tokenAuth(token string) *httpclient.Auth {
+	if token == "" {
+		return nil
+	}
+	return httpclient.GetUserByTokenAuth(token)
+}
+
+// fetchFile downloads url into file_path and computes the checksums of the data as it is
+// transferred, i.e. before uncompressing ("gzip" or "bzip2"), like the checksums of Shock.
+// A partial file of an earlier attempt is resumed with a range request, unless the data is
+// uncompressed; the checksums include the part downloaded before.
+func fetchFile(file_path string, url string, token string, uncompress string, stats *TransferStats) (size int64, sums map[string]string, err error) {
+	var offset int64
+	if uncompress == "" {
+		if fi, xerr := os.Stat(file_path); xerr == nil {
+			offset = fi.Size()
+		}
+	}
+	header := httpclient.Header{}
+	if offset > 0 {
+		header["Range"] = []string{fmt.Sprintf("bytes=%d-", offset)}
+	}
+	res, err := httpclient.Get(url, header, tokenAuth(token))
+	if err != nil {
+		err = &transferError{message: fmt.Sprintf("GET %s: %s", url, err.Error()), transient: true}
+		return
+	}
+	defer res.Body.Close()
+
+	checksums := NewChecksums()
+	var file *os.File
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		file, err = os.OpenFile(file_path, os.O_RDWR, 0644)
+		if err != nil {
+			return
+		}
+		// reads up to the end of the file, the download is appended
+		_, err = io.Copy(checksums, file)
+		if err != nil {
+			file.Close()
+			return
+		}
+		logger.Debug(1, "(fetchFile) resuming download of %s at %d bytes", url, offset)
+		addCounter(stats.resumed, offset)
+	case http.StatusOK:
+		// range not supported or no partial file
+		offset = 0
+		file, err = os.Create(file_path)
+		if err != nil {
+			return
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is not a prefix of the data, start over
+		os.Remove(file_path)
+		err = &transferError{message: fmt.Sprintf("GET %s: range %d- not satisfiable", url, offset), transient: true}
+		return
+	default:
+		err = httpTransferError(res)
+		return
+	}
+	defer file.Close()
+
+	stream := io.TeeReader(&transferReader{reader: res.Body, moved: stats.moved}, checksums)
+	var reader io.Reader
+	switch uncompress {
+	case "":
+		reader = stream
+	case "gzip":
+		var gzip_reader *gzip.Reader
+		gzip_reader, err = gzip.NewReader(stream)
+		if err != nil {
+			err = fmt.Errorf("(fetchFile) gzip.NewReader returned: %s", err.Error())
+			return
+		}
+		defer gzip_reader.Close()
+		reader = gzip_reader
+	case "bzip2":
+		reader = bzip2.NewReader(stream)
+	default:
+		err = &transferError{message: fmt.Sprintf("(fetchFile) uncompress type \"%s\" is not supported, use gzip or bzip2", uncompress)}
+		return
+	}
+
+	size, err = io.Copy(file, reader)
+	if err != nil {
+		err = &transferError{message: fmt.Sprintf("(fetchFile) downloading %s: %s", url, err.Error()), transient: true}
+		return
+	}
+	// the decompressor may stop before the end of the stream
+	_, err = io.Copy(ioutil.Discard, stream)
+	if err != nil {
+		err = &transferError{message: fmt.Sprintf("(fetchFile) downloading %s: %s", url, err.Error()), transient: true}
+		return
+	}
+	size += offset
+	sums = checksums.Map()
+	return
+}
+
+// FetchFileVerified downloads url into file_path, transient errors are retried and resumed.
+// The checksum of algo is compared with the expected value (if any), a corrupt file is removed
+// and downloaded again up to CHECKSUM_ATTEMPTS times.
+func FetchFileVerified(file_path string, url string, token string, uncompress string, algo string, expected string, stats *TransferStats) (size int64, sums map[string]string, err error) {
+	for attempt := 1; ; attempt++ {
+		err = withRetry("download of "+url, stats, func() (xerr error) {
+			size, sums, xerr = fetchFile(file_path, url, token, uncompress, stats)
+			return
+		})
+		if err != nil {
+			return
+		}
+		err = CompareChecksum(sums, algo, expected)
+		if err == nil {
+			return
+		}
+		os.Remove(file_path)
+		if attempt >= CHECKSUM_ATTEMPTS {
+			err = fmt.Errorf("(FetchFileVerified) %s: %s (%d attempts)", url, err.Error(), attempt)
+			return
+		}
+		logger.Warning("(FetchFileVerified) %s: %s, downloading again", url, err.Error())
+	}
+}
+
+// shockPutForm sends the form (created by new_form for every attempt) to a Shock node
+func shockPutForm(node_url string, token string, new_form func() *httpclient.Form) (err error) {
+	form := new_form()
+	err = form.Create()
+	if err != nil {
+		err = &transferError{message: fmt.Sprintf("(shockPutForm) form.Create returned: %s", err.Error())}
+		return
+	}
+	headers := httpclient.Header{
+		"Content-Type":   []string{form.ContentType},
+		"Content-Length": []string{strconv.FormatInt(form.Length, 10)},
+	}
+	res, err := httpclient.Put(node_url, headers, form.Reader, tokenAuth(token))
+	if err != nil {
+		err = &transferError{message: fmt.Sprintf("PUT %s: %s", node_url, err.Error()), transient: true}
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err = httpTransferError(res)
+	}
+	return
+}
+
+// uploadParts uploads a file into an existing empty Shock node as a parts node, in parts of
+// conf.UPLOAD_CHUNK_MB. Parts are uploaded concurrently and retried individually.
+func uploadParts(host string, node_id string, token string, file_path string, size int64, stats *TransferStats) (err error) {
+	chunk_size := int64(conf.UPLOAD_CHUNK_MB) * 1024 * 1024
+	parts := int((size + chunk_size - 1) / chunk_size)
+	node_url := fmt.Sprintf("%s/node/%s", host, node_id)
+
+	// Shock refuses to set the parts of a node twice
+	has_parts := func() (ok bool, err error) {
+		node, err := shock.ShockGet(host, node_id, token)
+		if err != nil {
+			return
+		}
+		ok = node != nil && node.Parts != nil && node.Parts.Count == parts
+		return
+	}
+	err = withRetryUnlessDone("creating parts of node "+node_id, stats, has_parts, func() error {
+		return shockPutForm(node_url, token, func() *httpclient.Form {
+			form := httpclient.NewForm()
+			form.AddParam("parts", strconv.Itoa(parts))
+			form.AddParam("file_name", path.Base(file_path))
+			return form
+		})
+	})
+	if err != nil {
+		return
+	}
+
+	file, err := os.Open(file_path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	logger.Debug(1, "(uploadParts) uploading %s in %d parts to node %s", file_path, parts, node_id)
+	err = runConcurrently(parts, func(i int) error {
+		offset := int64(i) * chunk_size
+		length := chunk_size
+		if offset+length > size {
+			length = size - offset
+		}
+		part := strconv.Itoa(i + 1)
+		return withRetry(fmt.Sprintf("upload of part %s of node %s", part, node_id), stats, func() error {
+			return shockPutForm(node_url, token, func() *httpclient.Form {
+				form := httpclient.NewForm()
+				section := io.NewSectionReader(file, offset, length)
+				form.AddFileReader(part, &transferReader{reader: section, moved: stats.moved}, length)
+				return form
+			})
+		})
+	})
+	return
+}
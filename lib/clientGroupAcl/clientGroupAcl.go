@@ -1,6 +1,8 @@
 package clientGroupAcl
 
-import ()
+import (
+	"github.com/MG-RAST/AWE/lib/acl"
+)
 
 // Acl struct
 type ClientGroupAcl struct {
@@ -50,14 +52,19 @@ func (a *ClientGroupAcl) Set(str string, r Rights) {
 	return
 }
 
+// Check returns the rights of a user, directly or through one of its groups
 func (a *ClientGroupAcl) Check(str string) (r Rights) {
 	r = Rights{"read": false, "write": false, "delete": false, "execute": false}
 	acls := map[string][]string{"read": a.Read, "write": a.Write, "delete": a.Delete, "execute": a.Execute}
+	principals := acl.Principals(str)
 	for k, v := range acls {
+	search:
 		for _, id := range v {
-			if str == id {
-				r[k] = true
-				break
+			for _, principal := range principals {
+				if principal == id {
+					r[k] = true
+					break search
+				}
 			}
 		}
 	}
@@ -80,6 +80,9 @@ var (
 	SSL_KEY_FILE  string
 	SSL_CERT_FILE string
 
+	// Secrets (private environment variables and data tokens) at rest
+	SECRETS_KEY_FILE string
+
 	// Anonymous-Access-Control
 	ANON_WRITE     bool
 	ANON_READ      bool
@@ -98,6 +101,18 @@ var (
 	CLIENT_AUTH_REQ    bool
 	CLIENT_GROUP_TOKEN string
 
+	// Auth with JWTs validated against local keys
+	JWT_JWKS           string // JWKS file or directory of *.json files
+	JWT_ISSUER         string
+	JWT_AUDIENCE       string // comma separated, one has to match
+	JWT_CLOCK_SKEW     int    // seconds
+	JWT_CLAIM_USERNAME string
+	JWT_CLAIM_NAME     string
+	JWT_CLAIM_EMAIL    string
+	JWT_CLAIM_ADMIN    string
+	JWT_ADMIN_VALUE    string // without it the admin claim has to be true
+	JWT_CLAIM_GROUPS   string
+
 	// Admin
 	ADMIN_EMAIL     string
 	ADMIN_USERS_VAR string
@@ -126,6 +141,28 @@ var (
 	MAX_CLIENT_FAILURE int
 	GOMAXPROCS         int
 
+	LOG_STREAM_MAX_BYTES int
+	FILE_RELAY_TIMEOUT   int
+
+	LOCALITY_WEIGHT   int
+	LOCALITY_MAX_WAIT int
+
+	MAX_PREFETCH     int
+	PREFETCH_TIMEOUT int
+
+	MAX_UPLOAD_MB        int
+	MAX_WORKER_UPLOAD_MB int
+
+	// RateLimit, requests per minute and burst size, 0 disables the limit
+	RATE_LIMIT_SUBMIT       int
+	RATE_LIMIT_SUBMIT_BURST int
+	RATE_LIMIT_READ         int
+	RATE_LIMIT_READ_BURST   int
+	RATE_LIMIT_WORKER       int
+	RATE_LIMIT_WORKER_BURST int
+	RATE_LIMIT_AUTH         int
+	RATE_LIMIT_AUTH_BURST   int
+
 	// Client
 	WORK_PATH                   string
 	APP_PATH                    string
@@ -148,10 +185,29 @@ var (
 	AUTO_CLEAN_DIR bool
 	NO_SYMLINK     bool
 	CACHE_ENABLED  bool
-
-	CWL_TOOL  string
-	CWL_JOB   string
-	SHOCK_URL string
+	CACHE_MAX_MB   int
+	CACHE_POLICY   string
+	CACHE_VERIFY   bool
+
+	LOG_STREAM            bool
+	LOG_STREAM_INTERVAL   int
+	LOG_STREAM_CHUNK_SIZE int
+	LOG_STREAM_BUFFER     int
+
+	KEEP_FAILED_WORKDIRS bool
+	KEEP_FAILED_MAX_MB   int
+	KEEP_FAILED_HOURS    int
+
+	TRANSFER_CONCURRENCY    int
+	TRANSFER_RETRIES        int
+	TRANSFER_MAX_MB_PER_SEC int
+	UPLOAD_CHUNK_MB         int
+	PREFETCH_DEPTH          int
+
+	CWL_TOOL     string
+	CWL_JOB      string
+	SHOCK_URL    string
+	LOCAL_RUNNER bool
 
 	// Docker
 	USE_DOCKER                    string
@@ -165,6 +221,13 @@ var (
 	DOCKER_WORK_DIR               string
 	DOCKER_WORKUNIT_PREDATA_DIR   string
 	SHOCK_DOCKER_IMAGE_REPOSITORY string
+	DOCKER_PULL_POLICY            string
+	CONTAINER_RUNTIME             string
+	PODMAN_BINARY                 string
+	SINGULARITY_BINARY            string
+	SINGULARITY_IMAGE_DIR         string
+	CONTAINER_NETWORK             bool
+	DOCKER_PIN_DIGEST             bool
 
 	// Other
 	ERROR_LENGTH         int
@@ -274,6 +337,9 @@ func getConfiguration(c *config.Config, mode string) (c_store *Config_store) {
 		c_store.AddString(&SSL_KEY_FILE, "", "SSL", "key", "", "")
 		c_store.AddString(&SSL_CERT_FILE, "", "SSL", "cert", "", "")
 
+		// Secrets
+		c_store.AddString(&SECRETS_KEY_FILE, "", "Secrets", "key_file", "file with the keys that encrypt private environment variables and data tokens in the database (default: <data>/secrets.key, created if missing)", "")
+
 		// Access-Control
 		c_store.AddBool(&ANON_WRITE, true, "Anonymous", "write", "", "")
 		c_store.AddBool(&ANON_READ, true, "Anonymous", "read", "", "")
@@ -288,6 +354,16 @@ func getConfiguration(c *config.Config, mode string) (c_store *Config_store) {
 		c_store.AddString(&GLOBUS_PROFILE_URL, "", "Auth", "globus_profile_url", "", "")
 		c_store.AddString(&OAUTH_URL_STR, "", "Auth", "oauth_urls", "", "")
 		c_store.AddString(&OAUTH_BEARER_STR, "", "Auth", "oauth_bearers", "", "")
+		c_store.AddString(&JWT_JWKS, "", "Auth", "jwt_jwks", "JWKS file or directory, enables local validation of JWT bearer tokens", "")
+		c_store.AddString(&JWT_ISSUER, "", "Auth", "jwt_issuer", "required iss claim", "")
+		c_store.AddString(&JWT_AUDIENCE, "", "Auth", "jwt_audience", "accepted aud claims, comma separated", "")
+		c_store.AddInt(&JWT_CLOCK_SKEW, 60, "Auth", "jwt_clock_skew", "allowed clock skew in seconds", "")
+		c_store.AddString(&JWT_CLAIM_USERNAME, "preferred_username", "Auth", "jwt_claim_username", "", "")
+		c_store.AddString(&JWT_CLAIM_NAME, "name", "Auth", "jwt_claim_name", "", "")
+		c_store.AddString(&JWT_CLAIM_EMAIL, "email", "Auth", "jwt_claim_email", "", "")
+		c_store.AddString(&JWT_CLAIM_ADMIN, "", "Auth", "jwt_claim_admin", "claim that makes a user admin, nested claims as a.b", "")
+		c_store.AddString(&JWT_ADMIN_VALUE, "", "Auth", "jwt_admin_value", "value the admin claim has to contain", "")
+		c_store.AddString(&JWT_CLAIM_GROUPS, "", "Auth", "jwt_claim_groups", "claim with group names of the user, used in ACLs as idp-group:<name>", "")
 
 		// WebApp
 		c_store.AddString(&SITE_LOGIN_URL, "", "WebApp", "login_url", "", "")
@@ -334,6 +410,24 @@ func getConfiguration(c *config.Config, mode string) (c_store *Config_store) {
 		c_store.AddString(&RELOAD, "", "Server", "reload", "path or url to awe job data. WARNING this will drop all current jobs", "")
 		c_store.AddBool(&RECOVER, false, "Server", "recover", "load unfinished jobs from mongodb on startup", "")
 		c_store.AddInt(&RECOVER_MAX, 0, "Server", "recover_max", "max number of jobs to recover, default (0) means recover all", "")
+		c_store.AddInt(&LOG_STREAM_MAX_BYTES, 1048576, "Server", "log_stream_max_bytes", "bytes of live stdout/stderr kept in memory per running workunit", "")
+		c_store.AddInt(&FILE_RELAY_TIMEOUT, 60, "Server", "file_relay_timeout", "seconds to wait for a worker to upload a file from a retained work dir", "")
+		c_store.AddInt(&LOCALITY_WEIGHT, 0, "Server", "locality_weight", "priority bonus of a workunit whose inputs and predata are all cached on the requesting worker, 0 disables data-locality-aware checkout", "")
+		c_store.AddInt(&LOCALITY_MAX_WAIT, 60, "Server", "locality_max_wait", "minutes a workunit waits in the queue until it gets the full locality bonus on every worker, so it is not starved by workunits with cached data", "")
+		c_store.AddInt(&MAX_PREFETCH, 2, "Server", "max_prefetch", "max number of workunits a worker may check out in advance (prefetched) while it computes another one, 0 disables prefetching", "")
+		c_store.AddInt(&PREFETCH_TIMEOUT, 60, "Server", "prefetch_timeout", "minutes after which a prefetched workunit that has not been started by the worker is put back into the queue", "")
+		c_store.AddInt(&MAX_UPLOAD_MB, 0, "Server", "max_upload_mb", "max total size in MB of the files uploaded with one multipart request, 0 means unlimited", "")
+		c_store.AddInt(&MAX_WORKER_UPLOAD_MB, 0, "Server", "max_worker_upload_mb", "max total size in MB of the files (e.g. logs and outputs) uploaded by a worker with one request, 0 means unlimited", "")
+
+		// RateLimit
+		c_store.AddInt(&RATE_LIMIT_SUBMIT, 0, "RateLimit", "submit_per_minute", "requests per minute and user (IP for anonymous callers) that create or change something, 0 disables the limit", "")
+		c_store.AddInt(&RATE_LIMIT_SUBMIT_BURST, 0, "RateLimit", "submit_burst", "max burst of submit requests, 0 means submit_per_minute", "")
+		c_store.AddInt(&RATE_LIMIT_READ, 0, "RateLimit", "read_per_minute", "GET requests per minute and user (IP for anonymous callers), 0 disables the limit", "")
+		c_store.AddInt(&RATE_LIMIT_READ_BURST, 0, "RateLimit", "read_burst", "max burst of GET requests, 0 means read_per_minute", "")
+		c_store.AddInt(&RATE_LIMIT_WORKER, 0, "RateLimit", "worker_per_minute", "requests per minute and clientgroup (IP for workers without clientgroup token), 0 disables the limit", "")
+		c_store.AddInt(&RATE_LIMIT_WORKER_BURST, 0, "RateLimit", "worker_burst", "max burst of worker requests, 0 means worker_per_minute", "")
+		c_store.AddInt(&RATE_LIMIT_AUTH, 0, "RateLimit", "auth_per_minute", "requests per minute and IP that carry credentials, counted before the credentials are checked, 0 disables the limit", "")
+		c_store.AddInt(&RATE_LIMIT_AUTH_BURST, 0, "RateLimit", "auth_burst", "max burst of requests with credentials, 0 means auth_per_minute", "")
 	}
 
 	if mode == "worker" || mode == "submitter" {
@@ -342,6 +436,10 @@ func getConfiguration(c *config.Config, mode string) (c_store *Config_store) {
 		c_store.AddString(&CWL_JOB, "", "Client", "cwl_job", "CWL job file", "")
 	}
 
+	if mode == "worker" {
+		c_store.AddBool(&LOCAL_RUNNER, false, "Client", "local_runner", "run the CWL workflow (cwl_tool) with its job (cwl_job) locally, without AWE server, MongoDB or Shock", "")
+	}
+
 	if mode == "worker" || mode == "submitter" {
 		c_store.AddString(&SHOCK_URL, "http://localhost:8001", "Client", "shockurl", "URL of SHOCK server, including port number", "")
 	}
@@ -380,8 +478,26 @@ func getConfiguration(c *config.Config, mode string) (c_store *Config_store) {
 		c_store.AddBool(&WORKER_OVERLAP, false, "Client", "worker_overlap", "overlap client side computation and data movement", "")
 		c_store.AddBool(&AUTO_CLEAN_DIR, true, "Client", "auto_clean_dir", "delete workunit directory to save space after completion, turn of for debugging", "")
 		c_store.AddBool(&CACHE_ENABLED, false, "Client", "cache_enabled", "", "")
+		c_store.AddInt(&CACHE_MAX_MB, 0, "Client", "cache_max_mb", "max total size of cached data (predata and cache_enabled files) in MB, 0 means unlimited", "")
+		c_store.AddString(&CACHE_POLICY, "lru", "Client", "cache_policy", "\"lru\" (least recently used) or \"lfu\" (least frequently used)", "which cached files are evicted first when the cache is full")
+		c_store.AddBool(&CACHE_VERIFY, false, "Client", "cache_verify", "verify the md5 checksum of cached files before they are used", "")
 		c_store.AddBool(&NO_SYMLINK, false, "Client", "no_symlink", "copy files from predata to work dir, default is to create symlink", "")
 
+		c_store.AddBool(&LOG_STREAM, true, "Client", "log_stream", "send stdout/stderr of running workunits to the server", "")
+		c_store.AddInt(&LOG_STREAM_INTERVAL, 2, "Client", "log_stream_interval", "seconds between checks for new stdout/stderr output", "")
+		c_store.AddInt(&LOG_STREAM_CHUNK_SIZE, 65536, "Client", "log_stream_chunk_size", "max bytes per log chunk sent to the server", "")
+		c_store.AddInt(&LOG_STREAM_BUFFER, 16, "Client", "log_stream_buffer", "max number of log chunks waiting to be sent, reading pauses when full", "")
+
+		c_store.AddBool(&KEEP_FAILED_WORKDIRS, true, "Client", "keep_failed_workdirs", "keep work dirs of failed workunits for inspection (within the limits below)", "")
+		c_store.AddInt(&KEEP_FAILED_MAX_MB, 10240, "Client", "keep_failed_max_mb", "max total size of retained work dirs in MB, oldest are removed first", "")
+		c_store.AddInt(&KEEP_FAILED_HOURS, 24, "Client", "keep_failed_hours", "hours a failed work dir is retained", "")
+
+		c_store.AddInt(&TRANSFER_CONCURRENCY, 4, "Client", "transfer_concurrency", "number of inputs, outputs or upload parts transferred at the same time", "")
+		c_store.AddInt(&TRANSFER_RETRIES, 5, "Client", "transfer_retries", "retries of a transfer after a transient error, with exponential backoff", "")
+		c_store.AddInt(&TRANSFER_MAX_MB_PER_SEC, 0, "Client", "transfer_max_mb_per_sec", "bandwidth cap for all transfers of the worker in MB/s, 0 means unlimited", "")
+		c_store.AddInt(&UPLOAD_CHUNK_MB, 1024, "Client", "upload_chunk_mb", "outputs larger than this are uploaded as Shock parts of this size, 0 disables chunked uploads", "")
+		c_store.AddInt(&PREFETCH_DEPTH, 0, "Client", "prefetch_depth", "number of workunits checked out in advance to stage their inputs while another workunit is computed, 0 disables prefetching", "requires worker_overlap=false")
+
 		c_store.AddString(&CWL_RUNNER_ARGS, "", "Client", "cwl_runner_args", "arguments to pass", "")
 
 	}
@@ -398,8 +514,15 @@ func getConfiguration(c *config.Config, mode string) (c_store *Config_store) {
 		c_store.AddString(&DOCKER_WORK_DIR, "/workdir/", "Docker", "docker_workpath", "work dir in docker container started by client", "")
 		c_store.AddString(&DOCKER_WORKUNIT_PREDATA_DIR, "/db/", "Docker", "docker_data", "predata dir in docker container started by client", "")
 		c_store.AddString(&SHOCK_DOCKER_IMAGE_REPOSITORY, "http://shock-internal.metagenomics.anl.gov", "Docker", "image_url", "url of shock server hosting docker images", "")
+		c_store.AddString(&DOCKER_PULL_POLICY, "if-not-present", "Docker", "docker_pull_policy", "\"always\", \"if-not-present\" or \"never\"", "pull policy for images of dockerPull tasks (registry images)")
+		c_store.AddString(&CONTAINER_RUNTIME, "docker", "Docker", "container_runtime", "\"docker\", \"podman\", \"singularity\" or \"apptainer\"", "container runtime used for tasks with docker images")
+		c_store.AddString(&PODMAN_BINARY, "podman", "Docker", "podman_binary", "podman binary to use", "")
+		c_store.AddString(&SINGULARITY_BINARY, "", "Docker", "singularity_binary", "singularity or apptainer binary to use", "default is the name of the runtime")
+		c_store.AddString(&SINGULARITY_IMAGE_DIR, "", "Docker", "singularity_image_dir", "directory for SIF images converted from docker images", "default is <data>/sif")
+		c_store.AddBool(&CONTAINER_NETWORK, false, "Docker", "container_network", "allow network access for all task containers", "otherwise only tasks with network_access get a network")
 	}
 	if mode == "server" {
+		c_store.AddBool(&DOCKER_PIN_DIGEST, true, "Docker", "docker_pin_digest", "resolve tags of dockerPull images to digests at submission time", "the digest is recorded in the task (or job for CWL DockerRequirements) and used by the worker, registries have to answer within 30 seconds")
 		c_store.AddString(&USE_APP_DEFS, "no", "Docker", "use_app_defs", "\"yes\", \"no\" or \"only\"", "yes: allow app defs, no: do not allow app defs, only: allow only app defs")
 		c_store.AddString(&APP_REGISTRY_URL, "https://raw.githubusercontent.com/MG-RAST/Skyport/master/app_definitions/", "Docker", "app_registry_url", "URL for app defintions", "")
 	}
@@ -569,6 +692,27 @@ func Init_conf(mode string) (err error) {
 		return fmt.Errorf("\"%s\" is invalid option for logoutput, use one of: file, console, both", LOG_OUTPUT)
 	}
 
+	if mode == "server" && JWT_JWKS != "" && (JWT_ISSUER == "" || JWT_AUDIENCE == "") {
+		return fmt.Errorf("jwt_jwks requires jwt_issuer and jwt_audience")
+	}
+
+	if mode == "worker" && DOCKER_PULL_POLICY != "always" && DOCKER_PULL_POLICY != "if-not-present" && DOCKER_PULL_POLICY != "never" {
+		return fmt.Errorf("\"%s\" is invalid option for docker_pull_policy, use one of: always, if-not-present, never", DOCKER_PULL_POLICY)
+	}
+	if mode == "worker" && CONTAINER_RUNTIME != "docker" && CONTAINER_RUNTIME != "podman" && CONTAINER_RUNTIME != "singularity" && CONTAINER_RUNTIME != "apptainer" {
+		return fmt.Errorf("\"%s\" is invalid option for container_runtime, use one of: docker, podman, singularity, apptainer", CONTAINER_RUNTIME)
+	}
+
+	if mode == "worker" && PREFETCH_DEPTH < 0 {
+		return fmt.Errorf("prefetch_depth must not be negative")
+	}
+	if mode == "worker" && TRANSFER_CONCURRENCY < 1 {
+		return fmt.Errorf("transfer_concurrency must be at least 1")
+	}
+	if mode == "worker" && CACHE_POLICY != "lru" && CACHE_POLICY != "lfu" {
+		return fmt.Errorf("\"%s\" is invalid option for cache_policy, use one of: lru, lfu", CACHE_POLICY)
+	}
+
 	SITE_PATH = cleanPath(SITE_PATH)
 	DATA_PATH = cleanPath(DATA_PATH)
 	LOGS_PATH = cleanPath(LOGS_PATH)
@@ -622,6 +766,9 @@ func Print(service string) {
 	if GLOBUS_TOKEN_URL != "" && GLOBUS_PROFILE_URL != "" {
 		fmt.Printf("type:\tglobus\ntoken_url:\t%s\nprofile_url:\t%s\n", GLOBUS_TOKEN_URL, GLOBUS_PROFILE_URL)
 	}
+	if JWT_JWKS != "" {
+		fmt.Printf("type:\tjwt\njwks:\t%s\nissuer:\t%s\naudience:\t%s\n", JWT_JWKS, JWT_ISSUER, JWT_AUDIENCE)
+	}
 	if len(AUTH_OAUTH) > 0 {
 		fmt.Printf("type:\toauth\n")
 		for b, u := range AUTH_OAUTH {
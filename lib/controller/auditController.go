@@ -0,0 +1,248 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/audit"
+	"github.com/MG-RAST/AWE/lib/conf"
+	e "github.com/MG-RAST/AWE/lib/errors"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"github.com/MG-RAST/AWE/lib/request"
+	"github.com/MG-RAST/AWE/lib/user"
+	"github.com/MG-RAST/golib/goweb"
+)
+
+// only the beginning of error responses is kept to extract the message
+const auditMaxBody = 4096
+
+// auditInsert stores the entries, tests replace it
+var auditInsert = audit.Insert
+
+type AuditController struct{}
+
+// OPTIONS: /audit
+func (cr *AuditController) Options(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	cx.RespondWithOK()
+	return
+}
+
+// GET: /audit?from=&to=&actor=&action=&target=&limit=&offset=, admins only
+// from and to are RFC3339 times or dates (2006-01-02), action "job." matches all job actions
+func (cr *AuditController) ReadMany(cx *goweb.Context) {
+	LogRequest(cx.Request)
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil && err.Error() != e.NoAuth {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if u == nil || !u.Admin {
+		cx.RespondWithErrorMessage(e.UnAuth, http.StatusUnauthorized)
+		return
+	}
+
+	query := &Query{Li: cx.Request.URL.Query()}
+	filter := audit.Filter{
+		Actor:  query.Value("actor"),
+		Action: query.Value("action"),
+		Target: query.Value("target"),
+	}
+	if query.Has("from") {
+		if filter.From, err = parseAuditTime(query.Value("from")); err != nil {
+			cx.RespondWithErrorMessage("Invalid datetime format: "+query.Value("from"), http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Has("to") {
+		if filter.To, err = parseAuditTime(query.Value("to")); err != nil {
+			cx.RespondWithErrorMessage("Invalid datetime format: "+query.Value("to"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := conf.DEFAULT_PAGE_SIZE
+	offset := 0
+	if query.Has("limit") {
+		if limit, err = strconv.Atoi(query.Value("limit")); err != nil || limit < 0 {
+			cx.RespondWithErrorMessage("limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Has("offset") {
+		if offset, err = strconv.Atoi(query.Value("offset")); err != nil || offset < 0 {
+			cx.RespondWithErrorMessage("offset must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, total, err := audit.Find(filter, limit, offset)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cx.RespondWithPaginatedData(entries, limit, offset, total)
+	return
+}
+
+func parseAuditTime(value string) (t time.Time, err error) {
+	if t, err = time.Parse(time.RFC3339, value); err == nil {
+		return
+	}
+	t, err = time.Parse("2006-01-02", value)
+	return
+}
+
+// auditRecord collects an audit entry while a handler runs. It is nil for requests that do
+// not change anything, all methods accept a nil receiver. Usage:
+//
+//	rec := newAuditRecord(cx, "job", id)
+//	defer rec.Save()
+//	...
+//	rec.SetUser(u)
+type auditRecord struct {
+	cx       *goweb.Context
+	entry    audit.Entry
+	recorder *auditResponseWriter
+}
+
+// auditResponseWriter keeps the status and the error message of the response
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 && w.body.Len() < auditMaxBody {
+		rest := auditMaxBody - w.body.Len()
+		if len(b) < rest {
+			rest = len(b)
+		}
+		w.body.Write(b[:rest])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func newAuditRecord(cx *goweb.Context, resource string, target string) (rec *auditRecord) {
+	switch cx.Request.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return nil
+	}
+	// worker heartbeats are not administrative actions
+	if _, ok := cx.Request.URL.Query()["heartbeat"]; ok {
+		return nil
+	}
+
+	rec = &auditRecord{cx: cx}
+	rec.entry.Params = make(map[string]string)
+	rec.entry.Action = resource + "." + strings.ToLower(cx.Request.Method)
+	rec.entry.Target = target
+	rec.entry.SourceIP, _, _ = net.SplitHostPort(cx.Request.RemoteAddr)
+	rec.entry.ForwardedFor = cx.Request.Header.Get("X-Forwarded-For")
+
+	rec.recorder = &auditResponseWriter{ResponseWriter: cx.ResponseWriter}
+	cx.ResponseWriter = rec.recorder
+	return
+}
+
+func (rec *auditRecord) SetUser(u *user.User) {
+	if rec == nil || u == nil {
+		return
+	}
+	rec.entry.Actor = u.Uuid
+	rec.entry.Username = u.Username
+}
+
+// SetOperation replaces the method in the action with the first of the query parameters that
+// is present, e.g. job.put becomes job.suspend for PUT /job/{id}?suspend
+func (rec *auditRecord) SetOperation(operations ...string) {
+	if rec == nil {
+		return
+	}
+	query := rec.cx.Request.URL.Query()
+	for _, operation := range operations {
+		if _, ok := query[operation]; ok {
+			rec.entry.Action = rec.entry.Action[:strings.LastIndex(rec.entry.Action, ".")+1] + operation
+			return
+		}
+	}
+}
+
+// SetParam records a parameter that is not part of the query or form, e.g. a path parameter
+func (rec *auditRecord) SetParam(key string, value string) {
+	if rec == nil {
+		return
+	}
+	rec.entry.Params[auditKey(key)] = auditValue(key, value)
+}
+
+// Save stores the entry with the outcome of the request, the parameters are taken from
+// the query and the parsed form with values of secret parameters removed
+func (rec *auditRecord) Save() {
+	if rec == nil {
+		return
+	}
+	r := rec.cx.Request
+	for key, values := range r.URL.Query() {
+		rec.entry.Params[auditKey(key)] = auditValue(key, strings.Join(values, ","))
+	}
+	if r.MultipartForm != nil {
+		for key, values := range r.MultipartForm.Value {
+			rec.entry.Params[auditKey(key)] = auditValue(key, strings.Join(values, ","))
+		}
+		for key := range r.MultipartForm.File {
+			rec.entry.Params[auditKey(key)] = "(file)"
+		}
+	}
+
+	rec.entry.Status = rec.recorder.status
+	if rec.entry.Status == 0 {
+		rec.entry.Status = http.StatusOK
+	}
+	rec.entry.Success = rec.entry.Status < 400
+	if !rec.entry.Success {
+		response := struct {
+			Error []string `json:"error"`
+		}{}
+		if json.Unmarshal(rec.recorder.body.Bytes(), &response) == nil {
+			rec.entry.Error = strings.Join(response.Error, "; ")
+		}
+		if rec.entry.Error == "" {
+			rec.entry.Error = http.StatusText(rec.entry.Status)
+		}
+	}
+
+	if err := auditInsert(&rec.entry); err != nil {
+		logger.Error("(auditRecord.Save) action=%s target=%s: %s", rec.entry.Action, rec.entry.Target, err.Error())
+	}
+}
+
+// mongo keys can not contain "." or start with "$"
+func auditKey(key string) string {
+	return strings.Replace(strings.Replace(key, ".", "_", -1), "$", "_", -1)
+}
+
+func auditValue(key string, value string) string {
+	lower := strings.ToLower(key)
+	if strings.Contains(lower, "password") || strings.Contains(lower, "token") || strings.Contains(lower, "secret") {
+		if value != "" {
+			return "(redacted)"
+		}
+	}
+	return value
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/MG-RAST/AWE/lib/audit"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"github.com/MG-RAST/golib/goweb"
+)
+
+// TestAuditMutatingHandlers checks that the handlers write an audit record, also for requests
+// that are rejected because they are not authenticated
+func TestAuditMutatingHandlers(t *testing.T) {
+	if logger.Log == nil {
+		logger.Initialize("server")
+	}
+	goweb.ConfigureDefaultFormatters()
+
+	var entries []*audit.Entry
+	auditInsert = func(entry *audit.Entry) error {
+		entries = append(entries, entry)
+		return nil
+	}
+	defer func() { auditInsert = audit.Insert }()
+
+	users := &UserController{}
+	groups := &GroupController{}
+	clientgroups := &ClientGroupController{}
+	loggers := &LoggerController{}
+
+	tests := []struct {
+		method  string
+		url     string
+		params  goweb.ParameterValueMap
+		handler func(cx *goweb.Context)
+		action  string
+		target  string
+	}{
+		{"POST", "/user", nil, users.Create, "user.post", ""},
+		{"PUT", "/user/u1", nil, func(cx *goweb.Context) { users.Update("u1", cx) }, "user.put", "u1"},
+		{"DELETE", "/user/u1", nil, func(cx *goweb.Context) { users.Delete("u1", cx) }, "user.delete", "u1"},
+		{"POST", "/user/u1/token", goweb.ParameterValueMap{"uid": "u1"}, UserTokenController, "user.token.post", "u1"},
+		{"DELETE", "/user/u1/token/t1", goweb.ParameterValueMap{"uid": "u1", "tid": "t1"}, UserTokenController, "user.token.delete", "u1"},
+		{"POST", "/group", nil, groups.Create, "group.post", ""},
+		{"PUT", "/group/g1", nil, func(cx *goweb.Context) { groups.Update("g1", cx) }, "group.put", "g1"},
+		{"DELETE", "/group/g1", nil, func(cx *goweb.Context) { groups.Delete("g1", cx) }, "group.delete", "g1"},
+		{"POST", "/group/g1/members", goweb.ParameterValueMap{"name": "g1", "type": "members"}, GroupControllerTyped, "group.member.post", "g1"},
+		{"DELETE", "/group/g1/admins", goweb.ParameterValueMap{"name": "g1", "type": "admins"}, GroupControllerTyped, "group.member.delete", "g1"},
+		{"PUT", "/cgroup/cg1/registry", goweb.ParameterValueMap{"cgid": "cg1"}, ClientGroupRegistryController, "clientgroup.registry.put", "cg1"},
+		{"DELETE", "/cgroup/cg1/registry?registry=r", goweb.ParameterValueMap{"cgid": "cg1"}, ClientGroupRegistryController, "clientgroup.registry.delete", "cg1"},
+		{"POST", "/cgroup/cg1", nil, func(cx *goweb.Context) { clientgroups.CreateWithId("cg1", cx) }, "clientgroup.post", "cg1"},
+		{"DELETE", "/cgroup/cg1", nil, func(cx *goweb.Context) { clientgroups.Delete("cg1", cx) }, "clientgroup.delete", "cg1"},
+		{"PUT", "/logger?debug=3", nil, loggers.UpdateMany, "logger.put", ""},
+	}
+
+	for _, test := range tests {
+		entries = nil
+		cx := &goweb.Context{
+			Request:        httptest.NewRequest(test.method, test.url, nil),
+			ResponseWriter: httptest.NewRecorder(),
+			PathParams:     test.params,
+			Format:         "JSON",
+		}
+		test.handler(cx)
+
+		if len(entries) != 1 {
+			t.Errorf("%s %s: %d audit records, expected 1", test.method, test.url, len(entries))
+			continue
+		}
+		entry := entries[0]
+		if entry.Action != test.action || entry.Target != test.target {
+			t.Errorf("%s %s: got action %s target %q, expected %s target %q", test.method, test.url, entry.Action, entry.Target, test.action, test.target)
+		}
+		if entry.Status != http.StatusUnauthorized || entry.Success {
+			t.Errorf("%s %s: got status %d success %t, expected an unauthorized failure", test.method, test.url, entry.Status, entry.Success)
+		}
+	}
+
+	// reading does not write records
+	entries = nil
+	cx := &goweb.Context{
+		Request:        httptest.NewRequest("GET", "/user/u1/token", nil),
+		ResponseWriter: httptest.NewRecorder(),
+		PathParams:     goweb.ParameterValueMap{"uid": "u1"},
+		Format:         "JSON",
+	}
+	UserTokenController(cx)
+	if len(entries) != 0 {
+		t.Errorf("GET wrote %d audit records", len(entries))
+	}
+}
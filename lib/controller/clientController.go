@@ -204,6 +204,9 @@ func (cr *ClientController) ReadMany(cx *goweb.Context) {
 // PUT: /client/{id} -> status update
 func (cr *ClientController) Update(id string, cx *goweb.Context) {
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "client", id)
+	defer rec.Save()
+	rec.SetOperation("subclients", "suspend", "resume")
 
 	// Gather query params
 	query := &Query{Li: cx.Request.URL.Query()}
@@ -235,6 +238,10 @@ func (cr *ClientController) Update(id string, cx *goweb.Context) {
 			return
 		}
 		worker_status.Current_work.Init("Current_work")
+		if worker_status.Prefetched_work == nil {
+			worker_status.Prefetched_work = core.NewWorkunitList()
+		}
+		worker_status.Prefetched_work.Init("Prefetched_work")
 
 		hbmsg, err := core.QMgr.ClientHeartBeat(id, cg, worker_status)
 		if err != nil {
@@ -250,6 +257,7 @@ func (cr *ClientController) Update(id string, cx *goweb.Context) {
 	if done {
 		return
 	}
+	rec.SetUser(u)
 
 	if query.Has("subclients") { //update the number of subclients for a proxy
 		if count, err := strconv.Atoi(query.Value("subclients")); err != nil {
@@ -283,6 +291,9 @@ func (cr *ClientController) Update(id string, cx *goweb.Context) {
 // PUT: /client
 func (cr *ClientController) UpdateMany(cx *goweb.Context) {
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "client", "")
+	defer rec.Save()
+	rec.SetOperation("resumeall", "suspendall")
 
 	// Try to authenticate user.
 	u, err := request.Authenticate(cx.Request)
@@ -300,6 +311,7 @@ func (cr *ClientController) UpdateMany(cx *goweb.Context) {
 			return
 		}
 	}
+	rec.SetUser(u)
 
 	// Gather query params
 	query := &Query{Li: cx.Request.URL.Query()}
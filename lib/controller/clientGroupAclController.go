@@ -6,7 +6,6 @@ import (
 	e "github.com/MG-RAST/AWE/lib/errors"
 	"github.com/MG-RAST/AWE/lib/request"
 	"github.com/MG-RAST/AWE/lib/user"
-	"github.com/MG-RAST/golib/go-uuid/uuid"
 	"github.com/MG-RAST/golib/goweb"
 	mgo "gopkg.in/mgo.v2"
 	"net/http"
@@ -82,6 +81,9 @@ var ClientGroupAclController goweb.ControllerFunc = func(cx *goweb.Context) {
 // GET, POST, PUT, DELETE, OPTIONS: /cgroup/{cgid}/acl/{type}
 var ClientGroupAclControllerTyped goweb.ControllerFunc = func(cx *goweb.Context) {
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "clientgroup.acl", cx.PathParams["cgid"])
+	defer rec.Save()
+	rec.SetParam("type", cx.PathParams["type"])
 
 	if cx.Request.Method == "OPTIONS" {
 		cx.RespondWithOK()
@@ -94,6 +96,7 @@ var ClientGroupAclControllerTyped goweb.ControllerFunc = func(cx *goweb.Context)
 		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
 		return
 	}
+	rec.SetUser(u)
 
 	cgid := cx.PathParams["cgid"]
 	rtype := cx.PathParams["type"]
@@ -225,16 +228,6 @@ func parseClientGroupAclRequestTyped(cx *goweb.Context) (ids []string, err error
 	} else {
 		return nil, nil
 	}
-	for _, v := range users {
-		if uuid.Parse(v) != nil {
-			ids = append(ids, v)
-		} else {
-			u := user.User{Username: v}
-			if err := u.SetMongoInfo(); err != nil {
-				return nil, err
-			}
-			ids = append(ids, u.Uuid)
-		}
-	}
-	return ids, nil
+	// users and groups (group:<name>)
+	return parseUserList(strings.Join(users, ","), true)
 }
@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"github.com/MG-RAST/AWE/lib/acl"
 	"github.com/MG-RAST/AWE/lib/conf"
 	"github.com/MG-RAST/AWE/lib/core"
 	e "github.com/MG-RAST/AWE/lib/errors"
@@ -26,6 +27,8 @@ func (cr *ClientGroupController) Options(cx *goweb.Context) {
 // POST: /cgroup/{name}
 func (cr *ClientGroupController) CreateWithId(name string, cx *goweb.Context) {
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "clientgroup", name)
+	defer rec.Save()
 
 	// Try to authenticate user.
 	u, err := request.Authenticate(cx.Request)
@@ -45,6 +48,7 @@ func (cr *ClientGroupController) CreateWithId(name string, cx *goweb.Context) {
 			return
 		}
 	}
+	rec.SetUser(u)
 
 	cg, err := core.CreateClientGroup(name, u)
 	if err != nil {
@@ -139,7 +143,7 @@ func (cr *ClientGroupController) ReadMany(cx *goweb.Context) {
 
 	// Add authorization checking to query if the user is not an admin
 	if u.Admin == false {
-		q["$or"] = []bson.M{bson.M{"acl.read": "public"}, bson.M{"acl.read": u.Uuid}, bson.M{"acl.owner": u.Uuid}}
+		q["$or"] = []bson.M{bson.M{"acl.read": "public"}, bson.M{"acl.read": bson.M{"$in": acl.Principals(u.Uuid)}}, bson.M{"acl.owner": u.Uuid}}
 	}
 
 	limit := conf.DEFAULT_PAGE_SIZE
@@ -196,6 +200,8 @@ func (cr *ClientGroupController) ReadMany(cx *goweb.Context) {
 // DELETE: /cgroup/{id}
 func (cr *ClientGroupController) Delete(id string, cx *goweb.Context) {
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "clientgroup", id)
+	defer rec.Save()
 
 	// Try to authenticate user.
 	u, err := request.Authenticate(cx.Request)
@@ -215,6 +221,7 @@ func (cr *ClientGroupController) Delete(id string, cx *goweb.Context) {
 			return
 		}
 	}
+	rec.SetUser(u)
 
 	// Load clientgroup by id
 	cg, err := core.LoadClientGroup(id)
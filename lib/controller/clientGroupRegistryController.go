@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	e "github.com/MG-RAST/AWE/lib/errors"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"github.com/MG-RAST/AWE/lib/request"
+	"github.com/MG-RAST/AWE/lib/user"
+	"github.com/MG-RAST/golib/goweb"
+	mgo "gopkg.in/mgo.v2"
+	"net/http"
+)
+
+// GET, PUT, DELETE, OPTIONS: /cgroup/{cgid}/registry
+// docker registry credentials used by the workers of the clientgroup.
+// PUT: multipart form with registry, username and password; DELETE: ?registry=<name>
+var ClientGroupRegistryController goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "clientgroup.registry", cx.PathParams["cgid"])
+	defer rec.Save()
+
+	if cx.Request.Method == "OPTIONS" {
+		cx.RespondWithOK()
+		return
+	}
+
+	// Try to authenticate user.
+	u, err := request.Authenticate(cx.Request)
+	if err != nil && err.Error() != e.NoAuth {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// If no auth was provided and ANON_CG_WRITE is true, use the public user.
+	if u == nil {
+		if conf.ANON_CG_WRITE == true {
+			u = &user.User{Uuid: "public"}
+		} else {
+			cx.RespondWithErrorMessage(e.UnAuth, http.StatusUnauthorized)
+			return
+		}
+	}
+	rec.SetUser(u)
+
+	cgid := cx.PathParams["cgid"]
+	cg, err := core.LoadClientGroup(cgid)
+
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			cx.RespondWithNotFound()
+		} else {
+			cx.RespondWithErrorMessage("clientgroup id not found:"+cgid, http.StatusBadRequest)
+		}
+		return
+	}
+
+	// same rights as for the clientgroup token
+	rights := cg.Acl.Check(u.Uuid)
+	public_rights := cg.Acl.Check("public")
+	if !((u.Uuid != "public" && (cg.Acl.Owner == u.Uuid || rights["write"] == true || u.Admin == true || public_rights["write"] == true)) ||
+		(u.Uuid == "public" && conf.ANON_CG_WRITE == true && public_rights["write"] == true)) {
+		cx.RespondWithErrorMessage(e.UnAuth, http.StatusUnauthorized)
+		return
+	}
+
+	switch cx.Request.Method {
+	case "GET":
+		cx.RespondWithData(cg.Registries)
+		return
+	case "PUT":
+		params, _, err := ParseMultipartForm(cx.Request)
+		if err != nil {
+			cx.RespondWithErrorMessage("error parsing form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if params["registry"] == "" || params["username"] == "" {
+			cx.RespondWithErrorMessage("registry and username are required", http.StatusBadRequest)
+			return
+		}
+		if err = cg.SetRegistryCredential(params["registry"], params["username"], params["password"]); err != nil {
+			logger.Error("(ClientGroupRegistryController) %s", err.Error())
+			cx.RespondWithErrorMessage("Could not store credential.", http.StatusInternalServerError)
+			return
+		}
+		if err = cg.Save(); err != nil {
+			cx.RespondWithErrorMessage("Could not save clientgroup.", http.StatusInternalServerError)
+			return
+		}
+		cx.RespondWithData(cg.Registries)
+		return
+	case "DELETE":
+		registry := cx.Request.URL.Query().Get("registry")
+		if !cg.DeleteRegistryCredential(registry) {
+			cx.RespondWithErrorMessage("no credential for registry "+registry, http.StatusBadRequest)
+			return
+		}
+		if err = cg.Save(); err != nil {
+			cx.RespondWithErrorMessage("Could not save clientgroup.", http.StatusInternalServerError)
+			return
+		}
+		cx.RespondWithData(cg.Registries)
+		return
+	default:
+		cx.RespondWithError(http.StatusNotImplemented)
+		return
+	}
+}
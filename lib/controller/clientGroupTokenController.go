@@ -14,6 +14,8 @@ import (
 // GET, POST, PUT, DELETE, OPTIONS: /cgroup/{cgid}/token/ (only OPTIONS, PUT and DELETE are implemented)
 var ClientGroupTokenController goweb.ControllerFunc = func(cx *goweb.Context) {
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "clientgroup.token", cx.PathParams["cgid"])
+	defer rec.Save()
 
 	if cx.Request.Method == "OPTIONS" {
 		cx.RespondWithOK()
@@ -38,6 +40,7 @@ var ClientGroupTokenController goweb.ControllerFunc = func(cx *goweb.Context) {
 			return
 		}
 	}
+	rec.SetUser(u)
 
 	cgid := cx.PathParams["cgid"]
 	cg, err := core.LoadClientGroup(cgid)
@@ -5,30 +5,50 @@ import (
 )
 
 type ServerController struct {
-	Awf              *AwfController
-	Client           *ClientController
-	ClientGroup      *ClientGroupController
-	ClientGroupAcl   map[string]goweb.ControllerFunc
-	ClientGroupToken goweb.ControllerFunc
-	Job              *JobController
-	JobAcl           map[string]goweb.ControllerFunc
-	Logger           *LoggerController
-	Queue            *QueueController
-	Work             *WorkController
+	Audit               *AuditController
+	Awf                 *AwfController
+	Client              *ClientController
+	ClientGroup         *ClientGroupController
+	ClientGroupAcl      map[string]goweb.ControllerFunc
+	ClientGroupToken    goweb.ControllerFunc
+	ClientGroupRegistry goweb.ControllerFunc
+	Group               *GroupController
+	GroupTyped          goweb.ControllerFunc
+	Job                 *JobController
+	JobAcl              map[string]goweb.ControllerFunc
+	JobBulk             goweb.ControllerFunc
+	Wes                 map[string]goweb.ControllerFunc
+	Tes                 map[string]goweb.ControllerFunc
+	Logger              *LoggerController
+	Queue               *QueueController
+	User                *UserController
+	UserToken           goweb.ControllerFunc
+	Work                *WorkController
+	WorkFiles           goweb.ControllerFunc
 }
 
 func NewServerController() *ServerController {
 	return &ServerController{
-		Awf:              new(AwfController),
-		Client:           new(ClientController),
-		ClientGroup:      new(ClientGroupController),
-		ClientGroupAcl:   map[string]goweb.ControllerFunc{"base": ClientGroupAclController, "typed": ClientGroupAclControllerTyped},
-		ClientGroupToken: ClientGroupTokenController,
-		Job:              new(JobController),
-		JobAcl:           map[string]goweb.ControllerFunc{"base": JobAclController, "typed": JobAclControllerTyped},
-		Logger:           new(LoggerController),
-		Queue:            new(QueueController),
-		Work:             new(WorkController),
+		Audit:               new(AuditController),
+		Awf:                 new(AwfController),
+		Client:              new(ClientController),
+		ClientGroup:         new(ClientGroupController),
+		ClientGroupAcl:      map[string]goweb.ControllerFunc{"base": ClientGroupAclController, "typed": ClientGroupAclControllerTyped},
+		ClientGroupToken:    ClientGroupTokenController,
+		ClientGroupRegistry: ClientGroupRegistryController,
+		Group:               new(GroupController),
+		GroupTyped:          GroupControllerTyped,
+		Job:                 new(JobController),
+		JobAcl:              map[string]goweb.ControllerFunc{"base": JobAclController, "typed": JobAclControllerTyped},
+		JobBulk:             JobBulkController,
+		Wes:                 map[string]goweb.ControllerFunc{"service-info": WesServiceInfoController, "runs": WesRunsController, "run": WesRunController, "status": WesRunStatusController, "cancel": WesRunCancelController},
+		Tes:                 map[string]goweb.ControllerFunc{"service-info": TesServiceInfoController, "tasks": TesTasksController, "task": TesTaskController},
+		Logger:              new(LoggerController),
+		Queue:               new(QueueController),
+		User:                new(UserController),
+		UserToken:           UserTokenController,
+		Work:                new(WorkController),
+		WorkFiles:           WorkFilesController,
 	}
 }
 
@@ -0,0 +1,197 @@
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	e "github.com/MG-RAST/AWE/lib/errors"
+	"github.com/MG-RAST/AWE/lib/request"
+	"github.com/MG-RAST/AWE/lib/user"
+	"github.com/MG-RAST/golib/goweb"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// run and task states of the GA4GH WES and TES APIs
+const (
+	GA4GH_UNKNOWN        = "UNKNOWN"
+	GA4GH_QUEUED         = "QUEUED"
+	GA4GH_INITIALIZING   = "INITIALIZING"
+	GA4GH_RUNNING        = "RUNNING"
+	GA4GH_PAUSED         = "PAUSED"
+	GA4GH_COMPLETE       = "COMPLETE"
+	GA4GH_EXECUTOR_ERROR = "EXECUTOR_ERROR"
+	GA4GH_SYSTEM_ERROR   = "SYSTEM_ERROR"
+	GA4GH_CANCELED       = "CANCELED"
+	GA4GH_CANCELING      = "CANCELING"
+)
+
+// larger page_size values are reduced to this
+const GA4GH_MAX_PAGE_SIZE = 1000
+
+type ga4ghError struct {
+	Msg        string `json:"msg"`
+	StatusCode int    `json:"status_code"`
+}
+
+// WES and TES responses are not wrapped in the standard AWE response
+func ga4ghRespond(cx *goweb.Context, status int, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(ga4ghError{Msg: "Could not marshal response: " + err.Error(), StatusCode: status})
+	}
+	cx.ResponseWriter.Header().Set("Content-Type", "application/json")
+	cx.ResponseWriter.WriteHeader(status)
+	cx.ResponseWriter.Write(body)
+}
+
+func ga4ghRespondError(cx *goweb.Context, status int, msg string) {
+	ga4ghRespond(cx, status, ga4ghError{Msg: msg, StatusCode: status})
+}
+
+// ga4ghUser authenticates the request, anonymous users get the public user if anon is allowed
+func ga4ghUser(cx *goweb.Context, anon bool) (u *user.User, ok bool) {
+	u, err := request.Authenticate(cx.Request)
+	if err != nil && err.Error() != e.NoAuth {
+		ga4ghRespondError(cx, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if u == nil {
+		if !anon {
+			ga4ghRespondError(cx, http.StatusUnauthorized, e.NoAuth)
+			return
+		}
+		u = &user.User{Uuid: "public"}
+	}
+	ok = true
+	return
+}
+
+// ga4ghState maps the job state, suspended jobs are paused unless a task failed
+func ga4ghState(job *core.Job) string {
+	switch job.State {
+	case core.JOB_STAT_INIT, core.JOB_STAT_QUEUING:
+		return GA4GH_INITIALIZING
+	case core.JOB_STAT_QUEUED:
+		return GA4GH_QUEUED
+	case core.JOB_STAT_INPROGRESS:
+		return GA4GH_RUNNING
+	case core.JOB_STAT_COMPLETED:
+		return GA4GH_COMPLETE
+	case core.JOB_STAT_FAILED_PERMANENT:
+		return GA4GH_EXECUTOR_ERROR
+	case core.JOB_STAT_DELETED:
+		return GA4GH_CANCELED
+	case core.JOB_STAT_SUSPEND:
+		if job.Error != nil && (job.Error.WorkFailed != "" || job.Error.TaskFailed != "") {
+			return GA4GH_EXECUTOR_ERROR
+		}
+		return GA4GH_PAUSED
+	}
+	return GA4GH_UNKNOWN
+}
+
+// ga4ghExitCode is the exit code of a workunit: 0 once its task has completed and, if the
+// workunit made the job fail, the exit status the worker reported or 1 if it failed without
+// one (e.g. while staging data). It is nil while the workunit has no result.
+func ga4ghExitCode(job *core.Job, task *core.Task, work_str string) *int {
+	exit_code := 0
+	if task.State == core.TASK_STAT_COMPLETED {
+		return &exit_code
+	}
+	if ga4ghState(job) != GA4GH_EXECUTOR_ERROR || job.Error.WorkFailed != work_str {
+		return nil
+	}
+	exit_code = job.Error.ExitStatus
+	if exit_code == 0 {
+		exit_code = 1
+	}
+	return &exit_code
+}
+
+func ga4ghTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// ga4ghLoadJob loads a job of the API (is tells which jobs belong to it) if the user has the
+// right on it, jobs the user can not read are not found
+func ga4ghLoadJob(cx *goweb.Context, id string, right string, is func(*core.Job) bool) (job *core.Job, u *user.User, ok bool) {
+	anon := conf.ANON_READ
+	if right == "delete" {
+		anon = conf.ANON_DELETE
+	}
+	u, ok = ga4ghUser(cx, anon)
+	if !ok {
+		return
+	}
+	ok = false
+
+	job, err := core.GetJob(id)
+	if err != nil || !is(job) {
+		ga4ghRespondError(cx, http.StatusNotFound, "not found: "+id)
+		return
+	}
+	rights := job.Acl.Check(u.Uuid)
+	if job.Acl.Owner != u.Uuid && rights[right] == false && u.Admin == false {
+		if rights["read"] {
+			ga4ghRespondError(cx, http.StatusForbidden, e.UnAuth)
+		} else {
+			ga4ghRespondError(cx, http.StatusNotFound, "not found: "+id)
+		}
+		return
+	}
+	ok = true
+	return
+}
+
+// ga4ghListJobs returns a page of the jobs of the query the user can read, newest first. The
+// page_token of the next page is empty on the last page.
+func ga4ghListJobs(cx *goweb.Context, u *user.User, q bson.M) (jobs core.Jobs, next string, ok bool) {
+	query := &Query{Li: cx.Request.URL.Query()}
+
+	limit := conf.DEFAULT_PAGE_SIZE
+	if query.Has("page_size") {
+		var err error
+		if limit, err = strconv.Atoi(query.Value("page_size")); err != nil || limit <= 0 {
+			ga4ghRespondError(cx, http.StatusBadRequest, "page_size must be a positive integer")
+			return
+		}
+		if limit > GA4GH_MAX_PAGE_SIZE {
+			limit = GA4GH_MAX_PAGE_SIZE
+		}
+	}
+	var cursor *core.Cursor
+	var err error
+	if query.Has("page_token") && query.Value("page_token") != "" {
+		cursor, err = core.DecodeCursor(query.Value("page_token"), core.JobListFields)
+	} else {
+		cursor, err = core.NewCursor("info.submittime", "desc", core.JobListFields)
+	}
+	if err != nil {
+		ga4ghRespondError(cx, http.StatusBadRequest, "invalid page_token")
+		return
+	}
+
+	if u.Uuid == "public" {
+		q["acl.read"] = "public"
+	} else if !u.Admin {
+		q["$or"] = readableJobs(u)
+	}
+	cursor, err = jobs.GetPage(q, limit, cursor)
+	if err != nil {
+		ga4ghRespondError(cx, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if cursor != nil {
+		next = cursor.Encode()
+	}
+	ok = true
+	return
+}
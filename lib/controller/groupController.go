@@ -0,0 +1,422 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/MG-RAST/AWE/lib/acl"
+	"github.com/MG-RAST/AWE/lib/core"
+	e "github.com/MG-RAST/AWE/lib/errors"
+	"github.com/MG-RAST/AWE/lib/group"
+	"github.com/MG-RAST/AWE/lib/request"
+	"github.com/MG-RAST/AWE/lib/user"
+	"github.com/MG-RAST/golib/go-uuid/uuid"
+	"github.com/MG-RAST/golib/goweb"
+	mgo "gopkg.in/mgo.v2"
+)
+
+var (
+	validGroupMemberTypes = map[string]bool{"members": true, "admins": true}
+	validGroupJobRights   = map[string]bool{"read": true, "write": true, "delete": true}
+)
+
+type GroupController struct{}
+
+// OPTIONS: /group
+func (cr *GroupController) Options(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	cx.RespondWithOK()
+	return
+}
+
+// POST: /group (name, description, job_acl)
+func (cr *GroupController) Create(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "group", "")
+	defer rec.Save()
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+	rec.SetUser(u)
+
+	params := parseGroupRequest(cx)
+	if params["name"] == "" {
+		cx.RespondWithErrorMessage("name is missing", http.StatusBadRequest)
+		return
+	}
+
+	job_acl, err := parseGroupJobAcl(params)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	g, err := group.New(params["name"], params["description"], u.Uuid)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+		return
+	}
+	rec.entry.Target = g.Name
+
+	if job_acl != nil {
+		g.JobAcl = job_acl
+		err = g.Save()
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	cx.RespondWithData(g)
+	return
+}
+
+// GET: /group/{name}
+func (cr *GroupController) Read(name string, cx *goweb.Context) {
+	LogRequest(cx.Request)
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	g, ok := loadGroup(name, cx)
+	if !ok {
+		return
+	}
+
+	// members and invited users can see the group, server admins all groups
+	if !g.IsMember(u.Uuid) && !g.IsInvited(u.Uuid) && !u.Admin {
+		cx.RespondWithErrorMessage(e.UnAuth, http.StatusUnauthorized)
+		return
+	}
+
+	cx.RespondWithData(g)
+	return
+}
+
+// GET: /group
+func (cr *GroupController) ReadMany(cx *goweb.Context) {
+	LogRequest(cx.Request)
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// server admins get all groups with ?all
+	query := &Query{Li: cx.Request.URL.Query()}
+	groups, err := group.List(u.Uuid, u.Admin && query.Has("all"))
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cx.RespondWithData(groups)
+	return
+}
+
+// PUT: /group/{name} (description, job_acl)
+func (cr *GroupController) Update(name string, cx *goweb.Context) {
+	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "group", name)
+	defer rec.Save()
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+	rec.SetUser(u)
+
+	g, ok := loadGroup(name, cx)
+	if !ok {
+		return
+	}
+
+	if !g.IsAdmin(u.Uuid) && !u.Admin {
+		cx.RespondWithErrorMessage(e.UnAuth, http.StatusUnauthorized)
+		return
+	}
+
+	params := parseGroupRequest(cx)
+	if _, ok := params["description"]; ok {
+		g.Description = params["description"]
+	}
+	job_acl, err := parseGroupJobAcl(params)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+		return
+	}
+	if job_acl != nil {
+		g.JobAcl = job_acl
+	}
+
+	err = g.Save()
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cx.RespondWithData(g)
+	return
+}
+
+// DELETE: /group/{name}
+func (cr *GroupController) Delete(name string, cx *goweb.Context) {
+	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "group", name)
+	defer rec.Save()
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+	rec.SetUser(u)
+
+	g, ok := loadGroup(name, cx)
+	if !ok {
+		return
+	}
+
+	if g.Owner != u.Uuid && !u.Admin {
+		cx.RespondWithErrorMessage("Only the owner of a group can delete it.", http.StatusUnauthorized)
+		return
+	}
+
+	// a new group with the same name must not inherit any rights
+	err = core.DBRemoveAclId(group.Principal(g.Name))
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = group.Delete(g.Name)
+	if err != nil {
+		cx.RespondWithErrorMessage("Could not delete group.", http.StatusInternalServerError)
+		return
+	}
+	cx.RespondWithOK()
+	return
+}
+
+// GET, POST, PUT, DELETE: /group/{name}/{type}
+var GroupControllerTyped goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "group.member", cx.PathParams["name"])
+	defer rec.Save()
+	rec.SetParam("type", cx.PathParams["type"])
+
+	if cx.Request.Method == "OPTIONS" {
+		cx.RespondWithOK()
+		return
+	}
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+	rec.SetUser(u)
+
+	name := cx.PathParams["name"]
+	mtype := cx.PathParams["type"]
+	rmeth := cx.Request.Method
+
+	if !validGroupMemberTypes[mtype] {
+		cx.RespondWithErrorMessage("Invalid group member type, use members or admins", http.StatusBadRequest)
+		return
+	}
+
+	g, ok := loadGroup(name, cx)
+	if !ok {
+		return
+	}
+
+	if rmeth == "GET" {
+		if !g.IsMember(u.Uuid) && !u.Admin {
+			cx.RespondWithErrorMessage(e.UnAuth, http.StatusUnauthorized)
+			return
+		}
+		if mtype == "admins" {
+			cx.RespondWithData(g.Admins)
+		} else {
+			cx.RespondWithData(g.Members)
+		}
+		return
+	}
+
+	// invited users accept an invitation by adding themselves
+	accept := false
+
+	ids, err := parseUserList(parseGroupRequest(cx)["users"], false)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(ids) == 0 {
+		cx.RespondWithErrorMessage("users is missing", http.StatusBadRequest)
+		return
+	}
+
+	if (rmeth == "POST" || rmeth == "PUT") && len(ids) == 1 && ids[0] == u.Uuid && !u.Admin {
+		if mtype == "admins" {
+			accept = g.AcceptAdmin(u.Uuid)
+		} else {
+			accept = g.AcceptMember(u.Uuid)
+		}
+	}
+
+	// members that do not manage the group can only leave it or decline an invitation
+	if !accept && !g.IsAdmin(u.Uuid) && !u.Admin {
+		if rmeth != "DELETE" || len(ids) != 1 || ids[0] != u.Uuid {
+			cx.RespondWithErrorMessage("Users that are not group admins can only remove themselves from a group.", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// only the owner hands out admin rights
+	if !accept && mtype == "admins" && rmeth != "DELETE" && g.Owner != u.Uuid && !u.Admin {
+		cx.RespondWithErrorMessage("Only the owner of a group can add admins.", http.StatusUnauthorized)
+		return
+	}
+
+	for _, id := range ids {
+		if accept {
+			break
+		}
+		switch rmeth {
+		case "POST", "PUT":
+			// server admins add users directly, group admins invite them
+			if mtype == "admins" && u.Admin {
+				g.AddAdmin(id)
+			} else if mtype == "admins" {
+				g.InviteAdmin(id)
+			} else if u.Admin {
+				g.AddMember(id)
+			} else {
+				g.InviteMember(id)
+			}
+		case "DELETE":
+			if mtype == "admins" {
+				g.RemoveAdmin(id)
+			} else {
+				g.RemoveMember(id)
+			}
+		default:
+			cx.RespondWithErrorMessage("This request type is not implemented.", http.StatusNotImplemented)
+			return
+		}
+	}
+
+	err = g.Save()
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cx.RespondWithData(g)
+	return
+}
+
+func loadGroup(name string, cx *goweb.Context) (g *group.Group, ok bool) {
+	g, err := group.Load(name)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			cx.RespondWithNotFound()
+		} else {
+			cx.RespondWithErrorMessage("group not found: "+name+" "+err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	ok = true
+	return
+}
+
+// parseGroupRequest reads the parameters from the query or from a multipart form
+func parseGroupRequest(cx *goweb.Context) (params map[string]string) {
+	params = make(map[string]string)
+	for key, values := range cx.Request.URL.Query() {
+		if len(values) > 0 {
+			params[key] = values[0]
+		}
+	}
+	form_params, _, err := ParseMultipartForm(cx.Request)
+	if err == nil {
+		for key, value := range form_params {
+			params[key] = value
+		}
+	}
+	return
+}
+
+// parseGroupJobAcl reads job_acl=read,write,... an empty value removes the job ACL,
+// job_acl is nil if the parameter is missing
+func parseGroupJobAcl(params map[string]string) (job_acl acl.Rights, err error) {
+	value, ok := params["job_acl"]
+	if !ok {
+		return
+	}
+	job_acl = acl.Rights{}
+	for _, right := range strings.Split(value, ",") {
+		right = strings.TrimSpace(right)
+		if right == "" {
+			continue
+		}
+		if !validGroupJobRights[right] {
+			err = fmt.Errorf("invalid right %s in job_acl, use read, write or delete", right)
+			return
+		}
+		job_acl[right] = true
+	}
+	return
+}
+
+// parseUserList resolves a comma separated list of usernames and uuids. With allow_groups,
+// entries of the form group:<name> are kept if the group exists, idp-group:<name> if the
+// name is valid.
+func parseUserList(list string, allow_groups bool) (ids []string, err error) {
+	if list == "" {
+		return
+	}
+	for _, v := range strings.Split(list, ",") {
+		if strings.HasPrefix(v, acl.GROUP_PREFIX) {
+			if !allow_groups {
+				err = fmt.Errorf("groups can not be members of groups: %s", v)
+				return
+			}
+			_, err = group.Load(strings.TrimPrefix(v, acl.GROUP_PREFIX))
+			if err != nil {
+				err = fmt.Errorf("group %s not found", strings.TrimPrefix(v, acl.GROUP_PREFIX))
+				return
+			}
+			ids = append(ids, v)
+		} else if strings.HasPrefix(v, acl.CLAIMED_GROUP_PREFIX) {
+			if !allow_groups {
+				err = fmt.Errorf("groups can not be members of groups: %s", v)
+				return
+			}
+			if !group.ValidName(strings.TrimPrefix(v, acl.CLAIMED_GROUP_PREFIX)) {
+				err = fmt.Errorf("invalid group name in %s", v)
+				return
+			}
+			ids = append(ids, v)
+		} else if uuid.Parse(v) != nil {
+			ids = append(ids, v)
+		} else {
+			u := user.User{Username: v}
+			if err = u.SetMongoInfo(); err != nil {
+				return
+			}
+			ids = append(ids, u.Uuid)
+		}
+	}
+	return
+}
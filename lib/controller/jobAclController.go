@@ -6,7 +6,6 @@ import (
 	e "github.com/MG-RAST/AWE/lib/errors"
 	"github.com/MG-RAST/AWE/lib/request"
 	"github.com/MG-RAST/AWE/lib/user"
-	"github.com/MG-RAST/golib/go-uuid/uuid"
 	"github.com/MG-RAST/golib/goweb"
 	mgo "gopkg.in/mgo.v2"
 	"net/http"
@@ -82,6 +81,9 @@ var JobAclController goweb.ControllerFunc = func(cx *goweb.Context) {
 // GET, POST, PUT, DELETE, OPTIONS: /job/{jid}/acl/{type}
 var JobAclControllerTyped goweb.ControllerFunc = func(cx *goweb.Context) {
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "job.acl", cx.PathParams["jid"])
+	defer rec.Save()
+	rec.SetParam("type", cx.PathParams["type"])
 
 	if cx.Request.Method == "OPTIONS" {
 		cx.RespondWithOK()
@@ -94,6 +96,7 @@ var JobAclControllerTyped goweb.ControllerFunc = func(cx *goweb.Context) {
 		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
 		return
 	}
+	rec.SetUser(u)
 
 	jid := cx.PathParams["jid"]
 	rtype := cx.PathParams["type"]
@@ -249,16 +252,6 @@ func parseJobAclRequestTyped(cx *goweb.Context) (ids []string, err error) {
 	} else {
 		return nil, nil
 	}
-	for _, v := range users {
-		if uuid.Parse(v) != nil {
-			ids = append(ids, v)
-		} else {
-			u := user.User{Username: v}
-			if err := u.SetMongoInfo(); err != nil {
-				return nil, err
-			}
-			ids = append(ids, u.Uuid)
-		}
-	}
-	return ids, nil
+	// users and groups (group:<name>)
+	return parseUserList(strings.Join(users, ","), true)
 }
@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/MG-RAST/AWE/lib/core"
+	e "github.com/MG-RAST/AWE/lib/errors"
+	"github.com/MG-RAST/AWE/lib/request"
+	"github.com/MG-RAST/golib/goweb"
+)
+
+// GET: /job/bulk, /job/bulk/{bid}
+// POST: /job/bulk?action=<action>&value=<value>&filter=<filter>[&full][&dryrun]
+// DELETE: /job/bulk/{bid} cancels a running operation
+//
+// The filter has the syntax of GET /job?filter=, actions are suspend, resume, delete (full
+// removes the jobs from the database), priority, clientgroup and expiration (value as in
+// PUT /job/{id}). dryrun only counts the jobs the action would be applied to.
+var JobBulkController goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	bid := cx.PathParams["bid"]
+	rec := newAuditRecord(cx, "job.bulk", bid)
+	defer rec.Save()
+
+	if cx.Request.Method == "OPTIONS" {
+		cx.RespondWithOK()
+		return
+	}
+
+	// bulk operations are not available to anonymous users
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+	rec.SetUser(u)
+
+	query := &Query{Li: cx.Request.URL.Query()}
+
+	switch cx.Request.Method {
+	case "GET":
+		if bid == "" {
+			cx.RespondWithData(core.ListBulkOperations(u))
+			return
+		}
+		op, ok := core.GetBulkOperation(bid)
+		if !ok || (op.Owner != u.Uuid && !u.Admin) {
+			cx.RespondWithNotFound()
+			return
+		}
+		cx.RespondWithData(op)
+	case "POST":
+		if bid != "" {
+			cx.RespondWithErrorMessage("bulk operations can not be modified", http.StatusBadRequest)
+			return
+		}
+		action := ""
+		value := ""
+		if query.Has("action") {
+			action = query.Value("action")
+		}
+		if query.Has("value") {
+			value = query.Value("value")
+		}
+		if err = core.CheckBulkAction(action, value); err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+			return
+		}
+		// an empty filter would select every job
+		filter, err := core.ParseFilter(query.List("filter"), core.JobListFields)
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(filter) == 0 {
+			cx.RespondWithErrorMessage("a filter is required", http.StatusBadRequest)
+			return
+		}
+
+		q := core.BulkJobQuery(filter, u, action)
+		if query.Has("dryrun") {
+			count, err := core.GetJobCount(q)
+			if err != nil {
+				cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+				return
+			}
+			cx.RespondWithData(map[string]interface{}{"action": action, "value": value, "count": count})
+			return
+		}
+
+		source_ip, _, _ := net.SplitHostPort(cx.Request.RemoteAddr)
+		op, err := core.StartBulkOperation(u, action, value, query.Has("full"), query.List("filter"), q, source_ip, cx.Request.Header.Get("X-Forwarded-For"))
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cx.RespondWithData(op)
+	case "DELETE":
+		if bid == "" {
+			cx.RespondWithErrorMessage("bulk operation id is missing", http.StatusBadRequest)
+			return
+		}
+		op, ok := core.GetBulkOperation(bid)
+		if !ok {
+			cx.RespondWithNotFound()
+			return
+		}
+		if op.Owner != u.Uuid && !u.Admin {
+			cx.RespondWithErrorMessage(e.UnAuth, http.StatusUnauthorized)
+			return
+		}
+		core.CancelBulkOperation(bid)
+		cx.RespondWithData("bulk operation canceled: " + bid)
+	default:
+		cx.RespondWithErrorMessage("This request type is not implemented.", http.StatusNotImplemented)
+	}
+	return
+}
@@ -2,15 +2,14 @@ package controller
 
 import (
 	"fmt"
-	"io/ioutil"
 	"net/http"
-	"reflect"
 
+	"github.com/MG-RAST/AWE/lib/acl"
 	"github.com/MG-RAST/AWE/lib/conf"
 	"github.com/MG-RAST/AWE/lib/core"
-	"github.com/MG-RAST/AWE/lib/core/cwl"
 	e "github.com/MG-RAST/AWE/lib/errors"
 	"github.com/MG-RAST/AWE/lib/foreign/taverna"
+	"github.com/MG-RAST/AWE/lib/group"
 	"github.com/MG-RAST/AWE/lib/logger"
 	"github.com/MG-RAST/AWE/lib/logger/event"
 	"github.com/MG-RAST/AWE/lib/request"
@@ -20,7 +19,7 @@ import (
 	"gopkg.in/mgo.v2/bson"
 	//"os"
 	"encoding/json"
-	"path"
+	"io/ioutil"
 	"strconv"
 	"strings"
 	"time"
@@ -58,11 +57,13 @@ func (cr *JobController) Create(cx *goweb.Context) {
 	}
 
 	// Parse uploaded form
-	_, files, err := ParseMultipartForm(cx.Request)
+	params, files, err := ParseMultipartForm(cx.Request)
 
 	if err != nil {
 		if err.Error() == "request Content-Type isn't multipart/form-data" {
 			cx.RespondWithErrorMessage("No job file is submitted", http.StatusBadRequest)
+		} else if err.Error() == e.UploadTooLarge {
+			cx.RespondWithErrorMessage(fmt.Sprintf("%s of %d MB", e.UploadTooLarge, conf.MAX_UPLOAD_MB), http.StatusRequestEntityTooLarge)
 		} else {
 			// Some error other than request encoding. Theoretically
 			// could be a lost db connection between user lookup and parsing.
@@ -79,6 +80,26 @@ func (cr *JobController) Create(cx *goweb.Context) {
 	cwl_file, has_cwl := files["cwl"] // TODO I could overload 'upload'
 	job_file, has_job := files["job"] // input data for an CWL workflow
 
+	// render the workflow graph of a CWL document without submitting it
+	if dag_format := cx.Request.URL.Query().Get("dag"); dag_format != "" {
+		if !has_cwl {
+			cx.RespondWithErrorMessage("cwl document missing", http.StatusBadRequest)
+			return
+		}
+		yamlstream, err := ioutil.ReadFile(cwl_file.Path)
+		if err != nil {
+			cx.RespondWithErrorMessage("error in reading workflow file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		dag, err := core.NewCWLDag(string(yamlstream))
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+			return
+		}
+		respondWithDag(cx, dag, dag_format)
+		return
+	}
+
 	var job *core.Job
 	job = nil
 
@@ -99,363 +120,11 @@ func (cr *JobController) Create(cx *goweb.Context) {
 			return
 		}
 
-		workflow_filename := cwl_file.Name
-
-		collection := cwl.NewCWL_collection()
-
-		//1) parse job
-
-		job_stream, err := ioutil.ReadFile(job_file.Path)
-		if err != nil {
-			cx.RespondWithErrorMessage("error in reading job yaml/json file: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		//job_str := string(job_stream[:])
-
-		job_input, err := cwl.ParseJob(&job_stream)
-		if err != nil {
-			logger.Error("ParseJob: " + err.Error())
-			cx.RespondWithErrorMessage("error in reading job yaml/json file: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		//collection.Job_input = job_input
-
-		// 2) parse cwl
-		logger.Debug(1, "got CWL")
-
-		// get CWL as byte[]
-		yamlstream, err := ioutil.ReadFile(cwl_file.Path)
-		if err != nil {
-			logger.Error("CWL error: " + err.Error())
-			cx.RespondWithErrorMessage("error in reading workflow file: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		// convert CWL to string
-		yaml_str := string(yamlstream[:])
-
-		var schemata []cwl.CWLType_Type
-		object_array, cwl_version, schemata, err := cwl.Parse_cwl_document(yaml_str)
-		if err != nil {
-			cx.RespondWithErrorMessage("error in parsing cwl workflow yaml file: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		err = collection.AddArray(object_array)
+		job, err = core.CreateJobCWL(_user, files, cwl_file, job_file)
 		if err != nil {
-			logger.Error("Parse_cwl_document error: " + err.Error())
-			cx.RespondWithErrorMessage("error in adding cwl objects to collection: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-		logger.Debug(1, "Parse_cwl_document done")
-
-		err = collection.AddSchemata(schemata)
-		if err != nil {
-			cx.RespondWithErrorMessage("error in adding schemata: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		entrypoint := ""
-
-		var cwl_workflow *cwl.Workflow
-		if len(collection.Workflows) == 0 {
-			if len(object_array) != 1 {
-				cx.RespondWithErrorMessage(fmt.Sprintf("Expected exactly one element in object_array, got %d", len(collection.Workflows)), http.StatusBadRequest)
-				return
-			}
-			// This probably is a CommandlineTool or ExpressionTool submission (without workflow)
-			// create new Workflow to wrap around the CommandLineTool/ExpressionTool
-			entrypoint = "#entrypoint"
-
-			pair := object_array[0]
-
-			runner := pair.Value
-
-			switch runner.(type) {
-
-			case *cwl.CommandLineTool:
-				commandlinetool_if := pair.Value
-
-				commandlinetool, ok := commandlinetool_if.(*cwl.CommandLineTool)
-				if !ok {
-
-					cx.RespondWithErrorMessage(fmt.Sprintf("(job/create) Error casting CommandLineTool (type: %s)", reflect.TypeOf(commandlinetool_if)), http.StatusBadRequest)
-					return
-				}
-
-				cwl_workflow_instance := cwl.NewWorkflowEmpty()
-				cwl_workflow = &cwl_workflow_instance
-				cwl_workflow.Id = entrypoint
-				new_step := cwl.WorkflowStep{}
-				step_id := entrypoint + "/wrapper_step"
-				new_step.Id = step_id
-				for _, input := range commandlinetool.Inputs { // input is CommandInputParameter
-
-					workflow_input_name := entrypoint + "/" + path.Base(input.Id)
-
-					var workflow_step_input cwl.WorkflowStepInput
-					workflow_step_input.Id = step_id + "/" + input.Id
-					workflow_step_input.Source = workflow_input_name
-					workflow_step_input.Default = input.Default
-
-					//fmt.Println("CommandInputParameter and WorkflowStepInput:")
-					//spew.Dump(input)
-					//spew.Dump(workflow_step_input)
-					new_step.In = append(new_step.In, workflow_step_input)
-
-					var workflow_input_parameter cwl.InputParameter
-					workflow_input_parameter.Id = workflow_input_name
-					workflow_input_parameter.SecondaryFiles = input.SecondaryFiles
-					workflow_input_parameter.Format = input.Format
-					workflow_input_parameter.Streamable = input.Streamable
-					workflow_input_parameter.InputBinding = input.InputBinding
-					workflow_input_parameter.Type = input.Type
-
-					workflow_input_parameter.Default = input.Default
-
-					add_null := false
-					if input.Default != nil { // check if this is an optional argument
-						add_null = true
-					}
-
-					if add_null {
-						has_null := false
-						for _, t := range workflow_input_parameter.Type {
-							if t == cwl.CWL_null {
-								has_null = true
-								break
-							}
-						}
-						if !has_null {
-							workflow_input_parameter.Type = append(workflow_input_parameter.Type, cwl.CWL_null)
-						}
-					}
-
-					cwl_workflow.Inputs = append(cwl_workflow.Inputs, workflow_input_parameter)
-				}
-
-				for _, output := range commandlinetool.Outputs {
-					var workflow_step_output cwl.WorkflowStepOutput
-					workflow_step_output.Id = step_id + "/" + strings.TrimPrefix(output.Id, "#")
-
-					new_step.Out = append(new_step.Out, workflow_step_output)
-
-					var workflow_output_parameter cwl.WorkflowOutputParameter
-
-					workflow_output_parameter.Id = entrypoint + "/" + path.Base(output.Id)
-					workflow_output_parameter.OutputSource = step_id + "/" + path.Base(output.Id)
-					workflow_output_parameter.SecondaryFiles = output.SecondaryFiles
-					workflow_output_parameter.Format = output.Format
-					workflow_output_parameter.Streamable = output.Streamable
-					//workflow_output_parameter.OutputBinding = output.OutputBinding
-					//workflow_output_parameter.OutputSource = output.OutputSource
-					//workflow_output_parameter.LinkMerge = output.LinkMerge
-					workflow_output_parameter.Type = output.Type
-					cwl_workflow.Outputs = append(cwl_workflow.Outputs, workflow_output_parameter)
-				}
-
-				if commandlinetool.Requirements != nil {
-					requirements := commandlinetool.Requirements
-					for i, _ := range *requirements {
-						require_type := (*requirements)[i].GetClass()
-						if require_type == "ShockRequirement" {
-							shock_requirement := (*requirements)[i]
-
-							cwl_workflow.Requirements, err = cwl.AddRequirement(shock_requirement, requirements)
-							if err != nil {
-								err = fmt.Errorf("(job/create) AddRequirement returned: %s", err.Error())
-								return
-							}
-						}
-					}
-				}
-
-				new_step.Run = commandlinetool.Id
-
-				cwl_workflow.Steps = []cwl.WorkflowStep{new_step}
-
-				cwl_workflow_named := cwl.Named_CWL_object{}
-				cwl_workflow_named.Id = cwl_workflow.Id
-				cwl_workflow_named.Value = cwl_workflow
-
-				object_array = append(object_array, cwl_workflow_named)
-				err = collection.Add(entrypoint, cwl_workflow)
-				if err != nil {
-					cx.RespondWithErrorMessage("collection.Add returned: "+err.Error(), http.StatusBadRequest)
-					return
-				}
-
-			case *cwl.ExpressionTool:
-				expressiontool_if := pair.Value
-
-				expressiontool, ok := expressiontool_if.(*cwl.ExpressionTool)
-				if !ok {
-
-					cx.RespondWithErrorMessage(fmt.Sprintf("(job/create) Error casting ExpressionTool (type: %s)", reflect.TypeOf(expressiontool_if)), http.StatusBadRequest)
-					return
-				}
-
-				cwl_workflow_instance := cwl.NewWorkflowEmpty()
-				cwl_workflow = &cwl_workflow_instance
-				cwl_workflow.Id = entrypoint
-				new_step := cwl.WorkflowStep{}
-				step_id := entrypoint + "/wrapper_step"
-				new_step.Id = step_id
-				for _, input := range expressiontool.Inputs { // input is InputParameter
-
-					workflow_input_name := entrypoint + "/" + path.Base(input.Id)
-
-					var workflow_step_input cwl.WorkflowStepInput
-					workflow_step_input.Id = step_id + "/" + input.Id
-					workflow_step_input.Source = workflow_input_name
-					workflow_step_input.Default = input.Default
-
-					//fmt.Println("InputParameter and WorkflowStepInput:")
-					//spew.Dump(input)
-					//spew.Dump(workflow_step_input)
-					new_step.In = append(new_step.In, workflow_step_input)
-
-					var workflow_input_parameter cwl.InputParameter
-					workflow_input_parameter.Id = workflow_input_name
-					workflow_input_parameter.SecondaryFiles = input.SecondaryFiles
-					workflow_input_parameter.Format = input.Format
-					workflow_input_parameter.Streamable = input.Streamable
-					workflow_input_parameter.InputBinding = input.InputBinding
-					workflow_input_parameter.Type = input.Type
-
-					workflow_input_parameter.Default = input.Default
-
-					add_null := false
-					if input.Default != nil { // check if this is an optional argument
-						add_null = true
-					}
-
-					if add_null {
-						has_null := false
-						for _, t := range workflow_input_parameter.Type {
-							if t == cwl.CWL_null {
-								has_null = true
-								break
-							}
-						}
-						if !has_null {
-							workflow_input_parameter.Type = append(workflow_input_parameter.Type, cwl.CWL_null)
-						}
-					}
-
-					cwl_workflow.Inputs = append(cwl_workflow.Inputs, workflow_input_parameter)
-				}
-
-				for _, output := range expressiontool.Outputs { // type: ExpressionToolOutputParameter
-					var workflow_step_output cwl.WorkflowStepOutput
-					workflow_step_output.Id = step_id + "/" + strings.TrimPrefix(output.Id, "#")
-
-					new_step.Out = append(new_step.Out, workflow_step_output)
-
-					var workflow_output_parameter cwl.WorkflowOutputParameter
-
-					workflow_output_parameter.Id = entrypoint + "/" + path.Base(output.Id)
-					workflow_output_parameter.OutputSource = step_id + "/" + path.Base(output.Id)
-					workflow_output_parameter.SecondaryFiles = output.SecondaryFiles
-					workflow_output_parameter.Format = output.Format
-					workflow_output_parameter.Streamable = output.Streamable
-					//workflow_output_parameter.OutputBinding = output.OutputBinding
-					//workflow_output_parameter.OutputSource = output.OutputSource
-					//workflow_output_parameter.LinkMerge = output.LinkMerge
-					workflow_output_parameter.Type = output.Type
-					cwl_workflow.Outputs = append(cwl_workflow.Outputs, workflow_output_parameter)
-				}
-
-				if expressiontool.Requirements != nil {
-					requirements := expressiontool.Requirements
-					for i, _ := range *requirements {
-						require_type := (*requirements)[i].GetClass()
-						if require_type == "ShockRequirement" {
-							shock_requirement := (*requirements)[i]
-
-							cwl_workflow.Requirements, err = cwl.AddRequirement(shock_requirement, requirements)
-							if err != nil {
-								err = fmt.Errorf("(job/create) AddRequirement returned: %s", err.Error())
-								return
-							}
-						}
-					}
-				}
-
-				new_step.Run = expressiontool.Id
-
-				cwl_workflow.Steps = []cwl.WorkflowStep{new_step}
-
-				cwl_workflow_named := cwl.Named_CWL_object{}
-				cwl_workflow_named.Id = cwl_workflow.Id
-				cwl_workflow_named.Value = cwl_workflow
-
-				object_array = append(object_array, cwl_workflow_named)
-				err = collection.Add(entrypoint, cwl_workflow)
-				if err != nil {
-					cx.RespondWithErrorMessage("collection.Add returned: "+err.Error(), http.StatusBadRequest)
-					return
-				}
-			default:
-				cx.RespondWithErrorMessage(fmt.Sprintf("Runner type %s not supported", reflect.TypeOf(runner)), http.StatusBadRequest)
-
-				return
-			}
-			//spew.Dump(cwl_workflow)
-
-		} else {
-			entrypoint = "#main"
-
-			var ok bool
-			cwl_workflow, ok = collection.Workflows[entrypoint]
-			if !ok {
-				cx.RespondWithErrorMessage("Workflow main not found", http.StatusBadRequest)
-				return
-			}
-		}
-
-		//fmt.Println("\n\n\n--------------------------------- Steps:\n")
-		//for _, step := range cwl_workflow.Steps {
-		//	spew.Dump(step)
-		//}
-
-		//fmt.Println("\n\n\n--------------------------------- Create AWE Job:\n")
-		job, err = core.CWL2AWE(_user, files, job_input, cwl_workflow, &collection)
-		if err != nil {
-			cx.RespondWithErrorMessage("Error: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		job.Entrypoint = entrypoint
-		job.IsCWL = true
-		job.CWL_objects = object_array
-		job.CwlVersion = cwl_version
-		//job.CWL_collection = &collection
-		job.Info.Name = job_file.Name
-		job.Info.Pipeline = workflow_filename
-		job.Info.ClientGroups = "docker" // TODO this needs to be configured
-
-		if job.CwlVersion == "" {
-			cx.RespondWithErrorMessage("Error: cwlVersion is empty", http.StatusBadRequest)
+			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		//job.CWL_workflow_interface = cwl_workflow
-		//job.CWL_job_input_interface = job_input
-
-		//job.CWL_workflow = cwl_workflow
-		//job.CWL_job_input = job_input
-
-		//job.AddWorkflowInstance("<main>", *job_input)
-
-		//job.Set_CWL_workflow_b64(yaml_str)
-
-		//job.Set_CWL_job_input_b64(job_str)
-
-		logger.Debug(1, "CWL2AWE done")
-
 	} else if !has_upload && !has_awf {
 		cx.RespondWithErrorMessage("No job script or awf is submitted", http.StatusBadRequest)
 		return
@@ -473,21 +142,13 @@ func (cr *JobController) Create(cx *goweb.Context) {
 		logger.Event(event.JOB_SUBMISSION, "jobid="+job.Id+";name="+job.Info.Name+";project="+job.Info.Project+";user="+job.Info.User)
 	}
 
-	token, err := request.RetrieveToken(cx.Request)
-	if err != nil {
-		logger.Debug(3, "job %s no token", job.Id)
-	} else {
-		err = job.SetDataToken(token)
-		if err != nil {
-			cx.RespondWithErrorMessage(fmt.Sprintf("(JobController/Create) SetDataToken returned: %s", err.Error()), http.StatusBadRequest)
-			return
-		}
-		logger.Debug(3, "job %s got token", job.Id)
+	group_name := params["group"]
+	if group_name == "" {
+		group_name = cx.Request.URL.Query().Get("group")
 	}
-
-	err = job.Save() // note that the job only goes into mongo, not into memory yet (EnqueueTasksByJobId is dowing that)
+	err = saveNewJob(cx, _user, job, group_name)
 	if err != nil {
-		cx.RespondWithErrorMessage(fmt.Sprintf("(JobController/Create) job.Save returned: %s", err.Error()), http.StatusBadRequest)
+		cx.RespondWithErrorMessage(fmt.Sprintf("(JobController/Create) %s", err.Error()), http.StatusBadRequest)
 		return
 	}
 
@@ -524,6 +185,39 @@ func (cr *JobController) Create(cx *goweb.Context) {
 	return
 }
 
+// readableJobs selects the jobs a user who is not an admin can read
+func readableJobs(u *user.User) []bson.M {
+	return []bson.M{bson.M{"acl.read": "public"}, bson.M{"acl.read": bson.M{"$in": acl.Principals(u.Uuid)}}, bson.M{"acl.owner": u.Uuid}, bson.M{"acl": bson.M{"$exists": "false"}}}
+}
+
+// saveNewJob shares a new job with the group the user requested (group=<name>) if that group
+// defines a job_acl, sets the data token of the request and saves the job
+func saveNewJob(cx *goweb.Context, _user *user.User, job *core.Job, group_name string) (err error) {
+	err = group.ApplyJobAcl(&job.Acl, _user.Uuid, group_name)
+	if err != nil {
+		err = fmt.Errorf("ApplyJobAcl returned: %s", err.Error())
+		return
+	}
+
+	token, xerr := request.RetrieveToken(cx.Request)
+	if xerr != nil {
+		logger.Debug(3, "job %s no token", job.Id)
+	} else {
+		err = job.SetDataToken(token)
+		if err != nil {
+			err = fmt.Errorf("SetDataToken returned: %s", err.Error())
+			return
+		}
+		logger.Debug(3, "job %s got token", job.Id)
+	}
+
+	err = job.Save() // note that the job only goes into mongo, not into memory yet (EnqueueTasksByJobId is dowing that)
+	if err != nil {
+		err = fmt.Errorf("job.Save returned: %s", err.Error())
+	}
+	return
+}
+
 // GET: /job/{id}
 func (cr *JobController) Read(id string, cx *goweb.Context) {
 	LogRequest(cx.Request)
@@ -663,6 +357,50 @@ func (cr *JobController) Read(id string, cx *goweb.Context) {
 		}
 	}
 
+	// timeline gives the intervals of tasks and workunits as json, timeline=trace in the Chrome trace event format
+	if query.Has("timeline") {
+		perf, err := core.GetJobPerf(id)
+		if err != nil {
+			if err == mgo.ErrNotFound {
+				cx.RespondWithErrorMessage("job perf stats not found:"+id, http.StatusNotFound)
+			} else {
+				cx.RespondWithErrorMessage("job perf stats not found:"+id+" "+err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		job.RLockRecursive()
+		timeline, err := core.NewJobTimeline(job, perf)
+		job.RUnlockRecursive()
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch query.Value("timeline") {
+		case "", "json":
+			cx.RespondWithData(timeline)
+		case "trace":
+			// the trace viewer expects the trace object itself, not the standard response
+			cx.ResponseWriter.Header().Set("Content-Type", "application/json")
+			cx.ResponseWriter.WriteHeader(http.StatusOK)
+			json.NewEncoder(cx.ResponseWriter).Encode(timeline.Trace())
+		default:
+			cx.RespondWithErrorMessage("unknown timeline format "+query.Value("timeline")+", use json or trace", http.StatusBadRequest)
+		}
+		return
+	}
+
+	if query.Has("dag") {
+		job.RLockRecursive()
+		dag, err := core.NewJobDag(job)
+		job.RUnlockRecursive()
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respondWithDag(cx, dag, query.Value("dag"))
+		return
+	}
+
 	job.RLockRecursive()
 	defer job.RUnlockRecursive()
 
@@ -671,7 +409,29 @@ func (cr *JobController) Read(id string, cx *goweb.Context) {
 	return
 }
 
+// respondWithDag writes the graph as dot or mermaid text, or as json
+func respondWithDag(cx *goweb.Context, dag *core.Dag, format string) {
+	var text string
+	switch format {
+	case "dot":
+		text = dag.DOT()
+	case "mermaid":
+		text = dag.Mermaid()
+	case "json":
+		cx.RespondWithData(dag)
+		return
+	default:
+		cx.RespondWithErrorMessage("unknown dag format "+format+", use dot, mermaid or json", http.StatusBadRequest)
+		return
+	}
+	cx.ResponseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	cx.ResponseWriter.WriteHeader(http.StatusOK)
+	cx.ResponseWriter.Write([]byte(text))
+}
+
 // GET: /job
+// filter=field:op:value;... selects jobs by indexed fields (see core/listquery.go),
+// cursor pages through the result, start with an empty cursor and pass next_cursor
 // To do:
 // - Iterate job queries
 func (cr *JobController) ReadMany(cx *goweb.Context) {
@@ -694,7 +454,7 @@ func (cr *JobController) ReadMany(cx *goweb.Context) {
 	if u != nil {
 		// Add authorization checking to query if the user is not an admin
 		if u.Admin == false {
-			q["$or"] = []bson.M{bson.M{"acl.read": "public"}, bson.M{"acl.read": u.Uuid}, bson.M{"acl.owner": u.Uuid}, bson.M{"acl": bson.M{"$exists": "false"}}}
+			q["$or"] = readableJobs(u)
 		}
 	} else {
 		// User is anonymous
@@ -772,11 +532,23 @@ func (cr *JobController) ReadMany(cx *goweb.Context) {
 		direction = query.Value("direction")
 	}
 
+	// structured filters on indexed fields, e.g. filter=state:in:completed,suspend
+	if query.Has("filter") {
+		filter, err := core.ParseFilter(query.List("filter"), core.JobListFields)
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+			return
+		}
+		core.AddQuery(q, filter.Bson()...)
+	}
+
 	// Gather params to make db query. Do not include the
 	// following list.
 	skip := map[string]int{
 		"limit":      1,
 		"offset":     1,
+		"filter":     1,
+		"cursor":     1,
 		"query":      1,
 		"recent":     1,
 		"order":      1,
@@ -1092,6 +864,30 @@ func (cr *JobController) ReadMany(cx *goweb.Context) {
 		return
 	}
 
+	// cursor pagination is stable under concurrent inserts and does not count all matching jobs
+	if query.Has("cursor") {
+		if limit <= 0 {
+			cx.RespondWithErrorMessage("limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		cursor, err := listCursor(query, order, direction, core.JobListFields)
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+			return
+		}
+		next, err := jobs.GetPage(q, limit, cursor)
+		if err != nil {
+			logger.Error("err " + err.Error())
+			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, job := range jobs {
+			job.Registered = core.QMgr.IsJobRegistered(job.Id)
+		}
+		respondWithCursor(cx, jobs, limit, next)
+		return
+	}
+
 	total, err := jobs.GetPaginated(q, limit, offset, order, direction, false)
 	if err != nil {
 		logger.Error("err " + err.Error())
@@ -1116,6 +912,9 @@ func (cr *JobController) ReadMany(cx *goweb.Context) {
 // PUT: /job
 func (cr *JobController) UpdateMany(cx *goweb.Context) {
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "job", "")
+	defer rec.Save()
+	rec.SetOperation("resumeall", "recoverall")
 
 	// Try to authenticate user.
 	u, err := request.Authenticate(cx.Request)
@@ -1133,6 +932,7 @@ func (cr *JobController) UpdateMany(cx *goweb.Context) {
 			return
 		}
 	}
+	rec.SetUser(u)
 
 	// Gather query params
 	query := &Query{Li: cx.Request.URL.Query()}
@@ -1165,6 +965,9 @@ func (cr *JobController) UpdateMany(cx *goweb.Context) {
 func (cr *JobController) Update(id string, cx *goweb.Context) {
 	// Log Request and check for Auth
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "job", id)
+	defer rec.Save()
+	rec.SetOperation("resume", "suspend", "recover", "register", "recompute", "resubmit", "clientgroup", "priority", "pipeline", "expiration", "settoken")
 
 	// Try to authenticate user.
 	u, err := request.Authenticate(cx.Request)
@@ -1182,6 +985,7 @@ func (cr *JobController) Update(id string, cx *goweb.Context) {
 			return
 		}
 	}
+	rec.SetUser(u)
 
 	// Gather query params
 	query := &Query{Li: cx.Request.URL.Query()}
@@ -1349,6 +1153,8 @@ func (cr *JobController) Update(id string, cx *goweb.Context) {
 // DELETE: /job/{id}
 func (cr *JobController) Delete(id string, cx *goweb.Context) {
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "job", id)
+	defer rec.Save()
 
 	// Try to authenticate user.
 	u, err := request.Authenticate(cx.Request)
@@ -1365,6 +1171,7 @@ func (cr *JobController) Delete(id string, cx *goweb.Context) {
 			return
 		}
 	}
+	rec.SetUser(u)
 
 	// Gather query params
 	query := &Query{Li: cx.Request.URL.Query()}
@@ -1393,6 +1200,9 @@ func (cr *JobController) Delete(id string, cx *goweb.Context) {
 // DELETE: /job?suspend, /job?zombie
 func (cr *JobController) DeleteMany(cx *goweb.Context) {
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "job", "")
+	defer rec.Save()
+	rec.SetOperation("suspend", "zombie")
 
 	// Try to authenticate user.
 	u, err := request.Authenticate(cx.Request)
@@ -1410,6 +1220,7 @@ func (cr *JobController) DeleteMany(cx *goweb.Context) {
 			return
 		}
 	}
+	rec.SetUser(u)
 
 	// Gather query params
 	query := &Query{Li: cx.Request.URL.Query()}
@@ -65,6 +65,8 @@ func (cr *LoggerController) Update(id string, cx *goweb.Context) {
 // PUT: /logger
 func (cr *LoggerController) UpdateMany(cx *goweb.Context) {
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "logger", "")
+	defer rec.Save()
 
 	// Try to authenticate user.
 	u, err := request.Authenticate(cx.Request)
@@ -77,6 +79,7 @@ func (cr *LoggerController) UpdateMany(cx *goweb.Context) {
 		cx.RespondWithErrorMessage(e.NoAuth, http.StatusUnauthorized)
 		return
 	}
+	rec.SetUser(u)
 
 	// Gather query params
 	query := &Query{Li: cx.Request.URL.Query()}
@@ -13,7 +13,7 @@ import (
 
 type QueueController struct{}
 
-var queueTypes = []string{"job", "task", "workall", "workqueue", "workcheckout", "worksuspend", "client"}
+var queueTypes = []string{"job", "task", "workall", "workqueue", "workcheckout", "workprefetch", "worksuspend", "client"}
 
 // OPTIONS: /queue
 func (cr *QueueController) Options(cx *goweb.Context) {
@@ -150,6 +150,9 @@ func (cr *QueueController) Update(id string, cx *goweb.Context) {
 // PUT: /queue
 func (cr *QueueController) UpdateMany(cx *goweb.Context) {
 	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "queue", "")
+	defer rec.Save()
+	rec.SetOperation("resume", "suspend")
 
 	// Try to authenticate user.
 	u, err := request.Authenticate(cx.Request)
@@ -157,6 +160,7 @@ func (cr *QueueController) UpdateMany(cx *goweb.Context) {
 		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
 		return
 	}
+	rec.SetUser(u)
 	// must be admin user
 	if u == nil || u.Admin == false {
 		cx.RespondWithErrorMessage(e.NoAuth, http.StatusUnauthorized)
@@ -0,0 +1,355 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	e "github.com/MG-RAST/AWE/lib/errors"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"github.com/MG-RAST/golib/goweb"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GA4GH Task Execution Service (TES) 1.0 under /ga4gh/tes/v1, tasks are jobs with a single
+// task (see core.CreateJobTES). The views are MINIMAL (id and state, the default), BASIC
+// (without logs of the executors, input contents and system logs) and FULL. Executor images
+// have to provide /bin/bash.
+
+const tesVersion = "1.0.0"
+
+// FULL views show this many bytes at the end of stdout and stderr
+const tesLogTailBytes = 64 << 10
+
+const (
+	TES_VIEW_MINIMAL = "MINIMAL"
+	TES_VIEW_BASIC   = "BASIC"
+	TES_VIEW_FULL    = "FULL"
+)
+
+type tesServiceInfo struct {
+	Id           string            `json:"id"`
+	Name         string            `json:"name"`
+	Type         tesServiceType    `json:"type"`
+	Description  string            `json:"description"`
+	Organization map[string]string `json:"organization"`
+	Doc          string            `json:"doc"`
+	Version      string            `json:"version"`
+	Storage      []string          `json:"storage"`
+}
+
+type tesServiceType struct {
+	Group    string `json:"group"`
+	Artifact string `json:"artifact"`
+	Version  string `json:"version"`
+}
+
+type tesTask struct {
+	Id           string             `json:"id"`
+	State        string             `json:"state"`
+	Name         string             `json:"name,omitempty"`
+	Description  string             `json:"description,omitempty"`
+	Inputs       []core.TesInput    `json:"inputs,omitempty"`
+	Outputs      []core.TesOutput   `json:"outputs,omitempty"`
+	Resources    *core.TesResources `json:"resources,omitempty"`
+	Executors    []core.TesExecutor `json:"executors,omitempty"`
+	Volumes      []string           `json:"volumes,omitempty"`
+	Tags         map[string]string  `json:"tags,omitempty"`
+	Logs         []tesTaskLog       `json:"logs,omitempty"`
+	CreationTime string             `json:"creation_time,omitempty"`
+}
+
+type tesTaskLog struct {
+	Logs       []tesExecutorLog  `json:"logs"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	StartTime  string            `json:"start_time,omitempty"`
+	EndTime    string            `json:"end_time,omitempty"`
+	Outputs    []tesOutputLog    `json:"outputs"`
+	SystemLogs []string          `json:"system_logs,omitempty"`
+}
+
+type tesExecutorLog struct {
+	StartTime string `json:"start_time,omitempty"`
+	EndTime   string `json:"end_time,omitempty"`
+	Stdout    string `json:"stdout,omitempty"`
+	Stderr    string `json:"stderr,omitempty"`
+	ExitCode  *int   `json:"exit_code,omitempty"`
+}
+
+type tesOutputLog struct {
+	Url       string `json:"url"`
+	Path      string `json:"path"`
+	SizeBytes string `json:"size_bytes"`
+}
+
+type tesTaskList struct {
+	Tasks         []tesTask `json:"tasks"`
+	NextPageToken string    `json:"next_page_token,omitempty"`
+}
+
+func isTesJob(job *core.Job) bool {
+	return job.Tes != nil
+}
+
+// GET: /ga4gh/tes/v1/service-info
+var TesServiceInfoController goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	if cx.Request.Method != "GET" {
+		ga4ghRespondError(cx, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	info := tesServiceInfo{
+		Id:           "awe.tes",
+		Name:         "AWE",
+		Type:         tesServiceType{Group: "org.ga4gh", Artifact: "tes", Version: tesVersion},
+		Description:  "single container tasks run by AWE, executor images have to provide /bin/bash",
+		Organization: map[string]string{"name": "MG-RAST", "url": "https://github.com/MG-RAST/AWE"},
+		Doc:          "Inputs are http, https or ftp URLs, outputs are uploaded into new nodes on the Shock server named by the output url.",
+		Version:      conf.VERSION,
+		Storage:      []string{},
+	}
+	ga4ghRespond(cx, http.StatusOK, info)
+	return
+}
+
+// GET: /ga4gh/tes/v1/tasks?name_prefix=&page_size=&page_token=&view=
+// POST: /ga4gh/tes/v1/tasks
+var TesTasksController goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	switch cx.Request.Method {
+	case "GET":
+		tesListTasks(cx)
+	case "POST":
+		tesCreateTask(cx)
+	default:
+		ga4ghRespondError(cx, http.StatusMethodNotAllowed, "method not allowed")
+	}
+	return
+}
+
+// GET: /ga4gh/tes/v1/tasks/{id}?view=
+// POST: /ga4gh/tes/v1/tasks/{id}:cancel, the job is deleted
+var TesTaskController goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	id := cx.PathParams["id"]
+	switch {
+	case cx.Request.Method == "GET":
+		view, ok := tesView(cx)
+		if !ok {
+			return
+		}
+		job, _, ok := ga4ghLoadJob(cx, id, "read", isTesJob)
+		if !ok {
+			return
+		}
+		ga4ghRespond(cx, http.StatusOK, newTesTask(job, view))
+	case cx.Request.Method == "POST" && strings.HasSuffix(id, ":cancel"):
+		id = strings.TrimSuffix(id, ":cancel")
+		rec := newAuditRecord(cx, "tes.cancel", id)
+		defer rec.Save()
+		job, u, ok := ga4ghLoadJob(cx, id, "delete", isTesJob)
+		rec.SetUser(u)
+		if !ok {
+			return
+		}
+		if err := core.QMgr.DeleteJobByUser(job.Id, u, false); err != nil {
+			ga4ghRespondError(cx, http.StatusInternalServerError, "fail to cancel task "+job.Id+": "+err.Error())
+			return
+		}
+		ga4ghRespond(cx, http.StatusOK, struct{}{})
+	default:
+		ga4ghRespondError(cx, http.StatusMethodNotAllowed, "method not allowed")
+	}
+	return
+}
+
+func tesView(cx *goweb.Context) (view string, ok bool) {
+	view = strings.ToUpper(cx.Request.URL.Query().Get("view"))
+	switch view {
+	case "":
+		view = TES_VIEW_MINIMAL
+	case TES_VIEW_MINIMAL, TES_VIEW_BASIC, TES_VIEW_FULL:
+	default:
+		ga4ghRespondError(cx, http.StatusBadRequest, "unknown view "+view)
+		return
+	}
+	ok = true
+	return
+}
+
+func tesListTasks(cx *goweb.Context) {
+	view, ok := tesView(cx)
+	if !ok {
+		return
+	}
+	u, ok := ga4ghUser(cx, conf.ANON_READ)
+	if !ok {
+		return
+	}
+	q := bson.M{"tes": bson.M{"$exists": true}}
+	if prefix := cx.Request.URL.Query().Get("name_prefix"); prefix != "" {
+		q["info.name"] = bson.M{"$regex": "^" + regexp.QuoteMeta(prefix)}
+	}
+	jobs, next, ok := ga4ghListJobs(cx, u, q)
+	if !ok {
+		return
+	}
+	list := tesTaskList{Tasks: []tesTask{}, NextPageToken: next}
+	for _, job := range jobs {
+		list.Tasks = append(list.Tasks, newTesTask(job, view))
+	}
+	ga4ghRespond(cx, http.StatusOK, list)
+}
+
+func tesCreateTask(cx *goweb.Context) {
+	rec := newAuditRecord(cx, "tes.task", "")
+	defer rec.Save()
+
+	u, ok := ga4ghUser(cx, conf.ANON_WRITE)
+	if !ok {
+		return
+	}
+	rec.SetUser(u)
+
+	r := cx.Request
+	if conf.MAX_UPLOAD_MB > 0 {
+		r.Body = http.MaxBytesReader(cx.ResponseWriter, r.Body, int64(conf.MAX_UPLOAD_MB)*1024*1024)
+	}
+	t := &core.TesTask{}
+	if err := json.NewDecoder(r.Body).Decode(t); err != nil {
+		var too_large *http.MaxBytesError
+		if errors.As(err, &too_large) {
+			ga4ghRespondError(cx, http.StatusRequestEntityTooLarge, fmt.Sprintf("%s of %d MB", e.UploadTooLarge, conf.MAX_UPLOAD_MB))
+		} else {
+			ga4ghRespondError(cx, http.StatusBadRequest, "Error parsing task: "+err.Error())
+		}
+		return
+	}
+
+	job, err := core.CreateJobTES(u, t)
+	if err != nil {
+		ga4ghRespondError(cx, http.StatusBadRequest, err.Error())
+		return
+	}
+	rec.entry.Target = job.Id
+
+	if err = saveNewJob(cx, u, job, r.URL.Query().Get("group")); err != nil {
+		ga4ghRespondError(cx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err = core.QMgr.EnqueueTasksByJobId(job.Id); err != nil {
+		ga4ghRespondError(cx, http.StatusInternalServerError, "EnqueueTasksByJobId returned: "+err.Error())
+		return
+	}
+	logger.Debug(1, "(tesCreateTask) job %s submitted by %s", job.Id, u.Uuid)
+	ga4ghRespond(cx, http.StatusOK, map[string]string{"id": job.Id})
+}
+
+// newTesTask describes the job in the view. The task log has a single executor log as all
+// executors run in one workunit.
+func newTesTask(job *core.Job, view string) (t tesTask) {
+	t.Id = job.Id
+	t.State = ga4ghState(job)
+	if view == TES_VIEW_MINIMAL {
+		return
+	}
+
+	tes := job.Tes
+	t.Name = tes.Name
+	t.Description = tes.Description
+	t.Outputs = tes.Outputs
+	t.Resources = tes.Resources
+	t.Executors = tes.Executors
+	t.Volumes = tes.Volumes
+	t.CreationTime = ga4ghTime(job.Info.SubmitTime)
+	t.Inputs = tes.Inputs
+	if view == TES_VIEW_BASIC {
+		t.Inputs = make([]core.TesInput, len(tes.Inputs))
+		for i, input := range tes.Inputs {
+			input.Content = ""
+			t.Inputs[i] = input
+		}
+	}
+	t.Tags = map[string]string{}
+	for key, value := range job.Info.UserAttr {
+		if s, ok := value.(string); ok {
+			t.Tags[key] = s
+		}
+	}
+
+	if len(job.Tasks) == 0 {
+		return
+	}
+	task := job.Tasks[0]
+	work_id := core.New_Workunit_Unique_Identifier(task.Task_Unique_Identifier, 0)
+	work_str, err := work_id.String()
+	if err != nil {
+		return
+	}
+
+	tl := tesTaskLog{
+		Logs:      []tesExecutorLog{},
+		Metadata:  map[string]string{"workunit": work_str},
+		StartTime: ga4ghTime(task.StartedDate),
+		EndTime:   ga4ghTime(task.CompletedDate),
+		Outputs:   []tesOutputLog{},
+	}
+	el := tesExecutorLog{StartTime: tl.StartTime, EndTime: tl.EndTime}
+	if perf, _ := core.GetJobPerf(job.Id); perf != nil && perf.Pworks[work_str] != nil {
+		if wp := perf.Pworks[work_str]; wp.Checkout > 0 {
+			el.StartTime = ga4ghTime(time.Unix(wp.Checkout, 0))
+			el.EndTime = ""
+			if wp.Deliver > 0 {
+				el.EndTime = ga4ghTime(time.Unix(wp.Deliver, 0))
+			}
+		}
+	}
+	if view == TES_VIEW_FULL {
+		el.Stdout = tesLogTail(work_id, "stdout")
+		el.Stderr = tesLogTail(work_id, "stderr")
+	}
+	el.ExitCode = ga4ghExitCode(job, task, work_str)
+	if task.State == core.TASK_STAT_COMPLETED {
+		for i, io := range task.Outputs {
+			if i >= len(tes.Outputs) {
+				break
+			}
+			tl.Outputs = append(tl.Outputs, tesOutputLog{Url: io.Host + "/node/" + io.Node, Path: tes.Outputs[i].Path, SizeBytes: strconv.FormatInt(io.Size, 10)})
+		}
+	}
+	if el.StartTime != "" || el.Stdout != "" || el.Stderr != "" || el.ExitCode != nil {
+		tl.Logs = append(tl.Logs, el)
+	}
+	if view == TES_VIEW_FULL && job.Error != nil {
+		for _, msg := range []string{job.Error.ServerNotes, job.Error.WorkNotes, job.Error.AppError, job.Error.Reason} {
+			if msg != "" {
+				tl.SystemLogs = append(tl.SystemLogs, msg)
+			}
+		}
+	}
+	if len(tl.Logs) > 0 || len(tl.SystemLogs) > 0 {
+		t.Logs = []tesTaskLog{tl}
+	}
+	return
+}
+
+func tesLogTail(id core.Workunit_Unique_Identifier, logname string) string {
+	if !core.HasStdLog(id, logname) {
+		return ""
+	}
+	report, err := core.QMgr.GetReportMsg(id, logname)
+	if err != nil {
+		return ""
+	}
+	if len(report) > tesLogTailBytes {
+		report = report[len(report)-tesLogTailBytes:]
+	}
+	return report
+}
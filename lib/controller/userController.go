@@ -0,0 +1,310 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/auth"
+	e "github.com/MG-RAST/AWE/lib/errors"
+	"github.com/MG-RAST/AWE/lib/request"
+	"github.com/MG-RAST/AWE/lib/user"
+	"github.com/MG-RAST/golib/goweb"
+	mgo "gopkg.in/mgo.v2"
+)
+
+// default lifetime of personal access tokens in days
+const defaultTokenDays = 90
+
+type UserController struct{}
+
+// OPTIONS: /user
+func (cr *UserController) Options(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	cx.RespondWithOK()
+	return
+}
+
+// POST: /user (username, password, fullname, email), admins only
+func (cr *UserController) Create(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "user", "")
+	defer rec.Save()
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+	rec.SetUser(u)
+	if !u.Admin {
+		cx.RespondWithErrorMessage(e.UnAuth, http.StatusUnauthorized)
+		return
+	}
+
+	params := parseGroupRequest(cx)
+	if params["username"] == "" || params["password"] == "" {
+		cx.RespondWithErrorMessage("username and password are required", http.StatusBadRequest)
+		return
+	}
+	if _, err := user.FindByUsername(params["username"]); err == nil {
+		cx.RespondWithErrorMessage("user "+params["username"]+" already exists", http.StatusBadRequest)
+		return
+	}
+
+	// admins are configured with admin_users
+	nu, err := user.New(params["username"], params["password"], false)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+		return
+	}
+	nu.Fullname = params["fullname"]
+	nu.Email = params["email"]
+	if err = nu.Save(); err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rec.entry.Target = nu.Uuid
+
+	cx.RespondWithData(nu)
+	return
+}
+
+// GET: /user, admins only
+func (cr *UserController) ReadMany(cx *goweb.Context) {
+	LogRequest(cx.Request)
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if !u.Admin {
+		cx.RespondWithErrorMessage(e.UnAuth, http.StatusUnauthorized)
+		return
+	}
+
+	users := user.Users{}
+	if err = user.AdminGet(&users); err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cx.RespondWithData(users)
+	return
+}
+
+// GET: /user/{id}, id is a uuid, a username or "me"
+func (cr *UserController) Read(id string, cx *goweb.Context) {
+	LogRequest(cx.Request)
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	target, ok := loadUser(id, u, cx)
+	if !ok {
+		return
+	}
+	cx.RespondWithData(target)
+	return
+}
+
+// PUT: /user/{id} (password, fullname, email), the user itself or admins
+func (cr *UserController) Update(id string, cx *goweb.Context) {
+	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "user", id)
+	defer rec.Save()
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+	rec.SetUser(u)
+
+	target, ok := loadUser(id, u, cx)
+	if !ok {
+		return
+	}
+
+	params := parseGroupRequest(cx)
+	password, set_password := params["password"]
+	// a token must not be enough to take over the account
+	if set_password && u.TokenId != "" {
+		cx.RespondWithErrorMessage("passwords can not be changed with a personal access token", http.StatusUnauthorized)
+		return
+	}
+	if set_password && password != "" && len(password) < user.PASSWORD_MIN_LENGTH {
+		cx.RespondWithErrorMessage(fmt.Sprintf("password must have at least %d characters", user.PASSWORD_MIN_LENGTH), http.StatusBadRequest)
+		return
+	}
+
+	if value, ok := params["fullname"]; ok {
+		target.Fullname = value
+	}
+	if value, ok := params["email"]; ok {
+		target.Email = value
+	}
+	if err = target.Save(); err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if set_password {
+		if err = target.SetPassword(password); err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+			return
+		}
+		auth.InvalidateUser(target.Uuid)
+	}
+
+	cx.RespondWithData(target)
+	return
+}
+
+// DELETE: /user/{id}, admins only
+func (cr *UserController) Delete(id string, cx *goweb.Context) {
+	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "user", id)
+	defer rec.Save()
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+	rec.SetUser(u)
+	if !u.Admin {
+		cx.RespondWithErrorMessage(e.UnAuth, http.StatusUnauthorized)
+		return
+	}
+
+	target, ok := loadUser(id, u, cx)
+	if !ok {
+		return
+	}
+	if err = user.Delete(target.Uuid); err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+		return
+	}
+	auth.InvalidateUser(target.Uuid)
+	cx.RespondWithOK()
+	return
+}
+
+// GET, POST: /user/{uid}/token
+// DELETE: /user/{uid}/token/{tid}
+var UserTokenController goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "user.token", cx.PathParams["uid"])
+	defer rec.Save()
+	rec.SetParam("tid", cx.PathParams["tid"])
+
+	if cx.Request.Method == "OPTIONS" {
+		cx.RespondWithOK()
+		return
+	}
+
+	u, err := request.Authenticate(cx.Request)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+	rec.SetUser(u)
+
+	target, ok := loadUser(cx.PathParams["uid"], u, cx)
+	if !ok {
+		return
+	}
+
+	// tokens can only be managed with a token that has the admin scope
+	if u.TokenId != "" && !u.HasScope(user.SCOPE_ADMIN) {
+		cx.RespondWithErrorMessage(e.UnAuth+": tokens can not be managed with this token", http.StatusUnauthorized)
+		return
+	}
+
+	tid := cx.PathParams["tid"]
+
+	switch cx.Request.Method {
+	case "GET":
+		tokens, err := user.ListTokens(target.Uuid)
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cx.RespondWithData(tokens)
+	case "POST":
+		if tid != "" {
+			cx.RespondWithErrorMessage("tokens can not be modified", http.StatusBadRequest)
+			return
+		}
+		params := parseGroupRequest(cx)
+		days := defaultTokenDays
+		if params["expires_in"] != "" {
+			days, err = strconv.Atoi(params["expires_in"])
+			if err != nil {
+				cx.RespondWithErrorMessage("expires_in must be a number of days", http.StatusBadRequest)
+				return
+			}
+		}
+		var scopes []string
+		for _, scope := range strings.Split(params["scopes"], ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				scopes = append(scopes, scope)
+			}
+		}
+		token, secret, err := user.NewToken(target, params["name"], scopes, time.Duration(days)*24*time.Hour)
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the only time the token is shown
+		cx.RespondWithData(map[string]interface{}{"token": secret, "info": token})
+	case "DELETE":
+		if tid == "" {
+			cx.RespondWithErrorMessage("token id is missing", http.StatusBadRequest)
+			return
+		}
+		if err = user.DeleteToken(target.Uuid, tid); err != nil {
+			if err == mgo.ErrNotFound {
+				cx.RespondWithNotFound()
+			} else {
+				cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		auth.InvalidateToken(tid)
+		cx.RespondWithOK()
+	default:
+		cx.RespondWithErrorMessage("This request type is not implemented.", http.StatusNotImplemented)
+	}
+	return
+}
+
+// loadUser finds the user by uuid or username ("me" is the authenticated user), only
+// admins can access other users
+func loadUser(id string, u *user.User, cx *goweb.Context) (target *user.User, ok bool) {
+	var err error
+	if id == "me" || id == u.Uuid {
+		target, err = user.FindByUuid(u.Uuid)
+	} else if !u.Admin {
+		cx.RespondWithErrorMessage(e.UnAuth, http.StatusUnauthorized)
+		return
+	} else if target, err = user.FindByUuid(id); err == mgo.ErrNotFound {
+		target, err = user.FindByUsername(id)
+	}
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			cx.RespondWithNotFound()
+		} else {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	ok = true
+	return
+}
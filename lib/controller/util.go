@@ -3,6 +3,7 @@ package controller
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/MG-RAST/AWE/lib/conf"
 	"github.com/MG-RAST/AWE/lib/core"
@@ -42,6 +43,15 @@ type StandardResponse struct {
 	E []string    `json:"error"`
 }
 
+// CursorResponse is the response of cursor paginated listings, NextCursor is empty on the last page
+type CursorResponse struct {
+	S          int         `json:"status"`
+	D          interface{} `json:"data"`
+	E          []string    `json:"error"`
+	Limit      int         `json:"limit"`
+	NextCursor string      `json:"next_cursor"`
+}
+
 func PrintLogo() {
 	fmt.Println(logo)
 	return
@@ -77,6 +87,29 @@ func (q *Query) Empty() bool {
 	return false
 }
 
+// listCursor returns the cursor of the cursor parameter, without a value the listing starts at
+// the first page. The order and direction are kept in the cursor.
+func listCursor(query *Query, order string, direction string, fields map[string]core.ListField) (cursor *core.Cursor, err error) {
+	if query.Value("cursor") == "" {
+		return core.NewCursor(order, direction, fields)
+	}
+	if cursor, err = core.DecodeCursor(query.Value("cursor"), fields); err != nil {
+		return
+	}
+	if (query.Has("order") && order != cursor.Order) || (query.Has("direction") && direction != cursor.Direction) {
+		err = errors.New("order and direction can not be changed when paging with a cursor")
+	}
+	return
+}
+
+func respondWithCursor(cx *goweb.Context, data interface{}, limit int, next *core.Cursor) {
+	response := CursorResponse{S: http.StatusOK, D: data, Limit: limit}
+	if next != nil {
+		response.NextCursor = next.Encode()
+	}
+	cx.WriteResponse(response, http.StatusOK)
+}
+
 func LogRequest(req *http.Request) {
 	host, _, _ := net.SplitHostPort(req.RemoteAddr)
 	//	prefix := fmt.Sprintf("%s [%s]", host, time.Now().Format(time.RFC1123))
@@ -172,7 +205,7 @@ func ResourceDescription(cx *goweb.Context) {
 	}
 
 	if core.Service == "server" {
-		r.R = []string{"job", "work", "client", "queue", "awf", "event"}
+		r.R = []string{"job", "work", "client", "queue", "awf", "event", "group", "user", "audit"}
 	} else if core.Service == "proxy" {
 		r.R = []string{"client", "work"}
 	}
@@ -198,7 +231,15 @@ func siteUrl(cx *goweb.Context) string {
 }
 
 // helper function for create & update
+// ParseMultipartForm reads the values and stores the files in the temp dir, the files may
+// not exceed max_upload_mb in total
 func ParseMultipartForm(r *http.Request) (params map[string]string, files core.FormFiles, err error) {
+	return ParseMultipartFormLimit(r, int64(conf.MAX_UPLOAD_MB)*1024*1024)
+}
+
+// ParseMultipartFormLimit is ParseMultipartForm with a limit in bytes for the files, 0 means
+// unlimited. Larger uploads return the error e.UploadTooLarge and no files are kept.
+func ParseMultipartFormLimit(r *http.Request, max_bytes int64) (params map[string]string, files core.FormFiles, err error) {
 	params = make(map[string]string)
 	files = make(core.FormFiles)
 
@@ -207,6 +248,7 @@ func ParseMultipartForm(r *http.Request) (params map[string]string, files core.F
 		err = fmt.Errorf("(ParseMultipartForm) MultipartReader not created: %s", xerr.Error())
 		return
 	}
+	var total_bytes int64
 	for {
 		var part *multipart.Part
 		part, err = reader.NextPart()
@@ -278,6 +320,14 @@ func ParseMultipartForm(r *http.Request) (params map[string]string, files core.F
 				}
 				bytes_written += n
 				//logger.Debug(3, "after reading, bytes_written: %d", bytes_written)
+				total_bytes += int64(n)
+				if max_bytes > 0 && total_bytes > max_bytes {
+					tmpFile.Close()
+					for _, file := range files {
+						os.Remove(file.Path)
+					}
+					return nil, nil, errors.New(e.UploadTooLarge)
+				}
 				m := 0
 				m, err = tmpFile.Write(buffer[0:n])
 				if err != nil {
@@ -299,6 +349,16 @@ func ParseMultipartForm(r *http.Request) (params map[string]string, files core.F
 
 	}
 
+	// keep the parsed values with the request, e.g. for the audit log
+	form := &multipart.Form{Value: make(map[string][]string), File: make(map[string][]*multipart.FileHeader)}
+	for key, value := range params {
+		form.Value[key] = []string{value}
+	}
+	for key, file := range files {
+		form.File[key] = []*multipart.FileHeader{&multipart.FileHeader{Filename: file.Name}}
+	}
+	r.MultipartForm = form
+
 	return
 }
 
@@ -318,6 +378,21 @@ func RespondPrivateEnvInHeader(cx *goweb.Context, Envs map[string]string) (err e
 	return
 }
 
+// the password is not part of the json representation of core.RegistryCredential
+func RespondRegistryCredentialInHeader(cx *goweb.Context, cred *core.RegistryCredential) (err error) {
+	cred_map := map[string]string{}
+	if cred != nil {
+		cred_map = map[string]string{"registry": cred.Registry, "username": cred.Username, "password": cred.Password}
+	}
+	cred_stream, err := json.Marshal(cred_map)
+	if err != nil {
+		return err
+	}
+	cx.ResponseWriter.Header().Set("Registryauth", string(cred_stream[:]))
+	cx.Respond(nil, http.StatusOK, nil, cx)
+	return
+}
+
 func GetAuthorizedUser(cx *goweb.Context) (u *user.User, done bool) {
 	// Try to authenticate user.
 
@@ -0,0 +1,457 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/core/cwl"
+	e "github.com/MG-RAST/AWE/lib/errors"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"github.com/MG-RAST/AWE/lib/user"
+	"github.com/MG-RAST/golib/goweb"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GA4GH Workflow Execution Service (WES) 1.0 under /ga4gh/wes/v1, runs are CWL jobs.
+// The workflow has to be a single (packed) CWL document sent as a workflow_attachment and
+// named by workflow_url, remote workflows are not fetched. Input files are referenced by URL
+// in workflow_params. Tags are stored as user attributes of the job.
+
+const wesVersion = "1.0.0"
+
+// form values are kept in memory up to this size, larger parts go to temporary files
+const wesMaxMemory = 32 << 20
+
+var wesWorkflowVersions = []string{"v1.0"}
+
+type wesServiceInfo struct {
+	WorkflowTypeVersions    map[string]wesWorkflowTypeVersion `json:"workflow_type_versions"`
+	SupportedWesVersions    []string                          `json:"supported_wes_versions"`
+	SupportedFsProtocols    []string                          `json:"supported_filesystem_protocols"`
+	WorkflowEngineVersions  map[string]string                 `json:"workflow_engine_versions"`
+	DefaultEngineParameters []interface{}                     `json:"default_workflow_engine_parameters"`
+	SystemStateCounts       map[string]int                    `json:"system_state_counts"`
+	AuthInstructionsUrl     string                            `json:"auth_instructions_url"`
+	ContactInfoUrl          string                            `json:"contact_info_url,omitempty"`
+	Tags                    map[string]string                 `json:"tags"`
+}
+
+type wesWorkflowTypeVersion struct {
+	WorkflowTypeVersion []string `json:"workflow_type_version"`
+}
+
+type wesRunId struct {
+	RunId string `json:"run_id"`
+}
+
+type wesRunStatus struct {
+	RunId string `json:"run_id"`
+	State string `json:"state"`
+}
+
+type wesRunList struct {
+	Runs          []wesRunStatus `json:"runs"`
+	NextPageToken string         `json:"next_page_token"`
+}
+
+type wesRunRequest struct {
+	WorkflowParams      interface{}       `json:"workflow_params"`
+	WorkflowType        string            `json:"workflow_type"`
+	WorkflowTypeVersion string            `json:"workflow_type_version"`
+	Tags                map[string]string `json:"tags"`
+	WorkflowUrl         string            `json:"workflow_url"`
+}
+
+type wesLog struct {
+	Name      string   `json:"name"`
+	Cmd       []string `json:"cmd,omitempty"`
+	StartTime string   `json:"start_time,omitempty"`
+	EndTime   string   `json:"end_time,omitempty"`
+	Stdout    string   `json:"stdout,omitempty"` // URL of the stored log
+	Stderr    string   `json:"stderr,omitempty"`
+	ExitCode  *int     `json:"exit_code,omitempty"`
+}
+
+type wesRunLog struct {
+	RunId    string        `json:"run_id"`
+	Request  wesRunRequest `json:"request"`
+	State    string        `json:"state"`
+	RunLog   wesLog        `json:"run_log"`
+	TaskLogs []wesLog      `json:"task_logs"`
+	Outputs  interface{}   `json:"outputs"`
+}
+
+// GET: /ga4gh/wes/v1/service-info
+var WesServiceInfoController goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	if cx.Request.Method != "GET" {
+		ga4ghRespondError(cx, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	counts := map[string]int{}
+	failed := bson.M{"$or": []bson.M{bson.M{"error.workfailed": bson.M{"$nin": []interface{}{"", nil}}}, bson.M{"error.taskfailed": bson.M{"$nin": []interface{}{"", nil}}}}}
+	queries := []struct {
+		state string
+		q     bson.M
+	}{
+		{GA4GH_INITIALIZING, bson.M{"state": bson.M{"$in": []string{core.JOB_STAT_INIT, core.JOB_STAT_QUEUING}}}},
+		{GA4GH_QUEUED, bson.M{"state": core.JOB_STAT_QUEUED}},
+		{GA4GH_RUNNING, bson.M{"state": core.JOB_STAT_INPROGRESS}},
+		{GA4GH_COMPLETE, bson.M{"state": core.JOB_STAT_COMPLETED}},
+		{GA4GH_EXECUTOR_ERROR, bson.M{"state": core.JOB_STAT_FAILED_PERMANENT}},
+		{GA4GH_EXECUTOR_ERROR, bson.M{"state": core.JOB_STAT_SUSPEND, "$and": []bson.M{failed}}},
+		{GA4GH_PAUSED, bson.M{"state": core.JOB_STAT_SUSPEND, "$nor": []bson.M{failed}}},
+		{GA4GH_CANCELED, bson.M{"state": core.JOB_STAT_DELETED}},
+	}
+	for _, query := range queries {
+		query.q["is_cwl"] = true
+		count, err := core.GetJobCount(query.q)
+		if err != nil {
+			ga4ghRespondError(cx, http.StatusInternalServerError, err.Error())
+			return
+		}
+		counts[query.state] += count
+	}
+
+	info := wesServiceInfo{
+		WorkflowTypeVersions:    map[string]wesWorkflowTypeVersion{"CWL": {WorkflowTypeVersion: wesWorkflowVersions}},
+		SupportedWesVersions:    []string{wesVersion},
+		SupportedFsProtocols:    []string{"http", "https"},
+		WorkflowEngineVersions:  map[string]string{"AWE": conf.VERSION},
+		DefaultEngineParameters: []interface{}{},
+		SystemStateCounts:       counts,
+		AuthInstructionsUrl:     conf.API_URL,
+		Tags:                    map[string]string{},
+	}
+	ga4ghRespond(cx, http.StatusOK, info)
+	return
+}
+
+// GET: /ga4gh/wes/v1/runs?page_size=&page_token=
+// POST: /ga4gh/wes/v1/runs
+var WesRunsController goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	switch cx.Request.Method {
+	case "GET":
+		wesListRuns(cx)
+	case "POST":
+		wesSubmitRun(cx)
+	default:
+		ga4ghRespondError(cx, http.StatusMethodNotAllowed, "method not allowed")
+	}
+	return
+}
+
+func wesListRuns(cx *goweb.Context) {
+	u, ok := ga4ghUser(cx, conf.ANON_READ)
+	if !ok {
+		return
+	}
+	jobs, next, ok := ga4ghListJobs(cx, u, bson.M{"is_cwl": true})
+	if !ok {
+		return
+	}
+	list := wesRunList{Runs: []wesRunStatus{}}
+	for _, job := range jobs {
+		list.Runs = append(list.Runs, wesRunStatus{RunId: job.Id, State: ga4ghState(job)})
+	}
+	list.NextPageToken = next
+	ga4ghRespond(cx, http.StatusOK, list)
+}
+
+func wesSubmitRun(cx *goweb.Context) {
+	rec := newAuditRecord(cx, "wes.run", "")
+	defer rec.Save()
+
+	u, ok := ga4ghUser(cx, conf.ANON_WRITE)
+	if !ok {
+		return
+	}
+	rec.SetUser(u)
+
+	r := cx.Request
+	if conf.MAX_UPLOAD_MB > 0 {
+		r.Body = http.MaxBytesReader(cx.ResponseWriter, r.Body, int64(conf.MAX_UPLOAD_MB)*1024*1024)
+	}
+	if err := r.ParseMultipartForm(wesMaxMemory); err != nil {
+		var too_large *http.MaxBytesError
+		if errors.As(err, &too_large) {
+			ga4ghRespondError(cx, http.StatusRequestEntityTooLarge, fmt.Sprintf("%s of %d MB", e.UploadTooLarge, conf.MAX_UPLOAD_MB))
+		} else {
+			ga4ghRespondError(cx, http.StatusBadRequest, "Error parsing form: "+err.Error())
+		}
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	form := func(key string) string {
+		if values := r.MultipartForm.Value[key]; len(values) > 0 {
+			return strings.TrimSpace(values[0])
+		}
+		return ""
+	}
+
+	if !strings.EqualFold(form("workflow_type"), "CWL") {
+		ga4ghRespondError(cx, http.StatusBadRequest, "workflow_type must be CWL")
+		return
+	}
+	if version := form("workflow_type_version"); version != "" && !contains(wesWorkflowVersions, version) {
+		ga4ghRespondError(cx, http.StatusBadRequest, "unsupported workflow_type_version "+version)
+		return
+	}
+	engine_params := map[string]interface{}{}
+	if s := form("workflow_engine_parameters"); s != "" {
+		if err := json.Unmarshal([]byte(s), &engine_params); err != nil {
+			ga4ghRespondError(cx, http.StatusBadRequest, "workflow_engine_parameters: "+err.Error())
+			return
+		}
+		if len(engine_params) > 0 {
+			ga4ghRespondError(cx, http.StatusBadRequest, "workflow_engine_parameters are not supported")
+			return
+		}
+	}
+	tags := map[string]string{}
+	if s := form("tags"); s != "" {
+		if err := json.Unmarshal([]byte(s), &tags); err != nil {
+			ga4ghRespondError(cx, http.StatusBadRequest, "tags: "+err.Error())
+			return
+		}
+	}
+	params := []byte(form("workflow_params"))
+	if len(params) == 0 {
+		params = []byte("{}")
+	}
+	job_input, err := cwl.ParseJob(&params)
+	if err != nil {
+		ga4ghRespondError(cx, http.StatusBadRequest, "workflow_params: "+err.Error())
+		return
+	}
+
+	workflow_url := form("workflow_url")
+	if workflow_url == "" {
+		ga4ghRespondError(cx, http.StatusBadRequest, "workflow_url is missing")
+		return
+	}
+	cwl_file, err := wesWorkflowAttachment(r, workflow_url)
+	if err != nil {
+		ga4ghRespondError(cx, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer os.Remove(cwl_file.Path)
+
+	name := tags["name"]
+	if name == "" {
+		name = path.Base(workflow_url)
+	}
+	job, err := core.CreateJobCWLFromInput(u, core.FormFiles{"cwl": cwl_file}, cwl_file, name, job_input)
+	if err != nil {
+		ga4ghRespondError(cx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(tags) > 0 {
+		if job.Info.UserAttr == nil {
+			job.Info.UserAttr = make(map[string]interface{})
+		}
+		for key, value := range tags {
+			job.Info.UserAttr[key] = value
+		}
+	}
+	rec.entry.Target = job.Id
+
+	if err = saveNewJob(cx, u, job, r.URL.Query().Get("group")); err != nil {
+		ga4ghRespondError(cx, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err = core.QMgr.EnqueueTasksByJobId(job.Id); err != nil {
+		ga4ghRespondError(cx, http.StatusInternalServerError, "EnqueueTasksByJobId returned: "+err.Error())
+		return
+	}
+	logger.Debug(1, "(wesSubmitRun) job %s submitted by %s", job.Id, u.Uuid)
+	ga4ghRespond(cx, http.StatusOK, wesRunId{RunId: job.Id})
+}
+
+// wesWorkflowAttachment copies the attachment named by workflow_url to a temporary file
+func wesWorkflowAttachment(r *http.Request, workflow_url string) (file core.FormFile, err error) {
+	name := path.Clean(strings.TrimPrefix(workflow_url, "file://"))
+	for _, fh := range r.MultipartForm.File["workflow_attachment"] {
+		if path.Clean(fh.Filename) != name && path.Base(fh.Filename) != name {
+			continue
+		}
+		src, xerr := fh.Open()
+		if xerr != nil {
+			err = xerr
+			return
+		}
+		defer src.Close()
+		file = core.FormFile{Name: path.Base(name), Path: fmt.Sprintf("%s/temp/%d%d", conf.DATA_PATH, rand.Int(), rand.Int()), Checksum: make(map[string]string)}
+		dst, xerr := os.Create(file.Path)
+		if xerr != nil {
+			err = xerr
+			return
+		}
+		defer dst.Close()
+		_, err = io.Copy(dst, src)
+		return
+	}
+	err = errors.New("workflow_url must name one of the workflow_attachment files, remote workflows are not supported")
+	return
+}
+
+// GET: /ga4gh/wes/v1/runs/{run_id}
+var WesRunController goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	if cx.Request.Method != "GET" {
+		ga4ghRespondError(cx, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	job, _, ok := wesLoadRun(cx, "read")
+	if !ok {
+		return
+	}
+	ga4ghRespond(cx, http.StatusOK, newWesRunLog(job))
+	return
+}
+
+// GET: /ga4gh/wes/v1/runs/{run_id}/status
+var WesRunStatusController goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	if cx.Request.Method != "GET" {
+		ga4ghRespondError(cx, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	job, _, ok := wesLoadRun(cx, "read")
+	if !ok {
+		return
+	}
+	ga4ghRespond(cx, http.StatusOK, wesRunStatus{RunId: job.Id, State: ga4ghState(job)})
+	return
+}
+
+// POST: /ga4gh/wes/v1/runs/{run_id}/cancel, the job is deleted
+var WesRunCancelController goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+	rec := newAuditRecord(cx, "wes.cancel", cx.PathParams["run_id"])
+	defer rec.Save()
+	if cx.Request.Method != "POST" {
+		ga4ghRespondError(cx, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	job, u, ok := wesLoadRun(cx, "delete")
+	rec.SetUser(u)
+	if !ok {
+		return
+	}
+	if err := core.QMgr.DeleteJobByUser(job.Id, u, false); err != nil {
+		ga4ghRespondError(cx, http.StatusInternalServerError, "fail to cancel run "+job.Id+": "+err.Error())
+		return
+	}
+	ga4ghRespond(cx, http.StatusOK, wesRunId{RunId: job.Id})
+	return
+}
+
+// wesLoadRun loads the CWL job of the run if the user has the right on it
+func wesLoadRun(cx *goweb.Context, right string) (job *core.Job, u *user.User, ok bool) {
+	return ga4ghLoadJob(cx, cx.PathParams["run_id"], right, func(job *core.Job) bool { return job.IsCWL })
+}
+
+// newWesRunLog describes the job and one task log per workunit that has started, the times of
+// workunits are taken from the performance statistics if available
+func newWesRunLog(job *core.Job) (rl wesRunLog) {
+	rl.RunId = job.Id
+	rl.State = ga4ghState(job)
+	rl.Request = wesRunRequest{
+		WorkflowParams:      job.CWL_job_input,
+		WorkflowType:        "CWL",
+		WorkflowTypeVersion: string(job.CwlVersion),
+		Tags:                map[string]string{},
+		WorkflowUrl:         job.Info.Pipeline,
+	}
+	for key, value := range job.Info.UserAttr {
+		if s, ok := value.(string); ok {
+			rl.Request.Tags[key] = s
+		}
+	}
+	rl.Outputs = map[string]interface{}{}
+	if wi, err := job.GetWorkflowInstance("", true); err == nil {
+		rl.Request.WorkflowParams = wi.Inputs.GetMap()
+		if rl.State == GA4GH_COMPLETE {
+			rl.Outputs = wi.Outputs.GetMap()
+		}
+	}
+
+	rl.RunLog = wesLog{
+		Name:      job.Info.Name,
+		StartTime: ga4ghTime(job.Info.StartedTime),
+		EndTime:   ga4ghTime(job.Info.CompletedTime),
+	}
+	if rl.State == GA4GH_COMPLETE {
+		exit_code := 0
+		rl.RunLog.ExitCode = &exit_code
+	}
+	// the run fails with the exit code of the workunit that failed
+	failed_work := ""
+	if rl.State == GA4GH_EXECUTOR_ERROR {
+		failed_work = job.Error.WorkFailed
+	}
+
+	perf, _ := core.GetJobPerf(job.Id)
+	rl.TaskLogs = []wesLog{}
+	for _, task := range job.Tasks {
+		ranks := []int{0}
+		if task.TotalWork > 1 {
+			ranks = ranks[:0]
+			for i := 1; i <= task.TotalWork; i++ {
+				ranks = append(ranks, i)
+			}
+		}
+		for _, rank := range ranks {
+			work_id := core.New_Workunit_Unique_Identifier(task.Task_Unique_Identifier, rank)
+			work_str, err := work_id.String()
+			if err != nil {
+				continue
+			}
+			l := wesLog{Name: work_str}
+			if task.Cmd != nil {
+				l.Cmd = append([]string{task.Cmd.Name}, task.Cmd.ArgsArray...)
+				if len(task.Cmd.ArgsArray) == 0 {
+					l.Cmd = append(l.Cmd, strings.Fields(task.Cmd.Args)...)
+				}
+			}
+			if perf != nil && perf.Pworks[work_str] != nil && perf.Pworks[work_str].Checkout > 0 {
+				l.StartTime = ga4ghTime(time.Unix(perf.Pworks[work_str].Checkout, 0))
+				if perf.Pworks[work_str].Deliver > 0 {
+					l.EndTime = ga4ghTime(time.Unix(perf.Pworks[work_str].Deliver, 0))
+				}
+			} else if task.TotalWork <= 1 {
+				l.StartTime = ga4ghTime(task.StartedDate)
+				l.EndTime = ga4ghTime(task.CompletedDate)
+			}
+			if core.HasStdLog(work_id, "stdout") {
+				l.Stdout = conf.API_URL + "/work/" + work_str + "?report=stdout"
+			}
+			if core.HasStdLog(work_id, "stderr") {
+				l.Stderr = conf.API_URL + "/work/" + work_str + "?report=stderr"
+			}
+			l.ExitCode = ga4ghExitCode(job, task, work_str)
+			if work_str == failed_work {
+				rl.RunLog.ExitCode = l.ExitCode
+			}
+			if l.StartTime == "" && l.Stdout == "" && l.Stderr == "" && l.ExitCode == nil {
+				// not started yet
+				continue
+			}
+			rl.TaskLogs = append(rl.TaskLogs, l)
+		}
+	}
+	return
+}
@@ -15,11 +15,15 @@ import (
 	"github.com/MG-RAST/golib/goweb"
 	//"github.com/davecgh/go-spew/spew"
 	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type WorkController struct{}
@@ -47,7 +51,7 @@ func (cr *WorkController) Read(id string, cx *goweb.Context) {
 	// Gather query params
 	query := &Query{Li: cx.Request.URL.Query()}
 
-	if (query.Has("datatoken") || query.Has("privateenv")) && query.Has("client") {
+	if (query.Has("datatoken") || query.Has("privateenv") || query.Has("registryauth")) && query.Has("client") {
 		cg, err := request.AuthenticateClientGroup(cx.Request)
 		if err != nil {
 			if err.Error() == e.NoAuth || err.Error() == e.UnAuth || err.Error() == e.InvalidAuth {
@@ -99,6 +103,16 @@ func (cr *WorkController) Read(id string, cx *goweb.Context) {
 			RespondPrivateEnvInHeader(cx, envs)
 			return
 		}
+
+		if query.Has("registryauth") { //a client is requesting credentials to pull a docker image
+			cred, err := core.QMgr.FetchRegistryCredential(work_id, clientid, query.Value("registryauth"))
+			if err != nil {
+				cx.RespondWithErrorMessage("error in getting registry credential for job "+id+" :"+err.Error(), http.StatusBadRequest)
+				return
+			}
+			RespondRegistryCredentialInHeader(cx, cred)
+			return
+		}
 	}
 
 	// Try to authenticate user.
@@ -144,6 +158,11 @@ func (cr *WorkController) Read(id string, cx *goweb.Context) {
 		return
 	}
 
+	if query.Has("report") && query.Has("follow") { //stream stdout or stderr of running workunit
+		StreamReport(cx, work_id, query.Value("report"))
+		return
+	}
+
 	if query.Has("report") { //retrieve report: stdout or stderr or worknotes
 		reportmsg, err := core.QMgr.GetReportMsg(work_id, query.Value("report"))
 		if err != nil {
@@ -179,6 +198,7 @@ func (cr *WorkController) Read(id string, cx *goweb.Context) {
 
 // GET: /work
 // checkout a workunit with earliest submission time
+// without client: list workunits, supports filter and cursor like GET /job
 // to-do: to support more options for workunit checkout
 func (cr *WorkController) ReadMany(cx *goweb.Context) {
 	LogRequest(cx.Request)
@@ -230,6 +250,41 @@ func (cr *WorkController) ReadMany(cx *goweb.Context) {
 			direction = query.Value("direction")
 		}
 
+		var filter core.Filter
+		if query.Has("filter") {
+			filter, err = core.ParseFilter(query.List("filter"), core.WorkListFields)
+			if err != nil {
+				cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// the read access and the filter clauses on job fields are checked with one job query,
+		// only the workunits of the page are kept
+		if query.Has("cursor") {
+			if limit <= 0 {
+				cx.RespondWithErrorMessage("limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+			cursor, err := listCursor(query, order, direction, core.WorkListFields)
+			if err != nil {
+				cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+				return
+			}
+			job_q := bson.M{}
+			if !u.Admin {
+				job_q["$or"] = readableJobs(u)
+			}
+			page, next, err := core.QMgr.WorkunitsPage(job_q, query.Value("state"), filter, limit, cursor)
+			if err != nil {
+				logger.Error("(WorkController) %s", err.Error())
+				cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+				return
+			}
+			respondWithCursor(cx, page, limit, next)
+			return
+		}
+
 		var workunits []*core.Workunit
 		if query.Has("state") {
 			workunits = core.QMgr.ShowWorkunitsByUser(query.Value("state"), u)
@@ -237,6 +292,16 @@ func (cr *WorkController) ReadMany(cx *goweb.Context) {
 			workunits = core.QMgr.ShowWorkunitsByUser("", u)
 		}
 
+		if len(filter) > 0 {
+			matching := []*core.Workunit{}
+			for _, work := range workunits {
+				if filter.Match(work.ListValue) {
+					matching = append(matching, work)
+				}
+			}
+			workunits = matching
+		}
+
 		// if using query syntax then do pagination and sorting
 		if query.Has("query") {
 			filtered_work := []*core.Workunit{}
@@ -309,8 +374,11 @@ func (cr *WorkController) ReadMany(cx *goweb.Context) {
 		}
 	}
 
+	// a worker that is still computing may reserve its next workunit to stage the inputs
+	prefetch := query.Has("prefetch")
+
 	//checkout a workunit in FCFS order
-	workunits, err := core.QMgr.CheckoutWorkunits("FCFS", clientid, client, availableBytes, 1)
+	workunits, err := core.QMgr.CheckoutWorkunits("FCFS", clientid, client, availableBytes, 1, prefetch)
 
 	if err != nil {
 
@@ -337,6 +405,11 @@ func (cr *WorkController) ReadMany(cx *goweb.Context) {
 	workids := []string{}
 	for _, work := range workunits {
 		workids = append(workids, work.Id)
+		// a workunit that runs again streams its logs again
+		err = core.QMgr.OpenLogStreams(work.Workunit_Unique_Identifier)
+		if err != nil {
+			logger.Error("(ReadMany GET /work) OpenLogStreams returned: %s", err.Error())
+		}
 	}
 	logger.Event(event.WORK_CHECKOUT, fmt.Sprintf("workids=%s;clientid=%s;available=%d", strings.Join(workids, ","), clientid, availableBytes))
 
@@ -350,7 +423,9 @@ func (cr *WorkController) ReadMany(cx *goweb.Context) {
 	}
 
 	workunit := workunits[0]
-	workunit.State = core.WORK_STAT_RESERVED
+	if !prefetch {
+		workunit.State = core.WORK_STAT_RESERVED
+	}
 	workunit.Client = clientid
 
 	//test, err := json.Marshal(workunit)
@@ -414,6 +489,74 @@ func (cr *WorkController) Update(id string, cx *goweb.Context) {
 		return
 	}
 
+	if query.Has("start") { // the client starts a prefetched workunit
+		err = core.QMgr.StartPrefetchedWork(work_id, clientid)
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusConflict)
+			return
+		}
+		cx.RespondWithData("ok")
+		return
+	}
+
+	if query.Has("logchunk") { // live stdout/stderr of a running workunit
+		has_work, err := client.Current_work.Has(work_id)
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !has_work {
+			cx.RespondWithErrorMessage("workunit "+id+" is not assigned to client "+clientid, http.StatusBadRequest)
+			return
+		}
+		offset, err := strconv.ParseInt(query.Value("offset"), 10, 64)
+		if err != nil || offset < 0 {
+			cx.RespondWithErrorMessage("offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		chunk, err := ioutil.ReadAll(io.LimitReader(cx.Request.Body, int64(conf.LOG_STREAM_MAX_BYTES)))
+		if err != nil {
+			cx.RespondWithErrorMessage("error reading log chunk: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = core.QMgr.AppendLogChunk(work_id, query.Value("logchunk"), offset, chunk)
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+			return
+		}
+		cx.RespondWithData("ok")
+		return
+	}
+
+	if query.Has("filerelay") { // client answers a request for a file in a retained work dir
+		params, files, err := ParseMultipartFormLimit(cx.Request, int64(conf.MAX_WORKER_UPLOAD_MB)*1024*1024)
+		if err != nil {
+			if err.Error() == e.UploadTooLarge {
+				cx.RespondWithErrorMessage(fmt.Sprintf("%s of %d MB", e.UploadTooLarge, conf.MAX_WORKER_UPLOAD_MB), http.StatusRequestEntityTooLarge)
+				return
+			}
+			cx.RespondWithErrorMessage("error getting form files: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		response := &core.FileRelayResponse{Type: params["type"], Error: params["error"]}
+		if file, ok := files["file"]; ok {
+			response.File = file.Path
+		}
+		if response.File == "" && response.Error == "" {
+			response.Error = "client did not send a file"
+		}
+		err = core.QMgr.DeliverWorkFile(query.Value("filerelay"), clientid, response)
+		if err != nil {
+			if response.File != "" {
+				os.Remove(response.File)
+			}
+			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+			return
+		}
+		cx.RespondWithData("ok")
+		return
+	}
+
 	// old-style
 	var notice *core.Notice
 	if query.Has("status") && query.Has("client") { //notify execution result: "done" or "fail"
@@ -430,11 +573,21 @@ func (cr *WorkController) Update(id string, cx *goweb.Context) {
 				notice.ComputeTime = comptime
 			}
 		}
+		notice.FailureReason = query.Value("reason")
+		if query.Has("exitstatus") {
+			if exit_status, err := strconv.Atoi(query.Value("exitstatus")); err == nil {
+				notice.ExitStatus = exit_status
+			}
+		}
 	}
 
-	params, files, err := ParseMultipartForm(cx.Request)
+	params, files, err := ParseMultipartFormLimit(cx.Request, int64(conf.MAX_WORKER_UPLOAD_MB)*1024*1024)
 
 	if err != nil {
+		if err.Error() == e.UploadTooLarge {
+			cx.RespondWithErrorMessage(fmt.Sprintf("%s of %d MB", e.UploadTooLarge, conf.MAX_WORKER_UPLOAD_MB), http.StatusRequestEntityTooLarge)
+			return
+		}
 		cx.RespondWithErrorMessage("error getting form files: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -508,8 +661,73 @@ func (cr *WorkController) Update(id string, cx *goweb.Context) {
 		}
 	}
 
+	// final logs have been saved, live logs are no longer needed
+	err = core.QMgr.CloseLogStreams(work_id)
+	if err != nil {
+		logger.Error("(WorkController/Update) CloseLogStreams returned: %s", err.Error())
+	}
+
 	core.QMgr.NotifyWorkStatus(*notice)
 	//}
 	cx.RespondWithData("ok")
 	return
 }
+
+// StreamReport writes stdout or stderr of a running workunit to the client as it arrives.
+// If no live log exists (workunit finished or not started) the saved log is returned.
+func StreamReport(cx *goweb.Context, work_id core.Workunit_Unique_Identifier, logname string) {
+	ls, ok, err := core.QMgr.GetLogStream(work_id, logname)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		reportmsg, err := core.QMgr.GetReportMsg(work_id, logname)
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+			return
+		}
+		cx.ResponseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		cx.ResponseWriter.WriteHeader(http.StatusOK)
+		cx.ResponseWriter.Write([]byte(reportmsg))
+		return
+	}
+
+	flusher, can_flush := cx.ResponseWriter.(http.Flusher)
+	cx.ResponseWriter.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	cx.ResponseWriter.Header().Set("X-Content-Type-Options", "nosniff")
+	cx.ResponseWriter.WriteHeader(http.StatusOK)
+
+	var offset int64
+	for {
+		chunk, next, skipped, update, closed, err := ls.Read(offset)
+		if err != nil {
+			logger.Error("(StreamReport) ls.Read returned: %s", err.Error())
+			return
+		}
+		if skipped > 0 {
+			cx.ResponseWriter.Write([]byte(fmt.Sprintf("[... %d bytes skipped ...]\n", skipped)))
+		}
+		if len(chunk) > 0 {
+			_, err = cx.ResponseWriter.Write(chunk)
+			if err != nil {
+				return
+			}
+		}
+		if can_flush {
+			flusher.Flush()
+		}
+		offset = next
+		if closed {
+			return
+		}
+
+		select {
+		case <-update:
+		case <-cx.Request.Context().Done():
+			return
+		case <-time.After(core.LOG_STREAM_IDLE_TIMEOUT):
+			return
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package controller
+
+import (
+	"encoding/json"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	e "github.com/MG-RAST/AWE/lib/errors"
+	"github.com/MG-RAST/AWE/lib/request"
+	"github.com/MG-RAST/AWE/lib/user"
+	"github.com/MG-RAST/golib/goweb"
+	mgo "gopkg.in/mgo.v2"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// GET: /work/{id}/files and /work/{id}/files/{path}
+// list or download files in the work directory of a failed workunit, retained and relayed by the worker
+var WorkFilesController goweb.ControllerFunc = func(cx *goweb.Context) {
+	LogRequest(cx.Request)
+
+	if cx.Request.Method == "OPTIONS" {
+		cx.RespondWithOK()
+		return
+	}
+	if cx.Request.Method != "GET" {
+		cx.RespondWithErrorMessage("This request type is not implemented.", http.StatusNotImplemented)
+		return
+	}
+
+	// path parameters may contain slashes and dots, parse them from the url
+	url_path := strings.TrimPrefix(cx.Request.URL.Path, "/work/")
+	parts := strings.SplitN(url_path, "/files", 2)
+	if len(parts) != 2 {
+		cx.RespondWithErrorMessage("invalid path "+cx.Request.URL.Path, http.StatusBadRequest)
+		return
+	}
+	id := DecodeBase64(cx, parts[0])
+	if id == "" {
+		// DecodeBase64 has responded with the error
+		return
+	}
+	file_path := strings.Trim(parts[1], "/")
+
+	work_id, err := core.New_Workunit_Unique_Identifier_FromString(id)
+	if err != nil {
+		cx.RespondWithErrorMessage("error parsing workunit identifier: "+id+" ("+err.Error()+")", http.StatusBadRequest)
+		return
+	}
+
+	// Try to authenticate user.
+	u, err := request.Authenticate(cx.Request)
+	if err != nil && err.Error() != e.NoAuth {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// If no auth was provided, and anonymous read is allowed, use the public user
+	if u == nil {
+		if conf.ANON_READ == true {
+			u = &user.User{Uuid: "public"}
+		} else {
+			cx.RespondWithErrorMessage(e.NoAuth, http.StatusUnauthorized)
+			return
+		}
+	}
+
+	jobid := work_id.JobId
+	acl, err := core.DBGetJobAcl(jobid)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			cx.RespondWithNotFound()
+		} else {
+			cx.RespondWithErrorMessage("job not found: "+jobid+" "+err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	// User must have read permissions on job or be job owner or be an admin
+	rights := acl.Check(u.Uuid)
+	if acl.Owner != u.Uuid && rights["read"] == false && u.Admin == false {
+		cx.RespondWithErrorMessage(e.UnAuth, http.StatusUnauthorized)
+		return
+	}
+
+	response, err := core.QMgr.RequestWorkFile(work_id, file_path)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer os.Remove(response.File)
+
+	if response.Type == "listing" {
+		listing_b, err := ioutil.ReadFile(response.File)
+		if err != nil {
+			cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var listing []core.WorkFileInfo
+		err = json.Unmarshal(listing_b, &listing)
+		if err != nil {
+			cx.RespondWithErrorMessage("could not parse file listing: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		cx.RespondWithData(listing)
+		return
+	}
+
+	file, err := os.Open(response.File)
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		cx.RespondWithErrorMessage(err.Error(), http.StatusInternalServerError)
+		return
+	}
+	file_name := path.Base(file_path)
+	cx.ResponseWriter.Header().Set("Content-Disposition", "attachment; filename=\""+file_name+"\"")
+	http.ServeContent(cx.ResponseWriter, cx.Request, file_name, info.ModTime(), file)
+	return
+}
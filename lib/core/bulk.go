@@ -0,0 +1,346 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/acl"
+	"github.com/MG-RAST/AWE/lib/audit"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core/uuid"
+	"github.com/MG-RAST/AWE/lib/db"
+	e "github.com/MG-RAST/AWE/lib/errors"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"github.com/MG-RAST/AWE/lib/user"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	BULK_STAT_RUNNING   = "running"
+	BULK_STAT_COMPLETED = "completed"
+	BULK_STAT_CANCELED  = "canceled"
+)
+
+// finished bulk operations are kept in memory for this long
+const bulkKeep = 24 * time.Hour
+
+// at most this many per-job errors are kept
+const bulkMaxErrors = 100
+
+// BulkActions are the actions of bulk operations, with the right a user needs on each job
+var BulkActions = map[string]string{
+	"suspend":     "write",
+	"resume":      "write",
+	"delete":      "delete",
+	"priority":    "write",
+	"clientgroup": "write",
+	"expiration":  "write",
+}
+
+// BulkOperation applies one action to the jobs that matched a filter when it was started. It
+// runs in the background, the counters show the progress.
+type BulkOperation struct {
+	lock      sync.RWMutex
+	canceled  bool
+	Id        string            `json:"id"`
+	Owner     string            `json:"owner"` // uuid of the user who started the operation
+	Action    string            `json:"action"`
+	Value     string            `json:"value,omitempty"`
+	Filter    []string          `json:"filter"`
+	State     string            `json:"state"`
+	Total     int               `json:"total"`
+	Done      int               `json:"done"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Skipped   int               `json:"skipped"` // jobs the user is no longer allowed to change
+	Errors    map[string]string `json:"errors"`  // job id -> error
+	Created   time.Time         `json:"created"`
+	Finished  time.Time         `json:"finished"`
+	user      *user.User
+	full      bool
+	jobs      []string
+	source_ip string // of the request that started the operation, for the audit log
+	forwarded string
+}
+
+var bulkOperations = struct {
+	sync.Mutex
+	ops map[string]*BulkOperation
+}{ops: make(map[string]*BulkOperation)}
+
+// CheckBulkAction validates the action and its value
+func CheckBulkAction(action string, value string) (err error) {
+	if _, ok := BulkActions[action]; !ok {
+		return fmt.Errorf("unknown action %q", action)
+	}
+	switch action {
+	case "priority":
+		if _, err = strconv.Atoi(value); err != nil {
+			return errors.New("priority value must be an integer")
+		}
+	case "clientgroup":
+		if value == "" {
+			return errors.New("lacking clientgroup name")
+		}
+	case "expiration":
+		if !ExpireRegex.MatchString(value) {
+			return errors.New("expiration format '" + value + "' is invalid")
+		}
+	}
+	return
+}
+
+// BulkJobQuery selects the jobs of the filter on which the user has the right the action needs,
+// deleted jobs are never selected
+func BulkJobQuery(filter Filter, u *user.User, action string) (q bson.M) {
+	q = bson.M{"state": bson.M{"$ne": JOB_STAT_DELETED}}
+	if !u.Admin {
+		right := BulkActions[action]
+		q["$or"] = []bson.M{bson.M{"acl.owner": u.Uuid}, bson.M{"acl." + right: bson.M{"$in": acl.Principals(u.Uuid)}}}
+	}
+	AddQuery(q, filter.Bson()...)
+	return
+}
+
+// StartBulkOperation selects the jobs of the query and applies the action to them in the
+// background, full removes deleted jobs from the database. It returns a copy of the operation,
+// the running one is only read through GetBulkOperation. Each job that is changed is logged
+// and audited with the source of the request.
+func StartBulkOperation(u *user.User, action string, value string, full bool, expressions []string, q bson.M, source_ip string, forwarded_for string) (op *BulkOperation, err error) {
+	ids, err := dbFindJobIds(q)
+	if err != nil {
+		err = fmt.Errorf("(StartBulkOperation) %s", err.Error())
+		return
+	}
+	running := &BulkOperation{
+		Id:        uuid.New(),
+		Owner:     u.Uuid,
+		Action:    action,
+		Value:     value,
+		Filter:    expressions,
+		State:     BULK_STAT_RUNNING,
+		Total:     len(ids),
+		Errors:    make(map[string]string),
+		Created:   time.Now(),
+		user:      u,
+		full:      full,
+		jobs:      ids,
+		source_ip: source_ip,
+		forwarded: forwarded_for,
+	}
+
+	bulkOperations.Lock()
+	for id, old := range bulkOperations.ops {
+		old.lock.RLock()
+		expired := old.State != BULK_STAT_RUNNING && time.Since(old.Finished) > bulkKeep
+		old.lock.RUnlock()
+		if expired {
+			delete(bulkOperations.ops, id)
+		}
+	}
+	bulkOperations.ops[running.Id] = running
+	bulkOperations.Unlock()
+
+	logger.Info("(StartBulkOperation) %s: %s %s on %d jobs by %s", running.Id, action, value, len(ids), u.Uuid)
+	op = running.snapshot()
+	go running.run()
+	return
+}
+
+// GetBulkOperation returns a copy of the operation with its current progress
+func GetBulkOperation(id string) (op *BulkOperation, ok bool) {
+	bulkOperations.Lock()
+	running, ok := bulkOperations.ops[id]
+	bulkOperations.Unlock()
+	if !ok {
+		return
+	}
+	op = running.snapshot()
+	return
+}
+
+// ListBulkOperations returns the operations of a user, all operations for admins
+func ListBulkOperations(u *user.User) (ops []*BulkOperation) {
+	ops = []*BulkOperation{}
+	bulkOperations.Lock()
+	defer bulkOperations.Unlock()
+	for _, op := range bulkOperations.ops {
+		if u.Admin || op.Owner == u.Uuid {
+			ops = append(ops, op.snapshot())
+		}
+	}
+	return
+}
+
+// CancelBulkOperation stops a running operation after the current job
+func CancelBulkOperation(id string) {
+	bulkOperations.Lock()
+	op, ok := bulkOperations.ops[id]
+	bulkOperations.Unlock()
+	if !ok {
+		return
+	}
+	op.lock.Lock()
+	op.canceled = true
+	op.lock.Unlock()
+}
+
+func (op *BulkOperation) snapshot() *BulkOperation {
+	op.lock.RLock()
+	defer op.lock.RUnlock()
+	c := &BulkOperation{
+		Id:        op.Id,
+		Owner:     op.Owner,
+		Action:    op.Action,
+		Value:     op.Value,
+		Filter:    op.Filter,
+		State:     op.State,
+		Total:     op.Total,
+		Done:      op.Done,
+		Succeeded: op.Succeeded,
+		Failed:    op.Failed,
+		Skipped:   op.Skipped,
+		Errors:    make(map[string]string, len(op.Errors)),
+		Created:   op.Created,
+		Finished:  op.Finished,
+	}
+	for id, msg := range op.Errors {
+		c.Errors[id] = msg
+	}
+	return c
+}
+
+func (op *BulkOperation) run() {
+	for _, id := range op.jobs {
+		op.lock.RLock()
+		canceled := op.canceled
+		op.lock.RUnlock()
+		if canceled {
+			break
+		}
+
+		err := op.apply(id)
+		op.record(id, err)
+
+		op.lock.Lock()
+		op.Done++
+		if err == nil {
+			op.Succeeded++
+		} else if err.Error() == e.UnAuth {
+			op.Skipped++
+		} else {
+			op.Failed++
+			if len(op.Errors) < bulkMaxErrors {
+				op.Errors[id] = err.Error()
+			}
+		}
+		op.lock.Unlock()
+	}
+
+	op.lock.Lock()
+	op.State = BULK_STAT_COMPLETED
+	if op.Done < op.Total {
+		op.State = BULK_STAT_CANCELED
+	}
+	op.Finished = time.Now()
+	op.jobs = nil
+	logger.Info("(BulkOperation) %s %s: %d succeeded, %d failed, %d skipped of %d jobs", op.Id, op.State, op.Succeeded, op.Failed, op.Skipped, op.Total)
+	op.lock.Unlock()
+}
+
+// record logs the outcome of the action on one job and adds it to the audit log like a
+// request on the job itself (e.g. job.suspend), with the id of the operation as parameter
+func (op *BulkOperation) record(id string, err error) {
+	entry := audit.Entry{
+		Actor:        op.user.Uuid,
+		Username:     op.user.Username,
+		Action:       "job." + op.Action,
+		Target:       id,
+		Params:       map[string]string{"bulk": op.Id},
+		Status:       http.StatusOK,
+		Success:      true,
+		SourceIP:     op.source_ip,
+		ForwardedFor: op.forwarded,
+	}
+	if op.Value != "" {
+		entry.Params["value"] = op.Value
+	}
+	if op.full {
+		entry.Params["full"] = "true"
+	}
+	if err != nil {
+		entry.Success = false
+		entry.Error = err.Error()
+		entry.Status = http.StatusInternalServerError
+		if err.Error() == e.UnAuth {
+			entry.Status = http.StatusUnauthorized
+		}
+		logger.Info("(BulkOperation) %s: %s job %s failed: %s", op.Id, op.Action, id, err.Error())
+	} else {
+		logger.Info("(BulkOperation) %s: %s job %s", op.Id, op.Action, id)
+	}
+	if xerr := audit.Insert(&entry); xerr != nil {
+		logger.Error("(BulkOperation) %s: audit of job %s: %s", op.Id, id, xerr.Error())
+	}
+}
+
+// apply runs the action on one job, the rights are checked again because the ACL may have
+// changed since the operation was started
+func (op *BulkOperation) apply(id string) (err error) {
+	job, err := GetJob(id)
+	if err != nil {
+		return
+	}
+	u := op.user
+	rights := job.Acl.Check(u.Uuid)
+	if job.Acl.Owner != u.Uuid && rights[BulkActions[op.Action]] == false && u.Admin == false {
+		return errors.New(e.UnAuth)
+	}
+
+	switch op.Action {
+	case "suspend":
+		jerror := &JobError{
+			ServerNotes: "suspended by bulk operation " + op.Id,
+			Status:      JOB_STAT_SUSPEND,
+		}
+		err = QMgr.SuspendJob(id, jerror)
+	case "resume":
+		err = QMgr.ResumeSuspendedJobByUser(id, u)
+	case "delete":
+		err = QMgr.DeleteJobByUser(id, u, op.full)
+	case "priority":
+		priority, _ := strconv.Atoi(op.Value)
+		err = job.SetPriority(priority)
+	case "clientgroup":
+		err = job.SetClientgroups(op.Value)
+	case "expiration":
+		err = job.SetExpiration(op.Value)
+	}
+	return
+}
+
+// dbFindJobIds returns the ids of the matching jobs
+func dbFindJobIds(q bson.M) (ids []string, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C(conf.DB_COLL_JOBS)
+	var results []struct {
+		Id string `bson:"id"`
+	}
+	if err = c.Find(q).Select(bson.M{"id": 1}).All(&results); err != nil {
+		return
+	}
+	ids = make([]string, 0, len(results))
+	for _, r := range results {
+		ids = append(ids, r.Id)
+	}
+	return
+}
@@ -58,13 +58,40 @@ type WorkerRuntime struct {
 
 // changes at runtime
 type WorkerState struct {
-	Busy         bool          `bson:"busy" json:"busy"` // a state
-	Current_work *WorkunitList `bson:"current_work" json:"current_work"`
+	Busy            bool              `bson:"busy" json:"busy"` // a state
+	Current_work    *WorkunitList     `bson:"current_work" json:"current_work"`
+	Prefetched_work *WorkunitList     `bson:"prefetched_work" json:"prefetched_work"` // checked out in advance, inputs are staged while Current_work runs
+	Retained_work   []RetainedWorkDir `bson:"retained_work" json:"retained_work"`     // work dirs of failed workunits kept on the worker
+	Cached_data     []CachedObject    `bson:"cached_data" json:"cached_data"`         // inventory of the data cache of the worker
+	Transfers       []WorkTransfer    `bson:"transfers" json:"transfers"`             // transfer progress of the workunits on the worker
+}
+
+// transfer counters of the WorkPerf of a workunit while its data is moved
+type WorkTransfer struct {
+	WorkId          string `bson:"workid" json:"workid"`
+	InFileMoved     int64  `bson:"moved_infile" json:"moved_infile"`
+	OutFileMoved    int64  `bson:"moved_outfile" json:"moved_outfile"`
+	ResumedSize     int64  `bson:"size_resumed" json:"size_resumed"`
+	TransferRetries int64  `bson:"transfer_retries" json:"transfer_retries"`
+}
+
+// work directory of a failed workunit, kept by the worker for post-mortem inspection
+type RetainedWorkDir struct {
+	WorkId   string    `bson:"workid" json:"workid"`
+	Size     int64     `bson:"size" json:"size"`
+	Retained time.Time `bson:"retained" json:"retained"`
+}
+
+// file in the data cache of a worker, Id is the Shock node id (or the url of data not in Shock)
+type CachedObject struct {
+	Id   string `bson:"id" json:"id"`
+	Size int64  `bson:"size" json:"size"`
 }
 
 func NewWorkerState() (ws *WorkerState) {
 	ws = &WorkerState{}
 	ws.Current_work = NewWorkunitList()
+	ws.Prefetched_work = NewWorkunitList()
 	return
 }
 
@@ -93,6 +120,11 @@ func (client *Client) Init() {
 
 	client.Current_work.Init("Current_work")
 
+	if client.Prefetched_work == nil { // workers that do not prefetch
+		client.Prefetched_work = NewWorkunitList()
+	}
+	client.Prefetched_work.Init("Prefetched_work")
+
 }
 
 func NewClient() (client *Client) {
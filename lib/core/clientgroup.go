@@ -24,6 +24,15 @@ type ClientGroup struct {
 	CreatedOn    time.Time                     `bson:"created_on" json:"created_on"`
 	Expiration   time.Time                     `bson:"expiration" json:"expiration"`
 	LastModified time.Time                     `bson:"last_modified" json:"last_modified"`
+	Registries   []RegistryCredential          `bson:"registries" json:"registries"`
+}
+
+// RegistryCredential is used by the workers of a clientgroup to pull images from a docker registry,
+// the password is never returned by the API and stored encrypted
+type RegistryCredential struct {
+	Registry string `bson:"registry" json:"registry"`
+	Username string `bson:"username" json:"username"`
+	Password string `bson:"password" json:"-"`
 }
 
 var (
@@ -77,3 +86,56 @@ func (cg *ClientGroup) Save() (err error) {
 	err = dbUpsert(cg)
 	return
 }
+
+func (cg *ClientGroup) registrySecretContext(registry string) string {
+	return "clientgroup/" + cg.Id + "/registry/" + registry
+}
+
+// SetRegistryCredential adds or replaces the credential for a registry
+func (cg *ClientGroup) SetRegistryCredential(registry string, username string, password string) (err error) {
+	registry = NormalizeDockerRegistry(registry)
+	encrypted, err := EncryptSecret(password, cg.registrySecretContext(registry))
+	if err != nil {
+		err = fmt.Errorf("(SetRegistryCredential) %s", err.Error())
+		return
+	}
+	cred := RegistryCredential{Registry: registry, Username: username, Password: encrypted}
+	for i, r := range cg.Registries {
+		if r.Registry == registry {
+			cg.Registries[i] = cred
+			return
+		}
+	}
+	cg.Registries = append(cg.Registries, cred)
+	return
+}
+
+func (cg *ClientGroup) DeleteRegistryCredential(registry string) (ok bool) {
+	registry = NormalizeDockerRegistry(registry)
+	for i, r := range cg.Registries {
+		if r.Registry == registry {
+			cg.Registries = append(cg.Registries[:i], cg.Registries[i+1:]...)
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// GetRegistryCredential returns a copy of the credential with the decrypted password
+func (cg *ClientGroup) GetRegistryCredential(registry string) (cred *RegistryCredential, ok bool, err error) {
+	registry = NormalizeDockerRegistry(registry)
+	for _, r := range cg.Registries {
+		if r.Registry == registry {
+			cred = &RegistryCredential{Registry: r.Registry, Username: r.Username}
+			cred.Password, err = DecryptSecret(r.Password, cg.registrySecretContext(registry))
+			if err != nil {
+				err = fmt.Errorf("(GetRegistryCredential) registry %s: %s", registry, err.Error())
+				return
+			}
+			ok = true
+			return
+		}
+	}
+	return
+}
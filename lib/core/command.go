@@ -9,17 +9,31 @@ package core
 //}
 
 type Command struct {
-	Name          string   `bson:"name" json:"name" mapstructure:"name"`
-	Args          string   `bson:"args" json:"args" mapstructure:"args"`
-	ArgsArray     []string `bson:"args_array" json:"args_array" mapstructure:"args_array"`    // use this instead of Args, which is just a string
-	Dockerimage   string   `bson:"Dockerimage" json:"Dockerimage" mapstructure:"Dockerimage"` // for Shock (TODO rename this !)
-	DockerPull    string   `bson:"dockerPull" json:"dockerPull" mapstructure:"dockerPull"`    // docker pull
-	Cmd_script    []string `bson:"cmd_script" json:"cmd_script" mapstructure:"cmd_script"`
-	Environ       Envs     `bson:"environ" json:"environ" mapstructure:"environ"`
-	HasPrivateEnv bool     `bson:"has_private_env" json:"has_private_env" mapstructure:"has_private_env"`
-	Description   string   `bson:"description" json:"description" mapstructure:"description"`
-	ParsedArgs    []string `bson:"-" json:"-" mapstructure:"-"`
-	Local         bool     // indicates local execution, i.e. working directory is same as current working directory (do not delete !)
+	Name          string     `bson:"name" json:"name" mapstructure:"name"`
+	Args          string     `bson:"args" json:"args" mapstructure:"args"`
+	ArgsArray     []string   `bson:"args_array" json:"args_array" mapstructure:"args_array"`       // use this instead of Args, which is just a string
+	Dockerimage   string     `bson:"Dockerimage" json:"Dockerimage" mapstructure:"Dockerimage"`    // for Shock (TODO rename this !)
+	DockerPull    string     `bson:"dockerPull" json:"dockerPull" mapstructure:"dockerPull"`       // docker pull
+	DockerDigest  string     `bson:"dockerDigest" json:"dockerDigest" mapstructure:"dockerDigest"` // digest of DockerPull, resolved at submission
+	Cmd_script    []string   `bson:"cmd_script" json:"cmd_script" mapstructure:"cmd_script"`
+	Environ       Envs       `bson:"environ" json:"environ" mapstructure:"environ"`
+	HasPrivateEnv bool       `bson:"has_private_env" json:"has_private_env" mapstructure:"has_private_env"`
+	Description   string     `bson:"description" json:"description" mapstructure:"description"`
+	Resources     *Resources `bson:"resources" json:"resources" mapstructure:"resources"`
+	NetworkAccess bool       `bson:"network_access" json:"network_access" mapstructure:"network_access"` // allow the container to access the network
+	ParsedArgs    []string   `bson:"-" json:"-" mapstructure:"-"`
+	Local         bool       // indicates local execution, i.e. working directory is same as current working directory (do not delete !)
+}
+
+// Resources requested by a task, the worker applies them as limits to the container.
+// Zero values mean no limit.
+type Resources struct {
+	Cores  float64 `bson:"cores" json:"cores" mapstructure:"cores"`    // CPU quota, e.g. 1.5
+	Cpuset string  `bson:"cpuset" json:"cpuset" mapstructure:"cpuset"` // CPUs the container may run on, e.g. "0-3"
+	RamMB  int64   `bson:"ram_mb" json:"ram_mb" mapstructure:"ram_mb"`
+	SwapMB int64   `bson:"swap_mb" json:"swap_mb" mapstructure:"swap_mb"` // swap in addition to ram_mb, -1 for unlimited
+	Pids   int64   `bson:"pids" json:"pids" mapstructure:"pids"`          // max number of processes
+	TmpMB  int64   `bson:"tmp_mb" json:"tmp_mb" mapstructure:"tmp_mb"`    // size of the tmpfs mounted on /tmp
 }
 
 type Envs struct {
@@ -42,8 +42,9 @@ type StandardResponse struct {
 	Error  []string    `json:"error"`
 }
 
+// service is "server", "proxy" or "local" (in-process server of the awe-worker local runner, without MongoDB)
 func InitResMgr(service string) {
-	if service == "server" {
+	if service == "server" || service == "local" {
 		QMgr = NewServerMgr()
 	} else if service == "proxy" {
 		//QMgr = NewProxyMgr()
@@ -71,7 +72,10 @@ type CoReq struct {
 	//fromclient *Client
 	available int64
 	count     int
-	response  chan CoAck
+	prefetch  bool // worker checks out in advance, while it computes another workunit
+	// cache inventory of the client, id -> size
+	cache_index map[string]int64
+	response    chan CoAck
 }
 
 type coInfo struct {
@@ -142,6 +146,12 @@ func CreateJobUpload(u *user.User, files FormFiles) (job *Job, err error) {
 		return
 	}
 
+	err = job.PinDockerImages()
+	if err != nil {
+		err = fmt.Errorf("(CreateJobUpload) PinDockerImages returned: %s", err.Error())
+		return
+	}
+
 	err = job.Save()
 	if err != nil {
 		err = errors.New("error in job.Save(), error=" + err.Error())
@@ -272,6 +282,12 @@ func ReadJobFile(filename string) (job *Job, err error) {
 		for key, val := range task_p.Cmd.Environ.Private {
 			task.Cmd.Environ.Private[key] = val
 		}
+		// fails on values that are encrypted already, they can only be copied from another job
+		err = EncryptSecretMap(task.Cmd.Environ.Private, JobSecretContext(job.Id, SECRET_CONTEXT_ENV))
+		if err != nil {
+			err = fmt.Errorf("(ReadJobFile) %s", err.Error())
+			return
+		}
 	}
 
 	return
@@ -494,6 +510,12 @@ func NotifyWorkunitProcessedWithLogs(work *Workunit, perf *WorkPerf, sendstdlogs
 	} else {
 		// old AWE style result reporting (note that nodes had been created by the AWE server)
 		target_url = fmt.Sprintf("%s/work/%s?status=%s&client=%s&computetime=%d", conf.SERVER_URL, work_id_b64, work.State, Self.Id, work.ComputeTime)
+		if work.FailureReason != "" {
+			target_url += "&reason=" + work.FailureReason
+		}
+		if work.ExitStatus > 0 {
+			target_url += fmt.Sprintf("&exitstatus=%d", work.ExitStatus)
+		}
 	}
 	form := httpclient.NewForm()
 	hasreport := false
@@ -526,6 +548,15 @@ func NotifyWorkunitProcessedWithLogs(work *Workunit, perf *WorkPerf, sendstdlogs
 		cwl_result := work.CWL_workunit.Notice
 		cwl_result.Status = work.State
 		cwl_result.ComputeTime = work.ComputeTime
+		cwl_result.FailureReason = work.FailureReason
+		if work.ExitStatus > 0 {
+			cwl_result.ExitStatus = work.ExitStatus
+		}
+		if cwl_result.Results == nil && work.CWL_workunit.Split != nil {
+			// split, chunk and merge workunits report their outputs with the locations they
+			// were uploaded to, the server merges them into the step output (see TaskSplit)
+			cwl_result.Results = work.CWL_workunit.Outputs
+		}
 
 		var result_bytes []byte
 		result_bytes, err = json.Marshal(cwl_result)
@@ -763,6 +794,11 @@ func GetJob(id string) (job *Job, err error) {
 		return
 	}
 	if !ok {
+		if dbDisabled() {
+			// no database to load from, all jobs are in memory
+			err = fmt.Errorf("(GetJob) job %s not found", id)
+			return
+		}
 		// load job if not already in memory
 		job, err = LoadJob(id)
 		if err != nil {
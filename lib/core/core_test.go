@@ -9,8 +9,8 @@ import (
 func TestIOmap(t *testing.T) {
 	print("\nTestIOmap\n")
 	i := NewIOmap()
-	i.Add("qc.passed.fna", "http://shock.mcs.anl.gov:8000/node/fad5eabc7602b1fcebcaff518266805f", "ff3f41a91bbf135b38d0b35b1df3a42e", false)
-	i.Add("qc.failed.fna", "http://shock.mcs.anl.gov:8000/node/f361be3e7a0914f82147bc1ba68df41e", "dff5aa75f124db423cda694c16254f69", false)
+	i.Add("qc.passed.fna", "http://shock.mcs.anl.gov:8000", "fad5eabc7602b1fcebcaff518266805f", "ff3f41a91bbf135b38d0b35b1df3a42e", false)
+	i.Add("qc.failed.fna", "http://shock.mcs.anl.gov:8000", "f361be3e7a0914f82147bc1ba68df41e", "dff5aa75f124db423cda694c16254f69", false)
 	m, _ := json.Marshal(i)
 	print(string(m) + "\n")
 
@@ -33,22 +33,29 @@ func TestIOmap(t *testing.T) {
 
 func TestCommand(t *testing.T) {
 	print("\nTestCommand\n")
-	c := Command{Name: "superblat", Description: "", Options: "-p8 -o8", Template: "inputs::i1 inputs::i2 > outputs::o1"}
-	c.Substitute(nil, nil)
+	c := NewCommand("superblat")
+	c.Args = "-p8 -o8 @i1 @i2"
 	m, _ := json.Marshal(c)
 	print(string(m) + "\n")
 }
 
 func TestTask(t *testing.T) {
 	print("\nTestTask\n")
-	nt, _ := NewTask()
+	job := NewJob()
+	job.Id = "a7f4d2c0-0000-4000-8000-000000000000"
+	nt, err := NewTask(job, "", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
 	m, _ := json.Marshal(nt)
 	print(string(m) + "\n")
 }
 
 func BenchmarkTask(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		nt, _ := NewTask()
+		job := NewJob()
+		job.Id = "a7f4d2c0-0000-4000-8000-000000000000"
+		nt, _ := NewTask(job, "", "0")
 		json.Marshal(nt)
 	}
 }
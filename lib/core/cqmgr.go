@@ -15,6 +15,7 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,6 +27,9 @@ type CQMgr struct {
 	coReq        chan CoReq  //workunit checkout request (WorkController -> qmgr.Handler)
 	feedback     chan Notice //workunit execution feedback (WorkController -> qmgr.Handler)
 	coSem        chan int    //semaphore for checkout (mutual exclusion between different clients)
+	fileRelay    *FileRelay  //requests for files in retained work dirs of workers (WorkController -> heartbeat)
+	locality     *LocalityStats
+	prefetchLock sync.Mutex // prefetched workunits are started by their client or expired, not both
 }
 
 type Filter_work_stats struct {
@@ -180,8 +184,17 @@ func (qm *CQMgr) CheckClient(client *Client) (ok bool, err error) {
 				continue
 			}
 			logger.Debug(3, "(CheckClient) work.State: %s", work.State)
-			if work.State == WORK_STAT_RESERVED {
-				qm.workQueue.StatusChange(work_id, work, WORK_STAT_CHECKOUT, "")
+			// a workunit that was requeued after its prefetch expired may have been checked out by another client
+			if work.Client != client.Id {
+				logger.Warning("(CheckClient) client %s reports work %s, which is assigned to client \"%s\"", client.Id, workid_str, work.Client)
+				continue
+			}
+			if work.State == WORK_STAT_RESERVED || work.State == WORK_STAT_PREFETCHED { // prefetched workunit has been started
+				qm.prefetchLock.Lock()
+				if work.Client == client.Id && (work.State == WORK_STAT_RESERVED || work.State == WORK_STAT_PREFETCHED) {
+					qm.workQueue.StatusChange(work_id, work, WORK_STAT_CHECKOUT, "")
+				}
+				qm.prefetchLock.Unlock()
 			}
 		}
 
@@ -245,9 +258,92 @@ func (qm *CQMgr) ClientChecker() {
 			qm.DeleteClients(delete_clients)
 
 		}
+
+		xerr = qm.ExpirePrefetched()
+		if xerr != nil {
+			logger.Error("(ClientChecker) ExpirePrefetched: %s", xerr.Error())
+		}
 	}
 }
 
+// ExpirePrefetched puts prefetched workunits back into the queue that have not been started
+// within conf.PREFETCH_TIMEOUT, the worker is told to discard them with the next heartbeat.
+// A worker asks before it starts a prefetched workunit (StartPrefetchedWork), so an expired
+// workunit does not run twice.
+func (qm *CQMgr) ExpirePrefetched() (err error) {
+	qm.prefetchLock.Lock()
+	defer qm.prefetchLock.Unlock()
+
+	workunits, err := qm.workQueue.Prefetch.GetWorkunits()
+	if err != nil {
+		return
+	}
+	timeout := time.Duration(conf.PREFETCH_TIMEOUT) * time.Minute
+	for _, work := range workunits {
+		if time.Since(work.CheckoutTime) < timeout {
+			continue
+		}
+		if work.State != WORK_STAT_PREFETCHED {
+			continue
+		}
+		var work_str string
+		work_str, err = work.String()
+		if err != nil {
+			return
+		}
+		logger.Info("(ExpirePrefetched) workunit %s prefetched by client %s was not started within %d minutes, requeueing it", work_str, work.Client, conf.PREFETCH_TIMEOUT)
+		err = qm.workQueue.StatusChange(work.Workunit_Unique_Identifier, work, WORK_STAT_QUEUED, "")
+		if err != nil {
+			return
+		}
+		logger.Event(event.WORK_REQUEUE, "workid="+work_str)
+	}
+	return
+}
+
+// countPrefetched returns the number of workunits prefetched by the client and not started yet
+func (qm *CQMgr) countPrefetched(client_id string) (count int, err error) {
+	workunits, err := qm.workQueue.Prefetch.GetWorkunits()
+	if err != nil {
+		return
+	}
+	for _, work := range workunits {
+		if work.Client == client_id {
+			count++
+		}
+	}
+	return
+}
+
+// StartPrefetchedWork is called by the client before it starts a prefetched workunit, it
+// fails if the prefetch expired and the workunit was requeued in the meantime
+func (qm *CQMgr) StartPrefetchedWork(id Workunit_Unique_Identifier, clientid string) (err error) {
+	qm.prefetchLock.Lock()
+	defer qm.prefetchLock.Unlock()
+
+	work, ok, err := qm.workQueue.all.Get(id)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = fmt.Errorf("(StartPrefetchedWork) workunit not found")
+		return
+	}
+	if work.Client != clientid {
+		err = fmt.Errorf("(StartPrefetchedWork) workunit is not assigned to client %s", clientid)
+		return
+	}
+	switch work.State {
+	case WORK_STAT_CHECKOUT:
+		// reported as current work by a heartbeat already
+	case WORK_STAT_RESERVED, WORK_STAT_PREFETCHED:
+		err = qm.workQueue.StatusChange(id, work, WORK_STAT_CHECKOUT, "")
+	default:
+		err = fmt.Errorf("(StartPrefetchedWork) workunit is in state %s", work.State)
+	}
+	return
+}
+
 func (qm *CQMgr) DeleteClients(delete_clients []string) {
 
 	for _, client_id := range delete_clients {
@@ -283,6 +379,7 @@ func (qm *CQMgr) ClientHeartBeat(id string, cg *ClientGroup, workerstate WorkerS
 	client.Set_Online(true, false)
 
 	workerstate.Current_work.FillMap() // fix struct by moving values from Data array into internal map (was not exported)
+	workerstate.Prefetched_work.FillMap()
 
 	client.WorkerState = workerstate // TODO could do a comparsion with assigned state here
 
@@ -294,9 +391,13 @@ func (qm *CQMgr) ClientHeartBeat(id string, cg *ClientGroup, workerstate WorkerS
 	current_work, xerr := client.Current_work.Get_list(false)
 	suspended := []string{}
 
+	if xerr != nil {
+		err = xerr
+		return
+	}
 	for _, work_id := range current_work {
 		work, ok, zerr := qm.workQueue.all.Get(work_id)
-		if err != nil {
+		if zerr != nil {
 			err = zerr
 			return
 		}
@@ -309,6 +410,26 @@ func (qm *CQMgr) ClientHeartBeat(id string, cg *ClientGroup, workerstate WorkerS
 		}
 
 	}
+
+	// prefetched workunits that expired (requeued or checked out by another client) are discarded too
+	prefetched_work, xerr := client.Prefetched_work.Get_list(false)
+	if xerr != nil {
+		err = xerr
+		return
+	}
+	for _, work_id := range prefetched_work {
+		work, ok, zerr := qm.workQueue.all.Get(work_id)
+		if zerr != nil {
+			err = zerr
+			return
+		}
+		if !ok {
+			continue
+		}
+		if work.Client != id || (work.State != WORK_STAT_PREFETCHED && work.State != WORK_STAT_RESERVED && work.State != WORK_STAT_CHECKOUT) {
+			suspended = append(suspended, work.Id)
+		}
+	}
 	if len(suspended) > 0 {
 		hbmsg["discard"] = strings.Join(suspended, ",")
 	}
@@ -316,6 +437,21 @@ func (qm *CQMgr) ClientHeartBeat(id string, cg *ClientGroup, workerstate WorkerS
 	//	hbmsg["stop"] = id
 	//}
 
+	// requests for files in retained work directories
+	file_requests, xerr := qm.fileRelay.Pending(id)
+	if xerr != nil {
+		err = xerr
+		return
+	}
+	if len(file_requests) > 0 {
+		file_requests_b, xerr := json.Marshal(file_requests)
+		if xerr != nil {
+			err = xerr
+			return
+		}
+		hbmsg["files"] = string(file_requests_b)
+	}
+
 	hbmsg["server-uuid"] = Server_UUID
 
 	return
@@ -385,6 +521,7 @@ func (qm *CQMgr) RegisterNewClient(files FormFiles, cg *ClientGroup) (client *Cl
 	if old_client_exists {
 		// copy values from new client to old client
 		old_client.Current_work = client.Current_work
+		old_client.Prefetched_work = client.Prefetched_work
 
 		old_client.Tag = true
 		// new client struct will be deleted afterwards
@@ -781,7 +918,8 @@ func (qm *CQMgr) UpdateSubClientsByUser(id string, count int, u *user.User) {
 
 //-------start of workunit methods---
 
-func (qm *CQMgr) CheckoutWorkunits(req_policy string, client_id string, client *Client, available_bytes int64, num int) (workunits []*Workunit, err error) {
+// with prefetch the client may have work, up to conf.MAX_PREFETCH workunits are reserved for it in advance
+func (qm *CQMgr) CheckoutWorkunits(req_policy string, client_id string, client *Client, available_bytes int64, num int, prefetch bool) (workunits []*Workunit, err error) {
 
 	logger.Debug(3, "run CheckoutWorkunits for client %s", client_id)
 
@@ -802,9 +940,23 @@ func (qm *CQMgr) CheckoutWorkunits(req_policy string, client_id string, client *
 	response_channel := client.coAckChannel
 
 	work_length, _ := client.Current_work.Length(false)
+	// popWorks runs while this request holds the read lock of the client, it cannot lock the
+	// client again to read the cache inventory
+	cache_index := client.CacheIndex()
 	client.Unlock()
 
-	if work_length > 0 {
+	if prefetch {
+		// the list of the last heartbeat misses workunits prefetched since then
+		prefetch_length, xerr := qm.countPrefetched(client_id)
+		if xerr != nil {
+			err = xerr
+			return
+		}
+		if prefetch_length >= conf.MAX_PREFETCH {
+			logger.Debug(3, "Client %s wants to prefetch work, but already has %d prefetched workunits (max_prefetch=%d)", client_id, prefetch_length, conf.MAX_PREFETCH)
+			return nil, errors.New(e.ClientBusy)
+		}
+	} else if work_length > 0 {
 		logger.Error("Client %s wants to checkout work, but still has work: work_length=%d", client_id, work_length)
 		return nil, errors.New(e.ClientBusy)
 	}
@@ -825,7 +977,7 @@ func (qm *CQMgr) CheckoutWorkunits(req_policy string, client_id string, client *
 	//}
 
 	//req := CoReq{policy: req_policy, fromclient: client_id, available: available_bytes, count: num, response: client.coAckChannel}
-	req := CoReq{policy: req_policy, fromclient: client_id, available: available_bytes, count: num, response: response_channel}
+	req := CoReq{policy: req_policy, fromclient: client_id, available: available_bytes, count: num, prefetch: prefetch, cache_index: cache_index, response: response_channel}
 
 	logger.Debug(3, "(CheckoutWorkunits) %s qm.coReq <- req", client_id)
 	// request workunit
@@ -908,6 +1060,62 @@ func (qm *CQMgr) GetWorkById(id Workunit_Unique_Identifier) (workunit *Workunit,
 	return
 }
 
+// FindRetainedWork returns the client that keeps the work directory of a failed workunit
+func (qm *CQMgr) FindRetainedWork(id Workunit_Unique_Identifier) (client_id string, ok bool, err error) {
+	work_str, err := id.String()
+	if err != nil {
+		err = fmt.Errorf("(FindRetainedWork) id.String() returned: %s", err.Error())
+		return
+	}
+	clients, err := qm.clientMap.GetClients()
+	if err != nil {
+		return
+	}
+	var newest time.Time
+	for _, client := range clients {
+		read_lock, xerr := client.RLockNamed("FindRetainedWork")
+		if xerr != nil {
+			err = xerr
+			return
+		}
+		// a workunit may have failed on several clients, use the latest attempt
+		for _, retained := range client.Retained_work {
+			if retained.WorkId == work_str && (!ok || retained.Retained.After(newest)) {
+				client_id = client.Id
+				newest = retained.Retained
+				ok = true
+			}
+		}
+		client.RUnlockNamed(read_lock)
+	}
+	return
+}
+
+// RequestWorkFile relays a request for a file (or the listing if path is empty) to the client
+// that retained the work directory of the workunit
+func (qm *CQMgr) RequestWorkFile(id Workunit_Unique_Identifier, path string) (response *FileRelayResponse, err error) {
+	client_id, ok, err := qm.FindRetainedWork(id)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = errors.New("no client retained the work directory of this workunit")
+		return
+	}
+	work_str, err := id.String()
+	if err != nil {
+		return
+	}
+	response, err = qm.fileRelay.Request(client_id, work_str, path)
+	return
+}
+
+// DeliverWorkFile passes a file uploaded by the client to the waiting request
+func (qm *CQMgr) DeliverWorkFile(request_id string, client_id string, response *FileRelayResponse) (err error) {
+	err = qm.fileRelay.Deliver(request_id, client_id, response)
+	return
+}
+
 func (qm *CQMgr) NotifyWorkStatus(notice Notice) {
 	qm.feedback <- notice
 	return
@@ -951,17 +1159,27 @@ func (qm *CQMgr) popWorks(req CoReq) (client_specific_workunits []*Workunit, err
 
 		return
 	}
-	client_specific_workunits, err = qm.workQueue.selectWorkunits(filtered, req.policy, req.available, req.count)
+	cache_index := req.cache_index
+	client_specific_workunits, err = qm.workQueue.selectWorkunits(filtered, req.policy, req.available, req.count, cache_index)
 	if err != nil {
 		err = fmt.Errorf("(popWorks) selectWorkunits returned: %s", err.Error())
 		return
 	}
+	for _, work := range client_specific_workunits {
+		local, total := work.Locality(cache_index)
+		logger.Debug(3, "(popWorks) workunit %s: %d of %d input bytes cached on client %s", work.Id, local, total, client_id)
+		qm.locality.Record(local, total)
+	}
 	//get workunits successfully, put them into coWorkMap
+	new_state := WORK_STAT_CHECKOUT
+	if req.prefetch {
+		new_state = WORK_STAT_PREFETCHED // not running yet, see ExpirePrefetched
+	}
 	for _, work := range client_specific_workunits {
 		work.Client = client_id
 		work.CheckoutTime = time.Now()
 		//qm.workQueue.Put(work) TODO isn't that already in the queue ?
-		qm.workQueue.StatusChange(work.Workunit_Unique_Identifier, work, WORK_STAT_CHECKOUT, "")
+		qm.workQueue.StatusChange(work.Workunit_Unique_Identifier, work, new_state, "")
 	}
 
 	logger.Debug(3, "(popWorks) done with client: %s ", client_id)
@@ -1101,6 +1319,63 @@ func (qm *CQMgr) ShowWorkunitsByUser(status string, u *user.User) (workunits []*
 	return workunits
 }
 
+// WorkunitsPage returns up to limit queued workunits after the cursor that match the filter,
+// next is nil on the last page. Only workunits of the jobs selected by job_q (e.g. the jobs a
+// user can read) are returned. The filter clauses on job fields are part of that job query,
+// the other clauses are matched while walking the queue, only the page is kept and sorted.
+func (qm *CQMgr) WorkunitsPage(job_q bson.M, status string, filter Filter, limit int, cursor *Cursor) (page []*Workunit, next *Cursor, err error) {
+	workunit_list, err := qm.workQueue.GetAll()
+	if err != nil {
+		return
+	}
+	job_filter, work_filter := filter.JobClauses()
+
+	candidates := []*Workunit{}
+	job_ids := map[string]bool{}
+	for _, work := range workunit_list {
+		if status != "" && work.State != status {
+			continue
+		}
+		if !cursor.After(work.Id, work.ListValue(cursor.Order)) || !work_filter.Match(work.ListValue) {
+			continue
+		}
+		candidates = append(candidates, work)
+		job_ids[work.JobId] = true
+	}
+
+	if len(job_q) > 0 || len(job_filter) > 0 {
+		if job_q == nil {
+			job_q = bson.M{}
+		}
+		ids := []string{}
+		for id := range job_ids {
+			ids = append(ids, id)
+		}
+		AddQuery(job_q, bson.M{"id": bson.M{"$in": ids}})
+		AddQuery(job_q, job_filter.Bson()...)
+		var selected []string
+		selected, err = dbFindJobIds(job_q)
+		if err != nil {
+			err = fmt.Errorf("(WorkunitsPage) %s", err.Error())
+			return
+		}
+		job_ids = map[string]bool{}
+		for _, id := range selected {
+			job_ids[id] = true
+		}
+		matching := candidates[:0]
+		for _, work := range candidates {
+			if job_ids[work.JobId] {
+				matching = append(matching, work)
+			}
+		}
+		candidates = matching
+	}
+
+	page, next = WorkunitsPage(candidates, nil, limit, cursor)
+	return
+}
+
 func (qm *CQMgr) EnqueueWorkunit(work *Workunit) (err error) {
 	err = qm.workQueue.Add(work)
 	return
@@ -1112,6 +1387,11 @@ func (qm *CQMgr) ReQueueWorkunitByClient(client *Client, client_write_lock bool)
 	if err != nil {
 		return
 	}
+	prefetched_list, err := client.Prefetched_work.Get_list(client_write_lock)
+	if err != nil {
+		return
+	}
+	worklist = append(worklist, prefetched_list...)
 	for _, workid := range worklist {
 		logger.Debug(3, "(ReQueueWorkunitByClient) try to requeue work %s", workid)
 		work, has_work, xerr := qm.workQueue.Get(workid)
@@ -0,0 +1,25 @@
+package cwl
+
+import (
+	"github.com/mitchellh/mapstructure"
+)
+
+// https://www.commonwl.org/v1.1/CommandLineTool.html#NetworkAccess
+// cwl-runner starts tool containers without network unless this requirement allows it
+type NetworkAccess struct {
+	BaseRequirement `bson:",inline" yaml:",inline" json:",inline" mapstructure:",squash"`
+	NetworkAccess   interface{} `yaml:"networkAccess" bson:"networkAccess" json:"networkAccess" mapstructure:"networkAccess"` // boolean or Expression
+}
+
+func (c NetworkAccess) GetId() string { return "None" }
+
+func NewNetworkAccess(original interface{}) (r *NetworkAccess, err error) {
+
+	var requirement NetworkAccess
+	r = &requirement
+	err = mapstructure.Decode(original, &requirement)
+
+	requirement.Class = "NetworkAccess"
+
+	return
+}
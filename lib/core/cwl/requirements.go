@@ -104,6 +104,27 @@ func NewRequirement(class string, obj interface{}) (r Requirement, schemata []CW
 		}
 		return
 
+	case "NetworkAccess":
+		r, err = NewNetworkAccess(obj)
+		if err != nil {
+			err = fmt.Errorf("(NewRequirement) NewNetworkAccess returns: %s", err.Error())
+			return
+		}
+		return
+	case "SplitRequirement":
+		r, err = NewSplitRequirement(obj)
+		if err != nil {
+			err = fmt.Errorf("(NewRequirement) NewSplitRequirement returns: %s", err.Error())
+			return
+		}
+		return
+	case SECRETS_CLASS, SECRETS_CLASS_FULL:
+		r, err = NewSecretsRequirement(obj)
+		if err != nil {
+			err = fmt.Errorf("(NewRequirement) NewSecretsRequirement returns: %s", err.Error())
+			return
+		}
+		return
 	case "SubworkflowFeatureRequirement":
 		this_r := DummyRequirement{}
 		this_r.Class = "SubworkflowFeatureRequirement"
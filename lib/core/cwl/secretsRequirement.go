@@ -0,0 +1,108 @@
+package cwl
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// https://cwltool.readthedocs.io/en/latest/#secrets
+// lists the string inputs that contain passwords, API keys and the like. AWE stores them
+// encrypted and the worker receives them only at execution time via the private env channel.
+type SecretsRequirement struct {
+	BaseRequirement `bson:",inline" yaml:",inline" json:",inline" mapstructure:",squash"`
+	Secrets         []string `yaml:"secrets" bson:"secrets" json:"secrets" mapstructure:"secrets"` // input ids
+}
+
+const (
+	SECRETS_CLASS      = "cwltool:Secrets"
+	SECRETS_CLASS_FULL = "http://commonwl.org/cwltool#Secrets"
+)
+
+// encrypted values look like "enc:v1:<key id>:<base64 nonce+ciphertext>", anything else is plain text
+const SECRET_PREFIX = "enc:v1:"
+
+// encrypted strings are replaced with this in all JSON documents
+const SECRET_REDACTED = "(secret)"
+
+func (s SecretsRequirement) GetId() string { return "None" }
+
+func NewSecretsRequirement(original interface{}) (r *SecretsRequirement, err error) {
+
+	var requirement SecretsRequirement
+	r = &requirement
+	err = mapstructure.Decode(original, &requirement)
+	if err != nil {
+		err = fmt.Errorf("(NewSecretsRequirement) mapstructure.Decode returned: %s", err.Error())
+		return
+	}
+
+	requirement.Class = SECRETS_CLASS
+
+	if len(requirement.Secrets) == 0 {
+		err = fmt.Errorf("(NewSecretsRequirement) secrets is empty")
+		return
+	}
+
+	return
+}
+
+func IsSecretsClass(class string) bool {
+	return class == SECRETS_CLASS || class == SECRETS_CLASS_FULL
+}
+
+// IsSecretValue tells if the string has been encrypted by the server
+func IsSecretValue(value string) bool {
+	return strings.HasPrefix(value, SECRET_PREFIX)
+}
+
+// GetSecretInputs returns the base names of all inputs listed in Secrets hints, hints may
+// be parsed requirements or plain maps (workflow hints and documents read from the database)
+func GetSecretInputs(hints []interface{}) (input_ids []string, err error) {
+
+	for _, hint := range hints {
+
+		var secrets_requirement *SecretsRequirement
+
+		switch hint.(type) {
+		case *SecretsRequirement:
+			secrets_requirement = hint.(*SecretsRequirement)
+		case Requirement:
+			continue
+		default:
+			var class string
+			class, err = GetClass(hint)
+			if err != nil {
+				err = fmt.Errorf("(GetSecretInputs) GetClass returned: %s (type: %s)", err.Error(), reflect.TypeOf(hint))
+				return
+			}
+			if !IsSecretsClass(class) {
+				continue
+			}
+			secrets_requirement, err = NewSecretsRequirement(hint)
+			if err != nil {
+				err = fmt.Errorf("(GetSecretInputs) %s", err.Error())
+				return
+			}
+		}
+
+		for _, secret := range secrets_requirement.Secrets {
+			input_ids = append(input_ids, path.Base(secret))
+		}
+	}
+
+	return
+}
+
+// GetSecretInputsOfRequirements is GetSecretInputs for tool hints
+func GetSecretInputsOfRequirements(hints []Requirement) (input_ids []string, err error) {
+	hints_generic := make([]interface{}, len(hints))
+	for i := range hints {
+		hints_generic[i] = hints[i]
+	}
+	input_ids, err = GetSecretInputs(hints_generic)
+	return
+}
@@ -0,0 +1,120 @@
+package cwl
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// SplitRequirement is an AWE-specific hint on a workflow step. The worker splits the input
+// into chunks of whole records (by record count or by size) and the step runs once per chunk.
+// Chunk outputs are merged in chunk order, Files are concatenated and all other types are
+// collected into an array, unless Merge says otherwise for an output.
+type SplitRequirement struct {
+	BaseRequirement `bson:",inline" yaml:",inline" json:",inline" mapstructure:",squash"`
+	Input           string            `yaml:"input" bson:"input" json:"input" mapstructure:"input"`                                         // id of the step input to split, must be a File
+	Format          string            `yaml:"format" bson:"format" json:"format" mapstructure:"format"`                                     // fasta, fastq or lines
+	Records         int               `yaml:"records,omitempty" bson:"records,omitempty" json:"records,omitempty" mapstructure:"records"`   // records per chunk
+	SizeMB          int               `yaml:"size_mb,omitempty" bson:"size_mb,omitempty" json:"size_mb,omitempty" mapstructure:"size_mb"`   // approximate chunk size, chunks end at a record boundary
+	Merge           map[string]string `yaml:"merge,omitempty" bson:"merge,omitempty" json:"merge,omitempty" mapstructure:"merge,omitempty"` // output id -> concatenate or array
+}
+
+const (
+	SPLIT_FORMAT_FASTA = "fasta"
+	SPLIT_FORMAT_FASTQ = "fastq"
+	SPLIT_FORMAT_LINES = "lines"
+
+	SPLIT_MERGE_CONCATENATE = "concatenate"
+	SPLIT_MERGE_ARRAY       = "array"
+)
+
+func (s SplitRequirement) GetId() string { return "None" }
+
+func NewSplitRequirement(original interface{}) (r *SplitRequirement, err error) {
+
+	var requirement SplitRequirement
+	r = &requirement
+	err = mapstructure.Decode(original, &requirement)
+	if err != nil {
+		err = fmt.Errorf("(NewSplitRequirement) mapstructure.Decode returned: %s", err.Error())
+		return
+	}
+
+	requirement.Class = "SplitRequirement"
+
+	err = requirement.Validate()
+	if err != nil {
+		err = fmt.Errorf("(NewSplitRequirement) %s", err.Error())
+		return
+	}
+
+	return
+}
+
+func (s *SplitRequirement) Validate() (err error) {
+	if s.Input == "" {
+		err = fmt.Errorf("input is missing")
+		return
+	}
+
+	switch s.Format {
+	case SPLIT_FORMAT_FASTA, SPLIT_FORMAT_FASTQ, SPLIT_FORMAT_LINES:
+	default:
+		err = fmt.Errorf("format %s not supported, use %s, %s or %s", s.Format, SPLIT_FORMAT_FASTA, SPLIT_FORMAT_FASTQ, SPLIT_FORMAT_LINES)
+		return
+	}
+
+	if s.Records < 0 || s.SizeMB < 0 {
+		err = fmt.Errorf("records and size_mb must not be negative")
+		return
+	}
+	if (s.Records > 0) == (s.SizeMB > 0) {
+		err = fmt.Errorf("exactly one of records and size_mb has to be set")
+		return
+	}
+
+	for output, mode := range s.Merge {
+		if mode != SPLIT_MERGE_CONCATENATE && mode != SPLIT_MERGE_ARRAY {
+			err = fmt.Errorf("merge mode %s for output %s not supported, use %s or %s", mode, output, SPLIT_MERGE_CONCATENATE, SPLIT_MERGE_ARRAY)
+			return
+		}
+	}
+
+	return
+}
+
+// GetSplitRequirement searches the hints of a workflow step, split_requirement is nil if there is none
+func GetSplitRequirement(step *WorkflowStep) (split_requirement *SplitRequirement, err error) {
+
+	for _, hint := range step.Hints {
+
+		switch hint.(type) {
+		case *SplitRequirement:
+			split_requirement = hint.(*SplitRequirement)
+			return
+		case Requirement:
+			continue
+		}
+
+		// hints read back from the database are plain maps
+		var class string
+		class, err = GetClass(hint)
+		if err != nil {
+			err = fmt.Errorf("(GetSplitRequirement) GetClass returned: %s (type: %s)", err.Error(), reflect.TypeOf(hint))
+			return
+		}
+		if class != "SplitRequirement" {
+			continue
+		}
+
+		split_requirement, err = NewSplitRequirement(hint)
+		if err != nil {
+			err = fmt.Errorf("(GetSplitRequirement) %s", err.Error())
+			return
+		}
+		return
+	}
+
+	return
+}
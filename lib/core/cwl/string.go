@@ -1,6 +1,7 @@
 package cwl
 
 import (
+	"encoding/json"
 	"fmt"
 	//"github.com/mitchellh/mapstructure"
 )
@@ -46,3 +47,22 @@ func NewStringFromInterface(native interface{}) (s *String, err error) {
 
 	return
 }
+
+// encrypted secrets are only stored in the database, documents sent to users and workers get SECRET_REDACTED
+func (s *String) MarshalJSON() (b []byte, err error) {
+	if IsSecretValue(string(*s)) {
+		b, err = json.Marshal(SECRET_REDACTED)
+		return
+	}
+	b, err = json.Marshal(string(*s))
+	return
+}
+
+func (s *String) MarshalYAML() (i interface{}, err error) {
+	if IsSecretValue(string(*s)) {
+		i = SECRET_REDACTED
+		return
+	}
+	i = string(*s)
+	return
+}
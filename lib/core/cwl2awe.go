@@ -3,6 +3,7 @@ package core
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"reflect"
 
 	"github.com/MG-RAST/AWE/lib/acl"
@@ -128,7 +129,7 @@ func CWL_input_check(job_input *cwl.Job_document, cwl_workflow *cwl.Workflow) (e
 	return
 }
 
-func CreateTasks(job *Job, workflow string, steps []cwl.WorkflowStep) (tasks []*Task, err error) {
+func CreateTasks(job *Job, collection *cwl.CWL_collection, workflow string, steps []cwl.WorkflowStep) (tasks []*Task, err error) {
 	tasks = []*Task{}
 
 	for s, _ := range steps {
@@ -165,6 +166,7 @@ func CreateTasks(job *Job, workflow string, steps []cwl.WorkflowStep) (tasks []*
 		}
 
 		awe_task.WorkflowStep = &step
+		setCWLTaskResources(awe_task.Cmd, &step, collection)
 		//spew.Dump(step)
 		tasks = append(tasks, awe_task)
 
@@ -172,6 +174,69 @@ func CreateTasks(job *Job, workflow string, steps []cwl.WorkflowStep) (tasks []*
 	return
 }
 
+// setCWLTaskResources copies the ResourceRequirement and NetworkAccess of the tool a step runs
+// into the command of the task. Requirements of the tool take precedence over those of the step,
+// and requirements over hints, as in the CWL specification.
+func setCWLTaskResources(cmd *Command, step *cwl.WorkflowStep, collection *cwl.CWL_collection) {
+	var requirements []interface{}
+	requirements = append(requirements, step.Hints...)
+
+	var clt *cwl.CommandLineTool
+	switch run := step.Run.(type) {
+	case string:
+		if collection != nil {
+			clt, _ = collection.GetCommandLineTool(run)
+		}
+	case *cwl.CommandLineTool:
+		clt = run
+	}
+	if clt != nil {
+		for _, r := range clt.Hints {
+			requirements = append(requirements, r)
+		}
+	}
+	requirements = append(requirements, step.Requirements...)
+	if clt != nil && clt.Requirements != nil {
+		for _, r := range *clt.Requirements {
+			requirements = append(requirements, r)
+		}
+	}
+
+	for _, r := range requirements {
+		switch req := r.(type) {
+		case cwl.ResourceRequirement:
+			cmd.Resources = cwlResources(&req)
+		case *cwl.ResourceRequirement:
+			cmd.Resources = cwlResources(req)
+		case cwl.NetworkAccess:
+			cmd.NetworkAccess = cwlNetworkAccess(&req)
+		case *cwl.NetworkAccess:
+			cmd.NetworkAccess = cwlNetworkAccess(req)
+		}
+	}
+	return
+}
+
+// cwlResources uses the maximum of a range as limit and the minimum if there is no maximum
+func cwlResources(req *cwl.ResourceRequirement) (res *Resources) {
+	res = &Resources{}
+	res.Cores = float64(req.CoresMin)
+	if req.CoresMax > 0 {
+		res.Cores = float64(req.CoresMax)
+	}
+	res.RamMB = int64(req.RamMin) // CWL uses mebibytes
+	if req.RamMax > 0 {
+		res.RamMB = int64(req.RamMax)
+	}
+	return
+}
+
+// cwlNetworkAccess is false for expressions, cwl-runner evaluates them and enforces the requirement itself
+func cwlNetworkAccess(req *cwl.NetworkAccess) bool {
+	allowed, ok := req.NetworkAccess.(bool)
+	return ok && allowed
+}
+
 func CWL2AWE(_user *user.User, files FormFiles, job_input *cwl.Job_document, cwl_workflow *cwl.Workflow, collection *cwl.CWL_collection) (job *Job, err error) {
 
 	//CommandLineTools := collection.CommandLineTools
@@ -179,17 +244,40 @@ func CWL2AWE(_user *user.User, files FormFiles, job_input *cwl.Job_document, cwl
 	// check that all expected workflow inputs exist and that they have the correct type
 	logger.Debug(1, "CWL2AWE starting")
 
+	//os.Exit(0)
+	job = NewJob()
+	job.setId()
+	//job.CWL_workflow = cwl_workflow
+
+	// encrypted values can only be copied from another job
+	err = RejectEncryptedInputs(job_input)
+	if err != nil {
+		err = fmt.Errorf("(CWL2AWE) %s", err.Error())
+		return
+	}
+
+	// inputs listed in a Secrets hint are only stored encrypted
+	secret_inputs, err := cwl.GetSecretInputs(cwl_workflow.Hints)
+	if err != nil {
+		err = fmt.Errorf("(CWL2AWE) GetSecretInputs returned: %s", err.Error())
+		return
+	}
+	secret_values, err := EncryptSecretInputs(job_input, secret_inputs, job.Id)
+	if err != nil {
+		err = fmt.Errorf("(CWL2AWE) EncryptSecretInputs returned: %s", err.Error())
+		return
+	}
+	for _, value := range secret_values {
+		logger.AddRedaction(value)
+		defer logger.RemoveRedaction(value)
+	}
+
 	err = CWL_input_check(job_input, cwl_workflow)
 	if err != nil {
 		err = fmt.Errorf("(CWL2AWE) CWL_input_check returned: %s", err.Error())
 		return
 	}
 
-	//os.Exit(0)
-	job = NewJob()
-	job.setId()
-	//job.CWL_workflow = cwl_workflow
-
 	logger.Debug(1, "Job created")
 
 	found_ShockRequirement := false
@@ -215,7 +303,7 @@ func CWL2AWE(_user *user.User, files FormFiles, job_input *cwl.Job_document, cwl
 		}
 	}
 
-	if !found_ShockRequirement {
+	if !found_ShockRequirement && Service != "local" { // the local runner does not use Shock
 		err = fmt.Errorf("ShockRequirement has to be provided in the workflow object")
 		return
 		//job.ShockHost = "http://shock:7445" // TODO make this different
@@ -239,7 +327,7 @@ func CWL2AWE(_user *user.User, files FormFiles, job_input *cwl.Job_document, cwl
 	//}
 
 	var tasks []*Task
-	tasks, err = CreateTasks(job, "", cwl_workflow.Steps)
+	tasks, err = CreateTasks(job, collection, "", cwl_workflow.Steps)
 	if err != nil {
 		return
 	}
@@ -277,3 +365,375 @@ func CWL2AWE(_user *user.User, files FormFiles, job_input *cwl.Job_document, cwl
 	return
 
 }
+
+// CreateJobCWL creates a job from a CWL document and a job input document. The CWL document
+// is either a workflow or a single CommandLineTool/ExpressionTool that is wrapped into a workflow.
+func CreateJobCWL(_user *user.User, files FormFiles, cwl_file FormFile, job_file FormFile) (job *Job, err error) {
+
+	job_stream, err := ioutil.ReadFile(job_file.Path)
+	if err != nil {
+		err = errors.New("error in reading job yaml/json file: " + err.Error())
+		return
+	}
+
+	job_input, err := cwl.ParseJob(&job_stream)
+	if err != nil {
+		logger.Error("ParseJob: " + err.Error())
+		err = errors.New("error in reading job yaml/json file: " + err.Error())
+		return
+	}
+
+	job, err = CreateJobCWLFromInput(_user, files, cwl_file, job_file.Name, job_input)
+	return
+}
+
+// CreateJobCWLFromInput is CreateJobCWL with an already parsed job input document
+func CreateJobCWLFromInput(_user *user.User, files FormFiles, cwl_file FormFile, job_name string, job_input *cwl.Job_document) (job *Job, err error) {
+
+	workflow_filename := cwl_file.Name
+
+	collection := cwl.NewCWL_collection()
+
+	logger.Debug(1, "got CWL")
+
+	// get CWL as byte[]
+	yamlstream, err := ioutil.ReadFile(cwl_file.Path)
+	if err != nil {
+		logger.Error("CWL error: " + err.Error())
+		err = errors.New("error in reading workflow file: " + err.Error())
+		return
+	}
+
+	// convert CWL to string
+	yaml_str := string(yamlstream[:])
+
+	var schemata []cwl.CWLType_Type
+	object_array, cwl_version, schemata, err := cwl.Parse_cwl_document(yaml_str)
+	if err != nil {
+		err = errors.New("error in parsing cwl workflow yaml file: " + err.Error())
+		return
+	}
+
+	err = collection.AddArray(object_array)
+	if err != nil {
+		logger.Error("Parse_cwl_document error: " + err.Error())
+		err = errors.New("error in adding cwl objects to collection: " + err.Error())
+		return
+	}
+	logger.Debug(1, "Parse_cwl_document done")
+
+	err = collection.AddSchemata(schemata)
+	if err != nil {
+		err = errors.New("error in adding schemata: " + err.Error())
+		return
+	}
+
+	entrypoint := ""
+
+	var cwl_workflow *cwl.Workflow
+	if len(collection.Workflows) == 0 {
+		if len(object_array) != 1 {
+			err = fmt.Errorf("Expected exactly one element in object_array, got %d", len(collection.Workflows))
+			return
+		}
+		// This probably is a CommandlineTool or ExpressionTool submission (without workflow)
+		// create new Workflow to wrap around the CommandLineTool/ExpressionTool
+		entrypoint = "#entrypoint"
+
+		pair := object_array[0]
+
+		runner := pair.Value
+
+		switch runner.(type) {
+
+		case *cwl.CommandLineTool:
+			commandlinetool_if := pair.Value
+
+			commandlinetool, ok := commandlinetool_if.(*cwl.CommandLineTool)
+			if !ok {
+
+				err = fmt.Errorf("(CreateJobCWLFromInput) Error casting CommandLineTool (type: %s)", reflect.TypeOf(commandlinetool_if))
+				return
+			}
+
+			cwl_workflow_instance := cwl.NewWorkflowEmpty()
+			cwl_workflow = &cwl_workflow_instance
+			cwl_workflow.Id = entrypoint
+			new_step := cwl.WorkflowStep{}
+			step_id := entrypoint + "/wrapper_step"
+			new_step.Id = step_id
+			for _, input := range commandlinetool.Inputs { // input is CommandInputParameter
+
+				workflow_input_name := entrypoint + "/" + path.Base(input.Id)
+
+				var workflow_step_input cwl.WorkflowStepInput
+				workflow_step_input.Id = step_id + "/" + input.Id
+				workflow_step_input.Source = workflow_input_name
+				workflow_step_input.Default = input.Default
+
+				//fmt.Println("CommandInputParameter and WorkflowStepInput:")
+				//spew.Dump(input)
+				//spew.Dump(workflow_step_input)
+				new_step.In = append(new_step.In, workflow_step_input)
+
+				var workflow_input_parameter cwl.InputParameter
+				workflow_input_parameter.Id = workflow_input_name
+				workflow_input_parameter.SecondaryFiles = input.SecondaryFiles
+				workflow_input_parameter.Format = input.Format
+				workflow_input_parameter.Streamable = input.Streamable
+				workflow_input_parameter.InputBinding = input.InputBinding
+				workflow_input_parameter.Type = input.Type
+
+				workflow_input_parameter.Default = input.Default
+
+				add_null := false
+				if input.Default != nil { // check if this is an optional argument
+					add_null = true
+				}
+
+				if add_null {
+					has_null := false
+					for _, t := range workflow_input_parameter.Type {
+						if t == cwl.CWL_null {
+							has_null = true
+							break
+						}
+					}
+					if !has_null {
+						workflow_input_parameter.Type = append(workflow_input_parameter.Type, cwl.CWL_null)
+					}
+				}
+
+				cwl_workflow.Inputs = append(cwl_workflow.Inputs, workflow_input_parameter)
+			}
+
+			for _, output := range commandlinetool.Outputs {
+				var workflow_step_output cwl.WorkflowStepOutput
+				workflow_step_output.Id = step_id + "/" + strings.TrimPrefix(output.Id, "#")
+
+				new_step.Out = append(new_step.Out, workflow_step_output)
+
+				var workflow_output_parameter cwl.WorkflowOutputParameter
+
+				workflow_output_parameter.Id = entrypoint + "/" + path.Base(output.Id)
+				workflow_output_parameter.OutputSource = step_id + "/" + path.Base(output.Id)
+				workflow_output_parameter.SecondaryFiles = output.SecondaryFiles
+				workflow_output_parameter.Format = output.Format
+				workflow_output_parameter.Streamable = output.Streamable
+				//workflow_output_parameter.OutputBinding = output.OutputBinding
+				//workflow_output_parameter.OutputSource = output.OutputSource
+				//workflow_output_parameter.LinkMerge = output.LinkMerge
+				workflow_output_parameter.Type = output.Type
+				cwl_workflow.Outputs = append(cwl_workflow.Outputs, workflow_output_parameter)
+			}
+
+			if commandlinetool.Requirements != nil {
+				requirements := commandlinetool.Requirements
+				for i, _ := range *requirements {
+					require_type := (*requirements)[i].GetClass()
+					if require_type == "ShockRequirement" {
+						shock_requirement := (*requirements)[i]
+
+						cwl_workflow.Requirements, err = cwl.AddRequirement(shock_requirement, requirements)
+						if err != nil {
+							err = fmt.Errorf("(CreateJobCWLFromInput) AddRequirement returned: %s", err.Error())
+							return
+						}
+					}
+				}
+			}
+
+			// the Secrets hint of the tool refers to the inputs of the wrapper workflow as well
+			for _, hint := range commandlinetool.Hints {
+				if cwl.IsSecretsClass(hint.GetClass()) {
+					cwl_workflow.Hints = append(cwl_workflow.Hints, hint)
+				}
+			}
+
+			new_step.Run = commandlinetool.Id
+
+			cwl_workflow.Steps = []cwl.WorkflowStep{new_step}
+
+			cwl_workflow_named := cwl.Named_CWL_object{}
+			cwl_workflow_named.Id = cwl_workflow.Id
+			cwl_workflow_named.Value = cwl_workflow
+
+			object_array = append(object_array, cwl_workflow_named)
+			err = collection.Add(entrypoint, cwl_workflow)
+			if err != nil {
+				err = errors.New("collection.Add returned: " + err.Error())
+				return
+			}
+
+		case *cwl.ExpressionTool:
+			expressiontool_if := pair.Value
+
+			expressiontool, ok := expressiontool_if.(*cwl.ExpressionTool)
+			if !ok {
+
+				err = fmt.Errorf("(CreateJobCWLFromInput) Error casting ExpressionTool (type: %s)", reflect.TypeOf(expressiontool_if))
+				return
+			}
+
+			cwl_workflow_instance := cwl.NewWorkflowEmpty()
+			cwl_workflow = &cwl_workflow_instance
+			cwl_workflow.Id = entrypoint
+			new_step := cwl.WorkflowStep{}
+			step_id := entrypoint + "/wrapper_step"
+			new_step.Id = step_id
+			for _, input := range expressiontool.Inputs { // input is InputParameter
+
+				workflow_input_name := entrypoint + "/" + path.Base(input.Id)
+
+				var workflow_step_input cwl.WorkflowStepInput
+				workflow_step_input.Id = step_id + "/" + input.Id
+				workflow_step_input.Source = workflow_input_name
+				workflow_step_input.Default = input.Default
+
+				//fmt.Println("InputParameter and WorkflowStepInput:")
+				//spew.Dump(input)
+				//spew.Dump(workflow_step_input)
+				new_step.In = append(new_step.In, workflow_step_input)
+
+				var workflow_input_parameter cwl.InputParameter
+				workflow_input_parameter.Id = workflow_input_name
+				workflow_input_parameter.SecondaryFiles = input.SecondaryFiles
+				workflow_input_parameter.Format = input.Format
+				workflow_input_parameter.Streamable = input.Streamable
+				workflow_input_parameter.InputBinding = input.InputBinding
+				workflow_input_parameter.Type = input.Type
+
+				workflow_input_parameter.Default = input.Default
+
+				add_null := false
+				if input.Default != nil { // check if this is an optional argument
+					add_null = true
+				}
+
+				if add_null {
+					has_null := false
+					for _, t := range workflow_input_parameter.Type {
+						if t == cwl.CWL_null {
+							has_null = true
+							break
+						}
+					}
+					if !has_null {
+						workflow_input_parameter.Type = append(workflow_input_parameter.Type, cwl.CWL_null)
+					}
+				}
+
+				cwl_workflow.Inputs = append(cwl_workflow.Inputs, workflow_input_parameter)
+			}
+
+			for _, output := range expressiontool.Outputs { // type: ExpressionToolOutputParameter
+				var workflow_step_output cwl.WorkflowStepOutput
+				workflow_step_output.Id = step_id + "/" + strings.TrimPrefix(output.Id, "#")
+
+				new_step.Out = append(new_step.Out, workflow_step_output)
+
+				var workflow_output_parameter cwl.WorkflowOutputParameter
+
+				workflow_output_parameter.Id = entrypoint + "/" + path.Base(output.Id)
+				workflow_output_parameter.OutputSource = step_id + "/" + path.Base(output.Id)
+				workflow_output_parameter.SecondaryFiles = output.SecondaryFiles
+				workflow_output_parameter.Format = output.Format
+				workflow_output_parameter.Streamable = output.Streamable
+				//workflow_output_parameter.OutputBinding = output.OutputBinding
+				//workflow_output_parameter.OutputSource = output.OutputSource
+				//workflow_output_parameter.LinkMerge = output.LinkMerge
+				workflow_output_parameter.Type = output.Type
+				cwl_workflow.Outputs = append(cwl_workflow.Outputs, workflow_output_parameter)
+			}
+
+			if expressiontool.Requirements != nil {
+				requirements := expressiontool.Requirements
+				for i, _ := range *requirements {
+					require_type := (*requirements)[i].GetClass()
+					if require_type == "ShockRequirement" {
+						shock_requirement := (*requirements)[i]
+
+						cwl_workflow.Requirements, err = cwl.AddRequirement(shock_requirement, requirements)
+						if err != nil {
+							err = fmt.Errorf("(CreateJobCWLFromInput) AddRequirement returned: %s", err.Error())
+							return
+						}
+					}
+				}
+			}
+
+			// the Secrets hint of the tool refers to the inputs of the wrapper workflow as well
+			for _, hint := range expressiontool.Hints {
+				if cwl.IsSecretsClass(hint.GetClass()) {
+					cwl_workflow.Hints = append(cwl_workflow.Hints, hint)
+				}
+			}
+
+			new_step.Run = expressiontool.Id
+
+			cwl_workflow.Steps = []cwl.WorkflowStep{new_step}
+
+			cwl_workflow_named := cwl.Named_CWL_object{}
+			cwl_workflow_named.Id = cwl_workflow.Id
+			cwl_workflow_named.Value = cwl_workflow
+
+			object_array = append(object_array, cwl_workflow_named)
+			err = collection.Add(entrypoint, cwl_workflow)
+			if err != nil {
+				err = errors.New("collection.Add returned: " + err.Error())
+				return
+			}
+		default:
+			err = fmt.Errorf("Runner type %s not supported", reflect.TypeOf(runner))
+
+			return
+		}
+		//spew.Dump(cwl_workflow)
+
+	} else {
+		entrypoint = "#main"
+
+		var ok bool
+		cwl_workflow, ok = collection.Workflows[entrypoint]
+		if !ok {
+			err = errors.New("Workflow main not found")
+			return
+		}
+	}
+
+	//fmt.Println("\n\n\n--------------------------------- Steps:\n")
+	//for _, step := range cwl_workflow.Steps {
+	//	spew.Dump(step)
+	//}
+
+	//fmt.Println("\n\n\n--------------------------------- Create AWE Job:\n")
+	job, err = CWL2AWE(_user, files, job_input, cwl_workflow, &collection)
+	if err != nil {
+		err = fmt.Errorf("(CreateJobCWLFromInput) CWL2AWE returned: %s", err.Error())
+		return
+	}
+
+	job.Entrypoint = entrypoint
+	job.IsCWL = true
+	job.CWL_objects = object_array
+	job.CwlVersion = cwl_version
+	job.Info.Name = job_name
+	job.Info.Pipeline = workflow_filename
+	job.Info.ClientGroups = "docker" // TODO this needs to be configured
+
+	if job.CwlVersion == "" {
+		err = errors.New("cwlVersion is empty")
+		return
+	}
+
+	// the caller saves the job, and with it the digests
+	job.CWL_collection = &collection
+	err = job.PinDockerImages()
+	if err != nil {
+		err = fmt.Errorf("(CreateJobCWLFromInput) PinDockerImages returned: %s", err.Error())
+		return
+	}
+
+	logger.Debug(1, "CWL2AWE done")
+	return
+}
@@ -0,0 +1,474 @@
+package core
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+
+	"github.com/MG-RAST/AWE/lib/core/cwl"
+	"github.com/MG-RAST/AWE/lib/logger"
+)
+
+// phases of a split task: rank 0 splits the input, ranks 1..N process one chunk each
+// and rank N+1 concatenates File outputs (only if there are any)
+const (
+	SPLIT_PHASE_SPLIT   = "split"
+	SPLIT_PHASE_PROCESS = "process"
+	SPLIT_PHASE_MERGE   = "merge"
+)
+
+// output of the split workunit that lists the chunk files
+const SPLIT_CHUNKS_OUTPUT = "chunks"
+
+// TaskSplit keeps track of a task with a SplitRequirement hint. It is stored with the task, so
+// a recovered or resumed task only reruns the workunits of its current phase that have no results.
+type TaskSplit struct {
+	RWMutex          `bson:"-" json:"-"`
+	Requirement      *cwl.SplitRequirement     `bson:"requirement" json:"requirement"`
+	Phase            string                    `bson:"phase" json:"phase"`
+	Chunks           []*cwl.File               `bson:"chunks,omitempty" json:"chunks,omitempty"`
+	ResultsInterface map[string]interface{}    `bson:"results,omitempty" json:"-"` // by rank, like StepOutputInterface
+	Results          map[int]*cwl.Job_document `bson:"-" json:"-"`                 // by rank
+	Merged           map[string]cwl.CWLType    `bson:"-" json:"-"`                 // outputs collected into arrays
+	Concatenate      []string                  `bson:"-" json:"-"`                 // outputs concatenated by the merge workunit
+}
+
+// SplitWork tells the worker to split or merge instead of running the tool. Chunk workunits
+// of the process phase run the tool, the phase only makes them report their outputs.
+type SplitWork struct {
+	Phase   string            `bson:"phase" json:"phase" mapstructure:"phase"`
+	Input   string            `bson:"input,omitempty" json:"input,omitempty" mapstructure:"input,omitempty"`
+	Format  string            `bson:"format,omitempty" json:"format,omitempty" mapstructure:"format,omitempty"`
+	Records int               `bson:"records,omitempty" json:"records,omitempty" mapstructure:"records,omitempty"`
+	SizeMB  int               `bson:"size_mb,omitempty" json:"size_mb,omitempty" mapstructure:"size_mb,omitempty"`
+	Merge   map[string]string `bson:"merge,omitempty" json:"merge,omitempty" mapstructure:"merge,omitempty"` // output id -> concatenate
+}
+
+func NewTaskSplit(requirement *cwl.SplitRequirement) (split *TaskSplit) {
+	split = &TaskSplit{
+		Requirement:      requirement,
+		Phase:            SPLIT_PHASE_SPLIT,
+		ResultsInterface: make(map[string]interface{}),
+		Results:          make(map[int]*cwl.Job_document),
+	}
+	split.RWMutex.Init("TaskSplit")
+	return
+}
+
+// initRaw restores a split loaded from the database
+func (split *TaskSplit) initRaw(step *cwl.WorkflowStep) (err error) {
+	split.RWMutex.Init("TaskSplit")
+
+	if split.Requirement == nil {
+		err = fmt.Errorf("(TaskSplit/initRaw) requirement missing")
+		return
+	}
+
+	if split.ResultsInterface == nil {
+		split.ResultsInterface = make(map[string]interface{})
+	}
+	split.Results = make(map[int]*cwl.Job_document)
+	for rank_str, results_generic := range split.ResultsInterface {
+		var rank int
+		rank, err = strconv.Atoi(rank_str)
+		if err != nil {
+			err = fmt.Errorf("(TaskSplit/initRaw) invalid rank %s", rank_str)
+			return
+		}
+		var results *cwl.Job_document
+		results, err = cwl.NewJob_documentFromNamedTypes(results_generic)
+		if err != nil {
+			err = fmt.Errorf("(TaskSplit/initRaw) results of rank %d: %s", rank, err.Error())
+			return
+		}
+		split.Results[rank] = results
+	}
+
+	if split.Phase == SPLIT_PHASE_MERGE {
+		if step == nil {
+			err = fmt.Errorf("(TaskSplit/initRaw) workflow step missing")
+			return
+		}
+		err = split.collectOutputs(step.Out)
+		if err != nil {
+			err = fmt.Errorf("(TaskSplit/initRaw) %s", err.Error())
+			return
+		}
+	}
+	return
+}
+
+// save stores the split with the task, the caller holds the lock of the split
+func (split *TaskSplit) save(task *Task) (err error) {
+	err = dbUpdateJobTaskField(task.JobId, task.Id, "split", split)
+	if err != nil {
+		err = fmt.Errorf("(TaskSplit/save) %s", err.Error())
+	}
+	return
+}
+
+func (split *TaskSplit) SetResults(task *Task, rank int, results *cwl.Job_document) (err error) {
+	err = split.LockNamed("SetResults")
+	if err != nil {
+		return
+	}
+	defer split.Unlock()
+
+	rank_str := strconv.Itoa(rank)
+	err = dbUpdateJobTaskField(task.JobId, task.Id, "split.results."+rank_str, *results)
+	if err != nil {
+		err = fmt.Errorf("(SetResults) %s", err.Error())
+		return
+	}
+	split.ResultsInterface[rank_str] = results
+	split.Results[rank] = results
+	return
+}
+
+// PendingRanks returns the ranks of the current phase that have not reported results. If all chunks
+// reported, the last one is run again so that the phase completes like any other.
+func (split *TaskSplit) PendingRanks() (ranks []int, err error) {
+	rlock, err := split.RLockNamed("PendingRanks")
+	if err != nil {
+		return
+	}
+	defer split.RUnlockNamed(rlock)
+
+	switch split.Phase {
+	case SPLIT_PHASE_SPLIT:
+		ranks = []int{0}
+	case SPLIT_PHASE_PROCESS:
+		for r := 1; r <= len(split.Chunks); r++ {
+			if results, ok := split.Results[r]; !ok || results == nil {
+				ranks = append(ranks, r)
+			}
+		}
+		if len(ranks) == 0 {
+			ranks = []int{len(split.Chunks)}
+		}
+	case SPLIT_PHASE_MERGE:
+		ranks = []int{len(split.Chunks) + 1}
+	default:
+		err = fmt.Errorf("(PendingRanks) unknown phase %s", split.Phase)
+	}
+	return
+}
+
+// SetupWorkunit adapts the job input of a workunit created by NewWorkunit to the current phase
+func (split *TaskSplit) SetupWorkunit(cwl_work *CWL_workunit, rank int) (err error) {
+	rlock, err := split.RLockNamed("SetupWorkunit")
+	if err != nil {
+		return
+	}
+	defer split.RUnlockNamed(rlock)
+
+	input_id := path.Base(split.Requirement.Input)
+
+	var input *cwl.File
+	for _, named := range *cwl_work.Job_input {
+		if path.Base(named.Id) != input_id {
+			continue
+		}
+		var ok bool
+		input, ok = named.Value.(*cwl.File)
+		if !ok {
+			err = fmt.Errorf("(SetupWorkunit) split input %s is not a File", input_id)
+			return
+		}
+	}
+	if input == nil {
+		err = fmt.Errorf("(SetupWorkunit) split input %s not found in step inputs", input_id)
+		return
+	}
+
+	switch split.Phase {
+	case SPLIT_PHASE_SPLIT:
+		// the split workunit only needs the file to split
+		cwl_work.Job_input = &cwl.Job_document{cwl.NewNamedCWLType(input_id, input)}
+		cwl_work.Split = &SplitWork{
+			Phase:   SPLIT_PHASE_SPLIT,
+			Input:   input_id,
+			Format:  split.Requirement.Format,
+			Records: split.Requirement.Records,
+			SizeMB:  split.Requirement.SizeMB,
+		}
+	case SPLIT_PHASE_PROCESS:
+		if rank < 1 || rank > len(split.Chunks) {
+			err = fmt.Errorf("(SetupWorkunit) no chunk for rank %d (%d chunks)", rank, len(split.Chunks))
+			return
+		}
+		chunk := *split.Chunks[rank-1]
+		if chunk.Format == "" {
+			chunk.Format = input.Format
+		}
+		for i, named := range *cwl_work.Job_input {
+			if path.Base(named.Id) == input_id {
+				(*cwl_work.Job_input)[i].Value = &chunk
+			}
+		}
+		// the worker runs the tool, but reports the outputs for the merge
+		cwl_work.Split = &SplitWork{Phase: SPLIT_PHASE_PROCESS}
+	case SPLIT_PHASE_MERGE:
+		job_input := cwl.Job_document{}
+		merge := make(map[string]string)
+		for _, output_id := range split.Concatenate {
+			parts := cwl.Array{}
+			for r := 1; r <= len(split.Chunks); r++ {
+				results, ok := split.Results[r]
+				if !ok || results == nil {
+					err = fmt.Errorf("(SetupWorkunit) chunk %d did not report results", r)
+					return
+				}
+				value, ok := results.GetMap()[output_id]
+				if !ok || value == nil {
+					err = fmt.Errorf("(SetupWorkunit) output %s missing for chunk %d", output_id, r)
+					return
+				}
+				// chunk outputs usually share a basename, they must not overwrite each other on download
+				part := *value.(*cwl.File)
+				part.Basename = part.Basename + ".part" + strconv.Itoa(r)
+				parts = append(parts, &part)
+			}
+			job_input = append(job_input, cwl.NewNamedCWLType(output_id, &parts))
+			merge[output_id] = cwl.SPLIT_MERGE_CONCATENATE
+		}
+		cwl_work.Job_input = &job_input
+		cwl_work.Split = &SplitWork{Phase: SPLIT_PHASE_MERGE, Merge: merge}
+	default:
+		err = fmt.Errorf("(SetupWorkunit) unknown phase %s", split.Phase)
+		return
+	}
+
+	return
+}
+
+// advanceTaskSplit is called when the last workunit of the current phase is done. It returns
+// true once the step output is complete, otherwise the workunits of the next phase have been enqueued.
+func (qm *ServerMgr) advanceTaskSplit(task *Task) (done bool, err error) {
+
+	split := task.Split
+
+	var job *Job
+	job, err = GetJob(task.JobId)
+	if err != nil {
+		err = fmt.Errorf("(advanceTaskSplit) GetJob returned: %s", err.Error())
+		return
+	}
+
+	err = split.LockNamed("advanceTaskSplit")
+	if err != nil {
+		return
+	}
+
+	var next_ranks []int
+	var step_output *cwl.Job_document
+
+	switch split.Phase {
+	case SPLIT_PHASE_SPLIT:
+		next_ranks, err = split.readChunks()
+		if err != nil {
+			split.Unlock()
+			return
+		}
+		split.Phase = SPLIT_PHASE_PROCESS
+		err = split.save(task)
+		split.Unlock()
+		if err != nil {
+			return
+		}
+
+		err = task.setTotalWork(len(next_ranks), true)
+		if err != nil {
+			return
+		}
+
+	case SPLIT_PHASE_PROCESS:
+		err = split.collectOutputs(task.WorkflowStep.Out)
+		if err != nil {
+			split.Unlock()
+			return
+		}
+		if len(split.Concatenate) == 0 {
+			step_output, err = split.stepOutput()
+			split.Unlock()
+			if err != nil {
+				return
+			}
+			done = true
+			break
+		}
+		split.Phase = SPLIT_PHASE_MERGE
+		err = split.save(task)
+		split.Unlock()
+		if err != nil {
+			return
+		}
+
+		next_ranks = []int{len(split.Chunks) + 1}
+		err = task.SetRemainWork(1, true)
+		if err != nil {
+			return
+		}
+
+	case SPLIT_PHASE_MERGE:
+		step_output, err = split.stepOutput()
+		split.Unlock()
+		if err != nil {
+			return
+		}
+		done = true
+
+	default:
+		split.Unlock()
+		err = fmt.Errorf("(advanceTaskSplit) unknown phase %s", split.Phase)
+		return
+	}
+
+	if done {
+		err = task.SetStepOutput(step_output, true)
+		return
+	}
+
+	logger.Debug(1, "(advanceTaskSplit) task %s enters phase %s with %d workunits", task.Id, split.Phase, len(next_ranks))
+
+	var workunits []*Workunit
+	for _, rank := range next_ranks {
+		var workunit *Workunit
+		workunit, err = NewWorkunit(qm, task, rank, job)
+		if err != nil {
+			err = fmt.Errorf("(advanceTaskSplit) NewWorkunit returned: %s", err.Error())
+			return
+		}
+		workunits = append(workunits, workunit)
+	}
+
+	err = qm.EnqueueWorkunits(workunits)
+	return
+}
+
+// readChunks takes the chunk list from the result of the split workunit
+func (split *TaskSplit) readChunks() (ranks []int, err error) {
+	results, ok := split.Results[0]
+	if !ok || results == nil {
+		err = fmt.Errorf("(readChunks) split workunit did not report results")
+		return
+	}
+
+	chunks_generic, ok := results.GetMap()[SPLIT_CHUNKS_OUTPUT]
+	if !ok {
+		err = fmt.Errorf("(readChunks) output %s missing", SPLIT_CHUNKS_OUTPUT)
+		return
+	}
+
+	chunks_array, ok := chunks_generic.(*cwl.Array)
+	if !ok {
+		err = fmt.Errorf("(readChunks) output %s is not an array", SPLIT_CHUNKS_OUTPUT)
+		return
+	}
+
+	split.Chunks = nil
+	for _, chunk_generic := range *chunks_array {
+		chunk, ok := chunk_generic.(*cwl.File)
+		if !ok {
+			err = fmt.Errorf("(readChunks) chunk is not a File")
+			return
+		}
+		split.Chunks = append(split.Chunks, chunk)
+		ranks = append(ranks, len(split.Chunks))
+	}
+
+	if len(split.Chunks) == 0 {
+		err = fmt.Errorf("(readChunks) input was split into zero chunks")
+		return
+	}
+	return
+}
+
+// collectOutputs orders the chunk outputs by rank. Files are concatenated unless the
+// SplitRequirement asks for an array, everything else is collected into an array.
+// Every chunk has to report its results, an output may only be missing in all of them.
+func (split *TaskSplit) collectOutputs(step_outputs []cwl.WorkflowStepOutput) (err error) {
+
+	split.Merged = make(map[string]cwl.CWLType)
+	split.Concatenate = nil
+
+	for r := 1; r <= len(split.Chunks); r++ {
+		if results, ok := split.Results[r]; !ok || results == nil {
+			err = fmt.Errorf("(collectOutputs) chunk %d did not report results", r)
+			return
+		}
+	}
+
+	for _, step_output := range step_outputs {
+		output_id := path.Base(step_output.Id)
+
+		values := cwl.Array{}
+		all_files := true
+		missing := 0
+		for r := 1; r <= len(split.Chunks); r++ {
+			value, ok := split.Results[r].GetMap()[output_id]
+			if !ok || value == nil {
+				missing = r
+				continue
+			}
+			if _, is_file := value.(*cwl.File); !is_file {
+				all_files = false
+			}
+			values = append(values, value)
+		}
+
+		if len(values) == 0 {
+			// optional output that no chunk produced
+			continue
+		}
+		if missing > 0 {
+			err = fmt.Errorf("(collectOutputs) output %s missing for chunk %d", output_id, missing)
+			return
+		}
+
+		mode, has_mode := split.Requirement.Merge[output_id]
+		if !has_mode {
+			mode = cwl.SPLIT_MERGE_CONCATENATE
+			if !all_files {
+				mode = cwl.SPLIT_MERGE_ARRAY
+			}
+		}
+
+		if mode == cwl.SPLIT_MERGE_CONCATENATE && all_files {
+			split.Concatenate = append(split.Concatenate, output_id)
+			continue
+		}
+		split.Merged[output_id] = &values
+	}
+	sort.Strings(split.Concatenate)
+	return
+}
+
+// stepOutput combines the arrays and the concatenated Files of the merge workunit
+func (split *TaskSplit) stepOutput() (step_output *cwl.Job_document, err error) {
+	step_output = &cwl.Job_document{}
+
+	for output_id, value := range split.Merged {
+		*step_output = append(*step_output, cwl.NewNamedCWLType(output_id, value))
+	}
+
+	if len(split.Concatenate) == 0 {
+		return
+	}
+	merge_results, ok := split.Results[len(split.Chunks)+1]
+	if !ok || merge_results == nil {
+		err = fmt.Errorf("(stepOutput) merge workunit did not report results")
+		return
+	}
+	merge_map := merge_results.GetMap()
+	for _, output_id := range split.Concatenate {
+		value, ok := merge_map[output_id]
+		if !ok || value == nil {
+			err = fmt.Errorf("(stepOutput) merge workunit did not report output %s", output_id)
+			return
+		}
+		*step_output = append(*step_output, cwl.NewNamedCWLType(output_id, value))
+	}
+	return
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/MG-RAST/AWE/lib/core/cwl"
+)
+
+func newTestSplit(chunks int, results map[int]*cwl.Job_document) (split *TaskSplit) {
+	split = NewTaskSplit(&cwl.SplitRequirement{Input: "reads", Format: cwl.SPLIT_FORMAT_FASTA})
+	for r := 1; r <= chunks; r++ {
+		split.Chunks = append(split.Chunks, &cwl.File{Basename: "chunk"})
+	}
+	split.Results = results
+	return
+}
+
+func chunkResult(values map[string]cwl.CWLType) (results *cwl.Job_document) {
+	results = &cwl.Job_document{}
+	for id, value := range values {
+		*results = append(*results, cwl.NewNamedCWLType(id, value))
+	}
+	return
+}
+
+func TestTaskSplitCollectOutputs(t *testing.T) {
+	outputs := []cwl.WorkflowStepOutput{{Id: "#main/step/hits"}, {Id: "#main/step/count"}, {Id: "#main/step/log"}}
+
+	tests := []struct {
+		name        string
+		results     map[int]*cwl.Job_document
+		concatenate []string
+		merged      []string
+		fails       bool
+	}{
+		{
+			name: "complete",
+			results: map[int]*cwl.Job_document{
+				1: chunkResult(map[string]cwl.CWLType{"hits": &cwl.File{Basename: "hits"}, "count": cwl.NewInt(1)}),
+				2: chunkResult(map[string]cwl.CWLType{"hits": &cwl.File{Basename: "hits"}, "count": cwl.NewInt(2)}),
+			},
+			concatenate: []string{"hits"},
+			merged:      []string{"count"},
+		},
+		{
+			name: "chunk without results",
+			results: map[int]*cwl.Job_document{
+				1: chunkResult(map[string]cwl.CWLType{"hits": &cwl.File{Basename: "hits"}}),
+			},
+			fails: true,
+		},
+		{
+			name: "output missing in one chunk",
+			results: map[int]*cwl.Job_document{
+				1: chunkResult(map[string]cwl.CWLType{"hits": &cwl.File{Basename: "hits"}}),
+				2: chunkResult(map[string]cwl.CWLType{"count": cwl.NewInt(2)}),
+			},
+			fails: true,
+		},
+	}
+
+	for _, test := range tests {
+		split := newTestSplit(2, test.results)
+		err := split.collectOutputs(outputs)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if len(split.Concatenate) != len(test.concatenate) || (len(test.concatenate) > 0 && split.Concatenate[0] != test.concatenate[0]) {
+			t.Errorf("%s: concatenate %v, expected %v", test.name, split.Concatenate, test.concatenate)
+		}
+		for _, id := range test.merged {
+			array, ok := split.Merged[id].(*cwl.Array)
+			if !ok || len(*array) != 2 {
+				t.Errorf("%s: output %s not merged from both chunks", test.name, id)
+			}
+		}
+	}
+}
+
+func TestTaskSplitStepOutput(t *testing.T) {
+	split := newTestSplit(2, map[int]*cwl.Job_document{})
+	split.Concatenate = []string{"hits"}
+	split.Merged = map[string]cwl.CWLType{}
+
+	if _, err := split.stepOutput(); err == nil {
+		t.Errorf("expected an error without merge results")
+	}
+
+	split.Results[3] = chunkResult(map[string]cwl.CWLType{"hits": &cwl.File{Basename: "hits"}})
+	step_output, err := split.stepOutput()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := step_output.GetMap()["hits"]; !ok {
+		t.Errorf("concatenated output missing")
+	}
+}
+
+func TestTaskSplitPendingRanks(t *testing.T) {
+	done := chunkResult(map[string]cwl.CWLType{})
+
+	tests := []struct {
+		phase   string
+		results map[int]*cwl.Job_document
+		ranks   []int
+	}{
+		{SPLIT_PHASE_SPLIT, map[int]*cwl.Job_document{}, []int{0}},
+		{SPLIT_PHASE_PROCESS, map[int]*cwl.Job_document{0: done}, []int{1, 2, 3}},
+		{SPLIT_PHASE_PROCESS, map[int]*cwl.Job_document{0: done, 2: done}, []int{1, 3}},
+		{SPLIT_PHASE_PROCESS, map[int]*cwl.Job_document{0: done, 1: done, 2: done, 3: done}, []int{3}},
+		{SPLIT_PHASE_MERGE, map[int]*cwl.Job_document{1: done, 2: done, 3: done}, []int{4}},
+	}
+
+	for _, test := range tests {
+		split := newTestSplit(3, test.results)
+		split.Phase = test.phase
+		ranks, err := split.PendingRanks()
+		if err != nil {
+			t.Errorf("%s: %s", test.phase, err.Error())
+			continue
+		}
+		if len(ranks) != len(test.ranks) {
+			t.Errorf("%s: ranks %v, expected %v", test.phase, ranks, test.ranks)
+			continue
+		}
+		for i := range ranks {
+			if ranks[i] != test.ranks[i] {
+				t.Errorf("%s: ranks %v, expected %v", test.phase, ranks, test.ranks)
+				break
+			}
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	//cwl_types "github.com/MG-RAST/AWE/lib/core/cwl/types"
 	//"github.com/davecgh/go-spew/spew"
 	"fmt"
+
+	"github.com/mitchellh/mapstructure"
 )
 
 type CWL_workunit struct {
@@ -16,6 +18,8 @@ type CWL_workunit struct {
 	Tool_filename   string                    `bson:"tool_filename,omitempty" json:"tool_filename,omitempty" mapstructure:"tool_filename,omitempty"`
 	Outputs         *cwl.Job_document         `bson:"outputs,omitempty" json:"outputs,omitempty" mapstructure:"outputs,omitempty"`
 	OutputsExpected *[]cwl.WorkflowStepOutput `bson:"outputs_expected,omitempty" json:"outputs_expected,omitempty" mapstructure:"outputs_expected,omitempty"` // this is the subset of outputs that are needed by the workflow
+	Split           *SplitWork                `bson:"split,omitempty" json:"split,omitempty" mapstructure:"split,omitempty"`                                  // set for the split and merge workunits of a SplitRequirement step
+	Secrets         []string                  `bson:"secrets,omitempty" json:"secrets,omitempty" mapstructure:"secrets,omitempty"`                            // ids of job inputs the worker has to fetch via the private env channel
 	Notice          `bson:",inline" json:",inline" mapstructure:",squash"`
 }
 
@@ -73,6 +77,26 @@ func NewCWL_workunit_from_interface(native interface{}) (workunit *CWL_workunit,
 			}
 		}
 
+		split_generic, has_split := native_map["split"]
+		if has_split && split_generic != nil {
+			split := &SplitWork{}
+			err = mapstructure.Decode(split_generic, split)
+			if err != nil {
+				err = fmt.Errorf("(NewCWL_workunit_from_interface) decoding split failed: %s", err.Error())
+				return
+			}
+			workunit.Split = split
+		}
+
+		secrets_generic, has_secrets := native_map["secrets"]
+		if has_secrets && secrets_generic != nil {
+			err = mapstructure.Decode(secrets_generic, &workunit.Secrets)
+			if err != nil {
+				err = fmt.Errorf("(NewCWL_workunit_from_interface) decoding secrets failed: %s", err.Error())
+				return
+			}
+		}
+
 		tool_generic, has_tool_generic := native_map["tool"]
 		if has_tool_generic {
 
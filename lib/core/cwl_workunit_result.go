@@ -10,13 +10,15 @@ import (
 // TODO core.Notice and this should be the same !!!!
 
 type Notice struct {
-	Id          Workunit_Unique_Identifier `bson:"id" json:"id" mapstructure:"id"` // redundant field, for reporting
-	WorkerId    string                     `bson:"worker_id" json:"worker_id" mapstructure:"worker_id"`
-	Results     *cwl.Job_document          `bson:"results" json:"results" mapstructure:"results"`                            // subset of tool_results with Shock URLs
-	Status      string                     `bson:"status,omitempty" json:"status,omitempty" mapstructure:"status,omitempty"` // this is redundant as workunit already has state, but this is only used for transfer
-	ComputeTime int                        `bson:"computetime,omitempty" json:"computetime,omitempty" mapstructure:"computetime,omitempty"`
-	Notes       string
-	Stderr      string
+	Id            Workunit_Unique_Identifier `bson:"id" json:"id" mapstructure:"id"` // redundant field, for reporting
+	WorkerId      string                     `bson:"worker_id" json:"worker_id" mapstructure:"worker_id"`
+	Results       *cwl.Job_document          `bson:"results" json:"results" mapstructure:"results"`                            // subset of tool_results with Shock URLs
+	Status        string                     `bson:"status,omitempty" json:"status,omitempty" mapstructure:"status,omitempty"` // this is redundant as workunit already has state, but this is only used for transfer
+	ComputeTime   int                        `bson:"computetime,omitempty" json:"computetime,omitempty" mapstructure:"computetime,omitempty"`
+	Notes         string
+	Stderr        string
+	FailureReason string `bson:"failure_reason,omitempty" json:"failure_reason,omitempty" mapstructure:"failure_reason,omitempty"`
+	ExitStatus    int    `bson:"exit_status,omitempty" json:"exit_status,omitempty" mapstructure:"exit_status,omitempty"` // of a failed command, 0 if unknown
 }
 
 //type Notice struct {
@@ -72,6 +74,13 @@ func NewNotice(native interface{}) (workunit_result *Notice, err error) {
 		}
 		workunit_result.Status, _ = status.(string)
 		workunit_result.ComputeTime, _ = native_map["computetime"].(int)
+		workunit_result.FailureReason, _ = native_map["failure_reason"].(string)
+		switch exit_status := native_map["exit_status"].(type) {
+		case float64:
+			workunit_result.ExitStatus = int(exit_status)
+		case int:
+			workunit_result.ExitStatus = exit_status
+		}
 
 		return
 
@@ -0,0 +1,434 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/MG-RAST/AWE/lib/core/cwl"
+)
+
+// A Dag is the task graph of a job or of a CWL workflow for visualisation. Nodes of tasks
+// that belong to a subworkflow instance name it in Group, the renderers draw each group as a
+// cluster next to the node of its workflow task.
+
+const (
+	DAG_EDGE_DEPENDS = "depends" // AWE dependency, dependsOn or input origin
+	DAG_EDGE_SOURCE  = "source"  // CWL step input source
+	DAG_EDGE_CHILD   = "child"   // scatter child
+)
+
+type Dag struct {
+	Id     string     `json:"id,omitempty"`
+	Name   string     `json:"name,omitempty"`
+	Nodes  []DagNode  `json:"nodes"`
+	Edges  []DagEdge  `json:"edges"`
+	Groups []DagGroup `json:"groups,omitempty"`
+}
+
+type DagNode struct {
+	Id       string `json:"id"`
+	Label    string `json:"label"`
+	State    string `json:"state,omitempty"`
+	TaskType string `json:"task_type,omitempty"`
+	Group    string `json:"group,omitempty"`
+}
+
+// DagGroup is a subworkflow instance, Node is its workflow task and Group the enclosing instance
+type DagGroup struct {
+	Id    string `json:"id"`
+	Node  string `json:"node"`
+	Group string `json:"group,omitempty"`
+}
+
+type DagEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Kind  string `json:"kind"`
+	Label string `json:"label,omitempty"`
+}
+
+var dagStateColor = map[string]string{
+	TASK_STAT_INIT:             "#eeeeee",
+	TASK_STAT_PENDING:          "#ffffff",
+	TASK_STAT_READY:            "#ddeeff",
+	TASK_STAT_QUEUED:           "#aaccff",
+	TASK_STAT_INPROGRESS:       "#ffdd66",
+	TASK_STAT_SUSPEND:          "#ffaa44",
+	TASK_STAT_FAILED:           "#ff7777",
+	TASK_STAT_FAILED_PERMANENT: "#ff7777",
+	TASK_STAT_COMPLETED:        "#88dd88",
+	TASK_STAT_SKIPPED:          "#bbbbbb",
+	TASK_STAT_FAIL_SKIP:        "#bbbbbb",
+	TASK_STAT_PASSED:           "#88dd88",
+}
+
+// dagBuilder resolves CWL sources to the node of the producing step, steps are looked up
+// by group and step id
+type dagBuilder struct {
+	dag   *Dag
+	steps map[string]string // group + " " + step id -> node id
+	edges map[string]bool
+}
+
+func newDagBuilder(id string, name string) *dagBuilder {
+	return &dagBuilder{
+		dag:   &Dag{Id: id, Name: name, Nodes: []DagNode{}, Edges: []DagEdge{}},
+		steps: make(map[string]string),
+		edges: make(map[string]bool),
+	}
+}
+
+func (b *dagBuilder) addNode(node DagNode, step_id string) {
+	b.dag.Nodes = append(b.dag.Nodes, node)
+	if step_id != "" {
+		b.steps[node.Group+" "+step_id] = node.Id
+	}
+}
+
+func (b *dagBuilder) addEdge(from string, to string, kind string, label string) {
+	if from == "" || from == to {
+		return
+	}
+	key := from + " " + to + " " + kind + " " + label
+	if b.edges[key] {
+		return
+	}
+	b.edges[key] = true
+	b.dag.Edges = append(b.dag.Edges, DagEdge{From: from, To: to, Kind: kind, Label: label})
+}
+
+// addSources adds the edges into a step from the producers of its input sources. A source
+// that is not the output of a sibling step is an input of the enclosing workflow, which is
+// produced by the node in parent (empty for the top level workflow).
+func (b *dagBuilder) addSources(to string, group string, parent string, step *cwl.WorkflowStep) {
+	for _, input := range step.In {
+		for _, source := range dagSources(input.Source) {
+			if !strings.HasPrefix(source, "#") {
+				source = "#" + source
+			}
+			from, ok := b.steps[group+" "+path.Dir(source)]
+			if ok {
+				b.addEdge(from, to, DAG_EDGE_SOURCE, path.Base(source))
+			} else {
+				b.addEdge(parent, to, DAG_EDGE_SOURCE, path.Base(source))
+			}
+		}
+	}
+}
+
+func dagSources(source interface{}) (sources []string) {
+	switch s := source.(type) {
+	case string:
+		sources = append(sources, s)
+	case []string:
+		sources = append(sources, s...)
+	case []interface{}:
+		for _, element := range s {
+			if str, ok := element.(string); ok {
+				sources = append(sources, str)
+			}
+		}
+	}
+	return
+}
+
+// NewJobDag returns the task graph of a job, the caller holds the read locks of the tasks
+func NewJobDag(job *Job) (dag *Dag, err error) {
+	name := ""
+	if job.Info != nil {
+		name = job.Info.Name
+	}
+	b := newDagBuilder(job.Id, name)
+
+	// subworkflow instances are named by parent and task name of their workflow task
+	instances := make(map[string]string)
+	for _, task := range job.Tasks {
+		if task.TaskType == TASK_TYPE_WORKFLOW {
+			instances[task.Parent+task.TaskName] = task.Id
+			b.dag.Groups = append(b.dag.Groups, DagGroup{Id: task.Parent + task.TaskName, Node: task.Id, Group: task.Parent})
+		}
+	}
+
+	by_name := make(map[string]string)
+	for _, task := range job.Tasks {
+		label := task.TaskName
+		if task.WorkflowStep != nil {
+			label = path.Base(label)
+		} else if task.Cmd != nil && task.Cmd.Name != "" {
+			label = task.TaskName + ": " + task.Cmd.Name
+		}
+		b.addNode(DagNode{
+			Id:       task.Id,
+			Label:    label,
+			State:    task.State,
+			TaskType: task.TaskType,
+			Group:    task.Parent,
+		}, task.TaskName)
+		by_name[task.TaskName] = task.Id
+	}
+
+	for _, task := range job.Tasks {
+		if task.WorkflowStep != nil {
+			b.addSources(task.Id, task.Parent, instances[task.Parent], task.WorkflowStep)
+		}
+		for _, dep := range task.DependsOn {
+			if id, ok := by_name[dep]; ok {
+				b.addEdge(id, task.Id, DAG_EDGE_DEPENDS, "")
+			} else {
+				b.addEdge(dep, task.Id, DAG_EDGE_DEPENDS, "")
+			}
+		}
+		for _, io := range task.Inputs {
+			if io.Origin != "" {
+				b.addEdge(by_name[io.Origin], task.Id, DAG_EDGE_DEPENDS, io.FileName)
+			}
+		}
+		if task.TaskType == TASK_TYPE_SCATTER {
+			for _, child := range task.Children {
+				child_id, xerr := child.String()
+				if xerr == nil {
+					b.addEdge(task.Id, child_id, DAG_EDGE_CHILD, "")
+				}
+			}
+		}
+	}
+
+	// edges to tasks that do not exist (yet) are dropped
+	known := make(map[string]bool)
+	for _, node := range b.dag.Nodes {
+		known[node.Id] = true
+	}
+	edges := []DagEdge{}
+	for _, edge := range b.dag.Edges {
+		if known[edge.From] && known[edge.To] {
+			edges = append(edges, edge)
+		}
+	}
+	b.dag.Edges = edges
+
+	dag = b.dag
+	return
+}
+
+// NewCWLDag returns the step graph of a CWL document before submission, subworkflows in the
+// document are expanded into groups the same way as in a running job
+func NewCWLDag(yaml_str string) (dag *Dag, err error) {
+	object_array, _, schemata, err := cwl.Parse_cwl_document(yaml_str)
+	if err != nil {
+		err = fmt.Errorf("(NewCWLDag) Parse_cwl_document returned: %s", err.Error())
+		return
+	}
+	collection := cwl.NewCWL_collection()
+	err = collection.AddArray(object_array)
+	if err != nil {
+		err = fmt.Errorf("(NewCWLDag) AddArray returned: %s", err.Error())
+		return
+	}
+	err = collection.AddSchemata(schemata)
+	if err != nil {
+		err = fmt.Errorf("(NewCWLDag) AddSchemata returned: %s", err.Error())
+		return
+	}
+
+	main, ok := collection.Workflows["#main"]
+	if !ok {
+		if len(object_array) != 1 {
+			err = errors.New("(NewCWLDag) workflow #main not found")
+			return
+		}
+		// a single tool is run as the only step of a wrapper workflow
+		b := newDagBuilder("#entrypoint", "")
+		b.addNode(DagNode{Id: "#entrypoint/wrapper_step", Label: path.Base(object_array[0].Id)}, "")
+		dag = b.dag
+		return
+	}
+
+	b := newDagBuilder(main.Id, main.Label)
+	err = b.addWorkflow(main, "", "", &collection, 0)
+	if err != nil {
+		return
+	}
+	dag = b.dag
+	return
+}
+
+func (b *dagBuilder) addWorkflow(wfl *cwl.Workflow, group string, parent string, collection *cwl.CWL_collection, depth int) (err error) {
+	if depth > 16 {
+		err = fmt.Errorf("(addWorkflow) subworkflows nested too deep at %s", group)
+		return
+	}
+
+	for i := range wfl.Steps {
+		step := &wfl.Steps[i]
+		task_name := strings.TrimSuffix(step.Id, "/")
+		id := group + task_name
+		b.addNode(DagNode{Id: id, Label: path.Base(task_name), Group: group}, task_name)
+	}
+
+	for i := range wfl.Steps {
+		step := &wfl.Steps[i]
+		task_name := strings.TrimSuffix(step.Id, "/")
+		id := group + task_name
+		b.addSources(id, group, parent, step)
+
+		var sub *cwl.Workflow
+		switch run := step.Run.(type) {
+		case string:
+			sub, _ = collection.GetWorkflow(run)
+		case *cwl.Workflow:
+			sub = run
+		}
+		if sub == nil {
+			continue
+		}
+		for j := range b.dag.Nodes {
+			if b.dag.Nodes[j].Id == id {
+				b.dag.Nodes[j].TaskType = TASK_TYPE_WORKFLOW
+			}
+		}
+		b.dag.Groups = append(b.dag.Groups, DagGroup{Id: id, Node: id, Group: group})
+		err = b.addWorkflow(sub, id, id, collection, depth+1)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func dagQuote(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// DOT renders the graph in the Graphviz dot language
+func (dag *Dag) DOT() string {
+	var sb strings.Builder
+	sb.WriteString("digraph " + dagQuote(dag.Name) + " {\n")
+	sb.WriteString("  rankdir=LR;\n")
+	sb.WriteString("  node [shape=box, style=\"rounded,filled\", fillcolor=\"#ffffff\"];\n")
+
+	groups, members := dag.groups()
+	var write_group func(group string, indent string)
+	write_group = func(group string, indent string) {
+		for _, node := range members[group] {
+			attrs := "label=" + dagQuote(node.Label)
+			if color, ok := dagStateColor[node.State]; ok {
+				attrs += ", fillcolor=" + dagQuote(color)
+			}
+			if node.State != "" {
+				attrs += ", tooltip=" + dagQuote(node.State)
+			}
+			if node.TaskType == TASK_TYPE_WORKFLOW || node.TaskType == TASK_TYPE_SCATTER {
+				attrs += ", shape=box3d"
+			}
+			sb.WriteString(indent + dagQuote(node.Id) + " [" + attrs + "];\n")
+		}
+		for i, sub := range groups[group] {
+			sb.WriteString(fmt.Sprintf("%ssubgraph \"cluster_%s_%d\" {\n", indent, strings.Replace(group, `"`, "", -1), i))
+			sb.WriteString(indent + "  label=" + dagQuote(sub) + ";\n")
+			write_group(sub, indent+"  ")
+			sb.WriteString(indent + "}\n")
+		}
+	}
+	write_group("", "  ")
+
+	for _, edge := range dag.Edges {
+		attrs := []string{}
+		if edge.Label != "" {
+			attrs = append(attrs, "label="+dagQuote(edge.Label))
+		}
+		if edge.Kind == DAG_EDGE_CHILD {
+			attrs = append(attrs, "style=dashed")
+		}
+		line := "  " + dagQuote(edge.From) + " -> " + dagQuote(edge.To)
+		if len(attrs) > 0 {
+			line += " [" + strings.Join(attrs, ", ") + "]"
+		}
+		sb.WriteString(line + ";\n")
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// Mermaid renders the graph as a Mermaid flowchart, node ids are replaced by their index
+// as Mermaid ids cannot contain the characters of task names
+func (dag *Dag) Mermaid() string {
+	var sb strings.Builder
+	sb.WriteString("flowchart LR\n")
+
+	index := make(map[string]string)
+	for i, node := range dag.Nodes {
+		index[node.Id] = fmt.Sprintf("n%d", i)
+	}
+
+	groups, members := dag.groups()
+	group_index := 0
+	var write_group func(group string, indent string)
+	write_group = func(group string, indent string) {
+		for _, node := range members[group] {
+			label := strings.Replace(node.Label, `"`, "#quot;", -1)
+			if node.TaskType == TASK_TYPE_WORKFLOW || node.TaskType == TASK_TYPE_SCATTER {
+				sb.WriteString(indent + index[node.Id] + "[[\"" + label + "\"]]\n")
+			} else {
+				sb.WriteString(indent + index[node.Id] + "[\"" + label + "\"]\n")
+			}
+		}
+		for _, sub := range groups[group] {
+			sb.WriteString(fmt.Sprintf("%ssubgraph g%d [\"%s\"]\n", indent, group_index, strings.Replace(sub, `"`, "#quot;", -1)))
+			group_index++
+			write_group(sub, indent+"  ")
+			sb.WriteString(indent + "end\n")
+		}
+	}
+	write_group("", "  ")
+
+	for _, edge := range dag.Edges {
+		arrow := " --> "
+		if edge.Kind == DAG_EDGE_CHILD {
+			arrow = " -.-> "
+		}
+		if edge.Label != "" {
+			arrow = strings.TrimSuffix(arrow, " ") + "|\"" + strings.Replace(edge.Label, `"`, "#quot;", -1) + "\"| "
+		}
+		sb.WriteString("  " + index[edge.From] + arrow + index[edge.To] + "\n")
+	}
+
+	states := []string{}
+	for state := range dagStateColor {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	for i, state := range states {
+		class := fmt.Sprintf("s%d", i)
+		ids := []string{}
+		for _, node := range dag.Nodes {
+			if node.State == state {
+				ids = append(ids, index[node.Id])
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		sb.WriteString("  classDef " + class + " fill:" + dagStateColor[state] + "\n")
+		sb.WriteString("  class " + strings.Join(ids, ",") + " " + class + "\n")
+	}
+	return sb.String()
+}
+
+// groups returns the subgroups of each group and the nodes of each group, groups without
+// nodes, e.g. of subworkflows that have not started, are left out
+func (dag *Dag) groups() (groups map[string][]string, members map[string][]DagNode) {
+	groups = make(map[string][]string)
+	members = make(map[string][]DagNode)
+	for _, node := range dag.Nodes {
+		members[node.Group] = append(members[node.Group], node)
+	}
+	for _, group := range dag.Groups {
+		if len(members[group.Id]) > 0 && group.Id != group.Group {
+			groups[group.Group] = append(groups[group.Group], group.Id)
+		}
+	}
+	return
+}
@@ -0,0 +1,280 @@
+package core
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewJobDag(t *testing.T) {
+	depends := testTask("1", "", TASK_TYPE_NORMAL)
+	depends.DependsOn = []string{"0", "9"}
+	origin := testTask("2", "", TASK_TYPE_NORMAL)
+	origin.Inputs = []*IO{{FileName: "out.txt", Origin: "1"}, {FileName: "in.txt"}}
+
+	scatter := testTask("#main/s", "", TASK_TYPE_SCATTER)
+	scatter.Children = []Task_Unique_Identifier{
+		{JobId: "j", TaskName: "#main/s_0"},
+		{JobId: "j", TaskName: "#main/s_1"},
+	}
+
+	tests := []struct {
+		name   string
+		tasks  []*Task
+		nodes  []string
+		groups []DagGroup
+		edges  []DagEdge
+	}{
+		{
+			"dependsOn and input origin",
+			[]*Task{testTask("0", "", TASK_TYPE_NORMAL), depends, origin},
+			[]string{"j_0", "j_1", "j_2"},
+			nil,
+			[]DagEdge{
+				{From: "j_0", To: "j_1", Kind: DAG_EDGE_DEPENDS},
+				{From: "j_1", To: "j_2", Kind: DAG_EDGE_DEPENDS, Label: "out.txt"},
+			},
+		},
+		{
+			"step sources",
+			[]*Task{
+				testStep(testTask("#main/a", "", TASK_TYPE_NORMAL), "#main/input"),
+				testStep(testTask("#main/b", "", TASK_TYPE_NORMAL), "#main/a/out", []interface{}{"#main/a/log", "main/b/out"}),
+			},
+			[]string{"j_#main/a", "j_#main/b"},
+			nil,
+			[]DagEdge{
+				{From: "j_#main/a", To: "j_#main/b", Kind: DAG_EDGE_SOURCE, Label: "out"},
+				{From: "j_#main/a", To: "j_#main/b", Kind: DAG_EDGE_SOURCE, Label: "log"},
+			},
+		},
+		{
+			"subworkflow",
+			[]*Task{
+				testStep(testTask("#main/a", "", TASK_TYPE_NORMAL)),
+				testStep(testTask("#main/sub", "", TASK_TYPE_WORKFLOW), "#main/a/out"),
+				testStep(testTask("#sub/s1", "#main/sub", TASK_TYPE_NORMAL), "#sub/input"),
+				testStep(testTask("#sub/s2", "#main/sub", TASK_TYPE_NORMAL), "#sub/s1/out"),
+			},
+			[]string{"j_#main/a", "j_#main/sub", "j_#main/sub/#sub/s1", "j_#main/sub/#sub/s2"},
+			[]DagGroup{{Id: "#main/sub", Node: "j_#main/sub"}},
+			[]DagEdge{
+				{From: "j_#main/a", To: "j_#main/sub", Kind: DAG_EDGE_SOURCE, Label: "out"},
+				{From: "j_#main/sub", To: "j_#main/sub/#sub/s1", Kind: DAG_EDGE_SOURCE, Label: "input"},
+				{From: "j_#main/sub/#sub/s1", To: "j_#main/sub/#sub/s2", Kind: DAG_EDGE_SOURCE, Label: "out"},
+			},
+		},
+		{
+			"scatter children",
+			[]*Task{scatter, testTask("#main/s_0", "", TASK_TYPE_NORMAL)},
+			[]string{"j_#main/s", "j_#main/s_0"},
+			nil,
+			[]DagEdge{
+				{From: "j_#main/s", To: "j_#main/s_0", Kind: DAG_EDGE_CHILD},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		dag, err := NewJobDag(testJob("j", test.tasks...))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		nodes := []string{}
+		for _, node := range dag.Nodes {
+			nodes = append(nodes, node.Id)
+		}
+		if !reflect.DeepEqual(nodes, test.nodes) {
+			t.Errorf("%s: got nodes %v, expected %v", test.name, nodes, test.nodes)
+		}
+		if !reflect.DeepEqual(dag.Groups, test.groups) {
+			t.Errorf("%s: got groups %v, expected %v", test.name, dag.Groups, test.groups)
+		}
+		if !reflect.DeepEqual(dag.Edges, test.edges) {
+			t.Errorf("%s: got edges %v, expected %v", test.name, dag.Edges, test.edges)
+		}
+	}
+}
+
+func TestDagRender(t *testing.T) {
+	dag := &Dag{
+		Name: `say "hi"`,
+		Nodes: []DagNode{
+			{Id: "a", Label: "a", State: TASK_STAT_COMPLETED},
+			{Id: "sub", Label: "sub", TaskType: TASK_TYPE_WORKFLOW},
+			{Id: "sub/b", Label: `b "x"`, Group: "sub"},
+		},
+		Edges: []DagEdge{
+			{From: "a", To: "sub", Kind: DAG_EDGE_SOURCE, Label: "out"},
+			{From: "sub", To: "sub/b", Kind: DAG_EDGE_CHILD},
+		},
+		Groups: []DagGroup{{Id: "sub", Node: "sub"}, {Id: "empty", Node: "a"}},
+	}
+
+	tests := []struct {
+		format   string
+		output   string
+		contains []string
+		excludes []string
+	}{
+		{
+			"dot",
+			dag.DOT(),
+			[]string{
+				`digraph "say \"hi\"" {`,
+				`"a" [label="a", fillcolor="#88dd88", tooltip="completed"];`,
+				`"sub" [label="sub", shape=box3d];`,
+				`subgraph "cluster__0" {`,
+				`    "sub/b" [label="b \"x\""];`,
+				`"a" -> "sub" [label="out"];`,
+				`"sub" -> "sub/b" [style=dashed];`,
+			},
+			[]string{`label="empty"`},
+		},
+		{
+			"mermaid",
+			dag.Mermaid(),
+			[]string{
+				"flowchart LR\n",
+				`n1[["sub"]]`,
+				`subgraph g0 ["sub"]`,
+				`    n2["b #quot;x#quot;"]`,
+				`n0 -->|"out"| n1`,
+				"n1 -.-> n2",
+				"class n0 ",
+			},
+			[]string{`["empty"]`},
+		},
+	}
+
+	for _, test := range tests {
+		for _, s := range test.contains {
+			if !strings.Contains(test.output, s) {
+				t.Errorf("%s: %q missing in\n%s", test.format, s, test.output)
+			}
+		}
+		for _, s := range test.excludes {
+			if strings.Contains(test.output, s) {
+				t.Errorf("%s: unexpected %q in\n%s", test.format, s, test.output)
+			}
+		}
+	}
+}
+
+const dagTestTool = `- id: '#tool.cwl'
+  class: CommandLineTool
+  baseCommand: cat
+  inputs:
+  - id: '#tool.cwl/in'
+    type: File
+  outputs:
+  - id: '#tool.cwl/out'
+    type: File
+`
+
+const dagTestWorkflow = `cwlVersion: v1.0
+$graph:
+` + dagTestTool + `- id: '#sub.cwl'
+  class: Workflow
+  inputs:
+  - id: '#sub.cwl/x'
+    type: File
+  outputs:
+  - id: '#sub.cwl/y'
+    type: File
+    outputSource: '#sub.cwl/s1/out'
+  steps:
+  - id: '#sub.cwl/s1'
+    run: '#tool.cwl'
+    in:
+    - id: '#sub.cwl/s1/in'
+      source: '#sub.cwl/x'
+    out: ['#sub.cwl/s1/out']
+- id: '#main'
+  class: Workflow
+  inputs:
+  - id: '#main/file'
+    type: File
+  outputs:
+  - id: '#main/result'
+    type: File
+    outputSource: '#main/sub/y'
+  steps:
+  - id: '#main/a'
+    run: '#tool.cwl'
+    in:
+    - id: '#main/a/in'
+      source: '#main/file'
+    out: ['#main/a/out']
+  - id: '#main/sub'
+    run: '#sub.cwl'
+    in:
+    - id: '#main/sub/x'
+      source: '#main/a/out'
+    out: ['#main/sub/y']
+`
+
+func TestNewCWLDag(t *testing.T) {
+	tests := []struct {
+		name   string
+		yaml   string
+		nodes  []DagNode
+		groups []DagGroup
+		edges  []DagEdge
+		fails  bool
+	}{
+		{
+			"workflow with subworkflow",
+			dagTestWorkflow,
+			[]DagNode{
+				{Id: "#main/a", Label: "a"},
+				{Id: "#main/sub", Label: "sub", TaskType: TASK_TYPE_WORKFLOW},
+				{Id: "#main/sub#sub.cwl/s1", Label: "s1", Group: "#main/sub"},
+			},
+			[]DagGroup{{Id: "#main/sub", Node: "#main/sub"}},
+			[]DagEdge{
+				{From: "#main/a", To: "#main/sub", Kind: DAG_EDGE_SOURCE, Label: "out"},
+				{From: "#main/sub", To: "#main/sub#sub.cwl/s1", Kind: DAG_EDGE_SOURCE, Label: "x"},
+			},
+			false,
+		},
+		{
+			"single tool",
+			"cwlVersion: v1.0\n$graph:\n" + dagTestTool,
+			[]DagNode{{Id: "#entrypoint/wrapper_step", Label: "#tool.cwl"}},
+			nil,
+			[]DagEdge{},
+			false,
+		},
+		{
+			"tools without #main",
+			"cwlVersion: v1.0\n$graph:\n" + dagTestTool + strings.Replace(dagTestTool, "tool.cwl", "other.cwl", -1),
+			nil, nil, nil,
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		dag, err := NewCWLDag(test.yaml)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(dag.Nodes, test.nodes) {
+			t.Errorf("%s: got nodes %v, expected %v", test.name, dag.Nodes, test.nodes)
+		}
+		if !reflect.DeepEqual(dag.Groups, test.groups) {
+			t.Errorf("%s: got groups %v, expected %v", test.name, dag.Groups, test.groups)
+		}
+		if !reflect.DeepEqual(dag.Edges, test.edges) {
+			t.Errorf("%s: got edges %v, expected %v", test.name, dag.Edges, test.edges)
+		}
+	}
+}
@@ -60,7 +60,18 @@ func InitClientGroupDB() {
 	cc.EnsureIndex(mgo.Index{Key: []string{"token"}, Unique: true})
 }
 
+// the local runner of awe-worker has no database, jobs are kept in memory and on disk only
+func dbDisabled() bool {
+	return Service == "local"
+}
+
+// errNoDatabase is returned by the readers of the database in local mode, where writes are skipped
+var errNoDatabase = errors.New("no database in local mode")
+
 func dbDelete(q bson.M, coll string) (err error) {
+	if dbDisabled() {
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 	c := session.DB(conf.MONGODB_DATABASE).C(coll)
@@ -69,6 +80,9 @@ func dbDelete(q bson.M, coll string) (err error) {
 }
 
 func dbUpsert(t interface{}) (err error) {
+	if dbDisabled() {
+		return
+	}
 	// test that document not to large
 	if nbson, err := bson.Marshal(t); err == nil {
 		if len(nbson) >= DocumentMaxByte {
@@ -94,6 +108,10 @@ func dbUpsert(t interface{}) (err error) {
 }
 
 func dbCount(q bson.M) (count int, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 	c := session.DB(conf.MONGODB_DATABASE).C(conf.DB_COLL_JOBS)
@@ -105,6 +123,10 @@ func dbCount(q bson.M) (count int, err error) {
 }
 
 func dbFind(q bson.M, results *Jobs, options map[string]int) (count int, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 	c := session.DB(conf.MONGODB_DATABASE).C(conf.DB_COLL_JOBS)
@@ -139,6 +161,10 @@ func dbFind(q bson.M, results *Jobs, options map[string]int) (count int, err err
 // get a minimal subset of the job documents required for an admin overview
 // for all completed jobs younger than a month and all running jobs
 func dbAdminData(special string) (data []interface{}, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	// get a DB connection
 	session := db.Connection.Session.Copy()
 
@@ -164,6 +190,10 @@ func dbAdminData(special string) (data []interface{}, err error) {
 }
 
 func dbFindSort(q bson.M, results *Jobs, options map[string]int, sortby string, do_init bool) (count int, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	if sortby == "" {
 		return 0, errors.New("sortby must be an nonempty string")
 	}
@@ -212,7 +242,24 @@ func dbFindSort(q bson.M, results *Jobs, options map[string]int, sortby string,
 	return
 }
 
+// dbFindPage loads up to limit jobs without counting all matching documents
+func dbFindPage(q bson.M, results *Jobs, limit int, sortby []string) (err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C(conf.DB_COLL_JOBS)
+	err = c.Find(q).Sort(sortby...).Limit(limit).All(results)
+	return
+}
+
 func DbFindDistinct(q bson.M, d string) (results interface{}, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 	c := session.DB(conf.MONGODB_DATABASE).C(conf.DB_COLL_JOBS)
@@ -221,6 +268,10 @@ func DbFindDistinct(q bson.M, d string) (results interface{}, err error) {
 }
 
 func dbFindClientGroups(q bson.M, results *ClientGroups) (count int, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 	c := session.DB(conf.MONGODB_DATABASE).C(conf.DB_COLL_CGS)
@@ -233,6 +284,10 @@ func dbFindClientGroups(q bson.M, results *ClientGroups) (count int, err error)
 }
 
 func dbFindSortClientGroups(q bson.M, results *ClientGroups, options map[string]int, sortby string) (count int, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	if sortby == "" {
 		return 0, errors.New("sortby must be an nonempty string")
 	}
@@ -267,6 +322,10 @@ func dbUpdateJobState(job_id string, newState string, notes string) (err error)
 }
 
 func dbGetJobTasks(job_id string) (tasks []*Task, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 
@@ -338,6 +397,10 @@ func dbGetJobTaskField(job_id string, task_id string, fieldname string, result *
 
 // TODO: warning: this does not cope with subfields such as "partinfo.index"
 func dbGetJobArrayField(job_id string, task_id string, array_name string, id_field string, fieldname string, result *StructContainer) (err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 
@@ -382,6 +445,10 @@ func dbGetJobArrayField(job_id string, task_id string, array_name string, id_fie
 }
 
 func dbGetJobTask(job_id string, task_id string) (result *Task, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	dummy_job := NewJob()
 	dummy_job.Init()
 
@@ -437,6 +504,10 @@ func dbGetJobFieldString(job_id string, fieldname string) (result string, err er
 }
 
 func dbGetJobField(job_id string, fieldname string, result interface{}) (err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 
 	session := db.Connection.Session.Copy()
 	defer session.Close()
@@ -457,6 +528,10 @@ type Job_Acl struct {
 }
 
 func DBGetJobAcl(job_id string) (_acl acl.Acl, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 
@@ -475,7 +550,37 @@ func DBGetJobAcl(job_id string) (_acl acl.Acl, err error) {
 	return
 }
 
+// DBRemoveAclId removes a user or group from the ACLs of all jobs and clientgroups
+func DBRemoveAclId(id string) (err error) {
+	if dbDisabled() {
+		return
+	}
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+
+	job_lists := bson.M{"acl.read": id, "acl.write": id, "acl.delete": id}
+	job_selector := bson.M{"$or": []bson.M{bson.M{"acl.read": id}, bson.M{"acl.write": id}, bson.M{"acl.delete": id}}}
+	_, err = session.DB(conf.MONGODB_DATABASE).C(conf.DB_COLL_JOBS).UpdateAll(job_selector, bson.M{"$pull": job_lists})
+	if err != nil {
+		err = fmt.Errorf("(DBRemoveAclId) jobs: %s", err.Error())
+		return
+	}
+
+	cg_lists := bson.M{"acl.read": id, "acl.write": id, "acl.delete": id, "acl.execute": id}
+	cg_selector := bson.M{"$or": []bson.M{bson.M{"acl.read": id}, bson.M{"acl.write": id}, bson.M{"acl.delete": id}, bson.M{"acl.execute": id}}}
+	_, err = session.DB(conf.MONGODB_DATABASE).C(conf.DB_COLL_CGS).UpdateAll(cg_selector, bson.M{"$pull": cg_lists})
+	if err != nil {
+		err = fmt.Errorf("(DBRemoveAclId) clientgroups: %s", err.Error())
+		return
+	}
+	return
+}
+
 func dbGetJobFieldTime(job_id string, fieldname string) (result time.Time, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 
@@ -491,6 +596,9 @@ func dbGetJobFieldTime(job_id string, fieldname string) (result time.Time, err e
 }
 
 func dbPushJobTask(job_id string, task *Task) (err error) {
+	if dbDisabled() {
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 
@@ -508,6 +616,9 @@ func dbPushJobTask(job_id string, task *Task) (err error) {
 }
 
 func dbPushJobWorkflowInstance(job_id string, wi *WorkflowInstance) (err error) {
+	if dbDisabled() {
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 
@@ -545,6 +656,9 @@ func dbUpdateJobWorkflow_instancesField(job_id string, subworkflow_id string, fi
 }
 
 func dbUpdateJobWorkflow_instancesFields(job_id string, subworkflow_id string, update_value bson.M) (err error) {
+	if dbDisabled() {
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 
@@ -560,6 +674,9 @@ func dbUpdateJobWorkflow_instancesFields(job_id string, subworkflow_id string, u
 }
 
 func dbUpdateJobFields(job_id string, update_value bson.M) (err error) {
+	if dbDisabled() {
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 
@@ -600,6 +717,9 @@ func dbUpdateJobFieldNull(job_id string, fieldname string) (err error) {
 }
 
 func dbUpdateJobTaskFields(job_id string, task_id string, update_value bson.M) (err error) {
+	if dbDisabled() {
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 
@@ -658,6 +778,9 @@ func dbUpdateJobTaskIO(job_id string, task_id string, fieldname string, value []
 
 func dbIncrementJobTaskField(job_id string, task_id string, fieldname string, increment_value int) (err error) {
 
+	if dbDisabled() {
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 
@@ -678,6 +801,9 @@ func dbIncrementJobTaskField(job_id string, task_id string, fieldname string, in
 
 func DbUpdateJobField(job_id string, key string, value interface{}) (err error) {
 
+	if dbDisabled() {
+		return
+	}
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 
@@ -697,6 +823,10 @@ func DbUpdateJobField(job_id string, key string, value interface{}) (err error)
 }
 
 func LoadJob(id string) (job *Job, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	job = NewJob()
 	session := db.Connection.Session.Copy()
 	defer session.Close()
@@ -725,6 +855,10 @@ func LoadJob(id string) (job *Job, err error) {
 }
 
 func LoadJobPerf(id string) (perf *JobPerf, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	perf = new(JobPerf)
 	session := db.Connection.Session.Copy()
 	defer session.Close()
@@ -736,6 +870,10 @@ func LoadJobPerf(id string) (perf *JobPerf, err error) {
 }
 
 func LoadClientGroup(id string) (clientgroup *ClientGroup, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	clientgroup = new(ClientGroup)
 	session := db.Connection.Session.Copy()
 	defer session.Close()
@@ -747,6 +885,10 @@ func LoadClientGroup(id string) (clientgroup *ClientGroup, err error) {
 }
 
 func LoadClientGroupByName(name string) (clientgroup *ClientGroup, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	clientgroup = new(ClientGroup)
 	session := db.Connection.Session.Copy()
 	defer session.Close()
@@ -758,6 +900,10 @@ func LoadClientGroupByName(name string) (clientgroup *ClientGroup, err error) {
 }
 
 func LoadClientGroupByToken(token string) (clientgroup *ClientGroup, err error) {
+	if dbDisabled() {
+		err = errNoDatabase
+		return
+	}
 	clientgroup = new(ClientGroup)
 	session := db.Connection.Session.Copy()
 	defer session.Close()
@@ -0,0 +1,494 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core/cwl"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const DOCKER_HUB_REGISTRY = "docker.io"
+
+// manifest types accepted when resolving a tag, the digest of a manifest list refers to all platforms
+var dockerManifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// DockerImageRef is a parsed image reference, e.g. quay.io/biocontainers/samtools:1.9 or ubuntu@sha256:...
+type DockerImageRef struct {
+	Registry   string // e.g. docker.io
+	Repository string // e.g. library/ubuntu
+	Tag        string
+	Digest     string
+}
+
+// NormalizeDockerRegistry maps the different names of a registry onto one, e.g. https://index.docker.io/v1/ -> docker.io
+func NormalizeDockerRegistry(registry string) string {
+	registry = strings.TrimPrefix(registry, "https://")
+	registry = strings.TrimPrefix(registry, "http://")
+	registry = strings.SplitN(registry, "/", 2)[0]
+	registry = strings.ToLower(registry)
+	switch registry {
+	case "", "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return DOCKER_HUB_REGISTRY
+	}
+	return registry
+}
+
+func ParseDockerImageRef(image string) (ref *DockerImageRef, err error) {
+	if image == "" || strings.ContainsAny(image, " \t\n") {
+		err = fmt.Errorf("(ParseDockerImageRef) invalid image name \"%s\"", image)
+		return
+	}
+	ref = &DockerImageRef{}
+
+	name := image
+	if i := strings.Index(name, "@"); i >= 0 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+		if !strings.Contains(ref.Digest, ":") {
+			err = fmt.Errorf("(ParseDockerImageRef) invalid digest in image name \"%s\"", image)
+			return
+		}
+	}
+
+	// a colon after the last slash separates the tag (a colon before is the port of the registry)
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry = NormalizeDockerRegistry(parts[0])
+		ref.Repository = parts[1]
+	} else {
+		ref.Registry = DOCKER_HUB_REGISTRY
+		ref.Repository = name
+	}
+	if ref.Registry == DOCKER_HUB_REGISTRY && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	if ref.Repository == "" {
+		err = fmt.Errorf("(ParseDockerImageRef) invalid image name \"%s\"", image)
+		return
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return
+}
+
+// Name returns the image name without tag and digest, in the short form for Docker Hub images
+func (ref *DockerImageRef) Name() string {
+	if ref.Registry == DOCKER_HUB_REGISTRY {
+		return strings.TrimPrefix(ref.Repository, "library/")
+	}
+	return ref.Registry + "/" + ref.Repository
+}
+
+// String returns the image name with digest if known, with tag otherwise
+func (ref *DockerImageRef) String() string {
+	if ref.Digest != "" {
+		return ref.Name() + "@" + ref.Digest
+	}
+	return ref.Name() + ":" + ref.Tag
+}
+
+func (ref *DockerImageRef) apiHost() string {
+	if ref.Registry == DOCKER_HUB_REGISTRY {
+		return "registry-1.docker.io"
+	}
+	return ref.Registry
+}
+
+// ResolveDockerDigest asks the registry for the digest of the manifest the tag currently points to
+func ResolveDockerDigest(ref *DockerImageRef, cred *RegistryCredential) (digest string, err error) {
+	if ref.Digest != "" {
+		digest = ref.Digest
+		return
+	}
+
+	manifest_url := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.apiHost(), ref.Repository, ref.Tag)
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	authorization := ""
+	for _, method := range []string{"HEAD", "GET"} {
+		var res *http.Response
+		res, err = registryRequest(client, method, manifest_url, authorization)
+		if err != nil {
+			return
+		}
+
+		if res.StatusCode == http.StatusUnauthorized && authorization == "" {
+			challenge := res.Header.Get("Www-Authenticate")
+			res.Body.Close()
+			authorization, err = registryAuthorization(client, challenge, cred)
+			if err != nil {
+				err = fmt.Errorf("(ResolveDockerDigest) %s", err.Error())
+				return
+			}
+			res, err = registryRequest(client, method, manifest_url, authorization)
+			if err != nil {
+				return
+			}
+		}
+
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			err = fmt.Errorf("(ResolveDockerDigest) registry returned %s for %s", res.Status, ref.String())
+			return
+		}
+
+		digest = res.Header.Get("Docker-Content-Digest")
+		if digest == "" && method == "GET" {
+			// registries are not required to send the header, the digest is the hash of the manifest
+			hash := sha256.New()
+			_, err = io.Copy(hash, res.Body)
+			if err != nil {
+				res.Body.Close()
+				return
+			}
+			digest = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+		}
+		res.Body.Close()
+		if digest != "" {
+			return
+		}
+	}
+	err = fmt.Errorf("(ResolveDockerDigest) registry did not return a digest for %s", ref.String())
+	return
+}
+
+func registryRequest(client *http.Client, method string, target_url string, authorization string) (res *http.Response, err error) {
+	req, err := http.NewRequest(method, target_url, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", strings.Join(dockerManifestTypes, ", "))
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	res, err = client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("(registryRequest) %s %s returned: %s", method, target_url, err.Error())
+	}
+	return
+}
+
+// registryAuthorization answers the Www-Authenticate challenge of a registry, either with basic
+// auth or with a bearer token obtained from the token service named in the challenge
+func registryAuthorization(client *http.Client, challenge string, cred *RegistryCredential) (authorization string, err error) {
+	scheme := strings.SplitN(challenge, " ", 2)[0]
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if cred == nil {
+			err = errors.New("registry requires credentials")
+			return
+		}
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(cred.Username+":"+cred.Password))
+		return
+	case "bearer":
+	default:
+		err = fmt.Errorf("unsupported authentication scheme \"%s\"", scheme)
+		return
+	}
+
+	params := parseAuthChallenge(strings.TrimPrefix(challenge, scheme))
+	realm := params["realm"]
+	if realm == "" {
+		err = errors.New("bearer challenge without realm")
+		return
+	}
+	query := url.Values{}
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	if params["scope"] != "" {
+		query.Set("scope", params["scope"])
+	}
+	token_url := realm
+	if len(query) > 0 {
+		token_url += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest("GET", token_url, nil)
+	if err != nil {
+		return
+	}
+	if cred != nil {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("token request returned: %s", err.Error())
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("token service returned %s", res.Status)
+		return
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	var token_response struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.Unmarshal(body, &token_response)
+	if err != nil {
+		err = fmt.Errorf("could not parse token response: %s", err.Error())
+		return
+	}
+	token := token_response.Token
+	if token == "" {
+		token = token_response.AccessToken
+	}
+	if token == "" {
+		err = errors.New("token service returned no token")
+		return
+	}
+	authorization = "Bearer " + token
+	return
+}
+
+// parseAuthChallenge parses the parameters of a challenge, e.g. realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseAuthChallenge(params_str string) (params map[string]string) {
+	params = make(map[string]string)
+	for _, pair := range strings.Split(params_str, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.ToLower(kv[0])] = strings.Trim(kv[1], "\"")
+	}
+	return
+}
+
+// registryCredential returns the credential for the registry from the clientgroups the job is restricted to
+func (job *Job) registryCredential(registry string) (cred *RegistryCredential) {
+	if dbDisabled() || job.Info == nil || job.Info.ClientGroups == "" {
+		return
+	}
+	for _, name := range strings.Split(job.Info.ClientGroups, ",") {
+		cg, err := LoadClientGroupByName(strings.TrimSpace(name))
+		if err != nil {
+			continue
+		}
+		c, ok, xerr := cg.GetRegistryCredential(registry)
+		if xerr != nil {
+			logger.Error("(registryCredential) job %s: %s", job.Id, xerr.Error())
+			continue
+		}
+		if ok {
+			cred = c
+			return
+		}
+	}
+	return
+}
+
+// PinDockerImages resolves the tags of dockerPull images to digests, the worker uses the
+// recorded digest. If the registry cannot be reached the task keeps using the tag.
+// Every image is resolved once and all of them in parallel, the submission waits at most
+// DOCKER_PIN_TIMEOUT for the registries.
+func (job *Job) PinDockerImages() (err error) {
+	if !conf.DOCKER_PIN_DIGEST {
+		return
+	}
+
+	var images []string
+	for _, task := range job.Tasks {
+		if task.Cmd == nil || task.Cmd.DockerPull == "" || task.Cmd.DockerDigest != "" {
+			continue
+		}
+		images = append(images, task.Cmd.DockerPull)
+	}
+	if job.CWL_collection != nil {
+		for _, clt := range job.CWL_collection.CommandLineTools {
+			images = append(images, cwlDockerPulls(clt)...)
+		}
+	}
+	if len(images) == 0 {
+		return
+	}
+
+	digests, err := job.resolveDockerDigests(images)
+	if err != nil {
+		err = fmt.Errorf("(PinDockerImages) %s", err.Error())
+		return
+	}
+
+	for _, task := range job.Tasks {
+		if task.Cmd == nil || task.Cmd.DockerPull == "" || task.Cmd.DockerDigest != "" {
+			continue
+		}
+		task.Cmd.DockerDigest = digests[task.Cmd.DockerPull]
+	}
+	if job.CWL_collection != nil {
+		for _, clt := range job.CWL_collection.CommandLineTools {
+			for _, image := range cwlDockerPulls(clt) {
+				digest, ok := digests[image]
+				if !ok {
+					continue
+				}
+				if job.DockerDigests == nil {
+					job.DockerDigests = make(map[string]string)
+				}
+				job.DockerDigests[image] = digest
+			}
+		}
+	}
+	return
+}
+
+const DOCKER_PIN_TIMEOUT = 30 * time.Second
+
+// resolveDockerDigests returns the digests of the images that could be resolved within DOCKER_PIN_TIMEOUT
+func (job *Job) resolveDockerDigests(images []string) (digests map[string]string, err error) {
+	type resolved struct {
+		image  string
+		digest string
+		err    error
+	}
+
+	refs := make(map[string]*DockerImageRef)
+	for _, image := range images {
+		if _, ok := refs[image]; ok {
+			continue
+		}
+		var ref *DockerImageRef
+		ref, err = ParseDockerImageRef(image)
+		if err != nil {
+			return
+		}
+		refs[image] = ref
+	}
+
+	results := make(chan resolved, len(refs))
+	for image, ref := range refs {
+		go func(image string, ref *DockerImageRef) {
+			digest, xerr := ResolveDockerDigest(ref, job.registryCredential(ref.Registry))
+			results <- resolved{image: image, digest: digest, err: xerr}
+		}(image, ref)
+	}
+
+	digests = make(map[string]string)
+	timeout := time.After(DOCKER_PIN_TIMEOUT)
+	for remaining := len(refs); remaining > 0; remaining-- {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				logger.Warning("(PinDockerImages) job %s: could not resolve %s: %s", job.Id, r.image, r.err.Error())
+				continue
+			}
+			logger.Debug(1, "(PinDockerImages) job %s: %s resolved to %s", job.Id, r.image, r.digest)
+			digests[r.image] = r.digest
+		case <-timeout:
+			logger.Warning("(PinDockerImages) job %s: %d images not resolved within %s, they keep their tags", job.Id, remaining, DOCKER_PIN_TIMEOUT)
+			return
+		}
+	}
+	return
+}
+
+// cwlDockerPulls returns the dockerPull images of the DockerRequirements of a tool
+func cwlDockerPulls(clt *cwl.CommandLineTool) (images []string) {
+	var requirements []cwl.Requirement
+	if clt.Requirements != nil {
+		requirements = append(requirements, *clt.Requirements...)
+	}
+	requirements = append(requirements, clt.Hints...)
+	for _, r := range requirements {
+		if dr := asDockerRequirement(r); dr != nil && dr.DockerPull != "" {
+			images = append(images, dr.DockerPull)
+		}
+	}
+	return
+}
+
+func asDockerRequirement(r cwl.Requirement) *cwl.DockerRequirement {
+	switch v := r.(type) {
+	case *cwl.DockerRequirement:
+		return v
+	case cwl.DockerRequirement:
+		return &v
+	}
+	return nil
+}
+
+// pinCWLDockerImages returns a copy of the tool whose dockerPull images refer to the digests
+// resolved at submission, the tool itself may be shared by the tasks of the job
+func pinCWLDockerImages(clt *cwl.CommandLineTool, digests map[string]string) (pinned *cwl.CommandLineTool, err error) {
+	pinned = clt
+	if len(digests) == 0 {
+		return
+	}
+
+	pin := func(requirements []cwl.Requirement) (result []cwl.Requirement, changed bool, err error) {
+		result = make([]cwl.Requirement, len(requirements))
+		for i, r := range requirements {
+			result[i] = r
+			dr := asDockerRequirement(r)
+			if dr == nil {
+				continue
+			}
+			digest, ok := digests[dr.DockerPull]
+			if !ok {
+				continue
+			}
+			var ref *DockerImageRef
+			ref, err = ParseDockerImageRef(dr.DockerPull)
+			if err != nil {
+				return
+			}
+			ref.Digest = digest
+			dr_copy := *dr
+			dr_copy.DockerPull = ref.String()
+			result[i] = &dr_copy
+			changed = true
+		}
+		return
+	}
+
+	clt_copy := *clt
+	changed := false
+	if clt.Requirements != nil {
+		var requirements []cwl.Requirement
+		var requirements_changed bool
+		requirements, requirements_changed, err = pin(*clt.Requirements)
+		if err != nil {
+			err = fmt.Errorf("(pinCWLDockerImages) %s", err.Error())
+			return
+		}
+		clt_copy.Requirements = &requirements
+		changed = changed || requirements_changed
+	}
+	var hints_changed bool
+	clt_copy.Hints, hints_changed, err = pin(clt.Hints)
+	if err != nil {
+		err = fmt.Errorf("(pinCWLDockerImages) %s", err.Error())
+		return
+	}
+	if changed || hints_changed {
+		pinned = &clt_copy
+	}
+	return
+}
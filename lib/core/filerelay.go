@@ -0,0 +1,148 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core/uuid"
+	"os"
+	"time"
+)
+
+// FileRelayRequest asks a worker for a file (or the file listing if Path is empty)
+// from the retained work directory of a failed workunit.
+// Requests are handed to the worker with the next heartbeat, the worker uploads the result.
+type FileRelayRequest struct {
+	Id       string                  `json:"id"`
+	ClientId string                  `json:"-"`
+	WorkId   string                  `json:"workid"`
+	Path     string                  `json:"path"`
+	Sent     bool                    `json:"-"`
+	response chan *FileRelayResponse `json:"-"`
+}
+
+// FileRelayResponse is the upload of a worker, File is a temporary file owned by the receiver.
+// Type is "file" or "listing" (json array of WorkFileInfo)
+type FileRelayResponse struct {
+	File  string
+	Type  string
+	Error string
+}
+
+// worker-side file listing entry of a retained work directory
+type WorkFileInfo struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	IsDir   bool      `json:"is_dir"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+type FileRelay struct {
+	RWMutex
+	_map map[string]*FileRelayRequest
+}
+
+func NewFileRelay() *FileRelay {
+	fr := &FileRelay{_map: make(map[string]*FileRelayRequest)}
+	fr.RWMutex.Init("FileRelay")
+	return fr
+}
+
+func (fr *FileRelay) add(req *FileRelayRequest) (err error) {
+	err = fr.LockNamed("FileRelay/add")
+	if err != nil {
+		return
+	}
+	defer fr.Unlock()
+	fr._map[req.Id] = req
+	return
+}
+
+func (fr *FileRelay) remove(id string) (err error) {
+	err = fr.LockNamed("FileRelay/remove")
+	if err != nil {
+		return
+	}
+	defer fr.Unlock()
+	delete(fr._map, id)
+	return
+}
+
+// Pending returns requests for the client that have not been sent yet and marks them as sent
+func (fr *FileRelay) Pending(client_id string) (requests []*FileRelayRequest, err error) {
+	err = fr.LockNamed("FileRelay/Pending")
+	if err != nil {
+		return
+	}
+	defer fr.Unlock()
+	for _, req := range fr._map {
+		if req.ClientId == client_id && !req.Sent {
+			req.Sent = true
+			requests = append(requests, req)
+		}
+	}
+	return
+}
+
+// Deliver passes the upload of the worker to the waiting request
+func (fr *FileRelay) Deliver(id string, client_id string, response *FileRelayResponse) (err error) {
+	read_lock, err := fr.RLockNamed("FileRelay/Deliver")
+	if err != nil {
+		return
+	}
+	req, ok := fr._map[id]
+	fr.RUnlockNamed(read_lock)
+	if !ok {
+		err = fmt.Errorf("file request %s not found (timeout?)", id)
+		return
+	}
+	if req.ClientId != client_id {
+		err = fmt.Errorf("file request %s was not sent to client %s", id, client_id)
+		return
+	}
+	select {
+	case req.response <- response:
+	default:
+		err = fmt.Errorf("file request %s has already been answered", id)
+	}
+	return
+}
+
+// Request waits until the worker uploaded the requested file or conf.FILE_RELAY_TIMEOUT is reached
+func (fr *FileRelay) Request(client_id string, work_str string, path string) (response *FileRelayResponse, err error) {
+	req := &FileRelayRequest{
+		Id:       uuid.New(),
+		ClientId: client_id,
+		WorkId:   work_str,
+		Path:     path,
+		response: make(chan *FileRelayResponse, 1),
+	}
+	err = fr.add(req)
+	if err != nil {
+		return
+	}
+	defer fr.remove(req.Id)
+
+	select {
+	case response = <-req.response:
+	case <-time.After(time.Duration(conf.FILE_RELAY_TIMEOUT) * time.Second):
+		fr.remove(req.Id)
+		// the upload may have arrived in the meantime
+		select {
+		case late := <-req.response:
+			if late.File != "" {
+				os.Remove(late.File)
+			}
+		default:
+		}
+		err = errors.New("timeout waiting for client " + client_id)
+		return
+	}
+	if response.Error != "" {
+		if response.File != "" {
+			os.Remove(response.File)
+		}
+		err = errors.New(response.Error)
+	}
+	return
+}
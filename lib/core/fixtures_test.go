@@ -0,0 +1,39 @@
+package core
+
+import (
+	"github.com/MG-RAST/AWE/lib/core/cwl"
+)
+
+// fixtures shared by the tests of the package, all tasks belong to the job "j"
+
+// testTask returns a pending task of the job "j", parent is the name of the task of a subworkflow
+func testTask(name string, parent string, task_type string) *Task {
+	task := &Task{}
+	task.Task_Unique_Identifier = Task_Unique_Identifier{JobId: "j", Parent: parent, TaskName: name}
+	task.Id, _ = task.Task_Unique_Identifier.String()
+	task.TaskType = task_type
+	task.State = TASK_STAT_PENDING
+	return task
+}
+
+// testStep makes the task a CWL workflow step with an input for each source
+func testStep(task *Task, sources ...interface{}) *Task {
+	task.WorkflowStep = &cwl.WorkflowStep{Id: task.TaskName}
+	for _, source := range sources {
+		task.WorkflowStep.In = append(task.WorkflowStep.In, cwl.WorkflowStepInput{Source: source})
+	}
+	return task
+}
+
+// testJob returns a new job with the tasks
+func testJob(id string, tasks ...*Task) *Job {
+	job := NewJob()
+	job.Id = id
+	job.Tasks = tasks
+	return job
+}
+
+// testWork returns a queued workunit of the job "j", info may be nil
+func testWork(id string, info *Info, inputs ...*IO) *Workunit {
+	return &Workunit{Id: id, JobId: "j", State: WORK_STAT_QUEUED, Info: info, Inputs: inputs}
+}
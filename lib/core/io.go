@@ -18,8 +18,9 @@ type IO struct {
 	Node          string                   `bson:"node" json:"node" mapstructure:"node"`
 	Url           string                   `bson:"url"  json:"url" mapstructure:"url"` // can be shock or any other url
 	Size          int64                    `bson:"size" json:"size" mapstructure:"size"`
-	MD5           string                   `bson:"md5" json:"-" mapstructure:"-"`
-	Cache         bool                     `bson:"cache" json:"cache" mapstructure:"cache"` // indicates that this files is "predata"" that needs to be cached
+	MD5           string                   `bson:"md5" json:"md5,omitempty" mapstructure:"md5,omitempty"`                          // expected md5 of downloads, verified by the worker
+	Checksum      map[string]string        `bson:"checksum,omitempty" json:"checksum,omitempty" mapstructure:"checksum,omitempty"` // md5, sha1 and sha256 computed by the worker
+	Cache         bool                     `bson:"cache" json:"cache" mapstructure:"cache"`                                        // indicates that this files is "predata"" that needs to be cached
 	Origin        string                   `bson:"origin" json:"origin" mapstructure:"origin"`
 	Path          string                   `bson:"-" json:"-" mapstructure:"-"`
 	Optional      bool                     `bson:"optional" json:"-" mapstructure:"-"`
@@ -124,7 +125,7 @@ func (io *IO) DataUrl() (dataurl string, err error) {
 }
 
 // this will update: io.Indexes, io.Size, io.MD5
-func (io *IO) getShockNode() (node *shock.ShockNode, err error) {
+func (io *IO) getShockNode(job_id string) (node *shock.ShockNode, err error) {
 	if io.Host == "" {
 		err = errors.New("empty shock host")
 		return
@@ -133,7 +134,11 @@ func (io *IO) getShockNode() (node *shock.ShockNode, err error) {
 		err = errors.New("empty node id")
 		return
 	}
-	sc := shock.ShockClient{Host: io.Host, Token: io.DataToken}
+	token, err := DecryptSecret(io.DataToken, JobSecretContext(job_id, SECRET_CONTEXT_DATATOKEN))
+	if err != nil {
+		return
+	}
+	sc := shock.ShockClient{Host: io.Host, Token: token}
 	node, err = sc.GetNode(io.Node)
 	if err != nil {
 		return
@@ -150,13 +155,13 @@ func (io *IO) getShockNode() (node *shock.ShockNode, err error) {
 	return
 }
 
-func (io *IO) UpdateFileSize() (modified bool, err error) {
+func (io *IO) UpdateFileSize(job_id string) (modified bool, err error) {
 	modified = false
 	if io.Size > 0 {
 		return
 	}
 	var node *shock.ShockNode
-	node, err = io.getShockNode() // this waits on locked file
+	node, err = io.getShockNode(job_id) // this waits on locked file
 	if err != nil {
 		return
 	}
@@ -177,7 +182,7 @@ func (io *IO) UpdateFileSize() (modified bool, err error) {
 	return
 }
 
-func (io *IO) IndexFile(indextype string) (idxInfo shock.IdxInfo, err error) {
+func (io *IO) IndexFile(job_id string, indextype string) (idxInfo shock.IdxInfo, err error) {
 	// make sure we have an index
 	if indextype == "" {
 		return
@@ -192,7 +197,7 @@ func (io *IO) IndexFile(indextype string) (idxInfo shock.IdxInfo, err error) {
 
 	// incomplete, update from shock
 	var node *shock.ShockNode
-	node, err = io.getShockNode() // this waits on locked file
+	node, err = io.getShockNode(job_id) // this waits on locked file
 	if err != nil {
 		return
 	}
@@ -206,7 +211,12 @@ func (io *IO) IndexFile(indextype string) (idxInfo shock.IdxInfo, err error) {
 
 	// create and wait on index
 	if !hasIndex || idxInfo.Locked != nil {
-		sc := shock.ShockClient{Host: io.Host, Token: io.DataToken}
+		var token string
+		token, err = DecryptSecret(io.DataToken, JobSecretContext(job_id, SECRET_CONTEXT_DATATOKEN))
+		if err != nil {
+			return
+		}
+		sc := shock.ShockClient{Host: io.Host, Token: token}
 		// create missing index
 		if !hasIndex {
 			err = sc.PutIndex(io.Node, indextype)
@@ -231,7 +241,11 @@ func (io *IO) IndexFile(indextype string) (idxInfo shock.IdxInfo, err error) {
 	return
 }
 
-func (io *IO) DeleteNode() (err error) {
-	err = shock.ShockDelete(io.Host, io.Node, io.DataToken)
+func (io *IO) DeleteNode(job_id string) (err error) {
+	token, err := DecryptSecret(io.DataToken, JobSecretContext(job_id, SECRET_CONTEXT_DATATOKEN))
+	if err != nil {
+		return
+	}
+	err = shock.ShockDelete(io.Host, io.Node, token)
 	return
 }
@@ -47,6 +47,8 @@ type JobError struct {
 	ServerNotes  string `bson:"servernotes" json:"servernotes"`
 	WorkNotes    string `bson:"worknotes" json:"worknotes"`
 	AppError     string `bson:"apperror" json:"apperror"`
+	Reason       string `bson:"reason" json:"reason"`                             // failure reason reported by the worker, e.g. WORK_FAILURE_OOM
+	ExitStatus   int    `bson:"exitstatus,omitempty" json:"exitstatus,omitempty"` // of the failed command, 0 if unknown
 	Status       string `bson:"status" json:"status"`
 }
 
@@ -77,7 +79,9 @@ type JobRaw struct {
 	CWL_workflow         *cwl.Workflow                `bson:"-" json:"-" yaml:"-" mapstructure:"-"`
 	WorkflowInstances    []interface{}                `bson:"workflow_instances" json:"workflow_instances" yaml:"workflow_instances" mapstructure:"workflow_instances"`
 	WorkflowInstancesMap map[string]*WorkflowInstance `bson:"-" json:"-" yaml:"-" mapstructure:"-"`
-	Entrypoint           string                       `bson:"entrypoint" json:"entrypoint"` // name of main workflow (typically has name #main or #entrypoint)
+	Entrypoint           string                       `bson:"entrypoint" json:"entrypoint"`                             // name of main workflow (typically has name #main or #entrypoint)
+	Tes                  *TesTask                     `bson:"tes,omitempty" json:"tes,omitempty"`                       // the submitted task of jobs created by the TES API
+	DockerDigests        map[string]string            `bson:"docker_digests,omitempty" json:"docker_digests,omitempty"` // digests of the dockerPull images of CWL tools, resolved at submission
 }
 
 func (job *JobRaw) GetId(do_read_lock bool) (id string, err error) {
@@ -270,17 +274,19 @@ func (job *Job) Decrease_WorkflowInstance_RemainTasks(id string) (remain_tasks i
 	}
 
 	// this is just to confirm the value was written TODO remove this
-	var remain_tasks_mongo int
-	remain_tasks_mongo, err = dbGetJobWorkflow_InstanceInt(job.Id, id, "remaintasks")
-	if err != nil {
-		err = fmt.Errorf("(Decrease_WorkflowInstance_RemainTasks) dbGetJobWorkflow_InstanceInt returned: %s", err.Error())
-		return
-	}
+	if !dbDisabled() {
+		var remain_tasks_mongo int
+		remain_tasks_mongo, err = dbGetJobWorkflow_InstanceInt(job.Id, id, "remaintasks")
+		if err != nil {
+			err = fmt.Errorf("(Decrease_WorkflowInstance_RemainTasks) dbGetJobWorkflow_InstanceInt returned: %s", err.Error())
+			return
+		}
 
-	if remain_tasks_mongo != remain_tasks {
-		err = fmt.Errorf("(Decrease_WorkflowInstance_RemainTasks) mongo value wrong: remain_tasks_mongo: %d  , remain_tasks: %d", remain_tasks_mongo, remain_tasks)
-		panic(err.Error())
-		return
+		if remain_tasks_mongo != remain_tasks {
+			err = fmt.Errorf("(Decrease_WorkflowInstance_RemainTasks) mongo value wrong: remain_tasks_mongo: %d  , remain_tasks: %d", remain_tasks_mongo, remain_tasks)
+			panic(err.Error())
+			return
+		}
 	}
 
 	workflow_instance.RemainTasks = remain_tasks
@@ -372,6 +378,14 @@ func (job *Job) Init() (changed bool, err error) {
 		changed = true
 	}
 
+	token_changed, err := job.renewDataToken()
+	if err != nil {
+		return
+	}
+	if token_changed {
+		changed = true
+	}
+
 	old_remaintasks := job.RemainTasks
 	job.RemainTasks = 0
 
@@ -952,6 +966,18 @@ func (job *Job) SetPipeline(pipeline string) (err error) {
 	return
 }
 
+// renewDataToken encrypts a token stored in plain text or with an older key
+func (job *Job) renewDataToken() (changed bool, err error) {
+	if job.Info.DataToken == "" {
+		return
+	}
+	job.Info.DataToken, changed, err = RenewSecret(job.Info.DataToken, JobSecretContext(job.Id, SECRET_CONTEXT_DATATOKEN))
+	if err != nil {
+		err = fmt.Errorf("(job.Init) RenewSecret returned: %s", err.Error())
+	}
+	return
+}
+
 func (job *Job) SetDataToken(token string) (err error) {
 	err = job.LockNamed("SetDataToken")
 	if err != nil {
@@ -959,15 +985,22 @@ func (job *Job) SetDataToken(token string) (err error) {
 	}
 	defer job.Unlock()
 
-	if job.Info.DataToken == token {
+	context := JobSecretContext(job.Id, SECRET_CONTEXT_DATATOKEN)
+	old_token, err := DecryptSecret(job.Info.DataToken, context)
+	if err == nil && old_token == token {
+		return
+	}
+	encrypted, err := EncryptSecret(token, context)
+	if err != nil {
+		err = fmt.Errorf("(SetDataToken) EncryptSecret returned: %s", err.Error())
 		return
 	}
 	// update toekn in info
-	err = dbUpdateJobFieldString(job.Id, "info.token", token)
+	err = dbUpdateJobFieldString(job.Id, "info.datatoken", encrypted)
 	if err != nil {
 		return
 	}
-	job.Info.DataToken = token
+	job.Info.DataToken = encrypted
 
 	// update token in IO structs
 	err = QMgr.UpdateQueueToken(job)
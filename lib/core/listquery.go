@@ -0,0 +1,599 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Listings of /job and /work can be filtered with clauses of the form field:op:value,
+// separated by ";" or given as multiple filter parameters, all clauses have to match:
+//
+//	filter=state:in:completed,suspend;info.submittime:range:2019-01-01,2019-02-01
+//
+// Operators are eq (the default if the op is left out), ne, lt, lte, gt, gte, in, nin
+// (comma separated values) and range (from,to with an exclusive to, either may be empty).
+// Times are RFC3339 or dates (2006-01-02). User attributes are addressed as userattr.<key>
+// and only support eq, ne, in and nin.
+
+const (
+	FieldString = iota
+	FieldInt
+	FieldTime
+)
+
+// ListField is a field that can be used in filters, Sort fields can also be used as the order
+// of cursor pagination
+type ListField struct {
+	Type int
+	Sort bool
+}
+
+// JobListFields are the indexed fields of job documents (see InitJobDB)
+var JobListFields = map[string]ListField{
+	"id":                       {FieldString, true},
+	"state":                    {FieldString, true},
+	"updatetime":               {FieldTime, true},
+	"expiration":               {FieldTime, true},
+	"info.name":                {FieldString, true},
+	"info.submittime":          {FieldTime, true},
+	"info.completedtime":       {FieldTime, true},
+	"info.pipeline":            {FieldString, true},
+	"info.clientgroups":        {FieldString, true},
+	"info.project":             {FieldString, true},
+	"info.service":             {FieldString, true},
+	"info.user":                {FieldString, true},
+	"info.priority":            {FieldInt, true},
+	"info.userattr.submission": {FieldString, true},
+}
+
+// WorkListFields are the fields of workunits in the queue
+var WorkListFields = map[string]ListField{
+	"id":                {FieldString, true},
+	"jobid":             {FieldString, true},
+	"state":             {FieldString, true},
+	"client":            {FieldString, true},
+	"checkout_time":     {FieldTime, true},
+	"rank":              {FieldInt, true},
+	"totalwork":         {FieldInt, true},
+	"failed":            {FieldInt, true},
+	"cmd.name":          {FieldString, true},
+	"info.name":         {FieldString, true},
+	"info.submittime":   {FieldTime, true},
+	"info.pipeline":     {FieldString, true},
+	"info.clientgroups": {FieldString, true},
+	"info.project":      {FieldString, true},
+	"info.user":         {FieldString, true},
+	"info.priority":     {FieldInt, true},
+}
+
+var filterOps = map[string]string{
+	"eq":    "",
+	"ne":    "$ne",
+	"lt":    "$lt",
+	"lte":   "$lte",
+	"gt":    "$gt",
+	"gte":   "$gte",
+	"in":    "$in",
+	"nin":   "$nin",
+	"range": "",
+}
+
+var (
+	opName      = regexp.MustCompile(`^[a-z]+$`)
+	userattrKey = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+)
+
+// FilterClause compares a field with one value, with a list (in, nin) or a range (nil for an
+// open end)
+type FilterClause struct {
+	Field  string
+	Op     string
+	Values []interface{}
+}
+
+type Filter []FilterClause
+
+// ParseFilter parses filter expressions, fields that are not in the allowlist are rejected
+func ParseFilter(expressions []string, fields map[string]ListField) (filter Filter, err error) {
+	for _, expression := range expressions {
+		for _, clause := range strings.Split(expression, ";") {
+			clause = strings.TrimSpace(clause)
+			if clause == "" {
+				continue
+			}
+			var c FilterClause
+			c, err = parseFilterClause(clause, fields)
+			if err != nil {
+				return
+			}
+			filter = append(filter, c)
+		}
+	}
+	return
+}
+
+func parseFilterClause(clause string, fields map[string]ListField) (c FilterClause, err error) {
+	parts := strings.SplitN(clause, ":", 3)
+	if len(parts) < 2 {
+		err = fmt.Errorf("invalid filter %q, expected field:op:value", clause)
+		return
+	}
+	c.Field = parts[0]
+	c.Op = "eq"
+	value := strings.Join(parts[1:], ":")
+	if _, ok := filterOps[parts[1]]; ok && len(parts) == 3 {
+		c.Op = parts[1]
+		value = parts[2]
+	} else if len(parts) == 3 && opName.MatchString(parts[1]) {
+		err = fmt.Errorf("unknown operator %q in filter %q", parts[1], clause)
+		return
+	}
+
+	field, err := lookupField(c.Field, fields)
+	if err != nil {
+		return
+	}
+	if strings.HasPrefix(c.Field, "userattr.") {
+		c.Field = "info." + c.Field
+	}
+	if strings.HasPrefix(c.Field, "info.userattr.") && !fields[c.Field].Sort {
+		switch c.Op {
+		case "eq", "ne", "in", "nin":
+		default:
+			err = fmt.Errorf("operator %s is not supported for %s", c.Op, c.Field)
+			return
+		}
+	}
+
+	var raw []string
+	switch c.Op {
+	case "in", "nin":
+		raw = strings.Split(value, ",")
+	case "range":
+		raw = strings.Split(value, ",")
+		if len(raw) != 2 || (raw[0] == "" && raw[1] == "") {
+			err = fmt.Errorf("invalid range %q for %s, expected from,to", value, c.Field)
+			return
+		}
+	default:
+		raw = []string{value}
+	}
+	for i, s := range raw {
+		if c.Op == "range" && s == "" {
+			c.Values = append(c.Values, nil)
+			continue
+		}
+		var v interface{}
+		v, err = parseFieldValue(field.Type, s)
+		if err != nil {
+			err = fmt.Errorf("invalid value %q for %s: %s", raw[i], c.Field, err.Error())
+			return
+		}
+		c.Values = append(c.Values, v)
+	}
+	return
+}
+
+// lookupField checks the field against the allowlist, user attributes are always allowed
+func lookupField(name string, fields map[string]ListField) (field ListField, err error) {
+	if f, ok := fields[name]; ok {
+		return f, nil
+	}
+	attr := strings.TrimPrefix(name, "info.")
+	if !strings.HasPrefix(attr, "userattr.") {
+		err = fmt.Errorf("field %q can not be used in filters", name)
+		return
+	}
+	if key := strings.TrimPrefix(attr, "userattr."); !userattrKey.MatchString(key) {
+		err = fmt.Errorf("invalid user attribute %q", key)
+		return
+	}
+	if f, ok := fields["info."+attr]; ok {
+		return f, nil
+	}
+	return ListField{Type: FieldString}, nil
+}
+
+func parseFieldValue(field_type int, s string) (v interface{}, err error) {
+	switch field_type {
+	case FieldInt:
+		v, err = strconv.Atoi(s)
+	case FieldTime:
+		var t time.Time
+		if t, err = time.Parse(time.RFC3339, s); err != nil {
+			t, err = time.Parse("2006-01-02", s)
+		}
+		v = t
+	default:
+		v = s
+	}
+	return
+}
+
+// Bson translates the filter into a MongoDB query
+func (filter Filter) Bson() (q []bson.M) {
+	for _, c := range filter {
+		switch c.Op {
+		case "eq":
+			q = append(q, bson.M{c.Field: c.Values[0]})
+		case "in", "nin":
+			q = append(q, bson.M{c.Field: bson.M{filterOps[c.Op]: c.Values}})
+		case "range":
+			r := bson.M{}
+			if c.Values[0] != nil {
+				r["$gte"] = c.Values[0]
+			}
+			if c.Values[1] != nil {
+				r["$lt"] = c.Values[1]
+			}
+			q = append(q, bson.M{c.Field: r})
+		default:
+			q = append(q, bson.M{c.Field: bson.M{filterOps[c.Op]: c.Values[0]}})
+		}
+	}
+	return
+}
+
+// JobClauses splits the filter of a workunit listing into the clauses on fields the workunits
+// take from their job, which are returned for job documents, and the rest
+func (filter Filter) JobClauses() (job Filter, work Filter) {
+	for _, c := range filter {
+		switch {
+		case strings.HasPrefix(c.Field, "info."):
+			job = append(job, c)
+		case c.Field == "jobid":
+			c.Field = "id"
+			job = append(job, c)
+		default:
+			work = append(work, c)
+		}
+	}
+	return
+}
+
+// Match evaluates the filter in memory, get returns the value of a field
+func (filter Filter) Match(get func(field string) interface{}) bool {
+	for _, c := range filter {
+		v := get(c.Field)
+		ok := false
+		switch c.Op {
+		case "eq":
+			ok = compareListValues(v, c.Values[0]) == 0
+		case "ne":
+			ok = compareListValues(v, c.Values[0]) != 0
+		case "lt":
+			ok = compareListValues(v, c.Values[0]) < 0
+		case "lte":
+			ok = compareListValues(v, c.Values[0]) <= 0
+		case "gt":
+			ok = compareListValues(v, c.Values[0]) > 0
+		case "gte":
+			ok = compareListValues(v, c.Values[0]) >= 0
+		case "in", "nin":
+			for _, value := range c.Values {
+				if compareListValues(v, value) == 0 {
+					ok = true
+					break
+				}
+			}
+			if c.Op == "nin" {
+				ok = !ok
+			}
+		case "range":
+			ok = (c.Values[0] == nil || compareListValues(v, c.Values[0]) >= 0) &&
+				(c.Values[1] == nil || compareListValues(v, c.Values[1]) < 0)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// compareListValues orders strings, ints and times, missing values come first
+func compareListValues(a interface{}, b interface{}) int {
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y)
+		}
+	case int:
+		if y, ok := b.(int); ok {
+			return x - y
+		}
+	case time.Time:
+		if y, ok := b.(time.Time); ok {
+			if x.Before(y) {
+				return -1
+			} else if x.After(y) {
+				return 1
+			}
+			return 0
+		}
+	}
+	if a == nil && b == nil {
+		return 0
+	} else if a == nil {
+		return -1
+	} else if b == nil {
+		return 1
+	}
+	// values of different types never match
+	return strings.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b))
+}
+
+// Cursor is the position after the last item of a page, items are ordered by the sort field
+// and the id. It is handed to clients as an opaque string.
+type Cursor struct {
+	Order     string      `json:"o"`
+	Direction string      `json:"d"`
+	Value     interface{} `json:"v"`
+	Id        string      `json:"i"`
+}
+
+// NewCursor checks the order and direction, the returned cursor points before the first item
+func NewCursor(order string, direction string, fields map[string]ListField) (c *Cursor, err error) {
+	if f, ok := fields[order]; !ok || !f.Sort {
+		err = fmt.Errorf("can not order by %q with a cursor", order)
+		return
+	}
+	if direction != "asc" && direction != "desc" {
+		err = fmt.Errorf("invalid direction %q", direction)
+		return
+	}
+	c = &Cursor{Order: order, Direction: direction}
+	return
+}
+
+// DecodeCursor parses a cursor returned by Encode
+func DecodeCursor(s string, fields map[string]ListField) (c *Cursor, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		err = fmt.Errorf("invalid cursor")
+		return
+	}
+	raw := Cursor{}
+	if err = json.Unmarshal(data, &raw); err != nil || raw.Id == "" {
+		err = fmt.Errorf("invalid cursor")
+		return
+	}
+	if c, err = NewCursor(raw.Order, raw.Direction, fields); err != nil {
+		return
+	}
+	c.Id = raw.Id
+	switch v := raw.Value.(type) {
+	case nil:
+	case float64:
+		c.Value = int(v)
+	case string:
+		if fields[c.Order].Type == FieldTime {
+			if c.Value, err = time.Parse(time.RFC3339Nano, v); err != nil {
+				err = fmt.Errorf("invalid cursor")
+				return
+			}
+		} else {
+			c.Value = v
+		}
+	default:
+		err = fmt.Errorf("invalid cursor")
+	}
+	return
+}
+
+func (c *Cursor) Encode() string {
+	raw := *c
+	if t, ok := c.Value.(time.Time); ok {
+		raw.Value = t.Format(time.RFC3339Nano)
+	}
+	data, _ := json.Marshal(raw)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Next returns the cursor after the item with the id and sort value
+func (c *Cursor) Next(id string, value interface{}) *Cursor {
+	return &Cursor{Order: c.Order, Direction: c.Direction, Value: value, Id: id}
+}
+
+func (c *Cursor) Sort() []string {
+	if c.Direction == "desc" {
+		return []string{"-" + c.Order, "-id"}
+	}
+	return []string{c.Order, "id"}
+}
+
+// Bson selects the items after the cursor, nil for the first page
+func (c *Cursor) Bson() bson.M {
+	if c.Id == "" {
+		return nil
+	}
+	opr := "$gt"
+	if c.Direction == "desc" {
+		opr = "$lt"
+	}
+	if c.Order == "id" {
+		return bson.M{"id": bson.M{opr: c.Id}}
+	}
+	// null and missing values come first in ascending order, $gt and $lt never match them
+	if c.Value == nil {
+		if c.Direction == "desc" {
+			return bson.M{c.Order: nil, "id": bson.M{opr: c.Id}}
+		}
+		return bson.M{"$or": []bson.M{
+			bson.M{c.Order: bson.M{"$ne": nil}},
+			bson.M{c.Order: nil, "id": bson.M{opr: c.Id}},
+		}}
+	}
+	after := []bson.M{
+		bson.M{c.Order: bson.M{opr: c.Value}},
+		bson.M{c.Order: c.Value, "id": bson.M{opr: c.Id}},
+	}
+	if c.Direction == "desc" {
+		after = append(after, bson.M{c.Order: nil})
+	}
+	return bson.M{"$or": after}
+}
+
+// After reports whether an item comes after the cursor
+func (c *Cursor) After(id string, value interface{}) bool {
+	if c.Id == "" {
+		return true
+	}
+	return c.compare(c.Id, c.Value, id, value) < 0
+}
+
+// compare orders two items by the sort field and the id in the direction of the cursor
+func (c *Cursor) compare(id_a string, a interface{}, id_b string, b interface{}) (cmp int) {
+	if c.Order != "id" {
+		cmp = compareListValues(a, b)
+	}
+	if cmp == 0 {
+		cmp = strings.Compare(id_a, id_b)
+	}
+	if c.Direction == "desc" {
+		cmp = -cmp
+	}
+	return
+}
+
+// AddQuery adds conditions to a MongoDB query without replacing an existing $and
+func AddQuery(q bson.M, conditions ...bson.M) {
+	and, _ := q["$and"].([]bson.M)
+	for _, condition := range conditions {
+		if condition != nil {
+			and = append(and, condition)
+		}
+	}
+	if len(and) > 0 {
+		q["$and"] = and
+	}
+}
+
+// ListValue returns the value of a field of JobListFields
+func (job *Job) ListValue(field string) interface{} {
+	switch field {
+	case "id":
+		return job.Id
+	case "state":
+		return job.State
+	case "updatetime":
+		return job.UpdateTime
+	case "expiration":
+		return job.Expiration
+	}
+	return job.Info.listValue(strings.TrimPrefix(field, "info."))
+}
+
+// ListValue returns the value of a field of WorkListFields or a user attribute
+func (work *Workunit) ListValue(field string) interface{} {
+	switch field {
+	case "id":
+		return work.Id
+	case "jobid":
+		return work.JobId
+	case "state":
+		return work.State
+	case "client":
+		return work.Client
+	case "checkout_time":
+		return work.CheckoutTime
+	case "rank":
+		return work.Rank
+	case "totalwork":
+		return work.TotalWork
+	case "failed":
+		return work.Failed
+	case "cmd.name":
+		if work.Cmd == nil {
+			return nil
+		}
+		return work.Cmd.Name
+	}
+	return work.Info.listValue(strings.TrimPrefix(field, "info."))
+}
+
+func (info *Info) listValue(field string) interface{} {
+	if info == nil {
+		return nil
+	}
+	switch field {
+	case "name":
+		return info.Name
+	case "submittime":
+		return info.SubmitTime
+	case "completedtime":
+		return info.CompletedTime
+	case "pipeline":
+		return info.Pipeline
+	case "clientgroups":
+		return info.ClientGroups
+	case "project":
+		return info.Project
+	case "service":
+		return info.Service
+	case "user":
+		return info.User
+	case "priority":
+		return info.Priority
+	}
+	if strings.HasPrefix(field, "userattr.") {
+		if v, ok := info.UserAttr[strings.TrimPrefix(field, "userattr.")]; ok {
+			if s, ok := v.(string); ok {
+				return s
+			}
+			return fmt.Sprint(v)
+		}
+	}
+	return nil
+}
+
+// GetPage loads up to limit jobs after the cursor, next is nil on the last page
+func (n *Jobs) GetPage(q bson.M, limit int, cursor *Cursor) (next *Cursor, err error) {
+	AddQuery(q, cursor.Bson())
+	if err = dbFindPage(q, n, limit+1, cursor.Sort()); err != nil {
+		return
+	}
+	if len(*n) > limit {
+		*n = (*n)[:limit]
+		last := (*n)[limit-1]
+		next = cursor.Next(last.Id, last.ListValue(cursor.Order))
+	}
+	return
+}
+
+// WorkunitsPage returns up to limit workunits after the cursor that match the filter, next is
+// nil on the last page. Only the page is kept in memory while the workunits are walked.
+func WorkunitsPage(workunits []*Workunit, filter Filter, limit int, cursor *Cursor) (page []*Workunit, next *Cursor) {
+	less := func(a *Workunit, b *Workunit) bool {
+		return cursor.compare(a.Id, a.ListValue(cursor.Order), b.Id, b.ListValue(cursor.Order)) < 0
+	}
+	// one more than the page tells whether there is a next page
+	page = make([]*Workunit, 0, limit+1)
+	for _, work := range workunits {
+		if !cursor.After(work.Id, work.ListValue(cursor.Order)) || !filter.Match(work.ListValue) {
+			continue
+		}
+		if len(page) == limit+1 && !less(work, page[limit]) {
+			continue
+		}
+		i := sort.Search(len(page), func(i int) bool { return less(work, page[i]) })
+		if len(page) < limit+1 {
+			page = append(page, nil)
+		}
+		copy(page[i+1:], page[i:len(page)-1])
+		page[i] = work
+	}
+	if len(page) > limit {
+		page = page[:limit]
+		last := page[limit-1]
+		next = cursor.Next(last.Id, last.ListValue(cursor.Order))
+	}
+	return
+}
@@ -0,0 +1,269 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestParseFilter(t *testing.T) {
+	day := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		expression string
+		filter     Filter
+		fails      bool
+	}{
+		{"state:completed", Filter{{"state", "eq", []interface{}{"completed"}}}, false},
+		{"state:in:completed,suspend", Filter{{"state", "in", []interface{}{"completed", "suspend"}}}, false},
+		{"info.priority:gte:3", Filter{{"info.priority", "gte", []interface{}{3}}}, false},
+		{"info.submittime:range:2019-01-01,", Filter{{"info.submittime", "range", []interface{}{day, nil}}}, false},
+		{"userattr.submission:ne:x", Filter{{"info.userattr.submission", "ne", []interface{}{"x"}}}, false},
+		{"userattr.color:eq:red; state:queued", Filter{{"info.userattr.color", "eq", []interface{}{"red"}}, {"state", "eq", []interface{}{"queued"}}}, false},
+		{"info.name:eq:a:b", Filter{{"info.name", "eq", []interface{}{"a:b"}}}, false},
+		{"info.name:a:b", nil, true},
+		{"acl.owner:eq:x", nil, true},
+		{"state:like:x", nil, true},
+		{"info.priority:gt:high", nil, true},
+		{"info.submittime:range:,", nil, true},
+		{"userattr.color:gt:red", nil, true},
+		{"userattr.$where:eq:x", nil, true},
+		{"state", nil, true},
+	}
+
+	for _, test := range tests {
+		filter, err := ParseFilter([]string{test.expression}, JobListFields)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.expression)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.expression, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(filter, test.filter) {
+			t.Errorf("%s: got %v, expected %v", test.expression, filter, test.filter)
+		}
+	}
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+	submitted := time.Date(2019, 1, 1, 12, 30, 0, 123456789, time.UTC)
+
+	tests := []struct {
+		order string
+		value interface{}
+	}{
+		{"id", nil},
+		{"info.submittime", submitted},
+		{"info.priority", 7},
+		{"info.name", "blast"},
+	}
+
+	for _, test := range tests {
+		cursor, err := NewCursor(test.order, "desc", JobListFields)
+		if err != nil {
+			t.Errorf("%s: %s", test.order, err.Error())
+			continue
+		}
+		next := cursor.Next("job1", test.value)
+		decoded, err := DecodeCursor(next.Encode(), JobListFields)
+		if err != nil {
+			t.Errorf("%s: %s", test.order, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(decoded, next) {
+			t.Errorf("%s: got %#v, expected %#v", test.order, decoded, next)
+		}
+	}
+
+	for _, s := range []string{"", "not base64!", "e30"} {
+		if _, err := DecodeCursor(s, JobListFields); err == nil {
+			t.Errorf("cursor %q accepted", s)
+		}
+	}
+	if _, err := NewCursor("acl.owner", "asc", JobListFields); err == nil {
+		t.Errorf("order by a field that is not sortable accepted")
+	}
+}
+
+func TestFilterJobClauses(t *testing.T) {
+	filter, err := ParseFilter([]string{"state:queued;info.project:p1;jobid:in:a,b;rank:gt:0"}, WorkListFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, work := filter.JobClauses()
+
+	expected_job := Filter{{"info.project", "eq", []interface{}{"p1"}}, {"id", "in", []interface{}{"a", "b"}}}
+	expected_work := Filter{{"state", "eq", []interface{}{"queued"}}, {"rank", "gt", []interface{}{0}}}
+	if !reflect.DeepEqual(job, expected_job) {
+		t.Errorf("job clauses %v, expected %v", job, expected_job)
+	}
+	if !reflect.DeepEqual(work, expected_work) {
+		t.Errorf("workunit clauses %v, expected %v", work, expected_work)
+	}
+	// the original filter keeps the workunit field
+	if filter[2].Field != "jobid" {
+		t.Errorf("filter changed: %v", filter)
+	}
+}
+
+func TestWorkunitsPage(t *testing.T) {
+	workunits := []*Workunit{}
+	for _, rank := range []int{3, 1, 4, 0, 5, 2} {
+		work := testWork(fmt.Sprintf("w%d", rank), nil)
+		work.Rank = rank
+		workunits = append(workunits, work)
+	}
+	filter, err := ParseFilter([]string{"rank:ne:4"}, WorkListFields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		direction string
+		limit     int
+		pages     [][]string
+	}{
+		{"asc", 2, [][]string{{"w0", "w1"}, {"w2", "w3"}, {"w5"}}},
+		{"desc", 3, [][]string{{"w5", "w3", "w2"}, {"w1", "w0"}}},
+		{"asc", 5, [][]string{{"w0", "w1", "w2", "w3", "w5"}}},
+	}
+
+	for _, test := range tests {
+		cursor, err := NewCursor("rank", test.direction, WorkListFields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages := [][]string{}
+		for cursor != nil && len(pages) <= len(test.pages) {
+			page, next := WorkunitsPage(workunits, filter, test.limit, cursor)
+			ids := []string{}
+			for _, work := range page {
+				ids = append(ids, work.Id)
+			}
+			pages = append(pages, ids)
+			cursor = next
+		}
+		if !reflect.DeepEqual(pages, test.pages) {
+			t.Errorf("%s limit %d: pages %v, expected %v", test.direction, test.limit, pages, test.pages)
+		}
+	}
+}
+
+// matchBson evaluates the operators of Cursor.Bson like MongoDB does, $gt and $lt never match null
+func matchBson(q bson.M, value func(field string) interface{}) bool {
+	for key, condition := range q {
+		if key == "$or" {
+			matched := false
+			for _, clause := range condition.([]bson.M) {
+				matched = matched || matchBson(clause, value)
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+		v := value(key)
+		operators, ok := condition.(bson.M)
+		if !ok {
+			if compareListValues(v, condition) != 0 {
+				return false
+			}
+			continue
+		}
+		for opr, operand := range operators {
+			cmp := compareListValues(v, operand)
+			switch opr {
+			case "$gt":
+				ok = v != nil && operand != nil && cmp > 0
+			case "$lt":
+				ok = v != nil && operand != nil && cmp < 0
+			case "$ne":
+				ok = cmp != 0
+			}
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestCursorNullValues(t *testing.T) {
+	submissions := map[string]interface{}{"j1": "b", "j2": nil, "j3": "a", "j4": nil, "j5": "b"}
+	jobs := []*Job{}
+	workunits := []*Workunit{}
+	for id, submission := range submissions {
+		job := testJob(id)
+		if submission != nil {
+			job.Info.UserAttr = map[string]interface{}{"submission": submission}
+		}
+		jobs = append(jobs, job)
+		workunits = append(workunits, testWork(id, job.Info))
+	}
+
+	tests := []struct {
+		direction string
+		expected  []string
+	}{
+		{"asc", []string{"j2", "j4", "j3", "j1", "j5"}},
+		{"desc", []string{"j5", "j1", "j3", "j4", "j2"}},
+	}
+
+	for _, test := range tests {
+		for _, limit := range []int{1, 2, 3} {
+			// the query of each page on the jobs in the sort order of MongoDB
+			cursor, err := NewCursor("info.userattr.submission", test.direction, JobListFields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(jobs, func(i, j int) bool {
+				return cursor.compare(jobs[i].Id, jobs[i].ListValue(cursor.Order), jobs[j].Id, jobs[j].ListValue(cursor.Order)) < 0
+			})
+			ids := []string{}
+			for cursor != nil && len(ids) <= len(jobs) {
+				q := cursor.Bson()
+				page := []*Job{}
+				for _, job := range jobs {
+					if q == nil || matchBson(q, job.ListValue) {
+						page = append(page, job)
+					}
+				}
+				next := (*Cursor)(nil)
+				if len(page) > limit {
+					page = page[:limit]
+					last := page[limit-1]
+					next = cursor.Next(last.Id, last.ListValue(cursor.Order))
+				}
+				for _, job := range page {
+					ids = append(ids, job.Id)
+				}
+				cursor = next
+			}
+			if !reflect.DeepEqual(ids, test.expected) {
+				t.Errorf("jobs %s limit %d: got %v, expected %v", test.direction, limit, ids, test.expected)
+			}
+
+			// the in-memory pages of the workunits are the same
+			cursor, _ = NewCursor("info.userattr.submission", test.direction, JobListFields)
+			ids = []string{}
+			for cursor != nil && len(ids) <= len(workunits) {
+				page, next := WorkunitsPage(workunits, nil, limit, cursor)
+				for _, work := range page {
+					ids = append(ids, work.Id)
+				}
+				cursor = next
+			}
+			if !reflect.DeepEqual(ids, test.expected) {
+				t.Errorf("workunits %s limit %d: got %v, expected %v", test.direction, limit, ids, test.expected)
+			}
+		}
+	}
+}
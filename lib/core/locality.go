@@ -0,0 +1,137 @@
+package core
+
+import (
+	"github.com/MG-RAST/AWE/lib/conf"
+	"time"
+)
+
+// LocalityStats counts how many checked out workunits found input data in the cache of the worker
+type LocalityStats struct {
+	RWMutex
+	Checkouts  int
+	Hits       int   // workunits with at least one cached input
+	LocalBytes int64 // input bytes found in worker caches
+	TotalBytes int64
+}
+
+func NewLocalityStats() (ls *LocalityStats) {
+	ls = &LocalityStats{}
+	ls.RWMutex.Init("LocalityStats")
+	return
+}
+
+func (ls *LocalityStats) Record(local int64, total int64) (err error) {
+	err = ls.LockNamed("LocalityStats/Record")
+	if err != nil {
+		return
+	}
+	defer ls.Unlock()
+	ls.Checkouts += 1
+	if local > 0 {
+		ls.Hits += 1
+	}
+	ls.LocalBytes += local
+	ls.TotalBytes += total
+	return
+}
+
+// Status returns the counters for the queue status, sizes in MB
+func (ls *LocalityStats) Status() (status map[string]int, err error) {
+	read_lock, err := ls.RLockNamed("LocalityStats/Status")
+	if err != nil {
+		return
+	}
+	defer ls.RUnlockNamed(read_lock)
+	hit_rate := 0
+	if ls.Checkouts > 0 {
+		hit_rate = ls.Hits * 100 / ls.Checkouts
+	}
+	status = map[string]int{
+		"checkouts": ls.Checkouts,
+		"hits":      ls.Hits,
+		"hit_rate":  hit_rate,
+		"local_mb":  int(ls.LocalBytes / (1024 * 1024)),
+		"total_mb":  int(ls.TotalBytes / (1024 * 1024)),
+	}
+	return
+}
+
+// CacheIndex maps the ids of the cache inventory of the client to their size. The heartbeat
+// replaces the inventory under the client lock, the caller holds it.
+func (cl *Client) CacheIndex() (index map[string]int64) {
+	index = make(map[string]int64)
+	for _, object := range cl.Cached_data {
+		index[object.Id] = object.Size
+	}
+	return
+}
+
+// Locality returns the predata and input bytes of the workunit that are in the cache index of a client.
+// Inputs are identified by Shock node id, data from other sources by url (as reported by the worker).
+func (work *Workunit) Locality(index map[string]int64) (local int64, total int64) {
+	ios := append([]*IO{}, work.Predata...)
+	ios = append(ios, work.Inputs...)
+	for _, io := range ios {
+		if io == nil || io.NoFile {
+			continue
+		}
+		id := io.Node
+		if id == "" || id == "-" {
+			id = io.Url
+		}
+		size := io.Size
+		cached_size, ok := index[id]
+		if ok && size <= 0 {
+			size = cached_size
+		}
+		total += size
+		if ok {
+			local += size
+		}
+	}
+	return
+}
+
+// byLocality sorts by priority plus the locality bonus (conf.LOCALITY_WEIGHT for fully cached
+// inputs), then by cached bytes and FCFS. Workunits that waited in the queue longer than
+// conf.LOCALITY_MAX_WAIT get the full bonus, they are not passed over by workunits with cached
+// data any more.
+type byLocality struct {
+	WorkList
+	local []int64
+	score []float64
+}
+
+func newByLocality(workunits WorkList, index map[string]int64) (s byLocality) {
+	s = byLocality{WorkList: workunits, local: make([]int64, len(workunits)), score: make([]float64, len(workunits))}
+	max_wait := time.Duration(conf.LOCALITY_MAX_WAIT) * time.Minute
+	for i, work := range workunits {
+		local, total := work.Locality(index)
+		fraction := 0.0
+		if total > 0 {
+			fraction = float64(local) / float64(total)
+		}
+		if !work.QueuedTime.IsZero() && time.Since(work.QueuedTime) > max_wait {
+			fraction = 1.0
+		}
+		s.local[i] = local
+		s.score[i] = float64(work.Info.Priority) + float64(conf.LOCALITY_WEIGHT)*fraction
+	}
+	return
+}
+
+func (s byLocality) Swap(i, j int) {
+	s.WorkList.Swap(i, j)
+	s.local[i], s.local[j] = s.local[j], s.local[i]
+	s.score[i], s.score[j] = s.score[j], s.score[i]
+}
+
+func (s byLocality) Less(i, j int) bool {
+	if s.score[i] != s.score[j] {
+		return s.score[i] > s.score[j]
+	}
+	if s.local[i] != s.local[j] {
+		return s.local[i] > s.local[j]
+	}
+	return s.WorkList[i].Info.SubmitTime.Before(s.WorkList[j].Info.SubmitTime)
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+)
+
+func localityTestWork(id string, priority int, submitted time.Time, queued time.Time, inputs ...*IO) *Workunit {
+	work := testWork(id, &Info{Priority: priority, SubmitTime: submitted}, inputs...)
+	work.QueuedTime = queued
+	return work
+}
+
+func TestByLocality(t *testing.T) {
+	weight, max_wait := conf.LOCALITY_WEIGHT, conf.LOCALITY_MAX_WAIT
+	conf.LOCALITY_WEIGHT, conf.LOCALITY_MAX_WAIT = 2, 60
+	defer func() { conf.LOCALITY_WEIGHT, conf.LOCALITY_MAX_WAIT = weight, max_wait }()
+
+	now := time.Now()
+	early, late := now.Add(-3*time.Hour), now.Add(-2*time.Hour)
+	recent, waiting := now.Add(-time.Minute), now.Add(-61*time.Minute)
+	index := map[string]int64{"cached": 100, "cached_url": 50, "half": 10}
+	cached := &IO{Node: "cached", Size: 100}
+	url := localityTestWork("url", 0, early, recent)
+	url.Predata = []*IO{{Node: "-", Url: "cached_url"}}
+	uncached := &IO{Node: "other", Size: 100}
+
+	tests := []struct {
+		name   string
+		work   []*Workunit
+		order  []string
+		scores []float64 // in sorted order
+	}{
+		{
+			"without cached inputs FCFS",
+			[]*Workunit{
+				localityTestWork("b", 0, late, recent, uncached),
+				localityTestWork("a", 0, early, recent, uncached),
+			},
+			[]string{"a", "b"},
+			[]float64{0, 0},
+		},
+		{
+			"cached inputs first",
+			[]*Workunit{
+				localityTestWork("uncached", 0, early, recent, uncached),
+				localityTestWork("cached", 0, late, recent, cached),
+			},
+			[]string{"cached", "uncached"},
+			[]float64{2, 0},
+		},
+		{
+			"bonus by cached fraction, predata and urls count",
+			[]*Workunit{
+				localityTestWork("none", 0, early, recent, uncached),
+				localityTestWork("half", 0, early, recent, cached, uncached),
+				url,
+				localityTestWork("quarter", 0, early, recent, &IO{Node: "half", Size: 10}, &IO{Node: "x", Size: 30}),
+			},
+			[]string{"url", "half", "quarter", "none"},
+			[]float64{2, 1, 0.5, 0},
+		},
+		{
+			"equal scores prefer more cached bytes",
+			[]*Workunit{
+				localityTestWork("small", 0, early, recent, &IO{Node: "half", Size: 10}),
+				localityTestWork("large", 0, late, recent, cached),
+			},
+			[]string{"large", "small"},
+			[]float64{2, 2},
+		},
+		{
+			"priority outweighs the bonus",
+			[]*Workunit{
+				localityTestWork("cached", 0, early, recent, cached),
+				localityTestWork("urgent", 3, late, recent, uncached),
+			},
+			[]string{"urgent", "cached"},
+			[]float64{3, 2},
+		},
+		{
+			"full bonus after max wait in the queue",
+			[]*Workunit{
+				localityTestWork("cached", 0, early, recent, cached),
+				localityTestWork("waiting", 1, late, waiting, uncached),
+				localityTestWork("new", 1, late, recent, uncached),
+			},
+			[]string{"waiting", "cached", "new"},
+			[]float64{3, 2, 1},
+		},
+		{
+			"old job submission does not count as waiting",
+			[]*Workunit{
+				localityTestWork("old_job", 1, now.Add(-24*time.Hour), recent, uncached),
+				localityTestWork("cached", 0, late, recent, cached),
+			},
+			[]string{"cached", "old_job"},
+			[]float64{2, 1},
+		},
+	}
+
+	for _, test := range tests {
+		sorter := newByLocality(WorkList(test.work), index)
+		sort.Sort(sorter)
+		order := []string{}
+		for _, work := range sorter.WorkList {
+			order = append(order, work.Id)
+		}
+		if !reflect.DeepEqual(order, test.order) {
+			t.Errorf("%s: got order %v, expected %v", test.name, order, test.order)
+		}
+		if !reflect.DeepEqual(sorter.score, test.scores) {
+			t.Errorf("%s: got scores %v, expected %v", test.name, sorter.score, test.scores)
+		}
+	}
+}
+
+func TestSelectWorkunitsLocalityOptIn(t *testing.T) {
+	weight := conf.LOCALITY_WEIGHT
+	defer func() { conf.LOCALITY_WEIGHT = weight }()
+
+	now := time.Now()
+	index := map[string]int64{"cached": 100}
+	tests := []struct {
+		weight   int
+		expected string
+	}{
+		{0, "first"},
+		{1, "cached"},
+	}
+	for _, test := range tests {
+		conf.LOCALITY_WEIGHT = test.weight
+		work := WorkList{
+			localityTestWork("cached", 0, now, now, &IO{Node: "cached", Size: 100}),
+			localityTestWork("first", 0, now.Add(-time.Hour), now, &IO{Node: "other", Size: 100}),
+		}
+		selected, err := (&WorkQueue{}).selectWorkunits(work, "FCFS", -1, 1, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selected[0].Id != test.expected {
+			t.Errorf("locality_weight %d: got %s, expected %s", test.weight, selected[0].Id, test.expected)
+		}
+	}
+}
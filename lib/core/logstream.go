@@ -0,0 +1,256 @@
+package core
+
+import (
+	"fmt"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"time"
+)
+
+// streams that did not receive data for this long are dropped (e.g. worker died)
+const LOG_STREAM_IDLE_TIMEOUT time.Duration = 2 * time.Hour
+
+// LogStream keeps the tail of stdout or stderr of a running workunit in memory.
+// Worker sends chunks together with their offset in the log file, followers read from an offset.
+// Only the most recent conf.LOG_STREAM_MAX_BYTES bytes are kept. The log uploaded after
+// completion (SaveStdLog) remains the source of truth.
+type LogStream struct {
+	RWMutex
+	data       []byte
+	start      int64     // file offset of data[0]
+	closed     bool      // no more data will arrive
+	update     chan bool // closed and replaced whenever data is appended or stream is closed
+	lastUpdate time.Time
+}
+
+func NewLogStream() (ls *LogStream) {
+	ls = &LogStream{data: []byte{}, update: make(chan bool), lastUpdate: time.Now()}
+	ls.RWMutex.Init("LogStream")
+	return
+}
+
+// End returns the file offset after the last byte received
+func (ls *LogStream) End() int64 {
+	return ls.start + int64(len(ls.data))
+}
+
+// Append adds a chunk that starts at the given file offset. Chunks that overlap data
+// already received (e.g. resent by the worker after a timeout) are trimmed.
+func (ls *LogStream) Append(offset int64, chunk []byte) (err error) {
+	err = ls.LockNamed("LogStream/Append")
+	if err != nil {
+		return
+	}
+	defer ls.Unlock()
+
+	if ls.closed {
+		return
+	}
+
+	end := ls.End()
+	if offset > end {
+		// the worker skipped data (should not happen), keep stream contiguous
+		if len(ls.data) > 0 {
+			ls.data = append(ls.data, []byte(fmt.Sprintf("\n[... %d bytes missing ...]\n", offset-end))...)
+		}
+		ls.start = offset - int64(len(ls.data))
+		end = offset
+	}
+	if offset+int64(len(chunk)) <= end {
+		return
+	}
+	ls.data = append(ls.data, chunk[end-offset:]...)
+
+	max_bytes := conf.LOG_STREAM_MAX_BYTES
+	if max_bytes > 0 && len(ls.data) > max_bytes {
+		drop := len(ls.data) - max_bytes
+		ls.data = append([]byte{}, ls.data[drop:]...)
+		ls.start += int64(drop)
+	}
+
+	ls.notify()
+	return
+}
+
+// Close marks the stream as complete and wakes up all followers
+func (ls *LogStream) Close() (err error) {
+	err = ls.LockNamed("LogStream/Close")
+	if err != nil {
+		return
+	}
+	defer ls.Unlock()
+	if ls.closed {
+		return
+	}
+	ls.closed = true
+	ls.notify()
+	return
+}
+
+// notify requires write lock
+func (ls *LogStream) notify() {
+	close(ls.update)
+	ls.update = make(chan bool)
+	ls.lastUpdate = time.Now()
+}
+
+// Read returns the data after offset, the offset for the next read, the channel
+// that is closed on the next update and whether the stream is complete.
+// If offset points to data that has already been dropped, skipped is the number of lost bytes.
+func (ls *LogStream) Read(offset int64) (chunk []byte, next int64, skipped int64, update <-chan bool, closed bool, err error) {
+	read_lock, err := ls.RLockNamed("LogStream/Read")
+	if err != nil {
+		return
+	}
+	defer ls.RUnlockNamed(read_lock)
+
+	if offset < ls.start {
+		skipped = ls.start - offset
+		offset = ls.start
+	}
+	end := ls.End()
+	if offset < end {
+		chunk = append([]byte{}, ls.data[offset-ls.start:]...)
+	}
+	next = end
+	if offset > end {
+		next = offset
+	}
+	update = ls.update
+	closed = ls.closed
+	return
+}
+
+func (ls *LogStream) idle() (is_idle bool) {
+	read_lock, err := ls.RLockNamed("LogStream/idle")
+	if err != nil {
+		return
+	}
+	defer ls.RUnlockNamed(read_lock)
+	is_idle = time.Since(ls.lastUpdate) > LOG_STREAM_IDLE_TIMEOUT
+	return
+}
+
+type LogStreamMap struct {
+	RWMutex
+	_map   map[string]*LogStream
+	closed map[string]time.Time // workunits whose logs have been closed, late chunks are dropped
+}
+
+func NewLogStreamMap() *LogStreamMap {
+	lm := &LogStreamMap{_map: make(map[string]*LogStream), closed: make(map[string]time.Time)}
+	lm.RWMutex.Init("LogStreamMap")
+	return lm
+}
+
+func logStreamKey(id Workunit_Unique_Identifier, logname string) (key string, err error) {
+	var work_str string
+	work_str, err = id.String()
+	if err != nil {
+		err = fmt.Errorf("(logStreamKey) id.String() returned: %s", err.Error())
+		return
+	}
+	key = work_str + "/" + logname
+	return
+}
+
+// Get returns the stream for a workunit log, if create is set a missing stream is created
+func (lm *LogStreamMap) Get(id Workunit_Unique_Identifier, logname string, create bool) (ls *LogStream, ok bool, err error) {
+	key, err := logStreamKey(id, logname)
+	if err != nil {
+		return
+	}
+
+	if !create {
+		read_lock, xerr := lm.RLockNamed("LogStreamMap/Get")
+		if xerr != nil {
+			err = xerr
+			return
+		}
+		defer lm.RUnlockNamed(read_lock)
+		ls, ok = lm._map[key]
+		return
+	}
+
+	err = lm.LockNamed("LogStreamMap/Get")
+	if err != nil {
+		return
+	}
+	defer lm.Unlock()
+
+	ls, ok = lm._map[key]
+	if ok {
+		return
+	}
+
+	work_str, _ := id.String()
+	if _, is_closed := lm.closed[work_str]; is_closed {
+		err = fmt.Errorf("logs of workunit %s have been closed", work_str)
+		return
+	}
+
+	// drop streams of workunits that disappeared without final report
+	for k, s := range lm._map {
+		if s.idle() {
+			logger.Debug(3, "(LogStreamMap/Get) removing idle log stream %s", k)
+			s.Close()
+			delete(lm._map, k)
+		}
+	}
+	for k, closed_at := range lm.closed {
+		if time.Since(closed_at) > LOG_STREAM_IDLE_TIMEOUT {
+			delete(lm.closed, k)
+		}
+	}
+
+	ls = NewLogStream()
+	lm._map[key] = ls
+	ok = true
+	return
+}
+
+// Delete closes and removes all streams of a workunit, chunks that arrive later do not
+// create a new stream until the workunit is checked out again (Open)
+func (lm *LogStreamMap) Delete(id Workunit_Unique_Identifier) (err error) {
+	err = lm.LockNamed("LogStreamMap/Delete")
+	if err != nil {
+		return
+	}
+	defer lm.Unlock()
+
+	work_str, err := id.String()
+	if err != nil {
+		return
+	}
+	lm.closed[work_str] = time.Now()
+
+	for _, logname := range conf.WORKUNIT_LOGS {
+		key, xerr := logStreamKey(id, logname)
+		if xerr != nil {
+			err = xerr
+			return
+		}
+		ls, ok := lm._map[key]
+		if !ok {
+			continue
+		}
+		ls.Close()
+		delete(lm._map, key)
+	}
+	return
+}
+
+// Open allows streams of a workunit again, e.g. when it runs again after a failure
+func (lm *LogStreamMap) Open(id Workunit_Unique_Identifier) (err error) {
+	work_str, err := id.String()
+	if err != nil {
+		return
+	}
+	err = lm.LockNamed("LogStreamMap/Open")
+	if err != nil {
+		return
+	}
+	defer lm.Unlock()
+	delete(lm.closed, work_str)
+	return
+}
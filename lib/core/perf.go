@@ -39,9 +39,13 @@ type WorkPerf struct {
 	MaxMemoryTotalRss  int64   `bson:"max_memory_total_rss" json:"max_memory_total_rss"`
 	MaxMemoryTotalSwap int64   `bson:"max_memory_total_swap" json:"max_memory_total_swap"`
 	ClientId           string  `bson:"client_id" json:"client_id"`
-	PreDataSize        int64   `bson:"size_predata" json:"size_predata"` //predata moved over network
-	InFileSize         int64   `bson:"size_infile" json:"size_infile"`   //input file moved over network
-	OutFileSize        int64   `bson:"size_outfile" json:"size_outfile"` //outpuf file moved over network
+	PreDataSize        int64   `bson:"size_predata" json:"size_predata"`   //predata moved over network
+	InFileSize         int64   `bson:"size_infile" json:"size_infile"`     //input file moved over network
+	OutFileSize        int64   `bson:"size_outfile" json:"size_outfile"`   //outpuf file moved over network
+	InFileMoved        int64   `bson:"moved_infile" json:"moved_infile"`   // progress: bytes of inputs and predata transferred so far
+	OutFileMoved       int64   `bson:"moved_outfile" json:"moved_outfile"` // progress: bytes of outputs transferred so far
+	ResumedSize        int64   `bson:"size_resumed" json:"size_resumed"`   // bytes not downloaded again because a partial file was resumed
+	TransferRetries    int64   `bson:"transfer_retries" json:"transfer_retries"`
 }
 
 func NewJobPerf(id string) *JobPerf {
@@ -66,3 +70,15 @@ func NewWorkPerf() *WorkPerf {
 		Queued: time.Now().Unix(),
 	}
 }
+
+// GetJobPerf returns the performance statistics of an active job or, once the job is done,
+// the stored statistics
+func GetJobPerf(id string) (perf *JobPerf, err error) {
+	if qm, ok := QMgr.(*ServerMgr); ok {
+		if perf, ok = qm.getActJob(id); ok {
+			return
+		}
+	}
+	perf, err = LoadJobPerf(id)
+	return
+}
@@ -32,6 +32,7 @@ func NewProxyMgr() *ProxyMgr {
 			coReq:        make(chan CoReq),
 			feedback:     make(chan Notice),
 			coSem:        make(chan int, 1), //non-blocking buffered channel
+			locality:     NewLocalityStats(),
 		},
 	}
 }
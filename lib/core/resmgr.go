@@ -2,10 +2,12 @@ package core
 
 import (
 	"github.com/MG-RAST/AWE/lib/user"
+	"gopkg.in/mgo.v2/bson"
 )
 
 type ClientMgr interface {
 	RegisterNewClient(FormFiles, *ClientGroup) (*Client, error)
+	AddClient(*Client, bool) error
 	ClientHeartBeat(string, *ClientGroup, WorkerState) (HeartbeatInstructions, error)
 	GetClient(string, bool) (*Client, bool, error)
 	GetClientByUser(string, *user.User) (*Client, error)
@@ -32,11 +34,16 @@ type WorkMgr interface {
 	GetWorkById(Workunit_Unique_Identifier) (*Workunit, error)
 	ShowWorkunits(string) ([]*Workunit, error)
 	ShowWorkunitsByUser(string, *user.User) []*Workunit
-	CheckoutWorkunits(string, string, *Client, int64, int) ([]*Workunit, error)
+	WorkunitsPage(bson.M, string, Filter, int, *Cursor) ([]*Workunit, *Cursor, error)
+	CheckoutWorkunits(string, string, *Client, int64, int, bool) ([]*Workunit, error)
 	NotifyWorkStatus(Notice)
 	EnqueueWorkunit(*Workunit) error
 	FetchDataToken(Workunit_Unique_Identifier, string) (string, error)
 	FetchPrivateEnv(Workunit_Unique_Identifier, string) (map[string]string, error)
+	FetchRegistryCredential(Workunit_Unique_Identifier, string, string) (*RegistryCredential, error)
+	FindRetainedWork(Workunit_Unique_Identifier) (string, bool, error)
+	RequestWorkFile(Workunit_Unique_Identifier, string) (*FileRelayResponse, error)
+	DeliverWorkFile(string, string, *FileRelayResponse) error
 }
 
 type JobMgr interface {
@@ -56,6 +63,11 @@ type JobMgr interface {
 	FinalizeWorkPerf(Workunit_Unique_Identifier, string) error
 	SaveStdLog(Workunit_Unique_Identifier, string, string) error
 	GetReportMsg(Workunit_Unique_Identifier, string) (string, error)
+	AppendLogChunk(Workunit_Unique_Identifier, string, int64, []byte) error
+	GetLogStream(Workunit_Unique_Identifier, string) (*LogStream, bool, error)
+	CloseLogStreams(Workunit_Unique_Identifier) error
+	OpenLogStreams(Workunit_Unique_Identifier) error
+	StartPrefetchedWork(Workunit_Unique_Identifier, string) error
 	RecomputeJob(string, string) error
 	UpdateQueueToken(*Job) error
 }
@@ -0,0 +1,427 @@
+package core
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core/cwl"
+	"github.com/MG-RAST/AWE/lib/logger"
+)
+
+// encrypted values look like "enc:v1:<key id>:<base64 nonce+ciphertext>", anything else is plain text.
+// The prefix is defined in the cwl package, which redacts encrypted strings in JSON documents.
+const SECRET_PREFIX = cwl.SECRET_PREFIX
+
+// SecretKeyring holds the AES-256 keys for secrets at rest. The first key of the
+// key file encrypts, all keys decrypt, so keys can be rotated by adding a new one on top.
+type SecretKeyring struct {
+	Active string
+	keys   map[string][]byte
+}
+
+// Secrets is nil unless the server called InitSecrets, values are then stored as they are
+var Secrets *SecretKeyring
+
+func InitSecrets() (err error) {
+	key_file := conf.SECRETS_KEY_FILE
+	if key_file == "" {
+		key_file = filepath.Join(conf.DATA_PATH, "secrets.key")
+	}
+
+	_, err = os.Stat(key_file)
+	if os.IsNotExist(err) {
+		err = createSecretKeyFile(key_file)
+		if err != nil {
+			err = fmt.Errorf("(InitSecrets) createSecretKeyFile returned: %s", err.Error())
+			return
+		}
+		logger.Info("created new key file for secrets: %s", key_file)
+	}
+
+	Secrets, err = ReadSecretKeyring(key_file)
+	if err != nil {
+		err = fmt.Errorf("(InitSecrets) %s", err.Error())
+		return
+	}
+	logger.Info("secrets are encrypted with key %s", Secrets.Active)
+	return
+}
+
+// InitSecretsEphemeral uses a random key that is not written to disk, for the local runner
+// which keeps jobs in memory only
+func InitSecretsEphemeral() (err error) {
+	key := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		err = fmt.Errorf("(InitSecretsEphemeral) %s", err.Error())
+		return
+	}
+	Secrets = &SecretKeyring{Active: "ephemeral", keys: map[string][]byte{"ephemeral": key}}
+	return
+}
+
+func createSecretKeyFile(key_file string) (err error) {
+	key := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return
+	}
+	err = os.MkdirAll(filepath.Dir(key_file), 0700)
+	if err != nil {
+		return
+	}
+	line := fmt.Sprintf("%s %s\n", time.Now().UTC().Format("20060102150405"), base64.StdEncoding.EncodeToString(key))
+	file, err := os.OpenFile(key_file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	_, err = file.WriteString(line)
+	if err != nil {
+		file.Close()
+		return
+	}
+	err = file.Close()
+	return
+}
+
+func ReadSecretKeyring(key_file string) (keyring *SecretKeyring, err error) {
+	file, err := os.Open(key_file)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	keyring = &SecretKeyring{keys: make(map[string][]byte)}
+
+	scanner := bufio.NewScanner(file)
+	line_number := 0
+	for scanner.Scan() {
+		line_number++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.Contains(fields[0], ":") {
+			err = fmt.Errorf("%s line %d: expected \"<key id> <base64 key>\"", key_file, line_number)
+			return
+		}
+		var key []byte
+		key, err = base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			err = fmt.Errorf("%s line %d: %s", key_file, line_number, err.Error())
+			return
+		}
+		if len(key) != 32 {
+			err = fmt.Errorf("%s line %d: key has %d bytes, 32 expected", key_file, line_number, len(key))
+			return
+		}
+		if _, ok := keyring.keys[fields[0]]; ok {
+			err = fmt.Errorf("%s line %d: duplicate key id %s", key_file, line_number, fields[0])
+			return
+		}
+		keyring.keys[fields[0]] = key
+		if keyring.Active == "" {
+			keyring.Active = fields[0]
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
+
+	if keyring.Active == "" {
+		err = fmt.Errorf("%s contains no key", key_file)
+		return
+	}
+	return
+}
+
+func (keyring *SecretKeyring) gcm(key_id string) (aead cipher.AEAD, err error) {
+	key, ok := keyring.keys[key_id]
+	if !ok {
+		err = fmt.Errorf("unknown key id %s", key_id)
+		return
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	aead, err = cipher.NewGCM(block)
+	return
+}
+
+// secret contexts: a ciphertext only decrypts in the context it was encrypted for, so a value
+// copied from another job or client group is useless
+const (
+	SECRET_CONTEXT_DATATOKEN = "datatoken"
+	SECRET_CONTEXT_ENV       = "env"    // + "/" + variable name
+	SECRET_CONTEXT_INPUTS    = "inputs" // secret inputs flow between steps under different ids, they are bound to the job only
+)
+
+func JobSecretContext(job_id string, field string) string {
+	return "job/" + job_id + "/" + field
+}
+
+func secretAAD(key_id string, context string) []byte {
+	return []byte(key_id + "\x00" + context)
+}
+
+// IsEncryptedSecret tells if the value was encrypted with the active key already
+func IsEncryptedSecret(value string) bool {
+	if Secrets == nil {
+		return strings.HasPrefix(value, SECRET_PREFIX)
+	}
+	return strings.HasPrefix(value, SECRET_PREFIX+Secrets.Active+":")
+}
+
+// EncryptSecret encrypts a plain text value with the active key. Encrypted values are refused,
+// they can only come from another job.
+func EncryptSecret(value string, context string) (encrypted string, err error) {
+	if cwl.IsSecretValue(value) {
+		err = fmt.Errorf("(EncryptSecret) value is encrypted already")
+		return
+	}
+	if Secrets == nil || value == "" {
+		encrypted = value
+		return
+	}
+
+	aead, err := Secrets.gcm(Secrets.Active)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), secretAAD(Secrets.Active, context))
+	encrypted = SECRET_PREFIX + Secrets.Active + ":" + base64.StdEncoding.EncodeToString(sealed)
+	return
+}
+
+// RenewSecret is for stored values: plain text values are encrypted, values encrypted with an older key re-encrypted
+func RenewSecret(value string, context string) (renewed string, changed bool, err error) {
+	renewed = value
+	if Secrets == nil || value == "" || IsEncryptedSecret(value) {
+		return
+	}
+	plain, err := DecryptSecret(value, context)
+	if err != nil {
+		return
+	}
+	renewed, err = EncryptSecret(plain, context)
+	if err != nil {
+		return
+	}
+	changed = true
+	return
+}
+
+// DecryptSecret returns plain text values unchanged
+func DecryptSecret(value string, context string) (plain string, err error) {
+	if !strings.HasPrefix(value, SECRET_PREFIX) {
+		plain = value
+		return
+	}
+	if Secrets == nil {
+		err = fmt.Errorf("(DecryptSecret) secret is encrypted, but no keys are loaded")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, SECRET_PREFIX), ":", 2)
+	if len(parts) != 2 {
+		err = fmt.Errorf("(DecryptSecret) malformed secret")
+		return
+	}
+	key_id := parts[0]
+
+	aead, err := Secrets.gcm(key_id)
+	if err != nil {
+		err = fmt.Errorf("(DecryptSecret) %s", err.Error())
+		return
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		err = fmt.Errorf("(DecryptSecret) %s", err.Error())
+		return
+	}
+	if len(sealed) < aead.NonceSize() {
+		err = fmt.Errorf("(DecryptSecret) secret too short")
+		return
+	}
+	nonce := sealed[:aead.NonceSize()]
+	plain_bytes, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], secretAAD(key_id, context))
+	if err != nil {
+		err = fmt.Errorf("(DecryptSecret) key %s: %s", key_id, err.Error())
+		return
+	}
+	plain = string(plain_bytes)
+	return
+}
+
+// EncryptSecretMap encrypts submitted values in place, each in the context of its key
+func EncryptSecretMap(secrets map[string]string, context string) (err error) {
+	for key, value := range secrets {
+		secrets[key], err = EncryptSecret(value, context+"/"+key)
+		if err != nil {
+			err = fmt.Errorf("(EncryptSecretMap) %s: %s", key, err.Error())
+			return
+		}
+	}
+	return
+}
+
+// RenewSecretMap is RenewSecret for all values, changed is true if any value was not encrypted with the active key
+func RenewSecretMap(secrets map[string]string, context string) (changed bool, err error) {
+	for key, value := range secrets {
+		var value_changed bool
+		secrets[key], value_changed, err = RenewSecret(value, context+"/"+key)
+		if err != nil {
+			err = fmt.Errorf("(RenewSecretMap) %s: %s", key, err.Error())
+			return
+		}
+		changed = changed || value_changed
+	}
+	return
+}
+
+// DecryptSecretMap returns a decrypted copy
+func DecryptSecretMap(secrets map[string]string, context string) (plain map[string]string, err error) {
+	if secrets == nil {
+		return
+	}
+	plain = make(map[string]string, len(secrets))
+	for key, value := range secrets {
+		plain[key], err = DecryptSecret(value, context+"/"+key)
+		if err != nil {
+			err = fmt.Errorf("(DecryptSecretMap) %s: %s", key, err.Error())
+			return
+		}
+	}
+	return
+}
+
+// RejectEncryptedInputs refuses submitted job inputs that look like secrets encrypted by the server
+func RejectEncryptedInputs(job_input *cwl.Job_document) (err error) {
+	if job_input == nil {
+		return
+	}
+	for _, named := range *job_input {
+		if containsSecretValue(named.Value) {
+			err = fmt.Errorf("(RejectEncryptedInputs) input %s must not start with %s", named.Id, SECRET_PREFIX)
+			return
+		}
+	}
+	return
+}
+
+func containsSecretValue(value cwl.CWLType) bool {
+	switch value.(type) {
+	case *cwl.String:
+		return cwl.IsSecretValue(string(*value.(*cwl.String)))
+	case *cwl.Array:
+		for _, element := range *value.(*cwl.Array) {
+			if containsSecretValue(element) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EncryptSecretInputs encrypts the values of the given inputs (CWL Secrets hint) in place and
+// returns the plain text values. Secret inputs have to be strings. Values that are encrypted
+// already have to belong to the job.
+func EncryptSecretInputs(job_input *cwl.Job_document, input_ids []string, job_id string) (plain []string, err error) {
+	if job_input == nil || len(input_ids) == 0 {
+		return
+	}
+	if Secrets == nil {
+		err = fmt.Errorf("(EncryptSecretInputs) no keys loaded to encrypt secret inputs")
+		return
+	}
+
+	context := JobSecretContext(job_id, SECRET_CONTEXT_INPUTS)
+
+	is_secret := make(map[string]bool)
+	for _, input_id := range input_ids {
+		is_secret[path.Base(input_id)] = true
+	}
+
+	for i, named := range *job_input {
+		if !is_secret[path.Base(named.Id)] || named.Value == nil {
+			continue
+		}
+		if named.Value.GetType() == cwl.CWL_null {
+			continue
+		}
+		value, ok := named.Value.(*cwl.String)
+		if !ok {
+			err = fmt.Errorf("(EncryptSecretInputs) secret input %s is not a string (type: %s)", named.Id, named.Value.GetType())
+			return
+		}
+		var plain_value string
+		plain_value, err = DecryptSecret(string(*value), context)
+		if err != nil {
+			err = fmt.Errorf("(EncryptSecretInputs) input %s: %s", named.Id, err.Error())
+			return
+		}
+		plain = append(plain, plain_value)
+
+		var encrypted string
+		encrypted, err = EncryptSecret(plain_value, context)
+		if err != nil {
+			err = fmt.Errorf("(EncryptSecretInputs) input %s: %s", named.Id, err.Error())
+			return
+		}
+		(*job_input)[i].Value = cwl.NewString(encrypted)
+	}
+	return
+}
+
+// setupSecretInputs encrypts the inputs listed in a Secrets hint of the tool and lists all
+// encrypted inputs in the workunit, the worker fetches their values via the private env channel
+func setupSecretInputs(cwl_work *CWL_workunit, job_id string) (err error) {
+	if cwl_work.Job_input == nil {
+		return
+	}
+
+	var tool_hints []cwl.Requirement
+	switch cwl_work.Tool.(type) {
+	case *cwl.CommandLineTool:
+		tool_hints = cwl_work.Tool.(*cwl.CommandLineTool).Hints
+	case *cwl.ExpressionTool:
+		tool_hints = cwl_work.Tool.(*cwl.ExpressionTool).Hints
+	}
+
+	tool_secrets, err := cwl.GetSecretInputsOfRequirements(tool_hints)
+	if err != nil {
+		return
+	}
+	_, err = EncryptSecretInputs(cwl_work.Job_input, tool_secrets, job_id)
+	if err != nil {
+		return
+	}
+
+	cwl_work.Secrets = nil
+	for _, named := range *cwl_work.Job_input {
+		value, ok := named.Value.(*cwl.String)
+		if ok && cwl.IsSecretValue(string(*value)) {
+			cwl_work.Secrets = append(cwl_work.Secrets, path.Base(named.Id))
+		}
+	}
+	return
+}
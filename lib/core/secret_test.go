@@ -0,0 +1,228 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MG-RAST/AWE/lib/core/cwl"
+)
+
+func setTestSecrets(t *testing.T) {
+	old_key := make([]byte, 32)
+	new_key := make([]byte, 32)
+	new_key[0] = 1
+	Secrets = &SecretKeyring{Active: "new", keys: map[string][]byte{"old": old_key, "new": new_key}}
+}
+
+// encryptWithKey encrypts with a key that is not the active one, like a value stored before a key rotation
+func encryptWithKey(t *testing.T, key_id string, value string, context string) string {
+	active := Secrets.Active
+	Secrets.Active = key_id
+	defer func() { Secrets.Active = active }()
+	encrypted, err := EncryptSecret(value, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypted
+}
+
+func TestSecretRoundTrip(t *testing.T) {
+	setTestSecrets(t)
+	defer func() { Secrets = nil }()
+
+	job_a := JobSecretContext("a", SECRET_CONTEXT_DATATOKEN)
+	job_b := JobSecretContext("b", SECRET_CONTEXT_DATATOKEN)
+	env_a := JobSecretContext("a", SECRET_CONTEXT_ENV)
+
+	tests := []struct {
+		name            string
+		encrypt_context string
+		decrypt_context string
+		fails           bool
+	}{
+		{"same job", job_a, job_a, false},
+		{"other job", job_a, job_b, true},
+		{"other field", job_a, env_a, true},
+		{"client group", "clientgroup/cg/registry/docker.io", "clientgroup/other/registry/docker.io", true},
+	}
+
+	for _, test := range tests {
+		encrypted, err := EncryptSecret("s3cret", test.encrypt_context)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if !strings.HasPrefix(encrypted, SECRET_PREFIX+"new:") || strings.Contains(encrypted, "s3cret") {
+			t.Errorf("%s: not encrypted with the active key: %s", test.name, encrypted)
+		}
+		plain, err := DecryptSecret(encrypted, test.decrypt_context)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: decrypted in the wrong context", test.name)
+			}
+			continue
+		}
+		if err != nil || plain != "s3cret" {
+			t.Errorf("%s: got %q, %v", test.name, plain, err)
+		}
+	}
+}
+
+func TestEncryptSecretRefusesEncrypted(t *testing.T) {
+	setTestSecrets(t)
+	defer func() { Secrets = nil }()
+
+	context := JobSecretContext("a", SECRET_CONTEXT_DATATOKEN)
+	encrypted, err := EncryptSecret("s3cret", context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = EncryptSecret(encrypted, context); err == nil {
+		t.Errorf("encrypted value accepted")
+	}
+
+	env := map[string]string{"PASSWORD": encrypted}
+	if err = EncryptSecretMap(env, JobSecretContext("b", SECRET_CONTEXT_ENV)); err == nil {
+		t.Errorf("encrypted environment variable accepted")
+	}
+}
+
+func TestRenewSecret(t *testing.T) {
+	setTestSecrets(t)
+	defer func() { Secrets = nil }()
+
+	context := JobSecretContext("a", SECRET_CONTEXT_DATATOKEN)
+	active, err := EncryptSecret("s3cret", context)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		changed bool
+	}{
+		{"plain", "s3cret", true},
+		{"older key", encryptWithKey(t, "old", "s3cret", context), true},
+		{"active key", active, false},
+	}
+
+	for _, test := range tests {
+		renewed, changed, err := RenewSecret(test.value, context)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if changed != test.changed || !IsEncryptedSecret(renewed) {
+			t.Errorf("%s: changed=%t value=%s", test.name, changed, renewed)
+		}
+		plain, err := DecryptSecret(renewed, context)
+		if err != nil || plain != "s3cret" {
+			t.Errorf("%s: got %q, %v", test.name, plain, err)
+		}
+	}
+
+	// a value of another job does not decrypt, so it is not renewed either
+	if _, _, err = RenewSecret(encryptWithKey(t, "old", "s3cret", context), JobSecretContext("b", SECRET_CONTEXT_DATATOKEN)); err == nil {
+		t.Errorf("value of another job renewed")
+	}
+}
+
+func TestSecretInputs(t *testing.T) {
+	setTestSecrets(t)
+	defer func() { Secrets = nil }()
+
+	foreign, err := EncryptSecret("s3cret", JobSecretContext("other", SECRET_CONTEXT_INPUTS))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		value    cwl.CWLType
+		rejected bool
+	}{
+		{"plain string", cwl.NewString("s3cret"), false},
+		{"encrypted string", cwl.NewString(foreign), true},
+		{"encrypted in array", &cwl.Array{cwl.NewString("x"), cwl.NewString(foreign)}, true},
+		{"int", cwl.NewInt(3), false},
+	}
+
+	for _, test := range tests {
+		job_input := &cwl.Job_document{cwl.NewNamedCWLType("password", test.value)}
+		err := RejectEncryptedInputs(job_input)
+		if (err != nil) != test.rejected {
+			t.Errorf("%s: rejected=%t, expected %t", test.name, err != nil, test.rejected)
+		}
+	}
+
+	job_input := &cwl.Job_document{cwl.NewNamedCWLType("#main/password", cwl.NewString("s3cret"))}
+	plain, err := EncryptSecretInputs(job_input, []string{"password"}, "job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plain) != 1 || plain[0] != "s3cret" {
+		t.Errorf("plain values: %v", plain)
+	}
+	encrypted := string(*(*job_input)[0].Value.(*cwl.String))
+	if !IsEncryptedSecret(encrypted) {
+		t.Errorf("input not encrypted: %s", encrypted)
+	}
+
+	// encrypting again keeps the value of the same job, but not that of another job
+	if _, err = EncryptSecretInputs(job_input, []string{"password"}, "job"); err != nil {
+		t.Errorf("value of the same job refused: %s", err.Error())
+	}
+	job_input = &cwl.Job_document{cwl.NewNamedCWLType("#main/password", cwl.NewString(foreign))}
+	if _, err = EncryptSecretInputs(job_input, []string{"password"}, "job"); err == nil {
+		t.Errorf("value of another job accepted")
+	}
+}
+
+func TestReadSecretKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awe_secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=" // 32 bytes
+
+	tests := []struct {
+		name   string
+		file   string
+		active string
+		fails  bool
+	}{
+		{"first key is active", "# comment\nnew " + key + "\nold " + key + "\n", "new", false},
+		{"short key", "k MDEy\n", "", true},
+		{"duplicate id", "k " + key + "\nk " + key + "\n", "", true},
+		{"colon in id", "a:b " + key + "\n", "", true},
+		{"empty", "\n", "", true},
+	}
+
+	for i, test := range tests {
+		key_file := filepath.Join(dir, string(rune('a'+i)))
+		err = ioutil.WriteFile(key_file, []byte(test.file), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyring, err := ReadSecretKeyring(key_file)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if keyring.Active != test.active {
+			t.Errorf("%s: active key %s, expected %s", test.name, keyring.Active, test.active)
+		}
+	}
+}
@@ -14,6 +14,7 @@ import (
 	shock "github.com/MG-RAST/go-shock-client"
 	"github.com/davecgh/go-spew/spew"
 	"github.com/robertkrimen/otto"
+	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"io/ioutil"
 	"os"
@@ -39,6 +40,7 @@ type ServerMgr struct {
 	TaskMap        TaskMap
 	ajLock         sync.RWMutex
 	actJobs        map[string]*JobPerf
+	logStreams     *LogStreamMap
 }
 
 func NewServerMgr() *ServerMgr {
@@ -48,14 +50,17 @@ func NewServerMgr() *ServerMgr {
 			workQueue:    NewWorkQueue(),
 			suspendQueue: false,
 
-			coReq:    make(chan CoReq, conf.COREQ_LENGTH), // number of clients that wait in queue to get a workunit. If queue is full, other client will be rejected and have to come back later again
-			feedback: make(chan Notice),
-			coSem:    make(chan int, 1), //non-blocking buffered channel
+			coReq:     make(chan CoReq, conf.COREQ_LENGTH), // number of clients that wait in queue to get a workunit. If queue is full, other client will be rejected and have to come back later again
+			feedback:  make(chan Notice),
+			coSem:     make(chan int, 1), //non-blocking buffered channel
+			fileRelay: NewFileRelay(),
+			locality:  NewLocalityStats(),
 
 		},
 		lastUpdate: time.Now().Add(time.Second * -30),
 		TaskMap:    *NewTaskMap(),
 		actJobs:    map[string]*JobPerf{},
+		logStreams: NewLogStreamMap(),
 	}
 }
 
@@ -78,10 +83,10 @@ func (qm *ServerMgr) UpdateQueueLoop() {
 		}
 		elapsed := time.Since(start)
 
-		if elapsed <= 1 {
+		if elapsed <= time.Second {
 			time.Sleep(1 * time.Second) // wait at least 5 seconds
-		} else if elapsed > 5 && elapsed < 30 {
-			time.Sleep(elapsed * time.Second)
+		} else if elapsed > 5*time.Second && elapsed < 30*time.Second {
+			time.Sleep(elapsed)
 		} else {
 			time.Sleep(30 * time.Second) // wait at mnost 30 seconds
 		}
@@ -250,6 +255,13 @@ func (qm *ServerMgr) GetQueue(name string) interface{} {
 		}
 		return workunits
 	}
+	if name == "workprefetch" {
+		workunits, err := qm.workQueue.Prefetch.GetWorkunits()
+		if err != nil {
+			return err
+		}
+		return workunits
+	}
 	if name == "worksuspend" {
 		workunits, err := qm.workQueue.Suspend.GetWorkunits()
 		if err != nil {
@@ -351,9 +363,28 @@ func (qm *ServerMgr) isSusJob(id string) (has bool) {
 
 //--------active job accessor methods-------
 
+// copyJobPerf returns a deep copy, the perf of an active job is only changed by updateActJob
 func (qm *ServerMgr) copyJobPerf(a *JobPerf) (b *JobPerf) {
 	b = new(JobPerf)
 	*b = *a
+	b.Ptasks = make(map[string]*TaskPerf, len(a.Ptasks))
+	for id, taskperf := range a.Ptasks {
+		if taskperf == nil {
+			continue
+		}
+		c := *taskperf
+		c.InFileSizes = append([]int64(nil), taskperf.InFileSizes...)
+		c.OutFileSizes = append([]int64(nil), taskperf.OutFileSizes...)
+		b.Ptasks[id] = &c
+	}
+	b.Pworks = make(map[string]*WorkPerf, len(a.Pworks))
+	for id, workperf := range a.Pworks {
+		if workperf == nil {
+			continue
+		}
+		c := *workperf
+		b.Pworks[id] = &c
+	}
 	return
 }
 
@@ -370,6 +401,18 @@ func (qm *ServerMgr) putActJob(jperf *JobPerf) {
 	qm.ajLock.Unlock()
 }
 
+// updateActJob changes the perf of an active job under ajLock, ok is false if the job is not active
+func (qm *ServerMgr) updateActJob(id string, update func(perf *JobPerf)) (ok bool) {
+	qm.ajLock.Lock()
+	defer qm.ajLock.Unlock()
+	perf, ok := qm.actJobs[id]
+	if ok {
+		update(perf)
+	}
+	return
+}
+
+// getActJob returns a copy of the perf of an active job
 func (qm *ServerMgr) getActJob(id string) (*JobPerf, bool) {
 	qm.ajLock.RLock()
 	defer qm.ajLock.RUnlock()
@@ -684,6 +727,38 @@ func (qm *ServerMgr) handleWorkStatDone(client *Client, clientid string, task *T
 
 	// ******* LAST WORKUNIT ******
 
+	if task.Split != nil {
+		var split_done bool
+		var serr error
+		split_done, serr = qm.advanceTaskSplit(task)
+		if serr != nil {
+			// e.g. a chunk without results, the step output would be incomplete
+			err_msg := fmt.Sprintf("(handleWorkStatDone) advanceTaskSplit failed: %s", serr.Error())
+			jerror := &JobError{
+				ClientFailed: clientid,
+				WorkFailed:   work_str,
+				TaskFailed:   task_str,
+				ServerNotes:  err_msg,
+				Status:       JOB_STAT_SUSPEND,
+			}
+			err = task.SetState(TASK_STAT_SUSPEND, true)
+			if err != nil {
+				err = fmt.Errorf("(handleWorkStatDone) task.SetState failed: %s", err.Error())
+				return
+			}
+			err = qm.SuspendJob(task.JobId, jerror)
+			if err != nil {
+				err = fmt.Errorf("(handleWorkStatDone) SuspendJob failed: %s", err.Error())
+				return
+			}
+			err = errors.New(err_msg)
+			return
+		}
+		if !split_done {
+			return
+		}
+	}
+
 	// validate file sizes of all outputs
 	verr := task.ValidateOutputs()
 	if verr != nil {
@@ -785,7 +860,15 @@ func (qm *ServerMgr) handleNoticeWorkDelivered(notice Notice) (err error) {
 		return
 	}
 
-	if notice.Results != nil { // TODO one workunit vs multiple !!!!!!!!!!!!!!!!!!!!!!!!!!!!!
+	if task.Split != nil {
+		// outputs of the chunks are merged when the last workunit is done
+		if notice.Results != nil {
+			err = task.Split.SetResults(task, work_id.Rank, notice.Results)
+			if err != nil {
+				return
+			}
+		}
+	} else if notice.Results != nil { // TODO one workunit vs multiple !!!!!!!!!!!!!!!!!!!!!!!!!!!!!
 		err = task.SetStepOutput(notice.Results, true)
 		if err != nil {
 			return
@@ -803,8 +886,8 @@ func (qm *ServerMgr) handleNoticeWorkDelivered(notice Notice) (err error) {
 		err = fmt.Errorf("(handleNoticeWorkDelivered) workunit %s not found in workQueue", work_str)
 		return
 	}
-	if work.State != WORK_STAT_CHECKOUT && work.State != WORK_STAT_RESERVED {
-		err = fmt.Errorf("(handleNoticeWorkDelivered) workunit %s did not have state WORK_STAT_CHECKOUT or WORK_STAT_RESERVED (state is %s)", work_str, work.State)
+	if work.State != WORK_STAT_CHECKOUT && work.State != WORK_STAT_RESERVED && work.State != WORK_STAT_PREFETCHED {
+		err = fmt.Errorf("(handleNoticeWorkDelivered) workunit %s did not have state WORK_STAT_CHECKOUT, WORK_STAT_RESERVED or WORK_STAT_PREFETCHED (state is %s)", work_str, work.State)
 		return
 	}
 
@@ -882,6 +965,8 @@ func (qm *ServerMgr) handleNoticeWorkDelivered(notice Notice) (err error) {
 			ServerNotes:  "exit code 42 encountered",
 			WorkNotes:    notes,
 			AppError:     notice.Stderr,
+			Reason:       notice.FailureReason,
+			ExitStatus:   notice.ExitStatus,
 			Status:       JOB_STAT_FAILED_PERMANENT,
 		}
 		if err = qm.SuspendJob(job_id, jerror); err != nil {
@@ -918,6 +1003,8 @@ func (qm *ServerMgr) handleNoticeWorkDelivered(notice Notice) (err error) {
 				ServerNotes:  fmt.Sprintf("workunit failed %d time(s)", MAX_FAILURE),
 				WorkNotes:    notes,
 				AppError:     notice.Stderr,
+				Reason:       notice.FailureReason,
+				ExitStatus:   notice.ExitStatus,
 				Status:       JOB_STAT_SUSPEND,
 			}
 			if err = qm.SuspendJob(job_id, jerror); err != nil {
@@ -974,6 +1061,10 @@ func (qm *ServerMgr) GetJsonStatus() (status map[string]map[string]int, err erro
 	if err != nil {
 		return
 	}
+	prefetch_work, err := qm.workQueue.Prefetch.Len()
+	if err != nil {
+		return
+	}
 	total_active_work, err := qm.workQueue.Len()
 	if err != nil {
 		return
@@ -1057,10 +1148,11 @@ func (qm *ServerMgr) GetJsonStatus() (status map[string]map[string]int, err erro
 		"failed":      fail_skip_task,
 	}
 	workunits := map[string]int{
-		"total":     total_active_work,
-		"queuing":   queuing_work,
-		"checkout":  out_work,
-		"suspended": suspend_work,
+		"total":      total_active_work,
+		"queuing":    queuing_work,
+		"checkout":   out_work,
+		"prefetched": prefetch_work,
+		"suspended":  suspend_work,
 	}
 	clients := map[string]int{
 		"total":     total_client,
@@ -1068,11 +1160,16 @@ func (qm *ServerMgr) GetJsonStatus() (status map[string]map[string]int, err erro
 		"idle":      idle_client,
 		"suspended": suspend_client,
 	}
+	locality, err := qm.locality.Status()
+	if err != nil {
+		return
+	}
 	status = map[string]map[string]int{
 		"jobs":      jobs,
 		"tasks":     tasks,
 		"workunits": workunits,
 		"clients":   clients,
+		"locality":  locality,
 	}
 	return
 }
@@ -1093,11 +1190,15 @@ func (qm *ServerMgr) GetTextStatus() string {
 		fmt.Sprintf("total workunits .......... %d\n", status["workunits"]["total"]) +
 		fmt.Sprintf("    queuing:          (%d)\n", status["workunits"]["queuing"]) +
 		fmt.Sprintf("    checkout:         (%d)\n", status["workunits"]["checkout"]) +
+		fmt.Sprintf("    prefetched:       (%d)\n", status["workunits"]["prefetched"]) +
 		fmt.Sprintf("    suspended:        (%d)\n", status["workunits"]["suspended"]) +
 		fmt.Sprintf("total clients ............ %d\n", status["clients"]["total"]) +
 		fmt.Sprintf("    busy:             (%d)\n", status["clients"]["busy"]) +
 		fmt.Sprintf("    idle:             (%d)\n", status["clients"]["idle"]) +
 		fmt.Sprintf("    suspend:          (%d)\n", status["clients"]["suspended"]) +
+		fmt.Sprintf("locality hit rate ........ %d%%\n", status["locality"]["hit_rate"]) +
+		fmt.Sprintf("    checkouts:        (%d)\n", status["locality"]["checkouts"]) +
+		fmt.Sprintf("    cached MB:        (%d of %d)\n", status["locality"]["local_mb"], status["locality"]["total_mb"]) +
 		fmt.Sprintf("---last update: %s\n\n", time.Now())
 	return statMsg
 }
@@ -1132,7 +1233,20 @@ func (qm *ServerMgr) FetchDataToken(work_id Workunit_Unique_Identifier, clientid
 	if err != nil {
 		return
 	}
-	token = job.GetDataToken()
+	has_work, err := client.Assigned_work.Has(work_id)
+	if err != nil {
+		return
+	}
+	if !has_work {
+		err = fmt.Errorf("(FetchDataToken) workunit is not assigned to client %s", clientid)
+		return
+	}
+
+	token, err = DecryptSecret(job.GetDataToken(), JobSecretContext(job.Id, SECRET_CONTEXT_DATATOKEN))
+	if err != nil {
+		err = fmt.Errorf("(FetchDataToken) %s", err.Error())
+		return
+	}
 	if token == "" {
 		var work_str string
 		work_str, err = work_id.String()
@@ -1213,6 +1327,53 @@ func (qm *ServerMgr) GetReportMsg(id Workunit_Unique_Identifier, logname string)
 	return string(content), err
 }
 
+// AppendLogChunk stores a chunk of stdout/stderr sent by the worker while the workunit is running
+func (qm *ServerMgr) AppendLogChunk(id Workunit_Unique_Identifier, logname string, offset int64, chunk []byte) (err error) {
+	if logname != "stdout" && logname != "stderr" {
+		err = errors.New("log type '" + logname + "' cannot be streamed")
+		return
+	}
+	ls, _, err := qm.logStreams.Get(id, logname, true)
+	if err != nil {
+		err = fmt.Errorf("(AppendLogChunk) logStreams.Get returned: %s", err.Error())
+		return
+	}
+	err = ls.Append(offset, chunk)
+	if err != nil {
+		err = fmt.Errorf("(AppendLogChunk) ls.Append returned: %s", err.Error())
+		return
+	}
+	return
+}
+
+// GetLogStream returns the live log of a running workunit, ok is false if the worker has not sent anything (yet)
+func (qm *ServerMgr) GetLogStream(id Workunit_Unique_Identifier, logname string) (ls *LogStream, ok bool, err error) {
+	ls, ok, err = qm.logStreams.Get(id, logname, false)
+	return
+}
+
+// CloseLogStreams ends the live logs of a workunit, the final logs are available via GetReportMsg
+func (qm *ServerMgr) CloseLogStreams(id Workunit_Unique_Identifier) (err error) {
+	err = qm.logStreams.Delete(id)
+	return
+}
+
+// OpenLogStreams allows live logs of a workunit that has been checked out (again)
+func (qm *ServerMgr) OpenLogStreams(id Workunit_Unique_Identifier) (err error) {
+	err = qm.logStreams.Open(id)
+	return
+}
+
+// HasStdLog reports whether a log (stdout, stderr, worknotes) of the workunit has been saved
+func HasStdLog(id Workunit_Unique_Identifier, logname string) bool {
+	logpath, err := getStdLogPathByWorkId(id, logname)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(logpath)
+	return err == nil
+}
+
 func getStdLogPathByWorkId(id Workunit_Unique_Identifier, logname string) (savedpath string, err error) {
 	jobid := id.JobId
 
@@ -1634,7 +1795,7 @@ func (qm *ServerMgr) taskEnQueue(task_id Task_Unique_Identifier, task *Task, job
 
 			// create tasks
 			var sub_workflow_tasks []*Task
-			sub_workflow_tasks, err = CreateTasks(job, new_sub_workflow, wfl.Steps)
+			sub_workflow_tasks, err = CreateTasks(job, job.CWL_collection, new_sub_workflow, wfl.Steps)
 
 			err = job.IncrementRemainTasks(len(sub_workflow_tasks))
 			if err != nil {
@@ -1719,6 +1880,39 @@ func (qm *ServerMgr) taskEnQueue(task_id Task_Unique_Identifier, task *Task, job
 		return
 	}
 
+	if !skip_workunit && task.WorkflowStep != nil {
+		var split_requirement *cwl.SplitRequirement
+		split_requirement, err = cwl.GetSplitRequirement(task.WorkflowStep)
+		if err != nil {
+			err = fmt.Errorf("(taskEnQueue) GetSplitRequirement: %s", err.Error())
+			return
+		}
+		if split_requirement != nil && task.Split == nil {
+			// one workunit splits the input, the chunk workunits are created when it is done
+			err = task.SetSplit(NewTaskSplit(split_requirement), true)
+			if err != nil {
+				err = fmt.Errorf("(taskEnQueue) SetSplit: %s", err.Error())
+				return
+			}
+			err = task.setTotalWork(1, true)
+			if err != nil {
+				return
+			}
+		} else if split_requirement != nil {
+			// recovered or resumed, continue with the phase the split was in
+			var ranks []int
+			ranks, err = task.Split.PendingRanks()
+			if err != nil {
+				err = fmt.Errorf("(taskEnQueue) PendingRanks: %s", err.Error())
+				return
+			}
+			err = task.SetRemainWork(len(ranks), true)
+			if err != nil {
+				return
+			}
+		}
+	}
+
 	if !skip_workunit {
 		workunitStart := time.Now()
 		err = qm.CreateAndEnqueueWorkunits(task, job)
@@ -2202,15 +2396,23 @@ func (qm *ServerMgr) CreateAndEnqueueWorkunits(task *Task, job *Job) (err error)
 		err = fmt.Errorf("(CreateAndEnqueueWorkunits) error in CreateWorkunits: %s", err.Error())
 		return err
 	}
+	err = qm.EnqueueWorkunits(workunits)
+	if err != nil {
+		err = fmt.Errorf("(CreateAndEnqueueWorkunits) %s", err.Error())
+	}
+	return
+}
+
+func (qm *ServerMgr) EnqueueWorkunits(workunits []*Workunit) (err error) {
 	for _, wu := range workunits {
 		if err := qm.workQueue.Add(wu); err != nil {
-			err = fmt.Errorf("(CreateAndEnqueueWorkunits) error in qm.workQueue.Add: %s", err.Error())
+			err = fmt.Errorf("(EnqueueWorkunits) error in qm.workQueue.Add: %s", err.Error())
 			return err
 		}
 		id := wu.GetId()
 		err = qm.CreateWorkPerf(id)
 		if err != nil {
-			err = fmt.Errorf("(CreateAndEnqueueWorkunits) error in CreateWorkPerf: %s", err.Error())
+			err = fmt.Errorf("(EnqueueWorkunits) error in CreateWorkPerf: %s", err.Error())
 			return
 		}
 	}
@@ -2295,7 +2497,12 @@ func (qm *ServerMgr) createOutputNode(task *Task) (err error) {
 			// POST empty shock node for this output
 			logger.Debug(2, "(createOutputNode) posting output Shock node for file %s in task %s", io.FileName, task.Id)
 
-			sc := shock.ShockClient{Host: io.Host, Token: task.Info.DataToken}
+			var token string
+			token, err = DecryptSecret(task.Info.DataToken, JobSecretContext(task.JobId, SECRET_CONTEXT_DATATOKEN))
+			if err != nil {
+				return
+			}
+			sc := shock.ShockClient{Host: io.Host, Token: token}
 			var nodeid string
 			nodeid, err = sc.CreateNode(io.FileName, task.TotalWork)
 			if err != nil {
@@ -2864,19 +3071,27 @@ func (qm *ServerMgr) updateJobTask(task *Task) (err error) {
 	//set expiration from conf if not set
 	nullTime := time.Time{}
 
-	job_expiration, xerr := dbGetJobFieldTime(jobid, "expiration")
-	if xerr != nil {
-		err = xerr
-		return
+	var job_expiration time.Time
+	if dbDisabled() {
+		job_expiration = job.Expiration
+	} else {
+		job_expiration, err = dbGetJobFieldTime(jobid, "expiration")
+		if err != nil {
+			return
+		}
 	}
 
 	if job_expiration == nullTime {
 		expire := conf.GLOBAL_EXPIRE
 
-		job_info_pipeline, xerr := dbGetJobFieldString(jobid, "info.pipeline")
-		if xerr != nil {
-			err = xerr
-			return
+		var job_info_pipeline string
+		if dbDisabled() {
+			job_info_pipeline = job.Info.Pipeline
+		} else {
+			job_info_pipeline, err = dbGetJobFieldString(jobid, "info.pipeline")
+			if err != nil {
+				return
+			}
 		}
 
 		if val, ok := conf.PIPELINE_EXPIRE_MAP[job_info_pipeline]; ok {
@@ -3359,6 +3574,13 @@ func (qm *ServerMgr) RecomputeJob(jobid string, stage string) (err error) {
 				err = errors.New("(RecomputeJob) failed to reset task " + err.Error())
 				return
 			}
+			if task.Split != nil {
+				err = task.SetSplit(nil, true)
+				if err != nil {
+					err = errors.New("(RecomputeJob) failed to reset split " + err.Error())
+					return
+				}
+			}
 			found = true
 			remaintasks += 1
 		}
@@ -3390,6 +3612,13 @@ func (qm *ServerMgr) RecomputeJob(jobid string, stage string) (err error) {
 				err = errors.New("(RecomputeJob) failed to reset task " + err.Error())
 				return
 			}
+			if task.Split != nil {
+				err = task.SetSplit(nil, true)
+				if err != nil {
+					err = errors.New("(RecomputeJob) failed to reset split " + err.Error())
+					return
+				}
+			}
 			remaintasks += 1
 		}
 	}
@@ -3458,6 +3687,13 @@ func (qm *ServerMgr) ResubmitJob(jobid string) (err error) {
 			err = errors.New("(ResubmitJob) failed to reset task " + err.Error())
 			return
 		}
+		if task.Split != nil {
+			err = task.SetSplit(nil, true)
+			if err != nil {
+				err = errors.New("(ResubmitJob) failed to reset split " + err.Error())
+				return
+			}
+		}
 		remaintasks += 1
 	}
 
@@ -3552,36 +3788,34 @@ func (qm *ServerMgr) CreateJobPerf(jobid string) {
 }
 
 func (qm *ServerMgr) UpdateJobPerfStartTime(jobid string) {
-	if perf, ok := qm.getActJob(jobid); ok {
-		now := time.Now().Unix()
-		perf.Start = now
-		qm.putActJob(perf)
-	}
+	qm.updateActJob(jobid, func(perf *JobPerf) {
+		perf.Start = time.Now().Unix()
+	})
 	return
 }
 
 func (qm *ServerMgr) FinalizeJobPerf(jobid string) {
-	if perf, ok := qm.getActJob(jobid); ok {
+	qm.updateActJob(jobid, func(perf *JobPerf) {
 		now := time.Now().Unix()
 		perf.End = now
 		perf.Resp = now - perf.Queued
-		qm.putActJob(perf)
-	}
+	})
 	return
 }
 
 func (qm *ServerMgr) CreateTaskPerf(task *Task) (err error) {
 	jobid := task.JobId
 	//taskid := task.String()
-	if perf, ok := qm.getActJob(jobid); ok {
+	if qm.isActJob(jobid) {
 		var task_str string
 		task_str, err = task.String()
 		if err != nil {
 			err = fmt.Errorf("() task.String returned: %s", err.Error())
 			return
 		}
-		perf.Ptasks[task_str] = NewTaskPerf(task_str)
-		qm.putActJob(perf)
+		qm.updateActJob(jobid, func(perf *JobPerf) {
+			perf.Ptasks[task_str] = NewTaskPerf(task_str)
+		})
 	}
 	return
 }
@@ -3589,18 +3823,18 @@ func (qm *ServerMgr) CreateTaskPerf(task *Task) (err error) {
 func (qm *ServerMgr) UpdateTaskPerfStartTime(task *Task) (err error) {
 	jobid := task.JobId
 
-	if jobperf, ok := qm.getActJob(jobid); ok {
+	if qm.isActJob(jobid) {
 		var task_str string
 		task_str, err = task.String()
 		if err != nil {
 			err = fmt.Errorf("() task.String returned: %s", err.Error())
 			return
 		}
-		if taskperf, ok := jobperf.Ptasks[task_str]; ok {
-			now := time.Now().Unix()
-			taskperf.Start = now
-			qm.putActJob(jobperf)
-		}
+		qm.updateActJob(jobid, func(jobperf *JobPerf) {
+			if taskperf, ok := jobperf.Ptasks[task_str]; ok {
+				taskperf.Start = time.Now().Unix()
+			}
+		})
 	}
 	return
 }
@@ -3612,7 +3846,7 @@ func (qm *ServerMgr) FinalizeTaskPerf(task *Task) (err error) {
 	if err != nil {
 		return
 	}
-	if jobperf, ok := qm.getActJob(jobid); ok {
+	if qm.isActJob(jobid) {
 		//combined_id := task.String()
 		var task_str string
 		task_str, err = task.String()
@@ -3621,7 +3855,11 @@ func (qm *ServerMgr) FinalizeTaskPerf(task *Task) (err error) {
 			return
 		}
 
-		if taskperf, ok := jobperf.Ptasks[task_str]; ok {
+		qm.updateActJob(jobid, func(jobperf *JobPerf) {
+			taskperf, ok := jobperf.Ptasks[task_str]
+			if !ok {
+				return
+			}
 			now := time.Now().Unix()
 			taskperf.End = now
 			taskperf.Resp = now - taskperf.Queued
@@ -3632,9 +3870,7 @@ func (qm *ServerMgr) FinalizeTaskPerf(task *Task) (err error) {
 			for _, io := range task.Outputs {
 				taskperf.OutFileSizes = append(taskperf.OutFileSizes, io.Size)
 			}
-			qm.putActJob(jobperf)
-			return
-		}
+		})
 	}
 	return
 }
@@ -3645,20 +3881,20 @@ func (qm *ServerMgr) CreateWorkPerf(id Workunit_Unique_Identifier) (err error) {
 	}
 	//workid := id.String()
 	jobid := id.JobId
-	jobperf, ok := qm.getActJob(jobid)
-	if !ok {
-		err = fmt.Errorf("(CreateWorkPerf) job perf not found: %s", jobid)
-		return
-	}
 	var work_str string
 	work_str, err = id.String()
 	if err != nil {
 		err = fmt.Errorf("(CreateWorkPerf) id.String() returned: %s", err.Error())
 		return
 	}
-	jobperf.Pworks[work_str] = NewWorkPerf()
+	ok := qm.updateActJob(jobid, func(jobperf *JobPerf) {
+		jobperf.Pworks[work_str] = NewWorkPerf()
+	})
+	if !ok {
+		err = fmt.Errorf("(CreateWorkPerf) job perf not found: %s", jobid)
+		return
+	}
 	fmt.Println("write jobperf.Pworks: " + work_str)
-	qm.putActJob(jobperf)
 
 	return
 }
@@ -3676,10 +3912,6 @@ func (qm *ServerMgr) FinalizeWorkPerf(id Workunit_Unique_Identifier, reportfile
 		return err
 	}
 	jobid := id.JobId
-	jobperf, ok := qm.getActJob(jobid)
-	if !ok {
-		return errors.New("(FinalizeWorkPerf) job perf not found:" + jobid)
-	}
 	//workid := id.String()
 	var work_str string
 	work_str, err = id.String()
@@ -3687,18 +3919,24 @@ func (qm *ServerMgr) FinalizeWorkPerf(id Workunit_Unique_Identifier, reportfile
 		err = fmt.Errorf("(FinalizeWorkPerf) workid.String() returned: %s", err.Error())
 		return
 	}
-	if _, ok := jobperf.Pworks[work_str]; !ok {
-		for key, _ := range jobperf.Pworks {
-			fmt.Println("FinalizeWorkPerf jobperf.Pworks: " + key)
+	found := false
+	ok := qm.updateActJob(jobid, func(jobperf *JobPerf) {
+		queued, ok := jobperf.Pworks[work_str]
+		if !ok {
+			return
 		}
+		found = true
+		workperf.Queued = queued.Queued
+		workperf.Done = time.Now().Unix()
+		workperf.Resp = workperf.Done - workperf.Queued
+		jobperf.Pworks[work_str] = workperf
+	})
+	if !ok {
+		return errors.New("(FinalizeWorkPerf) job perf not found:" + jobid)
+	}
+	if !found {
 		return errors.New("(FinalizeWorkPerf) work perf not found:" + work_str)
 	}
-
-	workperf.Queued = jobperf.Pworks[work_str].Queued
-	workperf.Done = time.Now().Unix()
-	workperf.Resp = workperf.Done - workperf.Queued
-	jobperf.Pworks[work_str] = workperf
-	qm.putActJob(jobperf)
 	os.Remove(reportfile)
 	return
 }
@@ -3753,7 +3991,49 @@ func (qm *ServerMgr) FetchPrivateEnv(id Workunit_Unique_Identifier, clientid str
 		return
 	}
 
-	env = task.Cmd.Environ.Private
+	has_work, err := client.Assigned_work.Has(id)
+	if err != nil {
+		return
+	}
+	if !has_work {
+		err = fmt.Errorf("(FetchPrivateEnv) workunit is not assigned to client %s", clientid)
+		return
+	}
+
+	env, err = DecryptSecretMap(task.Cmd.Environ.Private, JobSecretContext(task.JobId, SECRET_CONTEXT_ENV))
+	if err != nil {
+		err = fmt.Errorf("(FetchPrivateEnv) %s", err.Error())
+		return
+	}
+
+	// CWL workunits receive their secret inputs here, keyed by input id
+	work, has_workunit, err := qm.workQueue.Get(id)
+	if err != nil {
+		err = fmt.Errorf("(FetchPrivateEnv) qm.workQueue.Get returned: %s", err.Error())
+		return
+	}
+	if !has_workunit || work.CWL_workunit == nil || len(work.CWL_workunit.Secrets) == 0 || work.CWL_workunit.Job_input == nil {
+		return
+	}
+	if env == nil {
+		env = make(map[string]string)
+	}
+	job_input_map := make(map[string]cwl.CWLType)
+	for _, named := range *work.CWL_workunit.Job_input {
+		job_input_map[path.Base(named.Id)] = named.Value
+	}
+	for _, input_id := range work.CWL_workunit.Secrets {
+		value, ok := job_input_map[input_id].(*cwl.String)
+		if !ok {
+			err = fmt.Errorf("(FetchPrivateEnv) secret input %s not found", input_id)
+			return
+		}
+		env[input_id], err = DecryptSecret(string(*value), JobSecretContext(task.JobId, SECRET_CONTEXT_INPUTS))
+		if err != nil {
+			err = fmt.Errorf("(FetchPrivateEnv) input %s: %s", input_id, err.Error())
+			return
+		}
+	}
 	return
 	//env, err = dbGetPrivateEnv(jobid, taskid)
 	//if err != nil {
@@ -3762,3 +4042,52 @@ func (qm *ServerMgr) FetchPrivateEnv(id Workunit_Unique_Identifier, clientid str
 
 	//return
 }
+
+// FetchRegistryCredential returns the credential of the clientgroup of the client for a docker registry, nil if there is none
+func (qm *ServerMgr) FetchRegistryCredential(id Workunit_Unique_Identifier, clientid string, registry string) (cred *RegistryCredential, err error) {
+	client, ok, err := qm.GetClient(clientid, true)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = errors.New(e.ClientNotFound)
+		return
+	}
+
+	is_suspended, err := client.Get_Suspended(true)
+	if err != nil {
+		return
+	}
+	if is_suspended {
+		err = errors.New(e.ClientSuspended)
+		return
+	}
+
+	has_work, err := client.Assigned_work.Has(id)
+	if err != nil {
+		return
+	}
+	if !has_work {
+		err = fmt.Errorf("(FetchRegistryCredential) workunit is not assigned to client %s", clientid)
+		return
+	}
+
+	if dbDisabled() {
+		return
+	}
+
+	cg, err := LoadClientGroupByName(client.Group)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			err = nil
+			return
+		}
+		err = fmt.Errorf("(FetchRegistryCredential) LoadClientGroupByName returned: %s", err.Error())
+		return
+	}
+	cred, _, err = cg.GetRegistryCredential(registry)
+	if err != nil {
+		err = fmt.Errorf("(FetchRegistryCredential) %s", err.Error())
+	}
+	return
+}
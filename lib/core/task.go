@@ -59,14 +59,15 @@ type TaskRaw struct {
 	ComputeTime         int                      `bson:"computetime" json:"computetime"`
 	UserAttr            map[string]interface{}   `bson:"userattr" json:"userattr"`
 	ClientGroups        string                   `bson:"clientgroups" json:"clientgroups"`
-	WorkflowStep        *cwl.WorkflowStep        `bson:"workflowStep" json:"workflowStep"` // CWL-only
-	StepOutputInterface interface{}              `bson:"stepOutput" json:"stepOutput"`     // CWL-only
-	StepInput           *cwl.Job_document        `bson:"-" json:"-"`                       // CWL-only
-	StepOutput          *cwl.Job_document        `bson:"-" json:"-"`                       // CWL-only
-	Scatter_task        bool                     `bson:"scatter_task" json:"scatter_task"` // CWL-only, indicates if this is a scatter_task TODO: compare with TaskType ?
-	Children            []Task_Unique_Identifier `bson:"children" json:"children"`         // CWL-only, list of all children in a subworkflow task
-	Children_ptr        []*Task                  `bson:"-" json:"-"`                       // CWL-only
-	Finalizing          bool                     `bson:"-" json:"-"`                       // CWL-only, a lock mechanism
+	WorkflowStep        *cwl.WorkflowStep        `bson:"workflowStep" json:"workflowStep"`       // CWL-only
+	StepOutputInterface interface{}              `bson:"stepOutput" json:"stepOutput"`           // CWL-only
+	StepInput           *cwl.Job_document        `bson:"-" json:"-"`                             // CWL-only
+	StepOutput          *cwl.Job_document        `bson:"-" json:"-"`                             // CWL-only
+	Split               *TaskSplit               `bson:"split,omitempty" json:"split,omitempty"` // CWL-only, set if the step has a SplitRequirement hint
+	Scatter_task        bool                     `bson:"scatter_task" json:"scatter_task"`       // CWL-only, indicates if this is a scatter_task TODO: compare with TaskType ?
+	Children            []Task_Unique_Identifier `bson:"children" json:"children"`               // CWL-only, list of all children in a subworkflow task
+	Children_ptr        []*Task                  `bson:"-" json:"-"`                             // CWL-only
+	Finalizing          bool                     `bson:"-" json:"-"`                             // CWL-only, a lock mechanism
 }
 
 type Task struct {
@@ -205,6 +206,15 @@ func (task *TaskRaw) InitRaw(job *Job) (changed bool, err error) {
 
 	if len(task.Cmd.Environ.Private) > 0 {
 		task.Cmd.HasPrivateEnv = true
+		// jobs stored before secrets were encrypted, or with an older key
+		secrets_changed, xerr := RenewSecretMap(task.Cmd.Environ.Private, JobSecretContext(job.Id, SECRET_CONTEXT_ENV))
+		if xerr != nil {
+			err = fmt.Errorf("(InitRaw) RenewSecretMap returned: %s", xerr.Error())
+			return
+		}
+		if secrets_changed {
+			changed = true
+		}
 	}
 
 	//if strings.HasPrefix(task.Id, task.JobId+"_") {
@@ -225,6 +235,14 @@ func (task *TaskRaw) InitRaw(job *Job) (changed bool, err error) {
 		}
 	}
 
+	if task.Split != nil {
+		err = task.Split.initRaw(task.WorkflowStep)
+		if err != nil {
+			err = fmt.Errorf("(InitRaw) %s", err.Error())
+			return
+		}
+	}
+
 	return
 }
 
@@ -631,6 +649,24 @@ func (task *TaskRaw) SetStepOutput(jd *cwl.Job_document, lock bool) (err error)
 	return
 }
 
+// SetSplit starts a new split of the task, nil clears it so that the task is split again
+func (task *TaskRaw) SetSplit(split *TaskSplit, lock bool) (err error) {
+	if lock {
+		err = task.LockNamed("SetSplit")
+		if err != nil {
+			return
+		}
+		defer task.Unlock()
+	}
+
+	err = dbUpdateJobTaskField(task.JobId, task.Id, "split", split)
+	if err != nil {
+		return
+	}
+	task.Split = split
+	return
+}
+
 // only for debugging purposes
 func (task *TaskRaw) GetStateNamed(name string) (state string, err error) {
 	lock, err := task.RLockNamed("GetState/" + name)
@@ -733,7 +769,7 @@ func (task *TaskRaw) GetDependsOn() (dep []string, err error) {
 // checks and creates indices on input shock nodes if needed
 func (task *Task) CreateInputIndexes() (err error) {
 	for _, io := range task.Inputs {
-		_, err = io.IndexFile(io.ShockIndex)
+		_, err = io.IndexFile(task.JobId, io.ShockIndex)
 		if err != nil {
 			err = fmt.Errorf("(CreateInputIndexes) failed to create shock index: node=%s, taskid=%s, error=%s", io.Node, task.Id, err.Error())
 			logger.Error(err.Error())
@@ -747,7 +783,7 @@ func (task *Task) CreateInputIndexes() (err error) {
 // if worker failed to do so, this will catch it
 func (task *Task) CreateOutputIndexes() (err error) {
 	for _, io := range task.Outputs {
-		_, err = io.IndexFile(io.ShockIndex)
+		_, err = io.IndexFile(task.JobId, io.ShockIndex)
 		if err != nil {
 			err = fmt.Errorf("(CreateOutputIndexes) failed to create shock index: node=%s, taskid=%s, error=%s", io.Node, task.Id, err.Error())
 			logger.Error(err.Error())
@@ -799,7 +835,7 @@ func (task *Task) checkPartIndex() (newPartition *PartInfo, totalunits int, isSi
 		newPartition.Index = conf.DEFAULT_INDEX
 	}
 
-	idxInfo, err := inputIO.IndexFile(newPartition.Index)
+	idxInfo, err := inputIO.IndexFile(task.JobId, newPartition.Index)
 	if err != nil {
 		// bad state - set as not multi-workunit
 		logger.Error("warning: failed to create / retrieve index=%s, taskid=%s, error=%s", newPartition.Index, task.Id, err.Error())
@@ -1079,7 +1115,7 @@ func (task *Task) SetResetTask(info *Info) (err error) {
 		if dataUrl, _ := io.DataUrl(); dataUrl != "" {
 			// delete dataUrl if is shock node
 			if strings.HasSuffix(dataUrl, shock.DATA_SUFFIX) {
-				err = shock.ShockDelete(io.Host, io.Node, io.DataToken)
+				err = io.DeleteNode(task.JobId)
 				if err == nil {
 					logger.Debug(2, "Deleted node %s from shock", io.Node)
 				} else {
@@ -1163,6 +1199,25 @@ func (task *Task) CreateWorkunits(qm *ServerMgr, job *Job) (wus []*Workunit, err
 	//	step :=
 	//}
 
+	if task.Split != nil {
+		// only the workunits of the current phase, see TaskSplit
+		var ranks []int
+		ranks, err = task.Split.PendingRanks()
+		if err != nil {
+			err = fmt.Errorf("(CreateWorkunits) (split) %s", err.Error())
+			return
+		}
+		for _, rank := range ranks {
+			workunit, xerr := NewWorkunit(qm, task, rank, job)
+			if xerr != nil {
+				err = fmt.Errorf("(CreateWorkunits) (split) NewWorkunit failed: %s", xerr.Error())
+				return
+			}
+			wus = append(wus, workunit)
+		}
+		return
+	}
+
 	if task.TotalWork == 1 {
 		workunit, xerr := NewWorkunit(qm, task, 0, job)
 		if xerr != nil {
@@ -1364,14 +1419,14 @@ func (task *Task) ValidateInputs(qm *ServerMgr) (err error) {
 
 		// forece check file exists and get size
 		io.Size = 0
-		_, err = io.UpdateFileSize()
+		_, err = io.UpdateFileSize(task.JobId)
 		if err != nil {
 			err = fmt.Errorf("(ValidateInputs) input file %s UpdateFileSize returns: %s", io.FileName, err.Error())
 			return
 		}
 
 		// create or wait on shock index on input node (if set in workflow document)
-		_, err = io.IndexFile(io.ShockIndex)
+		_, err = io.IndexFile(task.JobId, io.ShockIndex)
 		if err != nil {
 			err = fmt.Errorf("(ValidateInputs) failed to create shock index: task=%s, node=%s: %s", task.Id, io.Node, err.Error())
 			return
@@ -1408,14 +1463,14 @@ func (task *Task) ValidateOutputs() (err error) {
 
 		// force check file exists and get size
 		io.Size = 0
-		_, err = io.UpdateFileSize()
+		_, err = io.UpdateFileSize(task.JobId)
 		if err != nil {
 			err = fmt.Errorf("input file %s GetFileSize returns: %s", io.FileName, err.Error())
 			return
 		}
 
 		// create or wait on shock index on output node (if set in workflow document)
-		_, err = io.IndexFile(io.ShockIndex)
+		_, err = io.IndexFile(task.JobId, io.ShockIndex)
 		if err != nil {
 			err = fmt.Errorf("failed to create shock index: task=%s, node=%s: %s", task.Id, io.Node, err.Error())
 			return
@@ -1443,7 +1498,7 @@ func (task *Task) ValidatePredata() (err error) {
 		// only verify predata that is a shock node
 		if (io.Node != "") && (io.Node != "-") {
 			// check file size
-			mod, xerr := io.UpdateFileSize()
+			mod, xerr := io.UpdateFileSize(task.JobId)
 			if xerr != nil {
 				err = fmt.Errorf("input file %s GetFileSize returns: %s", io.FileName, xerr.Error())
 				return
@@ -1479,7 +1534,7 @@ func (task *Task) DeleteOutput() (modified int) {
 		task_state == TASK_STAT_FAIL_SKIP {
 		for _, io := range task.Outputs {
 			if io.Delete {
-				if err := io.DeleteNode(); err != nil {
+				if err := io.DeleteNode(task.JobId); err != nil {
 					logger.Warning("failed to delete shock node %s: %s", io.Node, err.Error())
 				}
 				modified += 1
@@ -1497,7 +1552,7 @@ func (task *Task) DeleteInput() (modified int) {
 		task_state == TASK_STAT_FAIL_SKIP {
 		for _, io := range task.Inputs {
 			if io.Delete {
-				if err := io.DeleteNode(); err != nil {
+				if err := io.DeleteNode(task.JobId); err != nil {
 					logger.Warning("failed to delete shock node %s: %s", io.Node, err.Error())
 				}
 				modified += 1
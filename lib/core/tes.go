@@ -0,0 +1,300 @@
+package core
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/MG-RAST/AWE/lib/acl"
+	"github.com/MG-RAST/AWE/lib/user"
+)
+
+// GA4GH Task Execution Service (TES) tasks are run as jobs with a single task. All executors
+// run in one container of the image of the executors, one after the other, from a script that
+// links the inputs to their paths in the container and copies the outputs back into the work
+// directory. Inputs in Shock are task inputs, other URLs are predata. Outputs are uploaded into
+// new nodes on the Shock server named by the output url.
+//
+// The worker runs the script with /bin/bash like every other command script, and the script
+// uses bash process substitution to copy the output streams, so the image of the executors
+// has to provide /bin/bash. This cannot be checked when the task is created, a task with an
+// image without bash fails when its workunit starts.
+
+const (
+	TES_FILE      = "FILE"
+	TES_DIRECTORY = "DIRECTORY"
+)
+
+type TesTask struct {
+	Name        string        `bson:"name" json:"name,omitempty"`
+	Description string        `bson:"description" json:"description,omitempty"`
+	Inputs      []TesInput    `bson:"inputs" json:"inputs,omitempty"`
+	Outputs     []TesOutput   `bson:"outputs" json:"outputs,omitempty"`
+	Resources   *TesResources `bson:"resources" json:"resources,omitempty"`
+	Executors   []TesExecutor `bson:"executors" json:"executors"`
+	Volumes     []string      `bson:"volumes" json:"volumes,omitempty"`
+	// tags are stored as user attributes of the job
+	Tags map[string]string `bson:"-" json:"tags,omitempty"`
+}
+
+type TesInput struct {
+	Name        string `bson:"name" json:"name,omitempty"`
+	Description string `bson:"description" json:"description,omitempty"`
+	Url         string `bson:"url" json:"url,omitempty"`
+	Path        string `bson:"path" json:"path"`
+	Type        string `bson:"type" json:"type,omitempty"`
+	Content     string `bson:"content" json:"content,omitempty"`
+}
+
+type TesOutput struct {
+	Name        string `bson:"name" json:"name,omitempty"`
+	Description string `bson:"description" json:"description,omitempty"`
+	Url         string `bson:"url" json:"url"`
+	Path        string `bson:"path" json:"path"`
+	Type        string `bson:"type" json:"type,omitempty"`
+}
+
+type TesResources struct {
+	CpuCores    int      `bson:"cpu_cores" json:"cpu_cores,omitempty"`
+	Preemptible bool     `bson:"preemptible" json:"preemptible,omitempty"`
+	RamGb       float64  `bson:"ram_gb" json:"ram_gb,omitempty"`
+	DiskGb      float64  `bson:"disk_gb" json:"disk_gb,omitempty"`
+	Zones       []string `bson:"zones" json:"zones,omitempty"`
+}
+
+type TesExecutor struct {
+	Image       string            `bson:"image" json:"image"`
+	Command     []string          `bson:"command" json:"command"`
+	Workdir     string            `bson:"workdir" json:"workdir,omitempty"`
+	Stdin       string            `bson:"stdin" json:"stdin,omitempty"`
+	Stdout      string            `bson:"stdout" json:"stdout,omitempty"`
+	Stderr      string            `bson:"stderr" json:"stderr,omitempty"`
+	Env         map[string]string `bson:"env" json:"env,omitempty"`
+	IgnoreError bool              `bson:"ignore_error" json:"ignore_error,omitempty"`
+}
+
+var tesEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Validate checks that the task can be run as a single container task
+func (t *TesTask) Validate() (err error) {
+	if len(t.Executors) == 0 {
+		return errors.New("at least one executor is required")
+	}
+	for i, ex := range t.Executors {
+		if ex.Image == "" {
+			return fmt.Errorf("executor %d: image is missing", i)
+		}
+		if ex.Image != t.Executors[0].Image {
+			return errors.New("all executors have to use the same image")
+		}
+		if len(ex.Command) == 0 {
+			return fmt.Errorf("executor %d: command is missing", i)
+		}
+		for _, p := range []string{ex.Workdir, ex.Stdin, ex.Stdout, ex.Stderr} {
+			if p != "" && !path.IsAbs(p) {
+				return fmt.Errorf("executor %d: path %s is not absolute", i, p)
+			}
+		}
+		for name := range ex.Env {
+			if !tesEnvName.MatchString(name) {
+				return fmt.Errorf("executor %d: invalid environment variable name %q", i, name)
+			}
+		}
+	}
+	for i, input := range t.Inputs {
+		if !path.IsAbs(input.Path) {
+			return fmt.Errorf("input %d: path %q is not absolute", i, input.Path)
+		}
+		if input.Type == TES_DIRECTORY {
+			return fmt.Errorf("input %d: directories are not supported", i)
+		}
+		if input.Content != "" {
+			continue
+		}
+		u, xerr := url.Parse(input.Url)
+		if xerr != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ftp") {
+			return fmt.Errorf("input %d: url %q is not supported, use http, https or ftp", i, input.Url)
+		}
+	}
+	for i, output := range t.Outputs {
+		if !path.IsAbs(output.Path) {
+			return fmt.Errorf("output %d: path %q is not absolute", i, output.Path)
+		}
+		if output.Type == TES_DIRECTORY {
+			return fmt.Errorf("output %d: directories are not supported", i)
+		}
+		u, xerr := url.Parse(output.Url)
+		if xerr != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("output %d: url %q is not the URL of a Shock server", i, output.Url)
+		}
+		if strings.Contains(u.Path, "/node") {
+			return fmt.Errorf("output %d: outputs are uploaded into new Shock nodes, url has to name the server", i)
+		}
+	}
+	for _, v := range t.Volumes {
+		if !path.IsAbs(v) {
+			return fmt.Errorf("volume %q is not absolute", v)
+		}
+	}
+	return
+}
+
+// tesInputName is the file name of an input in the work directory, predata is cached by file
+// name so the name includes a hash of the url
+func tesInputName(input TesInput) string {
+	return fmt.Sprintf("tes_%.6x_%s", sha1.Sum([]byte(input.Url)), path.Base(input.Path))
+}
+
+func tesOutputName(i int, output TesOutput) string {
+	return fmt.Sprintf("tes_out_%d_%s", i, path.Base(output.Path))
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Script returns the bash commands that run the executors in the container, the work
+// directory of the workunit is the current directory when the script starts
+func (t *TesTask) Script() (script []string) {
+	script = append(script, `AWE_WORKDIR="$PWD"`)
+	for _, v := range t.Volumes {
+		script = append(script, "mkdir -p "+shellQuote(v))
+	}
+	for _, input := range t.Inputs {
+		p := shellQuote(input.Path)
+		script = append(script, "mkdir -p "+shellQuote(path.Dir(input.Path)))
+		if input.Content != "" {
+			script = append(script, "printf '%s' "+shellQuote(input.Content)+" > "+p)
+		} else {
+			script = append(script, `ln -sf "$AWE_WORKDIR"/`+shellQuote(tesInputName(input))+" "+p)
+		}
+	}
+	for _, output := range t.Outputs {
+		script = append(script, "mkdir -p "+shellQuote(path.Dir(output.Path)))
+	}
+	for _, ex := range t.Executors {
+		line := "("
+		names := []string{}
+		for name := range ex.Env {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			line += "export " + name + "=" + shellQuote(ex.Env[name]) + "; "
+		}
+		if ex.Workdir != "" {
+			line += "cd " + shellQuote(ex.Workdir) + " && "
+		}
+		command := []string{}
+		for _, arg := range ex.Command {
+			command = append(command, shellQuote(arg))
+		}
+		line += "exec " + strings.Join(command, " ")
+		if ex.Stdin != "" {
+			line += " < " + shellQuote(ex.Stdin)
+		}
+		line += ")"
+		// the streams are also kept in the stdout and stderr logs of the workunit
+		if ex.Stdout != "" {
+			line += " > >(tee " + shellQuote(ex.Stdout) + ")"
+		}
+		if ex.Stderr != "" {
+			line += " 2> >(tee " + shellQuote(ex.Stderr) + " >&2)"
+		}
+		if !ex.IgnoreError {
+			line += " || exit $?"
+		}
+		script = append(script, line)
+	}
+	// missing outputs are reported by the worker
+	for i, output := range t.Outputs {
+		script = append(script, "cp "+shellQuote(output.Path)+` "$AWE_WORKDIR"/`+shellQuote(tesOutputName(i, output))+" || true")
+	}
+	return
+}
+
+// CreateJobTES creates a job with a single task from a TES task, the job is not saved
+func CreateJobTES(u *user.User, t *TesTask) (job *Job, err error) {
+	err = t.Validate()
+	if err != nil {
+		return
+	}
+
+	job = NewJob()
+	job.setId()
+	job.Info = NewInfo()
+	job.Info.Name = t.Name
+	if job.Info.Name == "" {
+		job.Info.Name = "tes-task"
+	}
+	job.Info.Description = t.Description
+	job.Info.Pipeline = "tes"
+	if len(t.Tags) > 0 {
+		job.Info.UserAttr = make(map[string]interface{})
+		for key, value := range t.Tags {
+			job.Info.UserAttr[key] = value
+		}
+	}
+
+	task, err := NewTask(job, "", "0")
+	if err != nil {
+		err = fmt.Errorf("(CreateJobTES) NewTask returned: %s", err.Error())
+		return
+	}
+	task.Cmd = &Command{
+		Name:        t.Executors[0].Command[0],
+		DockerPull:  t.Executors[0].Image,
+		Cmd_script:  t.Script(),
+		Description: t.Description,
+	}
+	if r := t.Resources; r != nil {
+		task.Cmd.Resources = &Resources{Cores: float64(r.CpuCores), RamMB: int64(r.RamGb * 1024)}
+	}
+	for _, input := range t.Inputs {
+		if input.Content != "" {
+			continue
+		}
+		io := &IO{FileName: tesInputName(input), Url: input.Url}
+		if err = io.Url2Shock(); err != nil {
+			err = fmt.Errorf("(CreateJobTES) %s", err.Error())
+			return
+		}
+		if io.Node != "" {
+			task.Inputs = append(task.Inputs, io)
+		} else {
+			task.Predata = append(task.Predata, io)
+		}
+	}
+	for i, output := range t.Outputs {
+		task.Outputs = append(task.Outputs, &IO{FileName: tesOutputName(i, output), Host: strings.TrimRight(output.Url, "/")})
+	}
+	job.Tasks = []*Task{task}
+
+	stored := *t
+	stored.Tags = nil
+	job.Tes = &stored
+
+	job.Acl.SetOwner(u.Uuid)
+	job.Acl.Set(u.Uuid, acl.Rights{"read": true, "write": true, "delete": true})
+
+	_, err = job.Init()
+	if err != nil {
+		err = fmt.Errorf("(CreateJobTES) job.Init returned: %s", err.Error())
+		return
+	}
+	err = job.Mkdir()
+	if err != nil {
+		err = fmt.Errorf("(CreateJobTES) job.Mkdir returned: %s", err.Error())
+		return
+	}
+	err = job.PinDockerImages()
+	if err != nil {
+		err = fmt.Errorf("(CreateJobTES) PinDockerImages returned: %s", err.Error())
+	}
+	return
+}
@@ -0,0 +1,343 @@
+package core
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Timeline splits the perf statistics of a job into intervals. Workunits wait in the queue
+// until checkout, then the worker moves the input data in, prepares the container, runs the
+// command and moves the output data out, in that order. The perf data only has the length of
+// each phase, so the phases are laid out back to back from checkout. Times are in seconds.
+
+const (
+	TIMELINE_WAITING     = "waiting"
+	TIMELINE_DATA_IN     = "data-in"
+	TIMELINE_DOCKER_PREP = "docker-prep"
+	TIMELINE_RUNTIME     = "runtime"
+	TIMELINE_DATA_OUT    = "data-out"
+)
+
+type Timeline struct {
+	Id           string             `json:"id"`
+	Queued       int64              `json:"queued"`
+	Start        int64              `json:"start"`
+	End          int64              `json:"end"`
+	Tasks        []TimelineTask     `json:"tasks"`
+	CriticalPath []string           `json:"critical_path"`
+	Summary      TimelineSummary    `json:"summary"`
+	Workers      map[string]string  `json:"workers"` // client id -> client name
+	phases       map[string]float64 // totals per phase for the summary
+}
+
+type TimelineTask struct {
+	Id        string             `json:"id"`
+	Name      string             `json:"name"`
+	State     string             `json:"state,omitempty"`
+	Queued    int64              `json:"queued"`
+	Start     int64              `json:"start"`
+	End       int64              `json:"end"`
+	Waiting   int64              `json:"waiting"`
+	Critical  bool               `json:"critical,omitempty"`
+	Workunits []TimelineWorkunit `json:"workunits"`
+}
+
+type TimelineWorkunit struct {
+	Id        string             `json:"id"`
+	Worker    string             `json:"worker,omitempty"`
+	Queued    int64              `json:"queued"`
+	Checkout  int64              `json:"checkout"`
+	Deliver   int64              `json:"deliver"`
+	Done      int64              `json:"done"`
+	Intervals []TimelineInterval `json:"intervals"`
+}
+
+type TimelineInterval struct {
+	Phase string  `json:"phase"`
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+type TimelineSummary struct {
+	Wall         int64              `json:"wall"`          // end (or now) - queued of the job
+	QueueWait    float64            `json:"queue_wait"`    // waiting of all workunits
+	Compute      float64            `json:"compute"`       // runtime of all workunits
+	Phases       map[string]float64 `json:"phases"`        // total of each phase
+	CriticalPath int64              `json:"critical_path"` // end of the last task - queued of the first on the path
+}
+
+// NewJobTimeline combines the perf statistics with the tasks of the job, the caller holds
+// the read locks of the tasks
+func NewJobTimeline(job *Job, perf *JobPerf) (timeline *Timeline, err error) {
+	timeline = &Timeline{
+		Id:           job.Id,
+		Queued:       perf.Queued,
+		Start:        perf.Start,
+		End:          perf.End,
+		Tasks:        []TimelineTask{},
+		CriticalPath: []string{},
+		Workers:      make(map[string]string),
+		phases:       make(map[string]float64),
+	}
+
+	works := make(map[string][]string) // task id -> workunit ids
+	for work_str := range perf.Pworks {
+		i := strings.LastIndex(work_str, "_")
+		if i < 0 {
+			continue
+		}
+		works[work_str[:i]] = append(works[work_str[:i]], work_str)
+	}
+
+	for _, task := range job.Tasks {
+		tt := TimelineTask{
+			Id:        task.Id,
+			Name:      task.TaskName,
+			State:     task.State,
+			Workunits: []TimelineWorkunit{},
+		}
+		if tp, ok := perf.Ptasks[task.Id]; ok {
+			tt.Queued = tp.Queued
+			tt.Start = tp.Start
+			tt.End = tp.End
+			if tp.Start > 0 {
+				tt.Waiting = tp.Start - tp.Queued
+			}
+		}
+		sort.Strings(works[task.Id])
+		for _, work_str := range works[task.Id] {
+			tt.Workunits = append(tt.Workunits, timeline.newWorkunit(work_str, perf.Pworks[work_str]))
+		}
+		timeline.Tasks = append(timeline.Tasks, tt)
+	}
+	sort.SliceStable(timeline.Tasks, func(i, j int) bool {
+		return timeline.Tasks[i].Queued < timeline.Tasks[j].Queued
+	})
+
+	dag, err := NewJobDag(job)
+	if err != nil {
+		return
+	}
+	timeline.criticalPath(dag)
+
+	timeline.Summary.Phases = timeline.phases
+	timeline.Summary.QueueWait = timeline.phases[TIMELINE_WAITING]
+	timeline.Summary.Compute = timeline.phases[TIMELINE_RUNTIME]
+	end := timeline.End
+	if end == 0 {
+		end = time.Now().Unix()
+	}
+	timeline.Summary.Wall = end - timeline.Queued
+
+	if qm, ok := QMgr.(*ServerMgr); ok {
+		for client_id := range timeline.Workers {
+			client, ok, _ := qm.GetClient(client_id, true)
+			if ok {
+				timeline.Workers[client_id] = client.WorkerRuntime.Name
+			}
+		}
+	}
+	return
+}
+
+func (timeline *Timeline) newWorkunit(work_str string, wp *WorkPerf) (tw TimelineWorkunit) {
+	tw = TimelineWorkunit{
+		Id:        work_str,
+		Worker:    wp.ClientId,
+		Queued:    wp.Queued,
+		Checkout:  wp.Checkout,
+		Deliver:   wp.Deliver,
+		Done:      wp.Done,
+		Intervals: []TimelineInterval{},
+	}
+	if wp.ClientId != "" {
+		timeline.Workers[wp.ClientId] = ""
+	}
+	if wp.Checkout == 0 {
+		// still in the queue
+		return
+	}
+	tw.add(timeline, TIMELINE_WAITING, float64(wp.Queued), float64(wp.Checkout-wp.Queued))
+	t := float64(wp.Checkout)
+	for _, phase := range []struct {
+		name     string
+		duration float64
+	}{
+		{TIMELINE_DATA_IN, wp.PreDataIn + wp.DataIn},
+		{TIMELINE_DOCKER_PREP, float64(wp.DockerPrep)},
+		{TIMELINE_RUNTIME, float64(wp.Runtime)},
+		{TIMELINE_DATA_OUT, wp.DataOut},
+	} {
+		t = tw.add(timeline, phase.name, t, phase.duration)
+	}
+	return
+}
+
+// add appends an interval unless it is empty and returns its end, the phases of a workunit
+// that has been delivered end at delivery
+func (tw *TimelineWorkunit) add(timeline *Timeline, phase string, start float64, duration float64) (end float64) {
+	end = start + duration
+	if tw.Deliver > 0 && phase != TIMELINE_WAITING && end > float64(tw.Deliver) {
+		end = float64(tw.Deliver)
+	}
+	if end <= start {
+		end = start
+		return
+	}
+	tw.Intervals = append(tw.Intervals, TimelineInterval{Phase: phase, Start: start, End: end})
+	timeline.phases[phase] += end - start
+	return
+}
+
+// criticalPath walks back from the task that finished last, each time to the predecessor
+// that finished last, i.e. the one the task had to wait for. A subworkflow task waits for
+// the tasks of its instance, the tasks of the instance wait for the predecessors of the
+// subworkflow task.
+func (timeline *Timeline) criticalPath(dag *Dag) {
+	index := make(map[string]int)
+	for i, tt := range timeline.Tasks {
+		index[tt.Id] = i
+	}
+	node_group := make(map[string]string)
+	for _, node := range dag.Nodes {
+		node_group[node.Id] = node.Group
+	}
+	instance_of := make(map[string]string) // workflow task -> instance id
+	for _, group := range dag.Groups {
+		instance_of[group.Node] = group.Id
+	}
+
+	preds := make(map[string][]string)
+	for _, edge := range dag.Edges {
+		if instance, ok := instance_of[edge.From]; ok && node_group[edge.To] == instance {
+			continue // input of the instance, see below
+		}
+		preds[edge.To] = append(preds[edge.To], edge.From)
+	}
+	// outer instances first, their ids are prefixes of the ids of nested instances
+	groups := append([]DagGroup{}, dag.Groups...)
+	sort.SliceStable(groups, func(i, j int) bool { return len(groups[i].Id) < len(groups[j].Id) })
+	for _, group := range groups {
+		outer := append([]string{}, preds[group.Node]...)
+		for _, node := range dag.Nodes {
+			if node.Group == group.Id {
+				preds[node.Id] = append(preds[node.Id], outer...)
+			}
+		}
+	}
+	for _, group := range groups {
+		for _, node := range dag.Nodes {
+			if node.Group == group.Id {
+				preds[group.Node] = append(preds[group.Node], node.Id)
+			}
+		}
+	}
+
+	last := ""
+	for _, tt := range timeline.Tasks {
+		if tt.End > 0 && (last == "" || tt.End > timeline.Tasks[index[last]].End) {
+			last = tt.Id
+		}
+	}
+	visited := make(map[string]bool)
+	path := []string{}
+	for current := last; current != "" && !visited[current]; {
+		visited[current] = true
+		path = append(path, current)
+		next := ""
+		for _, pred := range preds[current] {
+			i, ok := index[pred]
+			if !ok || visited[pred] || timeline.Tasks[i].End == 0 {
+				continue
+			}
+			if next == "" || timeline.Tasks[i].End > timeline.Tasks[index[next]].End {
+				next = pred
+			}
+		}
+		current = next
+	}
+
+	for i := len(path) - 1; i >= 0; i-- {
+		timeline.CriticalPath = append(timeline.CriticalPath, path[i])
+		timeline.Tasks[index[path[i]]].Critical = true
+	}
+	if len(path) > 0 {
+		first := timeline.Tasks[index[path[len(path)-1]]]
+		timeline.Summary.CriticalPath = timeline.Tasks[index[path[0]]].End - first.Queued
+	}
+}
+
+// TraceEvent is an event of the Chrome trace event format, ts and dur are in microseconds
+type TraceEvent struct {
+	Name string                 `json:"name"`
+	Cat  string                 `json:"cat,omitempty"`
+	Ph   string                 `json:"ph"`
+	Ts   int64                  `json:"ts"`
+	Dur  int64                  `json:"dur,omitempty"`
+	Pid  int                    `json:"pid"`
+	Tid  int                    `json:"tid"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+type Trace struct {
+	TraceEvents     []TraceEvent `json:"traceEvents"`
+	DisplayTimeUnit string       `json:"displayTimeUnit"`
+}
+
+// Trace returns the timeline in the Chrome trace event format. Process 1 has a thread per
+// task with the task and the time its workunits waited in the queue, process 2 a thread per
+// worker with the phases of the workunits it ran.
+func (timeline *Timeline) Trace() (trace *Trace) {
+	trace = &Trace{TraceEvents: []TraceEvent{}, DisplayTimeUnit: "ms"}
+	meta := func(name string, pid int, tid int, value string) {
+		trace.TraceEvents = append(trace.TraceEvents, TraceEvent{Name: name, Ph: "M", Pid: pid, Tid: tid, Args: map[string]interface{}{"name": value}})
+	}
+	span := func(name string, cat string, pid int, tid int, start float64, end float64, args map[string]interface{}) {
+		trace.TraceEvents = append(trace.TraceEvents, TraceEvent{Name: name, Cat: cat, Ph: "X", Ts: int64(start * 1e6), Dur: int64((end - start) * 1e6), Pid: pid, Tid: tid, Args: args})
+	}
+
+	meta("process_name", 1, 0, "tasks "+timeline.Id)
+	meta("process_name", 2, 0, "workers")
+
+	worker_ids := []string{}
+	for client_id := range timeline.Workers {
+		worker_ids = append(worker_ids, client_id)
+	}
+	sort.Strings(worker_ids)
+	worker_tid := make(map[string]int)
+	for i, client_id := range worker_ids {
+		worker_tid[client_id] = i + 1
+		name := timeline.Workers[client_id]
+		if name == "" {
+			name = client_id
+		}
+		meta("thread_name", 2, i+1, name)
+	}
+
+	for i, tt := range timeline.Tasks {
+		meta("thread_name", 1, i+1, tt.Name)
+		if tt.Start > 0 {
+			cat := "task"
+			if tt.Critical {
+				cat = "task,critical"
+			}
+			end := tt.End
+			if end == 0 {
+				end = tt.Start
+			}
+			span(tt.Name, cat, 1, i+1, float64(tt.Start), float64(end), map[string]interface{}{"id": tt.Id, "state": tt.State, "waiting": tt.Waiting})
+		}
+		for _, tw := range tt.Workunits {
+			for _, interval := range tw.Intervals {
+				args := map[string]interface{}{"workunit": tw.Id, "worker": tw.Worker}
+				if interval.Phase == TIMELINE_WAITING {
+					span(interval.Phase, interval.Phase, 1, i+1, interval.Start, interval.End, args)
+				} else {
+					span(interval.Phase, interval.Phase, 2, worker_tid[tw.Worker], interval.Start, interval.End, args)
+				}
+			}
+		}
+	}
+	return
+}
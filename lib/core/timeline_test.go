@@ -0,0 +1,149 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+)
+
+func timelineTestJob(tasks []*Task, times map[string][3]int64) (job *Job, perf *JobPerf) {
+	job = testJob("j", tasks...)
+	perf = &JobPerf{Id: "j", Ptasks: make(map[string]*TaskPerf), Pworks: make(map[string]*WorkPerf)}
+	for _, task := range tasks {
+		if t, ok := times[task.Id]; ok {
+			perf.Ptasks[task.Id] = &TaskPerf{Queued: t[0], Start: t[1], End: t[2]}
+		}
+	}
+	return
+}
+
+func TestCriticalPath(t *testing.T) {
+	dependent := func(name string, depends_on ...string) *Task {
+		task := testTask(name, "", TASK_TYPE_NORMAL)
+		task.DependsOn = depends_on
+		return task
+	}
+
+	tests := []struct {
+		name   string
+		tasks  []*Task
+		times  map[string][3]int64 // queued, start, end
+		path   []string
+		length int64
+	}{
+		{
+			"chain next to a shorter task",
+			[]*Task{dependent("0"), dependent("1", "0"), dependent("2", "1"), dependent("3")},
+			map[string][3]int64{"j_0": {100, 101, 110}, "j_1": {110, 112, 120}, "j_2": {120, 121, 150}, "j_3": {100, 101, 140}},
+			[]string{"j_0", "j_1", "j_2"},
+			50,
+		},
+		{
+			"diamond waits for the predecessor that finished last",
+			[]*Task{dependent("0"), dependent("1", "0"), dependent("2", "0"), dependent("3", "1", "2")},
+			map[string][3]int64{"j_0": {100, 100, 110}, "j_1": {110, 110, 115}, "j_2": {110, 110, 130}, "j_3": {130, 130, 140}},
+			[]string{"j_0", "j_2", "j_3"},
+			40,
+		},
+		{
+			"unfinished predecessors are skipped",
+			[]*Task{dependent("0"), dependent("1", "0"), dependent("2", "1")},
+			map[string][3]int64{"j_0": {100, 100, 110}, "j_1": {110, 110, 0}, "j_2": {100, 105, 120}},
+			[]string{"j_2"},
+			20,
+		},
+		{
+			"subworkflow instance",
+			[]*Task{
+				testStep(testTask("#main/a", "", TASK_TYPE_NORMAL)),
+				testStep(testTask("#main/b", "", TASK_TYPE_NORMAL)),
+				testStep(testTask("#main/sub", "", TASK_TYPE_WORKFLOW), "#main/a/out", "#main/b/out"),
+				testStep(testTask("#sub/s1", "#main/sub", TASK_TYPE_NORMAL), "#sub/input"),
+				testStep(testTask("#sub/s2", "#main/sub", TASK_TYPE_NORMAL), "#sub/s1/out"),
+				testStep(testTask("#main/c", "", TASK_TYPE_NORMAL), "#main/sub/out"),
+			},
+			map[string][3]int64{
+				"j_#main/a":           {100, 100, 105},
+				"j_#main/b":           {100, 100, 110},
+				"j_#main/sub":         {110, 110, 131},
+				"j_#main/sub/#sub/s1": {110, 111, 120},
+				"j_#main/sub/#sub/s2": {120, 121, 130},
+				"j_#main/c":           {131, 132, 140},
+			},
+			[]string{"j_#main/b", "j_#main/sub/#sub/s1", "j_#main/sub/#sub/s2", "j_#main/sub", "j_#main/c"},
+			40,
+		},
+		{
+			"nothing finished",
+			[]*Task{dependent("0"), dependent("1", "0")},
+			map[string][3]int64{"j_0": {100, 101, 0}},
+			[]string{},
+			0,
+		},
+	}
+
+	for _, test := range tests {
+		job, perf := timelineTestJob(test.tasks, test.times)
+		timeline, err := NewJobTimeline(job, perf)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(timeline.CriticalPath, test.path) {
+			t.Errorf("%s: got path %v, expected %v", test.name, timeline.CriticalPath, test.path)
+		}
+		if timeline.Summary.CriticalPath != test.length {
+			t.Errorf("%s: got length %d, expected %d", test.name, timeline.Summary.CriticalPath, test.length)
+		}
+		critical := map[string]bool{}
+		for _, id := range test.path {
+			critical[id] = true
+		}
+		for _, tt := range timeline.Tasks {
+			if tt.Critical != critical[tt.Id] {
+				t.Errorf("%s: task %s critical is %t", test.name, tt.Id, tt.Critical)
+			}
+		}
+	}
+}
+
+func TestTimelineWorkunit(t *testing.T) {
+	tests := []struct {
+		name      string
+		perf      WorkPerf
+		intervals []TimelineInterval
+	}{
+		{
+			"queued",
+			WorkPerf{Queued: 100},
+			[]TimelineInterval{},
+		},
+		{
+			"phases back to back",
+			WorkPerf{Queued: 100, Checkout: 110, PreDataIn: 1, DataIn: 2, DockerPrep: 3, Runtime: 10, DataOut: 4, Deliver: 130},
+			[]TimelineInterval{
+				{TIMELINE_WAITING, 100, 110},
+				{TIMELINE_DATA_IN, 110, 113},
+				{TIMELINE_DOCKER_PREP, 113, 116},
+				{TIMELINE_RUNTIME, 116, 126},
+				{TIMELINE_DATA_OUT, 126, 130},
+			},
+		},
+		{
+			"phases end at delivery",
+			WorkPerf{Queued: 100, Checkout: 100, DataIn: 5, Runtime: 10, DataOut: 5, Deliver: 112},
+			[]TimelineInterval{
+				{TIMELINE_DATA_IN, 100, 105},
+				{TIMELINE_RUNTIME, 105, 112},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		timeline := &Timeline{Workers: make(map[string]string), phases: make(map[string]float64)}
+		wp := test.perf
+		tw := timeline.newWorkunit("j_0_0", &wp)
+		if !reflect.DeepEqual(tw.Intervals, test.intervals) {
+			t.Errorf("%s: got %v, expected %v", test.name, tw.Intervals, test.intervals)
+		}
+	}
+}
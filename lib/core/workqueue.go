@@ -2,11 +2,13 @@ package core
 
 import (
 	"errors"
+	"github.com/MG-RAST/AWE/lib/conf"
 	e "github.com/MG-RAST/AWE/lib/errors"
 	"github.com/MG-RAST/AWE/lib/logger"
 	"sort"
 	//"sync"
 	"fmt"
+	"time"
 )
 
 type WorkQueue struct {
@@ -16,6 +18,7 @@ type WorkQueue struct {
 	Queue    WorkunitMap // WORK_STAT_QUEUED - waiting workunits
 	Checkout WorkunitMap // WORK_STAT_CHECKOUT - workunits being checked out
 	Suspend  WorkunitMap // WORK_STAT_SUSPEND - suspended workunits
+	Prefetch WorkunitMap // WORK_STAT_PREFETCHED - workunits reserved by workers, not yet running
 }
 
 func NewWorkQueue() *WorkQueue {
@@ -24,12 +27,14 @@ func NewWorkQueue() *WorkQueue {
 		Queue:    *NewWorkunitMap(), // these workunits that are ready to be checked out
 		Checkout: *NewWorkunitMap(), // workunits that are checked out right now
 		Suspend:  *NewWorkunitMap(),
+		Prefetch: *NewWorkunitMap(),
 	}
 
 	wq.all.Init("WorkQueue/workMap")
 	wq.Queue.Init("WorkQueue/Queue")
 	wq.Checkout.Init("WorkQueue/Checkout")
 	wq.Suspend.Init("WorkQueue/Suspend")
+	wq.Prefetch.Init("WorkQueue/Prefetch")
 
 	return wq
 }
@@ -67,6 +72,9 @@ func (wq *WorkQueue) Add(workunit *Workunit) (err error) {
 	}
 
 	logger.Debug(3, "(WorkQueue/Add) Adding workunit %s to WorkQueue", work_str)
+	if workunit.QueuedTime.IsZero() {
+		workunit.QueuedTime = time.Now()
+	}
 	err = wq.all.Set(workunit)
 	if err != nil {
 		return
@@ -114,6 +122,7 @@ func (wq *WorkQueue) Clean() (workunits []*Workunit) {
 			wq.Queue.Delete(id)
 			wq.Checkout.Delete(id)
 			wq.Suspend.Delete(id)
+			wq.Prefetch.Delete(id)
 			wq.all.Delete(id)
 			logger.Error("error: in WorkQueue workunit %s is nil, deleted from queue", id)
 		}
@@ -134,6 +143,10 @@ func (wq *WorkQueue) Delete(id Workunit_Unique_Identifier) (err error) {
 	if err != nil {
 		return
 	}
+	err = wq.Prefetch.Delete(id)
+	if err != nil {
+		return
+	}
 	err = wq.all.Delete(id)
 	if err != nil {
 		return
@@ -176,7 +189,7 @@ func (wq *WorkQueue) StatusChange(id Workunit_Unique_Identifier, workunit *Worku
 	if workunit.State == new_status {
 		return
 	}
-	if workunit.State != WORK_STAT_CHECKOUT && workunit.State != WORK_STAT_RESERVED {
+	if workunit.State != WORK_STAT_CHECKOUT && workunit.State != WORK_STAT_RESERVED && workunit.State != WORK_STAT_PREFETCHED {
 		workunit.Client = ""
 	}
 
@@ -184,15 +197,27 @@ func (wq *WorkQueue) StatusChange(id Workunit_Unique_Identifier, workunit *Worku
 	case WORK_STAT_CHECKOUT:
 		wq.Queue.Delete(id)
 		wq.Suspend.Delete(id)
+		wq.Prefetch.Delete(id)
 		err = workunit.SetState(new_status, reason)
 		if err != nil {
 			return
 		}
 		wq.Checkout.Set(workunit)
 
+	case WORK_STAT_PREFETCHED:
+		wq.Queue.Delete(id)
+		wq.Suspend.Delete(id)
+		wq.Checkout.Delete(id)
+		err = workunit.SetState(new_status, reason)
+		if err != nil {
+			return
+		}
+		wq.Prefetch.Set(workunit)
+
 	case WORK_STAT_QUEUED:
 		wq.Checkout.Delete(id)
 		wq.Suspend.Delete(id)
+		wq.Prefetch.Delete(id)
 		err = workunit.SetState(new_status, reason)
 		if err != nil {
 			return
@@ -206,6 +231,7 @@ func (wq *WorkQueue) StatusChange(id Workunit_Unique_Identifier, workunit *Worku
 		}
 		wq.Checkout.Delete(id)
 		wq.Queue.Delete(id)
+		wq.Prefetch.Delete(id)
 		err = workunit.SetState(new_status, reason)
 		if err != nil {
 			return
@@ -216,6 +242,7 @@ func (wq *WorkQueue) StatusChange(id Workunit_Unique_Identifier, workunit *Worku
 		wq.Checkout.Delete(id)
 		wq.Queue.Delete(id)
 		wq.Suspend.Delete(id)
+		wq.Prefetch.Delete(id)
 		err = workunit.SetState(new_status, reason)
 		if err != nil {
 			return
@@ -227,11 +254,15 @@ func (wq *WorkQueue) StatusChange(id Workunit_Unique_Identifier, workunit *Worku
 
 //select workunits, return a slice of ids based on given queuing policy and requested count
 //if available is a positive value, filter by workunit input size
-func (wq *WorkQueue) selectWorkunits(workunits WorkList, policy string, available int64, count int) (selected []*Workunit, err error) {
+func (wq *WorkQueue) selectWorkunits(workunits WorkList, policy string, available int64, count int, cache_index map[string]int64) (selected []*Workunit, err error) {
 	logger.Debug(3, "starting selectWorkunits")
 
 	if policy == "FCFS" {
-		sort.Sort(byFCFS{workunits})
+		if conf.LOCALITY_WEIGHT > 0 && len(cache_index) > 0 {
+			sort.Sort(newByLocality(workunits, cache_index))
+		} else {
+			sort.Sort(byFCFS{workunits})
+		}
 	}
 	added := 0
 	for _, work := range workunits {
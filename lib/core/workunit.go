@@ -26,6 +26,7 @@ const (
 	WORK_STAT_QUEUED           = "queued"           // after requeue ; after failures below max ; on WorkQueue.Add()
 	WORK_STAT_RESERVED         = "reserved"         // short lived state between queued and checkout. when a worker checks the workunit out, the state is reserved.
 	WORK_STAT_CHECKOUT         = "checkout"         // normal work checkout ; client registers that already has a workunit (e.g. after reboot of server)
+	WORK_STAT_PREFETCHED       = "prefetched"       // reserved by a worker that stages the inputs while it computes another workunit, requeued after PREFETCH_TIMEOUT
 	WORK_STAT_SUSPEND          = "suspend"          // on MAX_FAILURE ; on SuspendJob
 	WORK_STAT_FAILED_PERMANENT = "failed-permanent" // app had exit code 42
 	WORK_STAT_DONE             = "done"             // client only: done
@@ -36,6 +37,11 @@ const (
 	WORK_STAT_PROXYQUEUED      = "proxyqueued"      // proxy only
 )
 
+// failure reasons reported by the worker in addition to the notes
+const (
+	WORK_FAILURE_OOM = "oom-killed" // container was killed for exceeding its memory limit
+)
+
 type Workunit struct {
 	Workunit_Unique_Identifier `bson:",inline" json:",inline" mapstructure:",squash"`
 	Id                         string                 `bson:"id,omitempty" json:"id,omitempty" mapstructure:"id,omitempty"`       // global identifier: jobid_taskid_rank (for backwards coompatibility only)
@@ -50,10 +56,12 @@ type Workunit struct {
 	State                      string                 `bson:"state,omitempty" json:"state,omitempty" mapstructure:"state,omitempty"`
 	Failed                     int                    `bson:"failed,omitempty" json:"failed,omitempty" mapstructure:"failed,omitempty"`
 	CheckoutTime               time.Time              `bson:"checkout_time,omitempty" json:"checkout_time,omitempty" mapstructure:"checkout_time,omitempty"`
+	QueuedTime                 time.Time              `bson:"queued_time,omitempty" json:"-" mapstructure:"-"` // first time the workunit was ready in the queue of the server
 	Client                     string                 `bson:"client,omitempty" json:"client,omitempty" mapstructure:"client,omitempty"`
 	ComputeTime                int                    `bson:"computetime,omitempty" json:"computetime,omitempty" mapstructure:"computetime,omitempty"`
 	ExitStatus                 int                    `bson:"exitstatus,omitempty" json:"exitstatus,omitempty" mapstructure:"exitstatus,omitempty"` // Linux Exit Status Code (0 is success)
 	Notes                      []string               `bson:"notes,omitempty" json:"notes,omitempty" mapstructure:"notes,omitempty"`
+	FailureReason              string                 `bson:"failure_reason,omitempty" json:"failure_reason,omitempty" mapstructure:"failure_reason,omitempty"` // WORK_FAILURE_*
 	UserAttr                   map[string]interface{} `bson:"userattr,omitempty" json:"userattr,omitempty" mapstructure:"userattr,omitempty"`
 	ShockHost                  string                 `bson:"shockhost,omitempty" json:"shockhost,omitempty" mapstructure:"shockhost,omitempty"` // specifies default Shock host for outputs
 	CWL_workunit               *CWL_workunit          `bson:"cwl,omitempty" json:"cwl,omitempty" mapstructure:"cwl,omitempty"`
@@ -142,6 +150,12 @@ func NewWorkunit(qm *ServerMgr, task *Task, rank int, job *Job) (workunit *Worku
 				err = fmt.Errorf("(NewWorkunit) CommandLineTool misses CwlVersion")
 				return
 			}
+			clt, err = pinCWLDockerImages(clt, job.DockerDigests)
+			if err != nil {
+				err = fmt.Errorf("(NewWorkunit) pinCWLDockerImages returned: %s", err.Error())
+				return
+			}
+			process = clt
 			requirements = clt.Requirements
 		case *cwl.ExpressionTool:
 			var et *cwl.ExpressionTool
@@ -159,21 +173,24 @@ func NewWorkunit(qm *ServerMgr, task *Task, rank int, job *Job) (workunit *Worku
 			return
 		}
 
-		var shock_requirement *cwl.ShockRequirement
-		shock_requirement, err = cwl.GetShockRequirement(requirements)
-		if err != nil {
-			//fmt.Println("process:")
-			//spew.Dump(process)
-			err = fmt.Errorf("(NewWorkunit) ShockRequirement not found , err: %s", err.Error())
-			return
-		}
+		// the local runner does not use Shock
+		if Service != "local" {
+			var shock_requirement *cwl.ShockRequirement
+			shock_requirement, err = cwl.GetShockRequirement(requirements)
+			if err != nil {
+				//fmt.Println("process:")
+				//spew.Dump(process)
+				err = fmt.Errorf("(NewWorkunit) ShockRequirement not found , err: %s", err.Error())
+				return
+			}
 
-		if shock_requirement.Shock_api_url == "" {
-			err = fmt.Errorf("(NewWorkunit) Shock_api_url in ShockRequirement is empty")
-			return
-		}
+			if shock_requirement.Shock_api_url == "" {
+				err = fmt.Errorf("(NewWorkunit) Shock_api_url in ShockRequirement is empty")
+				return
+			}
 
-		workunit.ShockHost = shock_requirement.Shock_api_url
+			workunit.ShockHost = shock_requirement.Shock_api_url
+		}
 
 		workunit.CWL_workunit.Tool = process
 
@@ -224,6 +241,20 @@ func NewWorkunit(qm *ServerMgr, task *Task, rank int, job *Job) (workunit *Worku
 		//spew.Dump(job_input)
 
 		workunit.CWL_workunit.OutputsExpected = &workflow_step.Out
+
+		if task.Split != nil {
+			err = task.Split.SetupWorkunit(workunit.CWL_workunit, rank)
+			if err != nil {
+				err = fmt.Errorf("(NewWorkunit) SetupWorkunit returned: %s", err.Error())
+				return
+			}
+		}
+
+		err = setupSecretInputs(workunit.CWL_workunit, task.JobId)
+		if err != nil {
+			err = fmt.Errorf("(NewWorkunit) setupSecretInputs returned: %s", err.Error())
+			return
+		}
 		//spew.Dump(workflow_step.Out)
 		//panic("done")
 
@@ -274,7 +305,7 @@ func (work *Workunit) SetState(new_state string, reason string) (err error) {
 	}
 
 	work.State = new_state
-	if new_state != WORK_STAT_CHECKOUT {
+	if new_state != WORK_STAT_CHECKOUT && new_state != WORK_STAT_PREFETCHED {
 		work.Client = ""
 	}
 
@@ -25,5 +25,6 @@ const (
 	QueueFull                = "Server queue is full"
 	QueueSuspend             = "Server queue is suspended"
 	UnAuth                   = "User Unauthorized"
+	UploadTooLarge           = "Upload exceeds the maximum size"
 	ServerNotFound           = "Server not found"
 )
@@ -0,0 +1,353 @@
+package group
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/acl"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/db"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Array of Group
+type Groups []Group
+
+// Group is a named set of users that can be placed in job and clientgroup ACLs as "group:<name>".
+// The owner and the admins manage the membership, all of them count as members. Users added by
+// a group admin are only invited, they become members when they accept.
+type Group struct {
+	Name          string     `bson:"name" json:"name"`
+	Description   string     `bson:"description" json:"description"`
+	Owner         string     `bson:"owner" json:"owner"`
+	Admins        []string   `bson:"admins" json:"admins"`
+	Members       []string   `bson:"members" json:"members"`
+	InvitedAdmins []string   `bson:"invited_admins" json:"invited_admins"`
+	Invited       []string   `bson:"invited" json:"invited"`
+	JobAcl        acl.Rights `bson:"job_acl" json:"job_acl"` // rights the group gets on jobs its members submit with ?group=<name>
+	CreatedOn     time.Time  `bson:"created_on" json:"created_on"`
+	LastUpdated   time.Time  `bson:"last_updated" json:"last_updated"`
+}
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// user uuid -> principals of the groups, kept in sync with the Groups collection by this package
+var memberships = struct {
+	sync.RWMutex
+	groups map[string][]string
+}{groups: make(map[string][]string)}
+
+func Initialize() (err error) {
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Groups")
+	if err = c.EnsureIndex(mgo.Index{Key: []string{"name"}, Unique: true}); err != nil {
+		return err
+	}
+	if err = c.EnsureIndex(mgo.Index{Key: []string{"members"}, Background: true}); err != nil {
+		return err
+	}
+	if err = c.EnsureIndex(mgo.Index{Key: []string{"admins"}, Background: true}); err != nil {
+		return err
+	}
+
+	err = loadMemberships()
+	if err != nil {
+		return
+	}
+	acl.Memberships = Memberships
+	return
+}
+
+// user uuid -> groups from identity provider claims, see SetClaimedGroups
+var claimed = struct {
+	sync.RWMutex
+	groups map[string]claimedGroups
+}{groups: make(map[string]claimedGroups)}
+
+type claimedGroups struct {
+	principals []string
+	expires    time.Time
+}
+
+// Principal is the id of the group in ACL lists
+func Principal(name string) string {
+	return acl.GROUP_PREFIX + name
+}
+
+// ClaimedPrincipal is the id of a group asserted by an identity provider in ACL lists
+func ClaimedPrincipal(name string) string {
+	return acl.CLAIMED_GROUP_PREFIX + name
+}
+
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
+func New(name string, description string, owner string) (g *Group, err error) {
+	if !validName.MatchString(name) {
+		err = fmt.Errorf("invalid group name %q, use up to 64 letters, digits, '.', '_' or '-'", name)
+		return
+	}
+	if _, xerr := Load(name); xerr == nil {
+		err = fmt.Errorf("group %s already exists", name)
+		return
+	}
+	now := time.Now()
+	g = &Group{
+		Name:          name,
+		Description:   description,
+		Owner:         owner,
+		Admins:        []string{},
+		Members:       []string{},
+		InvitedAdmins: []string{},
+		Invited:       []string{},
+		JobAcl:        acl.Rights{},
+		CreatedOn:     now,
+	}
+	err = g.Save()
+	if err != nil {
+		g = nil
+	}
+	return
+}
+
+func Load(name string) (g *Group, err error) {
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Groups")
+	g = &Group{}
+	if err = c.Find(bson.M{"name": name}).One(&g); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// List returns the groups the user belongs to or is invited to, all groups if all is true
+func List(uuid string, all bool) (groups Groups, err error) {
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Groups")
+	q := bson.M{"$or": []bson.M{bson.M{"owner": uuid}, bson.M{"admins": uuid}, bson.M{"members": uuid}, bson.M{"invited_admins": uuid}, bson.M{"invited": uuid}}}
+	if all {
+		q = bson.M{}
+	}
+	groups = Groups{}
+	err = c.Find(q).Sort("name").All(&groups)
+	return
+}
+
+func (g *Group) Save() (err error) {
+	g.LastUpdated = time.Now()
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Groups")
+	_, err = c.Upsert(bson.M{"name": g.Name}, &g)
+	if err != nil {
+		return
+	}
+	err = loadMemberships()
+	return
+}
+
+func Delete(name string) (err error) {
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Groups")
+	err = c.Remove(bson.M{"name": name})
+	if err != nil {
+		return
+	}
+	err = loadMemberships()
+	return
+}
+
+// IsAdmin tells if the user may manage the group
+func (g *Group) IsAdmin(uuid string) bool {
+	return g.Owner == uuid || contains(g.Admins, uuid)
+}
+
+func (g *Group) IsMember(uuid string) bool {
+	return g.IsAdmin(uuid) || contains(g.Members, uuid)
+}
+
+func (g *Group) IsInvited(uuid string) bool {
+	return contains(g.Invited, uuid) || contains(g.InvitedAdmins, uuid)
+}
+
+// InviteMember adds the user once the invitation is accepted, see AcceptMember
+func (g *Group) InviteMember(uuid string) {
+	if contains(g.Members, uuid) {
+		return
+	}
+	g.Invited = insert(g.Invited, uuid)
+}
+
+// AcceptMember turns an invitation into a membership, ok is false if there was none
+func (g *Group) AcceptMember(uuid string) (ok bool) {
+	if !contains(g.Invited, uuid) {
+		return
+	}
+	g.Invited = del(g.Invited, uuid)
+	g.AddMember(uuid)
+	ok = true
+	return
+}
+
+// AddMember adds the user without invitation, for server admins
+func (g *Group) AddMember(uuid string) {
+	g.Members = insert(g.Members, uuid)
+}
+
+// RemoveMember also withdraws or declines an invitation
+func (g *Group) RemoveMember(uuid string) {
+	g.Members = del(g.Members, uuid)
+	g.Invited = del(g.Invited, uuid)
+}
+
+func (g *Group) InviteAdmin(uuid string) {
+	if contains(g.Admins, uuid) {
+		return
+	}
+	g.InvitedAdmins = insert(g.InvitedAdmins, uuid)
+}
+
+func (g *Group) AcceptAdmin(uuid string) (ok bool) {
+	if !contains(g.InvitedAdmins, uuid) {
+		return
+	}
+	g.InvitedAdmins = del(g.InvitedAdmins, uuid)
+	g.AddAdmin(uuid)
+	ok = true
+	return
+}
+
+func (g *Group) AddAdmin(uuid string) {
+	g.Admins = insert(g.Admins, uuid)
+}
+
+func (g *Group) RemoveAdmin(uuid string) {
+	g.Admins = del(g.Admins, uuid)
+	g.InvitedAdmins = del(g.InvitedAdmins, uuid)
+}
+
+// Memberships returns the principals of all groups of a user, it is used by acl.Check
+func Memberships(uuid string) (principals []string) {
+	memberships.RLock()
+	principals = memberships.groups[uuid]
+	memberships.RUnlock()
+
+	claimed.RLock()
+	defer claimed.RUnlock()
+	if cg, ok := claimed.groups[uuid]; ok && time.Now().Before(cg.expires) {
+		principals = append([]string{}, principals...)
+		for _, principal := range cg.principals {
+			principals = insert(principals, principal)
+		}
+	}
+	return
+}
+
+// SetClaimedGroups makes the user a member of the named groups until expires, for groups
+// asserted by an identity provider (e.g. a JWT claim) instead of the Groups collection.
+// Only the ACLs see these memberships, as idp-group:<name> so that a claim can not make a
+// user a member of the AWE group with the same name. They replace the ones from earlier claims.
+func SetClaimedGroups(uuid string, names []string, expires time.Time) {
+	principals := []string{}
+	for _, name := range names {
+		if validName.MatchString(name) {
+			principals = insert(principals, ClaimedPrincipal(name))
+		}
+	}
+	claimed.Lock()
+	defer claimed.Unlock()
+	if len(principals) == 0 {
+		delete(claimed.groups, uuid)
+		return
+	}
+	claimed.groups[uuid] = claimedGroups{principals: principals, expires: expires}
+	return
+}
+
+func loadMemberships() (err error) {
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Groups")
+
+	groups := Groups{}
+	err = c.Find(nil).All(&groups)
+	if err != nil {
+		err = fmt.Errorf("(loadMemberships) %s", err.Error())
+		return
+	}
+
+	new_groups := make(map[string][]string)
+	for _, g := range groups {
+		principal := Principal(g.Name)
+		users := append([]string{g.Owner}, g.Admins...)
+		users = append(users, g.Members...)
+		for _, uuid := range users {
+			new_groups[uuid] = insert(new_groups[uuid], principal)
+		}
+	}
+	for uuid := range new_groups {
+		sort.Strings(new_groups[uuid])
+	}
+
+	memberships.Lock()
+	memberships.groups = new_groups
+	memberships.Unlock()
+	return
+}
+
+// ApplyJobAcl grants the job_acl rights of the group the user named on submission (?group=)
+// on a new job. The user has to be a member of the group. Without a group name the job is not shared.
+func ApplyJobAcl(job_acl *acl.Acl, uuid string, group_name string) (err error) {
+	if group_name == "" {
+		return
+	}
+	g, err := Load(group_name)
+	if err != nil {
+		err = fmt.Errorf("group %s not found", group_name)
+		return
+	}
+	if !g.IsMember(uuid) {
+		err = errors.New("user is not a member of group " + group_name)
+		return
+	}
+	if len(g.JobAcl) > 0 {
+		job_acl.Set(Principal(g.Name), g.JobAcl)
+	}
+	return
+}
+
+func contains(arr []string, s string) bool {
+	for _, item := range arr {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func del(arr []string, s string) (narr []string) {
+	narr = []string{}
+	for _, item := range arr {
+		if item != s {
+			narr = append(narr, item)
+		}
+	}
+	return
+}
+
+func insert(arr []string, s string) []string {
+	if contains(arr, s) {
+		return arr
+	}
+	return append(arr, s)
+}
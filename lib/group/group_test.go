@@ -0,0 +1,65 @@
+package group
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupInvitations(t *testing.T) {
+	tests := []struct {
+		name   string
+		action func(g *Group)
+		member bool
+		admin  bool
+	}{
+		{"invited", func(g *Group) { g.InviteMember("u") }, false, false},
+		{"accepted", func(g *Group) { g.InviteMember("u"); g.AcceptMember("u") }, true, false},
+		{"declined", func(g *Group) { g.InviteMember("u"); g.RemoveMember("u"); g.AcceptMember("u") }, false, false},
+		{"accept without invitation", func(g *Group) { g.AcceptMember("u") }, false, false},
+		{"admin invited", func(g *Group) { g.InviteAdmin("u") }, false, false},
+		{"admin accepted", func(g *Group) { g.InviteAdmin("u"); g.AcceptAdmin("u") }, true, true},
+		{"member invitation is no admin invitation", func(g *Group) { g.InviteMember("u"); g.AcceptAdmin("u") }, false, false},
+		{"added by server admin", func(g *Group) { g.AddMember("u") }, true, false},
+	}
+
+	for _, test := range tests {
+		g := &Group{Name: "g", Owner: "owner"}
+		test.action(g)
+		if g.IsMember("u") != test.member || g.IsAdmin("u") != test.admin {
+			t.Errorf("%s: member=%t admin=%t, expected %t %t", test.name, g.IsMember("u"), g.IsAdmin("u"), test.member, test.admin)
+		}
+	}
+}
+
+func TestClaimedGroups(t *testing.T) {
+	tests := []struct {
+		name       string
+		names      []string
+		expires    time.Time
+		principals []string
+	}{
+		{"claimed", []string{"team", "/invalid"}, time.Now().Add(time.Hour), []string{"idp-group:team"}},
+		{"expired", []string{"team"}, time.Now().Add(-time.Second), nil},
+		{"none", nil, time.Now().Add(time.Hour), nil},
+	}
+
+	for _, test := range tests {
+		SetClaimedGroups("u", test.names, test.expires)
+		principals := Memberships("u")
+		if len(principals) != len(test.principals) {
+			t.Errorf("%s: got %v, expected %v", test.name, principals, test.principals)
+			continue
+		}
+		for i := range principals {
+			if principals[i] != test.principals[i] {
+				t.Errorf("%s: got %v, expected %v", test.name, principals, test.principals)
+			}
+		}
+		// a claim never makes the user a member of the AWE group with the same name
+		for _, principal := range principals {
+			if principal == Principal("team") {
+				t.Errorf("%s: claim grants %s", test.name, principal)
+			}
+		}
+	}
+}
@@ -177,7 +177,7 @@ func (l *Logger) Handle() {
 }
 
 func (l *Logger) Log(log string, lvl l4g.Level, message string) {
-	l.queue <- m{log: log, lvl: lvl, message: message}
+	l.queue <- m{log: log, lvl: lvl, message: redact(message)}
 	return
 }
 
@@ -0,0 +1,133 @@
+package logger
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+const REDACTED = "****"
+
+// secret values that must not show up in any log, with a reference count
+// because the same value can be used by several workunits at once
+var redactions = struct {
+	sync.RWMutex
+	values   map[string]int
+	sorted   []string // longest first
+	replacer *strings.Replacer
+}{values: make(map[string]int)}
+
+// AddRedaction replaces the value with **** in all log messages until RemoveRedaction is called
+func AddRedaction(value string) {
+	if value == "" {
+		return
+	}
+	redactions.Lock()
+	defer redactions.Unlock()
+	redactions.values[value]++
+	redactions.sorted, redactions.replacer = newRedactionReplacer()
+	return
+}
+
+func RemoveRedaction(value string) {
+	redactions.Lock()
+	defer redactions.Unlock()
+	count, ok := redactions.values[value]
+	if !ok {
+		return
+	}
+	if count > 1 {
+		redactions.values[value] = count - 1
+		return
+	}
+	delete(redactions.values, value)
+	redactions.sorted, redactions.replacer = newRedactionReplacer()
+	return
+}
+
+// longer values first, a secret may contain another one
+func newRedactionReplacer() (values []string, replacer *strings.Replacer) {
+	if len(redactions.values) == 0 {
+		return
+	}
+	values = make([]string, 0, len(redactions.values))
+	for value := range redactions.values {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	oldnew := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		oldnew = append(oldnew, value, REDACTED)
+	}
+	replacer = strings.NewReplacer(oldnew...)
+	return
+}
+
+// HasRedactions tells if any value is redacted at the moment
+func HasRedactions() bool {
+	redactions.RLock()
+	defer redactions.RUnlock()
+	return redactions.replacer != nil
+}
+
+// RedactStream redacts the next piece of a stream, e.g. a log file. Unless final is set, the end
+// of data is not consumed if it could be the beginning of a secret; the caller passes it again
+// together with the following data. consumed is the number of bytes of data that were redacted.
+func RedactStream(data []byte, final bool) (redacted []byte, consumed int) {
+	redactions.RLock()
+	values := redactions.sorted
+	replacer := redactions.replacer
+	redactions.RUnlock()
+
+	if replacer == nil {
+		redacted = data
+		consumed = len(data)
+		return
+	}
+
+	consumed = len(data)
+	if !final {
+		consumed = streamCut(data, values)
+	}
+	redacted = []byte(replacer.Replace(string(data[:consumed])))
+	return
+}
+
+// streamCut keeps back as many bytes as the longest secret minus one, and moves the cut
+// before any secret that would otherwise be split
+func streamCut(data []byte, values []string) (cut int) {
+	cut = len(data) - (len(values[0]) - 1)
+	if cut <= 0 {
+		return 0
+	}
+	for moved := true; moved && cut > 0; {
+		moved = false
+		for _, value := range values {
+			start := cut - len(value) + 1
+			if start < 0 {
+				start = 0
+			}
+			end := cut + len(value) - 1
+			if end > len(data) {
+				end = len(data)
+			}
+			index := strings.Index(string(data[start:end]), value)
+			if index >= 0 && start+index < cut {
+				cut = start + index
+				moved = true
+			}
+		}
+	}
+	return
+}
+
+func redact(message string) string {
+	redactions.RLock()
+	replacer := redactions.replacer
+	redactions.RUnlock()
+	if replacer == nil {
+		return message
+	}
+	return replacer.Replace(message)
+}
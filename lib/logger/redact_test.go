@@ -0,0 +1,52 @@
+package logger
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactStream(t *testing.T) {
+	AddRedaction("s3cret")
+	AddRedaction("token1234")
+	defer RemoveRedaction("s3cret")
+	defer RemoveRedaction("token1234")
+
+	tests := []struct {
+		name   string
+		pieces []string
+		result string
+	}{
+		{"whole", []string{"user s3cret\n"}, "user ****\n"},
+		{"split secret", []string{"user s3", "cret\n"}, "user ****\n"},
+		{"split at every byte", strings.Split("a token1234 b s3cret", ""), "a **** b ****"},
+		{"held back until final", []string{"s3cre"}, "s3cre"},
+		{"no secret", []string{"hello ", "world"}, "hello world"},
+	}
+
+	for _, test := range tests {
+		var pending []byte
+		var result []byte
+		for i, piece := range test.pieces {
+			pending = append(pending, piece...)
+			redacted, consumed := RedactStream(pending, i == len(test.pieces)-1)
+			result = append(result, redacted...)
+			pending = pending[consumed:]
+		}
+		if len(pending) != 0 {
+			t.Errorf("%s: %d bytes left after final piece", test.name, len(pending))
+		}
+		if string(result) != test.result {
+			t.Errorf("%s: got %q, expected %q", test.name, result, test.result)
+		}
+	}
+}
+
+func TestRedactStreamWithoutSecrets(t *testing.T) {
+	if HasRedactions() {
+		t.Fatal("redactions left by another test")
+	}
+	redacted, consumed := RedactStream([]byte("s3cret"), false)
+	if consumed != 6 || string(redacted) != "s3cret" {
+		t.Errorf("got %q, consumed %d", redacted, consumed)
+	}
+}
@@ -0,0 +1,217 @@
+package request
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/auth"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/logger"
+)
+
+// buckets are removed when they have not been used for rateLimitIdle, if there are more than
+// rateLimitMaxBuckets the least recently used one makes room for a new key
+const (
+	rateLimitIdle       = 10 * time.Minute
+	rateLimitMaxBuckets = 100000
+)
+
+// RateLimiter is a set of token buckets, one per key (user, client or IP)
+type RateLimiter struct {
+	sync.Mutex
+	Name    string
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*bucket
+	cleaned time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter allows per_minute requests per key with bursts of up to burst requests,
+// it returns nil (no limit) if per_minute is not positive
+func NewRateLimiter(name string, per_minute int, burst int) *RateLimiter {
+	if per_minute <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = per_minute
+	}
+	return &RateLimiter{
+		Name:    name,
+		rate:    float64(per_minute) / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		cleaned: time.Now(),
+	}
+}
+
+// Allow takes a token from the bucket of the key, if there is none it returns how long the
+// caller has to wait for the next one
+func (l *RateLimiter) Allow(key string) (ok bool, retry_after time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.cleaned) > rateLimitIdle {
+		l.clean(now)
+	}
+
+	b, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= rateLimitMaxBuckets {
+			l.clean(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	retry_after = time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, retry_after
+}
+
+// clean removes idle buckets, and the least recently used one if all are in use and there
+// is no room for another, caller holds the lock
+func (l *RateLimiter) clean(now time.Time) {
+	oldest := ""
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > rateLimitIdle {
+			delete(l.buckets, key)
+			continue
+		}
+		if oldest == "" || b.last.Before(l.buckets[oldest].last) {
+			oldest = key
+		}
+	}
+	if len(l.buckets) >= rateLimitMaxBuckets && oldest != "" {
+		delete(l.buckets, oldest)
+	}
+	l.cleaned = now
+}
+
+var (
+	submitLimiter *RateLimiter
+	readLimiter   *RateLimiter
+	workerLimiter *RateLimiter
+	authLimiter   *RateLimiter
+)
+
+// replaced by tests
+var (
+	authenticateUser        = auth.Authenticate
+	authenticateClientGroup = auth.AuthenticateClientGroup
+)
+
+// InitRateLimits creates the limiters configured in the [RateLimit] section
+func InitRateLimits() {
+	submitLimiter = NewRateLimiter("submit", conf.RATE_LIMIT_SUBMIT, conf.RATE_LIMIT_SUBMIT_BURST)
+	readLimiter = NewRateLimiter("read", conf.RATE_LIMIT_READ, conf.RATE_LIMIT_READ_BURST)
+	workerLimiter = NewRateLimiter("worker", conf.RATE_LIMIT_WORKER, conf.RATE_LIMIT_WORKER_BURST)
+	authLimiter = NewRateLimiter("auth", conf.RATE_LIMIT_AUTH, conf.RATE_LIMIT_AUTH_BURST)
+}
+
+// RateLimit wraps the API handler. Requests with credentials are first limited per IP, before
+// the credentials are checked. Then requests of workers with a valid clientgroup token are
+// limited per clientgroup, anonymous requests on /work and /client per IP, and all others per
+// authenticated user or, for anonymous callers, per IP, with separate limits for reads and
+// everything else.
+func RateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ip := remoteIP(r)
+		if r.Header.Get("Authorization") != "" && !allowRequest(w, r, authLimiter, "ip:"+ip) {
+			return
+		}
+		limiter, key := rateLimitClass(r, ip)
+		if !allowRequest(w, r, limiter, key) {
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// allowRequest takes a token from the bucket of the key or answers the request with 429
+func allowRequest(w http.ResponseWriter, r *http.Request, limiter *RateLimiter, key string) bool {
+	ok, retry_after := limiter.Allow(key)
+	if ok {
+		return true
+	}
+	logger.Debug(1, "(RateLimit) %s limit exceeded by %s: %s %s", limiter.Name, key, r.Method, r.URL.Path)
+	seconds := int(math.Ceil(retry_after.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	// same format as goweb responses
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": http.StatusTooManyRequests,
+		"data":   nil,
+		"error":  []string{fmt.Sprintf("rate limit exceeded, retry after %d seconds", seconds)},
+	})
+	return false
+}
+
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// rateLimitClass returns the limiter and the bucket key of a request. Keys only come from
+// validated credentials or the IP, never from anything else the caller sends.
+func rateLimitClass(r *http.Request, ip string) (limiter *RateLimiter, key string) {
+	if workerLimiter == nil && readLimiter == nil && submitLimiter == nil {
+		return
+	}
+	header := r.Header.Get("Authorization")
+
+	// workers
+	if strings.HasPrefix(strings.ToLower(header), "cg_token ") {
+		if cg, err := authenticateClientGroup(header); err == nil && cg != nil {
+			return workerLimiter, "clientgroup:" + cg.Id
+		}
+		// invalid tokens are limited like anonymous requests
+		header = ""
+	} else if header == "" && (strings.HasPrefix(r.URL.Path, "/work") || strings.HasPrefix(r.URL.Path, "/client")) {
+		return workerLimiter, "ip:" + ip
+	}
+
+	if r.Method == "GET" || r.Method == "HEAD" {
+		limiter = readLimiter
+	} else {
+		limiter = submitLimiter
+	}
+	if limiter == nil {
+		return
+	}
+	key = "ip:" + ip
+	if header != "" {
+		// cached by auth
+		if u, err := authenticateUser(header); err == nil && u != nil {
+			key = "user:" + u.Uuid
+		}
+	}
+	return
+}
@@ -0,0 +1,118 @@
+package request
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/auth"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/user"
+)
+
+func TestRateLimitClass(t *testing.T) {
+	submitLimiter = NewRateLimiter("submit", 60, 0)
+	readLimiter = NewRateLimiter("read", 60, 0)
+	workerLimiter = NewRateLimiter("worker", 60, 0)
+	authenticateUser = func(header string) (*user.User, error) {
+		if header == "Bearer valid" {
+			return &user.User{Uuid: "u1"}, nil
+		}
+		return nil, errors.New("invalid")
+	}
+	authenticateClientGroup = func(header string) (*core.ClientGroup, error) {
+		if header == "CG_TOKEN valid" {
+			return &core.ClientGroup{Id: "cg1"}, nil
+		}
+		return nil, errors.New("invalid")
+	}
+	defer func() {
+		submitLimiter, readLimiter, workerLimiter = nil, nil, nil
+		authenticateUser, authenticateClientGroup = auth.Authenticate, auth.AuthenticateClientGroup
+	}()
+
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		header  string
+		limiter *RateLimiter
+		key     string
+	}{
+		{"worker", "GET", "/work?client=c1", "CG_TOKEN valid", workerLimiter, "clientgroup:cg1"},
+		{"client id is ignored", "GET", "/work?client=random", "CG_TOKEN valid", workerLimiter, "clientgroup:cg1"},
+		{"client path is ignored", "PUT", "/client/random", "CG_TOKEN valid", workerLimiter, "clientgroup:cg1"},
+		{"fake clientgroup token", "GET", "/job", "CG_TOKEN fake", readLimiter, "ip:10.0.0.1"},
+		{"fake clientgroup token on /work", "GET", "/work?client=random", "CG_TOKEN fake", readLimiter, "ip:10.0.0.1"},
+		{"anonymous worker", "GET", "/work?client=random", "", workerLimiter, "ip:10.0.0.1"},
+		{"user on /work", "GET", "/work", "Bearer valid", readLimiter, "user:u1"},
+		{"user read", "GET", "/job", "Bearer valid", readLimiter, "user:u1"},
+		{"user submit", "POST", "/job", "Bearer valid", submitLimiter, "user:u1"},
+		{"invalid user", "POST", "/job", "Bearer invalid", submitLimiter, "ip:10.0.0.1"},
+		{"anonymous", "GET", "/job", "", readLimiter, "ip:10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.url, nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		limiter, key := rateLimitClass(r, remoteIP(r))
+		if limiter != test.limiter || key != test.key {
+			name := "nil"
+			if limiter != nil {
+				name = limiter.Name
+			}
+			t.Errorf("%s: got %s %s, expected %s %s", test.name, name, key, test.limiter.Name, test.key)
+		}
+	}
+}
+
+func TestRateLimitBeforeAuthentication(t *testing.T) {
+	authLimiter = NewRateLimiter("auth", 60, 2)
+	calls := 0
+	authenticateUser = func(header string) (*user.User, error) {
+		calls++
+		return nil, errors.New("invalid")
+	}
+	readLimiter = NewRateLimiter("read", 6000, 0)
+	defer func() {
+		authLimiter, readLimiter = nil, nil
+		authenticateUser = auth.Authenticate
+	}()
+
+	handler := RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	codes := []int{}
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "/job", nil)
+		r.RemoteAddr = "10.0.0.2:1234"
+		r.Header.Set("Authorization", "Bearer guess")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		codes = append(codes, w.Code)
+	}
+	if codes[2] != http.StatusTooManyRequests || calls != 2 {
+		t.Errorf("codes %v, %d authentications", codes, calls)
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	l := NewRateLimiter("test", 60, 1)
+	l.Allow("a")
+	l.buckets["a"].last = time.Now().Add(-rateLimitIdle - time.Second)
+	l.cleaned = time.Now().Add(-rateLimitIdle - time.Second)
+	l.Allow("b")
+	if _, ok := l.buckets["a"]; ok {
+		t.Errorf("idle bucket kept")
+	}
+
+	for i := 0; i < rateLimitMaxBuckets+10; i++ {
+		l.Allow(string(rune(i)))
+	}
+	if len(l.buckets) > rateLimitMaxBuckets {
+		t.Errorf("%d buckets", len(l.buckets))
+	}
+}
@@ -2,6 +2,7 @@ package request
 
 import (
 	"errors"
+	"fmt"
 	"github.com/MG-RAST/AWE/lib/auth"
 	"github.com/MG-RAST/AWE/lib/core"
 	e "github.com/MG-RAST/AWE/lib/errors"
@@ -18,6 +19,19 @@ func Authenticate(req *http.Request) (u *user.User, err error) {
 	}
 	header := req.Header.Get("Authorization")
 	u, err = auth.Authenticate(header)
+	if err != nil {
+		return
+	}
+
+	// personal access tokens are limited to their scopes
+	scope := user.SCOPE_SUBMIT
+	if req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS" {
+		scope = user.SCOPE_READ
+	}
+	if !u.HasScope(scope) {
+		u = nil
+		err = fmt.Errorf("%s: token does not have the %s scope", e.UnAuth, scope)
+	}
 	return
 }
 
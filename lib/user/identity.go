@@ -0,0 +1,56 @@
+package user
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/db"
+	"github.com/MG-RAST/golib/go-uuid/uuid"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Identity of a user at an external identity provider, e.g. the iss and sub claims of a JWT
+type Identity struct {
+	Issuer  string `bson:"issuer" json:"issuer"`
+	Subject string `bson:"subject" json:"subject"`
+}
+
+func FindByIdentity(identity Identity) (u *User, err error) {
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Users")
+	u = &User{}
+	if err = c.Find(bson.M{"identity.issuer": identity.Issuer, "identity.subject": identity.Subject}).One(&u); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// FindOrCreateByIdentity returns the user of the identity and creates it on first login. The
+// username is only used for a new user; if another user already has it, e.g. a local account,
+// the new user gets a name derived from the identity instead of access to that account.
+func FindOrCreateByIdentity(identity Identity, username string) (u *User, err error) {
+	if u, err = FindByIdentity(identity); err != mgo.ErrNotFound {
+		return
+	}
+	u = &User{Uuid: uuid.New(), Username: username, Identity: &identity}
+	if _, xerr := FindByUsername(username); xerr == nil {
+		u.Username = identityUsername(identity, username)
+	}
+	if err = u.Save(); err != nil {
+		if mgo.IsDup(err) {
+			// created by a concurrent login
+			return FindByIdentity(identity)
+		}
+		return nil, err
+	}
+	return
+}
+
+// identityUsername is username@<hash of issuer and subject>
+func identityUsername(identity Identity, username string) string {
+	sum := sha256.Sum256([]byte(identity.Issuer + "\x00" + identity.Subject))
+	return username + "@" + hex.EncodeToString(sum[:])[:12]
+}
@@ -0,0 +1,130 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Failed password logins are counted per user name. After LOGIN_MAX_FAILURES failures within
+// LOGIN_FAILURE_WINDOW further attempts are refused until the window has passed. Passwords that
+// already failed are remembered, trying them again does not cost another hash.
+const (
+	LOGIN_MAX_FAILURES   = 5
+	LOGIN_FAILURE_WINDOW = 15 * time.Minute
+	LOGIN_MAX_TRACKED    = 10000 // user names
+)
+
+var ErrInvalidLogin = errors.New("invalid username or password")
+var ErrLoginThrottled = errors.New("too many failed logins, try again later")
+
+type loginFailures struct {
+	sync.Mutex
+	key   []byte // keys the digests of failed passwords, they are never kept in plain text
+	users map[string]*loginFailure
+	now   func() time.Time
+}
+
+type loginFailure struct {
+	count     int
+	last      time.Time
+	passwords map[string]bool
+}
+
+var failedLogins = newLoginFailures()
+
+func newLoginFailures() (f *loginFailures) {
+	f = &loginFailures{users: map[string]*loginFailure{}, now: time.Now}
+	f.key = make([]byte, 32)
+	if _, err := rand.Read(f.key); err != nil {
+		panic(err)
+	}
+	return
+}
+
+func (f *loginFailures) digest(password string) string {
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(password))
+	return string(mac.Sum(nil))
+}
+
+// get returns the failures of the user within the window, caller holds the lock
+func (f *loginFailures) get(username string) *loginFailure {
+	failure, ok := f.users[username]
+	if !ok {
+		return nil
+	}
+	if f.now().Sub(failure.last) > LOGIN_FAILURE_WINDOW {
+		delete(f.users, username)
+		return nil
+	}
+	return failure
+}
+
+// check refuses the login without looking at the stored password if the user had too many
+// failures or the password already failed
+func (f *loginFailures) check(username string, password string) (err error) {
+	f.Lock()
+	defer f.Unlock()
+	failure := f.get(username)
+	if failure == nil {
+		return
+	}
+	if failure.count >= LOGIN_MAX_FAILURES {
+		err = ErrLoginThrottled
+		return
+	}
+	if failure.passwords[f.digest(password)] {
+		failure.count++
+		failure.last = f.now()
+		err = ErrInvalidLogin
+	}
+	return
+}
+
+func (f *loginFailures) failed(username string, password string) {
+	f.Lock()
+	defer f.Unlock()
+	failure := f.get(username)
+	if failure == nil {
+		if len(f.users) >= LOGIN_MAX_TRACKED {
+			f.prune()
+		}
+		failure = &loginFailure{passwords: map[string]bool{}}
+		f.users[username] = failure
+	}
+	failure.count++
+	failure.last = f.now()
+	failure.passwords[f.digest(password)] = true
+	return
+}
+
+// reset forgets the failures of the user, after a successful login or a password change
+func (f *loginFailures) reset(username string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.users, username)
+	return
+}
+
+// prune removes the failures outside of the window, or the oldest one if all are recent,
+// caller holds the lock
+func (f *loginFailures) prune() {
+	oldest := ""
+	for username, failure := range f.users {
+		if f.now().Sub(failure.last) > LOGIN_FAILURE_WINDOW {
+			delete(f.users, username)
+			continue
+		}
+		if oldest == "" || failure.last.Before(f.users[oldest].last) {
+			oldest = username
+		}
+	}
+	if len(f.users) >= LOGIN_MAX_TRACKED && oldest != "" {
+		delete(f.users, oldest)
+	}
+	return
+}
@@ -0,0 +1,59 @@
+package user
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoginFailures(t *testing.T) {
+	now := time.Now()
+	f := newLoginFailures()
+	f.now = func() time.Time { return now }
+
+	tests := []struct {
+		name     string
+		action   func()
+		password string
+		err      error
+	}{
+		{"first attempt", func() {}, "a", nil},
+		{"failed password is cached", func() { f.failed("u", "a") }, "a", ErrInvalidLogin},
+		{"other password is checked", func() {}, "b", nil},
+		{"throttled", func() {
+			for i := 0; i < LOGIN_MAX_FAILURES; i++ {
+				f.failed("u", fmt.Sprintf("p%d", i))
+			}
+		}, "b", ErrLoginThrottled},
+		{"window passed", func() { now = now.Add(LOGIN_FAILURE_WINDOW + time.Second) }, "a", nil},
+		{"reset", func() { f.failed("u", "a"); f.reset("u") }, "a", nil},
+	}
+
+	for _, test := range tests {
+		test.action()
+		if err := f.check("u", test.password); err != test.err {
+			t.Errorf("%s: got %v, expected %v", test.name, err, test.err)
+		}
+	}
+
+	if err := f.check("other", "b"); err != nil {
+		t.Errorf("failures of u applied to other: %v", err)
+	}
+}
+
+func TestLoginFailuresPrune(t *testing.T) {
+	now := time.Now()
+	f := newLoginFailures()
+	f.now = func() time.Time { return now }
+
+	for i := 0; i < LOGIN_MAX_TRACKED+10; i++ {
+		f.failed(fmt.Sprintf("u%d", i), "a")
+		now = now.Add(time.Millisecond)
+	}
+	if len(f.users) > LOGIN_MAX_TRACKED {
+		t.Errorf("%d users tracked", len(f.users))
+	}
+	if f.get(fmt.Sprintf("u%d", LOGIN_MAX_TRACKED+9)) == nil {
+		t.Errorf("latest failure pruned")
+	}
+}
@@ -0,0 +1,85 @@
+package user
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwords are stored as bcrypt hashes. Older versions stored plain text, it is still accepted and
+// replaced with a bcrypt hash on login.
+const (
+	PASSWORD_COST       = 12
+	PASSWORD_MIN_LENGTH = 8
+	PASSWORD_MAX_LENGTH = 72 // bcrypt ignores everything after 72 bytes
+)
+
+// passwordCost is only lowered by tests
+var passwordCost = PASSWORD_COST
+
+// dummyHash is compared with the password of logins without a stored password, so that
+// unknown users take as long as wrong passwords
+var dummyHash []byte
+var dummyHashOnce sync.Once
+
+func HashPassword(password string) (hashed string, err error) {
+	if len(password) < PASSWORD_MIN_LENGTH {
+		err = fmt.Errorf("password must have at least %d characters", PASSWORD_MIN_LENGTH)
+		return
+	}
+	if len(password) > PASSWORD_MAX_LENGTH {
+		err = fmt.Errorf("password must not be longer than %d bytes", PASSWORD_MAX_LENGTH)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	if err != nil {
+		return
+	}
+	hashed = string(hash)
+	return
+}
+
+func isBcrypt(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// NeedsRehash is true for passwords stored in plain text or with a lower bcrypt cost
+func NeedsRehash(stored string) bool {
+	if stored == "" {
+		return false
+	}
+	if !isBcrypt(stored) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(stored))
+	return err != nil || cost < passwordCost
+}
+
+// CheckPassword compares a password with the stored value. An empty stored value never
+// matches, but costs as much as a stored hash.
+func CheckPassword(stored string, password string) (ok bool, err error) {
+	if stored == "" {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("no password set"), passwordCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return
+	}
+	if password == "" {
+		return
+	}
+	if isBcrypt(stored) {
+		err = bcrypt.CompareHashAndPassword([]byte(stored), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			err = nil
+			return
+		}
+		ok = err == nil
+		return
+	}
+	ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	return
+}
@@ -0,0 +1,75 @@
+package user
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	passwordCost = bcrypt.MinCost
+}
+
+func TestCheckPassword(t *testing.T) {
+	hashed, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hashed, "$2a$") {
+		t.Fatalf("not a bcrypt hash: %s", hashed)
+	}
+	strong, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		ok       bool
+		rehash   bool
+	}{
+		{"bcrypt", hashed, "correct horse", true, false},
+		{"bcrypt wrong password", hashed, "wrong horse", false, false},
+		{"bcrypt higher cost", string(strong), "correct horse", true, false},
+		{"plain text", "correct horse", "correct horse", true, true},
+		{"plain text wrong password", "correct horse", "wrong horse", false, true},
+		{"no password", "", "correct horse", false, false},
+		{"empty password", hashed, "", false, false},
+	}
+
+	for _, test := range tests {
+		ok, err := CheckPassword(test.stored, test.password)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if ok != test.ok {
+			t.Errorf("%s: ok=%t, expected %t", test.name, ok, test.ok)
+		}
+		if NeedsRehash(test.stored) != test.rehash {
+			t.Errorf("%s: rehash=%t, expected %t", test.name, !test.rehash, test.rehash)
+		}
+	}
+}
+
+func TestHashPasswordLength(t *testing.T) {
+	tests := []struct {
+		password string
+		fails    bool
+	}{
+		{strings.Repeat("a", PASSWORD_MIN_LENGTH-1), true},
+		{strings.Repeat("a", PASSWORD_MIN_LENGTH), false},
+		{strings.Repeat("a", PASSWORD_MAX_LENGTH), false},
+		{strings.Repeat("a", PASSWORD_MAX_LENGTH+1), true},
+	}
+
+	for _, test := range tests {
+		_, err := HashPassword(test.password)
+		if (err != nil) != test.fails {
+			t.Errorf("length %d: error=%v, expected failure %t", len(test.password), err, test.fails)
+		}
+	}
+}
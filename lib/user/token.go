@@ -0,0 +1,157 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/db"
+	"github.com/MG-RAST/golib/go-uuid/uuid"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// personal access tokens start with this prefix, the server only stores their sha256
+const TOKEN_PREFIX = "awe_"
+
+// Token is a personal access token of a user with limited scopes and an expiry
+type Token struct {
+	Id        string    `bson:"id" json:"id"`
+	User      string    `bson:"user" json:"user"`
+	Name      string    `bson:"name" json:"name"`
+	Scopes    []string  `bson:"scopes" json:"scopes"`
+	Hash      string    `bson:"hash" json:"-"`
+	Hint      string    `bson:"hint" json:"hint"` // first characters of the token, to tell tokens apart
+	CreatedOn time.Time `bson:"created_on" json:"created_on"`
+	ExpiresOn time.Time `bson:"expires_on" json:"expires_on"`
+	LastUsed  time.Time `bson:"last_used" json:"last_used"`
+}
+
+type Tokens []Token
+
+func initTokenDB() (err error) {
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Tokens")
+	if err = c.EnsureIndex(mgo.Index{Key: []string{"hash"}, Unique: true}); err != nil {
+		return
+	}
+	if err = c.EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true}); err != nil {
+		return
+	}
+	err = c.EnsureIndex(mgo.Index{Key: []string{"user"}, Background: true})
+	return
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewToken creates a token for the user, the secret is only returned here
+func NewToken(u *User, name string, scopes []string, expires_in time.Duration) (token *Token, secret string, err error) {
+	if len(scopes) == 0 {
+		err = errors.New("at least one scope is required")
+		return
+	}
+	for _, scope := range scopes {
+		if !ValidScopes[scope] {
+			err = fmt.Errorf("invalid scope %s, use %s, %s or %s", scope, SCOPE_READ, SCOPE_SUBMIT, SCOPE_ADMIN)
+			return
+		}
+		if scope == SCOPE_ADMIN && !u.Admin {
+			err = errors.New("only admins can create tokens with the admin scope")
+			return
+		}
+	}
+	if expires_in <= 0 {
+		err = errors.New("tokens have to expire")
+		return
+	}
+
+	random := make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, random)
+	if err != nil {
+		return
+	}
+	secret = TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(random)
+
+	now := time.Now()
+	token = &Token{
+		Id:        uuid.New(),
+		User:      u.Uuid,
+		Name:      name,
+		Scopes:    scopes,
+		Hash:      hashToken(secret),
+		Hint:      secret[:len(TOKEN_PREFIX)+4],
+		CreatedOn: now,
+		ExpiresOn: now.Add(expires_in),
+	}
+
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Tokens")
+	err = c.Insert(token)
+	if err != nil {
+		token = nil
+		secret = ""
+	}
+	return
+}
+
+func ListTokens(user_uuid string) (tokens Tokens, err error) {
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Tokens")
+	tokens = Tokens{}
+	err = c.Find(bson.M{"user": user_uuid}).Sort("created_on").All(&tokens)
+	return
+}
+
+func DeleteToken(user_uuid string, id string) (err error) {
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Tokens")
+	err = c.Remove(bson.M{"user": user_uuid, "id": id})
+	return
+}
+
+// FindByToken returns the owner of a valid token with the scopes of the token. The admin
+// flag is only kept if the token has the admin scope.
+func FindByToken(secret string) (u *User, err error) {
+	if !strings.HasPrefix(secret, TOKEN_PREFIX) {
+		err = errors.New("not a personal access token")
+		return
+	}
+
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Tokens")
+	token := Token{}
+	if err = c.Find(bson.M{"hash": hashToken(secret)}).One(&token); err != nil {
+		return nil, errors.New("unknown token")
+	}
+	if time.Now().After(token.ExpiresOn) {
+		return nil, fmt.Errorf("token %s expired", token.Id)
+	}
+
+	if u, err = FindByUuid(token.User); err != nil {
+		return nil, err
+	}
+	u.TokenId = token.Id
+	u.TokenExpires = token.ExpiresOn
+	u.Scopes = token.Scopes
+	if !u.HasScope(SCOPE_ADMIN) {
+		u.Admin = false
+	}
+
+	c.Update(bson.M{"id": token.Id}, bson.M{"$set": bson.M{"last_used": time.Now()}})
+	return
+}
@@ -1,8 +1,11 @@
 package user
 
 import (
+	"time"
+
 	"github.com/MG-RAST/AWE/lib/conf"
 	"github.com/MG-RAST/AWE/lib/db"
+	"github.com/MG-RAST/AWE/lib/logger"
 	"github.com/MG-RAST/golib/go-uuid/uuid"
 	mgo "gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
@@ -20,8 +23,23 @@ type User struct {
 	Password     string      `bson:"password" json:"-"`
 	Admin        bool        `bson:"admin" json:"admin"`
 	CustomFields interface{} `bson:"custom_fields" json:"custom_fields"`
+	Identity     *Identity   `bson:"identity,omitempty" json:"identity,omitempty"` // users of an identity provider
+
+	// set when the request was authenticated with a personal access token
+	TokenId      string    `bson:"-" json:"-"`
+	TokenExpires time.Time `bson:"-" json:"-"`
+	Scopes       []string  `bson:"-" json:"-"`
 }
 
+// scopes of personal access tokens
+const (
+	SCOPE_READ   = "read"   // GET requests
+	SCOPE_SUBMIT = "submit" // all requests that create or modify jobs, implies read
+	SCOPE_ADMIN  = "admin"  // keeps the admin rights of the user, implies submit
+)
+
+var ValidScopes = map[string]bool{SCOPE_READ: true, SCOPE_SUBMIT: true, SCOPE_ADMIN: true}
+
 func Initialize() (err error) {
 	session := db.Connection.Session.Copy()
 	defer session.Close()
@@ -32,6 +50,12 @@ func Initialize() (err error) {
 	if err = c.EnsureIndex(mgo.Index{Key: []string{"username"}, Unique: true}); err != nil {
 		return err
 	}
+	if err = c.EnsureIndex(mgo.Index{Key: []string{"identity.issuer", "identity.subject"}, Unique: true, Sparse: true}); err != nil {
+		return err
+	}
+	if err = initTokenDB(); err != nil {
+		return err
+	}
 
 	// Setting admin users based on config file.  First, set all users to Admin = false
 	if _, err = c.UpdateAll(bson.M{}, bson.M{"$set": bson.M{"admin": false}}); err != nil {
@@ -53,8 +77,14 @@ func Initialize() (err error) {
 	return
 }
 
+// New creates a user, without password the user can only log in through OAuth or Globus
 func New(username string, password string, isAdmin bool) (u *User, err error) {
-	u = &User{Uuid: uuid.New(), Username: username, Password: password, Admin: isAdmin}
+	u = &User{Uuid: uuid.New(), Username: username, Admin: isAdmin}
+	if password != "" {
+		if u.Password, err = HashPassword(password); err != nil {
+			return nil, err
+		}
+	}
 	err = u.Save()
 	if err != nil {
 		u = nil
@@ -73,17 +103,92 @@ func FindByUuid(uuid string) (u *User, err error) {
 	return
 }
 
-func FindByUsernamePassword(username string, password string) (u *User, err error) {
+func FindByUsername(username string) (u *User, err error) {
 	session := db.Connection.Session.Copy()
 	defer session.Close()
 	c := session.DB(conf.MONGODB_DATABASE).C("Users")
 	u = &User{}
-	if err = c.Find(bson.M{"username": username, "password": password}).One(&u); err != nil {
+	if err = c.Find(bson.M{"username": username}).One(&u); err != nil {
 		return nil, err
 	}
 	return
 }
 
+// FindByUsernamePassword checks a local login. Unknown users, users without password and wrong
+// passwords all fail with ErrInvalidLogin after the same amount of hashing.
+func FindByUsernamePassword(username string, password string) (u *User, err error) {
+	if err = failedLogins.check(username, password); err != nil {
+		return nil, err
+	}
+	stored := ""
+	u, err = FindByUsername(username)
+	if err == nil {
+		stored = u.Password
+	} else if err != mgo.ErrNotFound {
+		return nil, err
+	}
+	ok, err := CheckPassword(stored, password)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		failedLogins.failed(username, password)
+		return nil, ErrInvalidLogin
+	}
+	failedLogins.reset(username)
+	// passwords of older versions were stored in plain text
+	if NeedsRehash(u.Password) {
+		// passwords that are too short or too long for a new hash keep the old one
+		if err = u.SetPassword(password); err != nil {
+			logger.Error("(FindByUsernamePassword) could not rehash password of %s: %s", u.Username, err.Error())
+			err = nil
+		}
+	}
+	return
+}
+
+// SetPassword hashes and saves the password, an empty password disables local login
+func (u *User) SetPassword(password string) (err error) {
+	hashed := ""
+	if password != "" {
+		if hashed, err = HashPassword(password); err != nil {
+			return
+		}
+	}
+	u.Password = hashed
+	failedLogins.reset(u.Username)
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Users")
+	err = c.Update(bson.M{"uuid": u.Uuid}, bson.M{"$set": bson.M{"password": u.Password}})
+	return
+}
+
+// Delete removes the user and its access tokens
+func Delete(uuid string) (err error) {
+	session := db.Connection.Session.Copy()
+	defer session.Close()
+	c := session.DB(conf.MONGODB_DATABASE).C("Users")
+	if err = c.Remove(bson.M{"uuid": uuid}); err != nil {
+		return
+	}
+	_, err = session.DB(conf.MONGODB_DATABASE).C("Tokens").RemoveAll(bson.M{"user": uuid})
+	return
+}
+
+// HasScope is true for requests that were not authenticated with a token
+func (u *User) HasScope(scope string) bool {
+	if u.Scopes == nil {
+		return true
+	}
+	for _, s := range u.Scopes {
+		if s == scope || s == SCOPE_ADMIN || (s == SCOPE_SUBMIT && scope == SCOPE_READ) {
+			return true
+		}
+	}
+	return false
+}
+
 func AdminGet(u *Users) (err error) {
 	session := db.Connection.Session.Copy()
 	defer session.Close()
@@ -0,0 +1,364 @@
+package worker
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/core/cwl"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// image sources of a CWL DockerRequirement (AWE tasks use dockerPull or dockerLoad via Shock)
+const (
+	IMAGE_SOURCE_PULL     = "dockerPull"
+	IMAGE_SOURCE_LOAD     = "dockerLoad"
+	IMAGE_SOURCE_FILE     = "dockerFile"
+	IMAGE_SOURCE_IMPORT   = "dockerImport"
+	IMAGE_SOURCE_IMAGE_ID = "dockerImageId"
+)
+
+type ContainerMount struct {
+	Source   string
+	Target   string
+	ReadOnly bool
+}
+
+// ContainerSpec describes the container of a workunit, independent of the runtime
+type ContainerSpec struct {
+	Name    string
+	Image   string // as returned by InspectImage
+	WorkDir string
+	Cmd     []string
+	Env     []string // KEY=VALUE
+	Mounts  []ContainerMount
+	// limits, nil for none
+	Resources *core.Resources
+	// without network access the container has only a loopback interface
+	NetworkAccess bool
+}
+
+type ContainerStats struct {
+	MemoryRss  int64
+	MemorySwap int64
+}
+
+// ContainerRuntime is the container engine the worker runs workunits with (conf.CONTAINER_RUNTIME).
+// Images are referenced by docker names, runtimes that do not use docker images convert them.
+type ContainerRuntime interface {
+	Name() string
+	// Supports reports if images of the DockerRequirement field (IMAGE_SOURCE_*) can be used
+	Supports(source string) bool
+	// InspectImage returns the id of the image if it is available locally
+	InspectImage(image string) (id string, err error)
+	PullImage(ref *core.DockerImageRef, cred *core.RegistryCredential) error
+	// LoadImage reads an image saved with "docker save" and makes it available as image
+	LoadImage(image string, archive io.Reader) error
+	Create(spec *ContainerSpec) (id string, err error)
+	Start(id string) error
+	// Wait blocks until the container exits and returns its exit status
+	Wait(id string) (status int, err error)
+	Kill(id string) error
+	// Remove removes the container with the name, if any
+	Remove(name string) error
+	Stats(id string) (stats *ContainerStats, err error)
+	// OOMKilled reports if the exited container was killed for exceeding its memory limit
+	OOMKilled(id string) bool
+}
+
+func NewContainerRuntime() (runtime ContainerRuntime, err error) {
+	switch conf.CONTAINER_RUNTIME {
+	case "docker":
+		runtime, err = NewDockerRuntime()
+	case "podman":
+		runtime = NewPodmanRuntime()
+	case "singularity", "apptainer":
+		runtime = NewSingularityRuntime(conf.CONTAINER_RUNTIME)
+	default:
+		err = fmt.Errorf("(NewContainerRuntime) unknown container runtime \"%s\"", conf.CONTAINER_RUNTIME)
+	}
+	return
+}
+
+// containerLimitArgs returns the resource and network options for "docker create" and "podman create"
+func containerLimitArgs(spec *ContainerSpec) (args []string) {
+	if !spec.NetworkAccess {
+		args = append(args, "--network=none")
+	}
+	res := spec.Resources
+	if res == nil {
+		return
+	}
+	if res.Cores > 0 {
+		args = append(args, "--cpus="+strconv.FormatFloat(res.Cores, 'f', -1, 64))
+	}
+	if res.Cpuset != "" {
+		args = append(args, "--cpuset-cpus="+res.Cpuset)
+	}
+	if res.RamMB > 0 {
+		args = append(args, fmt.Sprintf("--memory=%dm", res.RamMB))
+		if res.SwapMB < 0 {
+			args = append(args, "--memory-swap=-1")
+		} else {
+			// the option is the limit for memory and swap together
+			args = append(args, fmt.Sprintf("--memory-swap=%dm", res.RamMB+res.SwapMB))
+		}
+	}
+	if res.Pids > 0 {
+		args = append(args, fmt.Sprintf("--pids-limit=%d", res.Pids))
+	}
+	if res.TmpMB > 0 {
+		args = append(args, fmt.Sprintf("--tmpfs=/tmp:rw,size=%dm", res.TmpMB))
+	}
+	return
+}
+
+// MEM_CHECK_MAX_FAILURES is the number of failed stats reads in a row after which the memory
+// checker gives up, e.g. on a kernel without memory accounting
+const MEM_CHECK_MAX_FAILURES = 3
+
+// memoryMaxima keeps the maximum memory usage of a container in bytes, -1 while unknown
+type memoryMaxima struct {
+	Rss      int64
+	Swap     int64
+	Combined int64 // rss+swap
+	failures int
+}
+
+func newMemoryMaxima() *memoryMaxima {
+	return &memoryMaxima{Rss: -1, Swap: -1, Combined: -1}
+}
+
+// measure reads the stats of the container and updates the maxima. It returns false once
+// MEM_CHECK_MAX_FAILURES reads in a row failed.
+func (m *memoryMaxima) measure(container_runtime ContainerRuntime, id string) bool {
+	stats, err := container_runtime.Stats(id)
+	if err != nil {
+		m.failures++
+		logger.Error("warning: memory measurement requested, but %s returned (%d/%d): %s", container_runtime.Name(), m.failures, MEM_CHECK_MAX_FAILURES, err.Error())
+		return m.failures < MEM_CHECK_MAX_FAILURES
+	}
+	m.failures = 0
+
+	if stats.MemoryRss > m.Rss {
+		m.Rss = stats.MemoryRss
+	}
+	if stats.MemorySwap > m.Swap {
+		m.Swap = stats.MemorySwap
+	}
+	if stats.MemoryRss >= 0 && stats.MemorySwap >= 0 && stats.MemoryRss+stats.MemorySwap > m.Combined {
+		m.Combined = stats.MemoryRss + stats.MemorySwap
+	}
+
+	logger.Debug(1, "memory: rss=%d, swap=%d, max_rss=%d max_swap=%d max_combined=%d",
+		stats.MemoryRss, stats.MemorySwap, m.Rss, m.Swap, m.Combined)
+	return true
+}
+
+// inspectOOMKilled asks the docker or podman binary if the container was killed by the OOM killer
+func inspectOOMKilled(binary string, id string) bool {
+	stdo, _, err := RunCommand(binary, "inspect", "--format", "{{.State.OOMKilled}}", id)
+	if err != nil {
+		logger.Debug(1, "(inspectOOMKilled) %s inspect returned: %s", binary, err.Error())
+		return false
+	}
+	return strings.TrimSpace(string(stdo)) == "true"
+}
+
+// CWLRunnerContainerArgs returns the cwl-runner options that select the container runtime of the worker
+func CWLRunnerContainerArgs() []string {
+	switch conf.CONTAINER_RUNTIME {
+	case "podman":
+		return []string{"--podman"}
+	case "singularity", "apptainer":
+		return []string{"--singularity"}
+	}
+	return nil
+}
+
+// ValidateWorkunitContainer checks that the container runtime of the worker can provide the
+// image the workunit asks for. A DockerRequirement in the hints of a CWL tool is optional.
+func ValidateWorkunitContainer(workunit *core.Workunit) (err error) {
+	var required []string
+	var optional []string
+
+	if workunit.Cmd.Dockerimage != "" {
+		required = append(required, IMAGE_SOURCE_LOAD)
+	}
+	if workunit.Cmd.DockerPull != "" {
+		required = append(required, IMAGE_SOURCE_PULL)
+	}
+	if workunit.CWL_workunit != nil {
+		if tool, ok := workunit.CWL_workunit.Tool.(*cwl.CommandLineTool); ok {
+			if tool.Requirements != nil {
+				for _, r := range *tool.Requirements {
+					required = append(required, dockerRequirementSources(r)...)
+				}
+			}
+			for _, r := range tool.Hints {
+				optional = append(optional, dockerRequirementSources(r)...)
+			}
+		}
+	}
+
+	if len(required) == 0 && len(optional) == 0 {
+		return
+	}
+
+	runtime, err := NewContainerRuntime()
+	if err != nil {
+		return
+	}
+	for _, source := range required {
+		if !runtime.Supports(source) {
+			err = fmt.Errorf("(ValidateWorkunitContainer) container runtime %s does not support %s", runtime.Name(), source)
+			return
+		}
+	}
+	for _, source := range optional {
+		if !runtime.Supports(source) {
+			logger.Warning("(ValidateWorkunitContainer) container runtime %s does not support %s (hint)", runtime.Name(), source)
+		}
+	}
+	return
+}
+
+func dockerRequirementSources(r cwl.Requirement) (sources []string) {
+	var dr *cwl.DockerRequirement
+	switch v := r.(type) {
+	case *cwl.DockerRequirement:
+		dr = v
+	case cwl.DockerRequirement:
+		dr = &v
+	default:
+		return
+	}
+	if dr.DockerPull != "" {
+		sources = append(sources, IMAGE_SOURCE_PULL)
+	}
+	if dr.DockerLoad != "" {
+		sources = append(sources, IMAGE_SOURCE_LOAD)
+	}
+	if dr.DockerFile != "" {
+		sources = append(sources, IMAGE_SOURCE_FILE)
+	}
+	if dr.DockerImport != "" {
+		sources = append(sources, IMAGE_SOURCE_IMPORT)
+	}
+	if dr.DockerImageId != "" {
+		sources = append(sources, IMAGE_SOURCE_IMAGE_ID)
+	}
+	return
+}
+
+// writeDockerConfig writes a docker config.json with the registry credential into a new
+// temporary directory, the docker and podman binaries read credentials only from files
+func writeDockerConfig(ref *core.DockerImageRef, cred *core.RegistryCredential) (config_dir string, err error) {
+	config_dir, err = ioutil.TempDir("", "awe_docker_config_")
+	if err != nil {
+		return
+	}
+
+	server := ref.Registry
+	if server == core.DOCKER_HUB_REGISTRY {
+		server = "https://index.docker.io/v1/"
+	}
+	auth := base64.StdEncoding.EncodeToString([]byte(cred.Username + ":" + cred.Password))
+	config := map[string]interface{}{"auths": map[string]interface{}{server: map[string]string{"auth": auth}}}
+	config_bytes, err := json.Marshal(config)
+	if err != nil {
+		os.RemoveAll(config_dir)
+		return
+	}
+	err = ioutil.WriteFile(path.Join(config_dir, "config.json"), config_bytes, 0600)
+	if err != nil {
+		os.RemoveAll(config_dir)
+	}
+	return
+}
+
+// cgroupMemoryStatFile returns the memory.stat file of the cgroup of the process
+func cgroupMemoryStatFile(pid int) (filename string, err error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	// cgroup v1: "4:memory:/docker/<id>", cgroup v2: "0::/system.slice/..."
+	v2_path := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "memory" {
+				filename = path.Join("/sys/fs/cgroup/memory", fields[2], "memory.stat")
+				return
+			}
+		}
+		if fields[0] == "0" && fields[1] == "" {
+			v2_path = fields[2]
+		}
+	}
+	if v2_path == "" {
+		err = fmt.Errorf("(cgroupMemoryStatFile) no memory cgroup found for pid %d", pid)
+		return
+	}
+	filename = path.Join("/sys/fs/cgroup", v2_path, "memory.stat")
+	return
+}
+
+// readCgroupMemoryStat reads rss and swap usage from a memory.stat file.
+// documentation: https://docs.docker.com/articles/runmetrics/
+func readCgroupMemoryStat(filename string) (stats *ContainerStats, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	stats = &ContainerStats{MemoryRss: -1, MemorySwap: -1}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, xerr := strconv.ParseInt(fields[1], 10, 64)
+		if xerr != nil {
+			continue
+		}
+		switch fields[0] {
+		case "total_rss", "anon": // cgroup v1, v2
+			stats.MemoryRss = value
+		case "total_swap":
+			stats.MemorySwap = value
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
+
+	// cgroup v2 does not list swap in memory.stat
+	if stats.MemorySwap < 0 {
+		swap_bytes, xerr := ioutil.ReadFile(path.Join(path.Dir(filename), "memory.swap.current"))
+		if xerr == nil {
+			if value, xerr := strconv.ParseInt(strings.TrimSpace(string(swap_bytes)), 10, 64); xerr == nil {
+				stats.MemorySwap = value
+			}
+		}
+	}
+	return
+}
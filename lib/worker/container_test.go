@@ -0,0 +1,246 @@
+package worker
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"github.com/fsouza/go-dockerclient"
+)
+
+func TestContainerLimits(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        ContainerSpec
+		args        []string
+		host_config docker.HostConfig
+	}{
+		{
+			"no network by default",
+			ContainerSpec{},
+			[]string{"--network=none"},
+			docker.HostConfig{NetworkMode: "none"},
+		},
+		{
+			"network access",
+			ContainerSpec{NetworkAccess: true, Resources: &core.Resources{}},
+			nil,
+			docker.HostConfig{},
+		},
+		{
+			"cpu quota and cpuset",
+			ContainerSpec{NetworkAccess: true, Resources: &core.Resources{Cores: 1.5, Cpuset: "0-3"}},
+			[]string{"--cpus=1.5", "--cpuset-cpus=0-3"},
+			docker.HostConfig{CPUPeriod: 100000, CPUQuota: 150000, CPUSetCPUs: "0-3"},
+		},
+		{
+			"memory and swap",
+			ContainerSpec{NetworkAccess: true, Resources: &core.Resources{RamMB: 512, SwapMB: 256}},
+			[]string{"--memory=512m", "--memory-swap=768m"},
+			docker.HostConfig{Memory: 512 << 20, MemorySwap: 768 << 20},
+		},
+		{
+			"memory without swap",
+			ContainerSpec{NetworkAccess: true, Resources: &core.Resources{RamMB: 512}},
+			[]string{"--memory=512m", "--memory-swap=512m"},
+			docker.HostConfig{Memory: 512 << 20, MemorySwap: 512 << 20},
+		},
+		{
+			"unlimited swap",
+			ContainerSpec{NetworkAccess: true, Resources: &core.Resources{RamMB: 512, SwapMB: -1}},
+			[]string{"--memory=512m", "--memory-swap=-1"},
+			docker.HostConfig{Memory: 512 << 20, MemorySwap: -1},
+		},
+		{
+			"swap without memory limit",
+			ContainerSpec{NetworkAccess: true, Resources: &core.Resources{SwapMB: 256}},
+			nil,
+			docker.HostConfig{},
+		},
+		{
+			"pids and tmpfs",
+			ContainerSpec{Resources: &core.Resources{Pids: 100, TmpMB: 64}},
+			[]string{"--network=none", "--pids-limit=100", "--tmpfs=/tmp:rw,size=64m"},
+			docker.HostConfig{NetworkMode: "none", PidsLimit: 100, Tmpfs: map[string]string{"/tmp": "rw,size=64m"}},
+		},
+	}
+
+	for _, test := range tests {
+		args := containerLimitArgs(&test.spec)
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: got args %v, expected %v", test.name, args, test.args)
+		}
+		host_config := dockerHostConfig(&test.spec)
+		if !reflect.DeepEqual(*host_config, test.host_config) {
+			t.Errorf("%s: got host config %+v, expected %+v", test.name, *host_config, test.host_config)
+		}
+	}
+}
+
+// initTestLogger sets up a console logger for tests that run code which logs
+func initTestLogger() {
+	if logger.Log == nil {
+		logger.Initialize("client")
+	}
+}
+
+// statsRuntime returns the stats, or errors where the stats are nil, one per call
+type statsRuntime struct {
+	ContainerRuntime
+	stats []*ContainerStats
+}
+
+func (r *statsRuntime) Name() string {
+	return "test"
+}
+
+func (r *statsRuntime) Stats(id string) (stats *ContainerStats, err error) {
+	stats = r.stats[0]
+	r.stats = r.stats[1:]
+	if stats == nil {
+		err = errors.New("no memory.stat")
+	}
+	return
+}
+
+func TestMemoryMaxima(t *testing.T) {
+	initTestLogger()
+	tests := []struct {
+		name      string
+		stats     []*ContainerStats
+		available []bool
+		expected  memoryMaxima
+	}{
+		{
+			"maxima",
+			[]*ContainerStats{{MemoryRss: 100, MemorySwap: 50}, {MemoryRss: 200, MemorySwap: 0}, {MemoryRss: 150, MemorySwap: 10}},
+			[]bool{true, true, true},
+			memoryMaxima{Rss: 200, Swap: 50, Combined: 200},
+		},
+		{
+			"swap unknown",
+			[]*ContainerStats{{MemoryRss: 100, MemorySwap: -1}},
+			[]bool{true},
+			memoryMaxima{Rss: 100, Swap: -1, Combined: -1},
+		},
+		{
+			"failed reads are retried",
+			[]*ContainerStats{nil, nil, {MemoryRss: 100, MemorySwap: 0}, nil, nil},
+			[]bool{true, true, true, true, true},
+			memoryMaxima{Rss: 100, Swap: 0, Combined: 100, failures: 2},
+		},
+		{
+			"gives up after failures in a row",
+			[]*ContainerStats{nil, nil, nil},
+			[]bool{true, true, false},
+			memoryMaxima{Rss: -1, Swap: -1, Combined: -1, failures: MEM_CHECK_MAX_FAILURES},
+		},
+	}
+
+	for _, test := range tests {
+		memory := newMemoryMaxima()
+		runtime := &statsRuntime{stats: test.stats}
+		for i, expected := range test.available {
+			if available := memory.measure(runtime, "id"); available != expected {
+				t.Errorf("%s: measure %d returned %t, expected %t", test.name, i, available, expected)
+			}
+		}
+		if *memory != test.expected {
+			t.Errorf("%s: got %+v, expected %+v", test.name, *memory, test.expected)
+		}
+	}
+}
+
+func TestContainerStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awe-cgroup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		// cgroup v1
+		"v1/memory.stat": "cache 4096\nrss 1024\ntotal_rss 2048\ntotal_swap 512\n",
+		// cgroup v2 lists swap in a file of its own
+		"v2/memory.stat":             "anon 3072\nfile 4096\n",
+		"v2/memory.swap.current":     "256\n",
+		"v2_no_swap/memory.stat":     "anon 3072\n",
+		"docker/abc/memory.stat":     "total_rss 10\ntotal_swap 20\n",
+		"broken/memory.stat":         "total_rss x\n",
+		"broken/memory.swap.current": "y\n",
+	}
+	for name, content := range files {
+		filename := path.Join(dir, name)
+		if err = os.MkdirAll(path.Dir(filename), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		file     string
+		expected ContainerStats
+	}{
+		{"v1/memory.stat", ContainerStats{MemoryRss: 2048, MemorySwap: 512}},
+		{"v2/memory.stat", ContainerStats{MemoryRss: 3072, MemorySwap: 256}},
+		{"v2_no_swap/memory.stat", ContainerStats{MemoryRss: 3072, MemorySwap: -1}},
+		{"broken/memory.stat", ContainerStats{MemoryRss: -1, MemorySwap: -1}},
+	}
+	for _, test := range tests {
+		stats, err := readCgroupMemoryStat(path.Join(dir, test.file))
+		if err != nil {
+			t.Errorf("%s: %s", test.file, err.Error())
+			continue
+		}
+		if *stats != test.expected {
+			t.Errorf("%s: got %+v, expected %+v", test.file, *stats, test.expected)
+		}
+	}
+
+	if _, err = readCgroupMemoryStat(path.Join(dir, "missing/memory.stat")); err == nil {
+		t.Errorf("missing memory.stat: expected an error")
+	}
+
+	// the docker runtime finds the cgroup of the container with the [ID] pattern
+	cgroup_dir := conf.CGROUP_MEMORY_DOCKER_DIR
+	conf.CGROUP_MEMORY_DOCKER_DIR = path.Join(dir, "docker/[ID]/memory.stat")
+	defer func() { conf.CGROUP_MEMORY_DOCKER_DIR = cgroup_dir }()
+	stats, err := (&DockerRuntime{}).Stats("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *stats != (ContainerStats{MemoryRss: 10, MemorySwap: 20}) {
+		t.Errorf("docker: got %+v", *stats)
+	}
+}
+
+func TestInspectOOMKilled(t *testing.T) {
+	initTestLogger()
+	dir, err := ioutil.TempDir("", "awe-oom-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the stub replaces the docker binary, it reports the container "oom" as killed
+	binary := path.Join(dir, "docker")
+	stub := "#!/bin/sh\nif [ \"$4\" = oom ]; then echo true; elif [ \"$4\" = ok ]; then echo false; else exit 1; fi\n"
+	if err = ioutil.WriteFile(binary, []byte(stub), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{"oom": true, "ok": false, "missing": false}
+	for id, expected := range tests {
+		if killed := inspectOOMKilled(binary, id); killed != expected {
+			t.Errorf("%s: got %t, expected %t", id, killed, expected)
+		}
+	}
+}
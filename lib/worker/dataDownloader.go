@@ -195,7 +195,7 @@ func downloadWorkunitData(workunit *core.Workunit) (err error) {
 		return
 	}
 
-	if Client_mode == "online" {
+	if Client_mode != "offline" {
 		//make a working directory for the workunit (not for commandline execution !!!!!!)
 		err = workunit.Mkdir()
 		if err != nil {
@@ -248,10 +248,17 @@ func downloadWorkunitData(workunit *core.Workunit) (err error) {
 	}
 
 	//download input data
-	if Client_mode == "online" {
+	if Client_mode != "offline" {
 
 		datamove_start := time.Now().UnixNano()
-		moved_data, xerr := cache.MoveInputData(workunit)
+		var moved_data int64
+		var xerr error
+		if Client_mode == "local" {
+			// local runner: no Shock, input files are used in place
+			_, xerr = cache.ProcessIOData(workunit.CWL_workunit.Job_input, work_path, "local", nil)
+		} else {
+			moved_data, xerr = cache.MoveInputData(workunit)
+		}
 		if xerr != nil {
 
 			err = fmt.Errorf("(downloadWorkunitData) workid=%s error=%s", work_str, xerr.Error())
@@ -269,7 +276,6 @@ func downloadWorkunitData(workunit *core.Workunit) (err error) {
 
 			job_input := workunit.CWL_workunit.Job_input
 			cwl_tool := workunit.CWL_workunit.Tool
-			job_input_filename := path.Join(work_path, "cwl_job_input.yaml")
 			cwl_tool_filename := path.Join(work_path, "cwl_tool.yaml")
 
 			if job_input == nil {
@@ -294,6 +300,14 @@ func downloadWorkunitData(workunit *core.Workunit) (err error) {
 					err = fmt.Errorf("(downloadWorkunitData) DeleteRequirement/CommandLineTool returned: %s", err.Error())
 					return
 				}
+				// the worker takes care of secrets, cwl-runner does not know the hint without the cwltool namespace
+				var clt_hints *[]cwl.Requirement
+				clt_hints, err = cwl.DeleteRequirement(cwl.SECRETS_CLASS, &cwl_tool_clt.Hints)
+				if err != nil {
+					err = fmt.Errorf("(downloadWorkunitData) DeleteRequirement/CommandLineTool returned: %s", err.Error())
+					return
+				}
+				cwl_tool_clt.Hints = *clt_hints
 				cwl_tool_bytes, err = yaml.Marshal(cwl_tool_clt)
 				if err != nil {
 					return
@@ -305,6 +319,14 @@ func downloadWorkunitData(workunit *core.Workunit) (err error) {
 					err = fmt.Errorf("(downloadWorkunitData) DeleteRequirement/ExpressionTool returned: %s", err.Error())
 					return
 				}
+				// the worker takes care of secrets, cwl-runner does not know the hint without the cwltool namespace
+				var et_hints *[]cwl.Requirement
+				et_hints, err = cwl.DeleteRequirement(cwl.SECRETS_CLASS, &cwl_tool_et.Hints)
+				if err != nil {
+					err = fmt.Errorf("(downloadWorkunitData) DeleteRequirement/ExpressionTool returned: %s", err.Error())
+					return
+				}
+				cwl_tool_et.Hints = *et_hints
 				cwl_tool_bytes, err = yaml.Marshal(cwl_tool_et)
 				if err != nil {
 					return
@@ -314,18 +336,10 @@ func downloadWorkunitData(workunit *core.Workunit) (err error) {
 				return
 			}
 
-			// convert job_input into a map
-			job_input_map := job_input.GetMap()
-
-			// create job_input file
-			var job_input_bytes []byte
-			job_input_bytes, err = yaml.Marshal(job_input_map)
-			if err != nil {
-				return
-			}
-
-			err = ioutil.WriteFile(job_input_filename, job_input_bytes, 0644)
+			// create job_input file, secret inputs are only written right before execution
+			err = writeCWLJobInput(workunit, nil)
 			if err != nil {
+				err = fmt.Errorf("(downloadWorkunitData) writeCWLJobInput returned: %s", err.Error())
 				return
 			}
 
@@ -337,7 +351,7 @@ func downloadWorkunitData(workunit *core.Workunit) (err error) {
 		}
 	}
 
-	if Client_mode == "online" {
+	if Client_mode != "offline" {
 
 		//create userattr.json
 		var work_path string
@@ -537,6 +551,10 @@ func fetchFile_old(filename string, url string, token string) (size int64, err e
 
 //fetch prerequisite data (e.g. reference dbs)
 func movePreData(workunit *core.Workunit) (size int64, err error) {
+	work_str, err := workunit.Workunit_Unique_Identifier.String()
+	if err != nil {
+		return
+	}
 	for _, io := range workunit.Predata {
 		name := io.FileName
 		predata_directory := path.Join(conf.DATA_PATH, "predata")
@@ -556,8 +574,11 @@ func movePreData(workunit *core.Workunit) (size int64, err error) {
 		// get shock and local md5sums
 		isShockPredata := true
 		node_md5 := ""
+		var node_size int64
+		cache_id := io.Node
 		if io.Node == "-" {
 			isShockPredata = false
+			cache_id = dataUrl
 		} else {
 			node, err := shock.ShockGet(io.Host, io.Node, workunit.Info.DataToken)
 			if err != nil {
@@ -565,47 +586,53 @@ func movePreData(workunit *core.Workunit) (size int64, err error) {
 			}
 			// rename file to be md5sum
 			node_md5 = node.File.Checksum["md5"]
+			node_size = node.File.Size
 			file_path = path.Join(predata_directory, node_md5)
 		}
 
-		// file does not exist or its md5sum is wrong
-		if !isFileExisting(file_path) {
+		// file is not in the cache or failed the integrity check, pins the file otherwise
+		cached, err := cache.Manager.Use(file_path, cache_id, work_str)
+		if err != nil {
+			return 0, errors.New("error in cache lookup of predata: " + err.Error())
+		}
+		if !cached {
 			logger.Debug(2, "mover: fetching predata from url: "+dataUrl)
 			logger.Event(event.PRE_IN, "workid="+workunit.Id+" url="+dataUrl)
 
-			var md5sum string
+			err = cache.Manager.MakeRoom(node_size)
+			if err != nil {
+				logger.Error("(movePreData) could not make room in the cache: %s", err.Error())
+			}
+
+			var sums map[string]string
 			file_path_part := file_path + ".part" // temporary name
-			// this gets file from any downloadable url, not just shock
-			size, md5sum, err = shock.FetchFile(file_path_part, dataUrl, workunit.Info.DataToken, io.Uncompress, isShockPredata)
+			// this gets file from any downloadable url, not just shock, the md5 of shock nodes is verified
+			size, sums, err = cache.FetchFileVerified(file_path_part, dataUrl, workunit.Info.DataToken, io.Uncompress, "md5", node_md5, cache.NewInputTransferStats(workunit.WorkPerf))
 			if err != nil {
 				return 0, errors.New("error in fetchFile: " + err.Error())
 			}
-			os.Rename(file_path_part, file_path)
+			logger.Debug(2, "mover: predata "+name+" has md5sum "+sums["md5"])
+			io.Checksum = sums
+			err = os.Rename(file_path_part, file_path)
 			if err != nil {
 				return 0, errors.New("error renaming after download of preData: " + err.Error())
 			}
-			if isShockPredata {
-				if node_md5 != md5sum {
-					return 0, errors.New("error downloaded file md5 does not mach shock md5, node: " + io.Node)
-				} else {
-					logger.Debug(2, "mover: predata "+name+" has md5sum "+md5sum)
-				}
+			// the checksums are those of the transferred, not of the uncompressed data
+			cached_md5 := ""
+			if io.Uncompress == "" {
+				cached_md5 = sums["md5"]
+			}
+			err = cache.Manager.Add(file_path, cache_id, cached_md5, work_str)
+			if err != nil {
+				return 0, errors.New("error adding predata to the cache: " + err.Error())
 			}
 		} else {
 			logger.Debug(2, "mover: predata already exists: "+name)
 		}
 
-		// timstamp for last access - future caching
-		accessfile, err := os.Create(file_path + ".access")
-		if err != nil {
-			return 0, errors.New("error creating predata access file: " + err.Error())
-		}
-		defer accessfile.Close()
-		accessfile.WriteString(time.Now().String())
-
 		// determine if running with docker
 		wants_docker := false
-		if workunit.Cmd.Dockerimage != "" {
+		if workunit.Cmd.Dockerimage != "" || workunit.Cmd.DockerPull != "" {
 			wants_docker = true
 		}
 		if wants_docker && conf.USE_DOCKER == "no" {
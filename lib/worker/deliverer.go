@@ -34,6 +34,7 @@ func deliverer_run(control chan int) (err error) { // TODO return all errors
 	// this makes sure new work is only requested when deliverer is done
 	defer func() { <-chanPermit }()
 	workunit := <-fromProcessor
+	defer workRedactions.Release(workunit.Id)
 
 	if Client_mode == "offline" {
 		return
@@ -67,7 +68,10 @@ func deliverer_run(control chan int) (err error) { // TODO return all errors
 		// post-process for works computed successfully: push output data to Shock
 		move_start := time.Now().UnixNano()
 		logger.Debug(3, "(deliverer_run) work.State: %s", workunit.State)
-		if workunit.State == core.WORK_STAT_COMPUTED {
+		if workunit.State == core.WORK_STAT_COMPUTED && Client_mode == "local" {
+			// local runner: outputs stay in the work directory
+			workunit.SetState(core.WORK_STAT_DONE, "")
+		} else if workunit.State == core.WORK_STAT_COMPUTED {
 
 			shock_client := &shock.ShockClient{Host: workunit.ShockHost, Token: workunit.Info.DataToken, Debug: false}
 			data_moved, err := cache.UploadOutputData(workunit, shock_client)
@@ -86,9 +90,21 @@ func deliverer_run(control chan int) (err error) { // TODO return all errors
 		perfstat.ClientResp = perfstat.Deliver - perfstat.Checkout
 		perfstat.ClientId = core.Self.Id
 
+		// secrets of the workunit must not end up in the uploaded stdout and stderr
+		rerr := redactWorkLogs(workunit)
+		if rerr != nil {
+			logger.Error("(deliverer_run) workid=%s redactWorkLogs returned: %s", work_str, rerr.Error())
+			workunit.Notes = append(workunit.Notes, "[deliverer#redactWorkLogs]"+rerr.Error())
+			removeWorkLogs(workunit)
+		}
+
 		// notify server the final process results; send perflog, stdout, and stderr if needed
 		// detect e.ClientNotFound
 		do_retry := true
+		if Client_mode == "local" {
+			NotifyWorkunitProcessedLocal(workunit)
+			do_retry = false
+		}
 		retry_count := 0
 		for do_retry {
 			response, err := core.NotifyWorkunitProcessedWithLogs(workunit, perfstat, conf.PRINT_APP_MSG)
@@ -145,17 +161,40 @@ func deliverer_run(control chan int) (err error) { // TODO return all errors
 		}
 		core.Self.Increment_total_failed(true)
 		if conf.AUTO_CLEAN_DIR && workunit.Cmd.Local == false {
-			go removeDirLater(work_path, conf.CLIEN_DIR_DELAY_FAIL)
+			retained := false
+			if conf.KEEP_FAILED_WORKDIRS && workunit.State != core.WORK_STAT_DISCARDED {
+				// keep for post-mortem, removed by retainedDirs when out of budget
+				xerr := retainedDirs.Add(work_str, work_path)
+				if xerr != nil {
+					logger.Error("(deliverer) could not retain work dir %s: %s", work_path, xerr.Error())
+				} else {
+					retained = true
+				}
+			}
+			if !retained {
+				go removeDirLater(work_path, conf.CLIEN_DIR_DELAY_FAIL)
+			}
 		}
 	}
 
 	// cleanup
+	err = cache.Manager.UnpinWork(work_str)
+	if err != nil {
+		logger.Error("(deliverer) could not unpin cached files of workunit %s: %s", work_str, err.Error())
+	}
 	err = core.Self.Current_work.Delete(work_id, true)
 	if err != nil {
 		logger.Error("Could not remove work_id %s", work_id)
 	}
+	err = core.Self.Prefetched_work.Delete(work_id, true) // discarded before it was started
+	if err != nil {
+		logger.Error("Could not remove prefetched work_id %s", work_str)
+	}
 	workmap.Delete(work_id)
-	core.Self.Busy = false
+	workPerfs.Delete(work_str)
+	if in_progress, _ := workmap.GetKeys(); len(in_progress) == 0 { // prefetched workunits keep the client busy
+		core.Self.Busy = false
+	}
 	return
 }
 
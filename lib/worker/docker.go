@@ -10,11 +10,13 @@ import (
 	"errors"
 	"fmt"
 	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
 	shock "github.com/MG-RAST/go-shock-client"
 	"github.com/fsouza/go-dockerclient"
 	"io"
 	"io/ioutil"
 	"net/url"
+	"os"
 	"os/exec"
 	"regexp"
 	"sort"
@@ -522,6 +524,85 @@ func dockerBuildImage(client *docker.Client, Dockerimage string) (err error) {
 	return nil
 }
 
+// pullDockerImage makes the image of a dockerPull task available according to conf.DOCKER_PULL_POLICY
+// and returns the reference to create the container with, pinned to the digest if the server resolved one
+func pullDockerImage(runtime ContainerRuntime, workunit *core.Workunit) (image string, err error) {
+	ref, err := core.ParseDockerImageRef(workunit.Cmd.DockerPull)
+	if err != nil {
+		return
+	}
+	if workunit.Cmd.DockerDigest != "" {
+		ref.Digest = workunit.Cmd.DockerDigest
+	}
+	image = ref.String()
+
+	if conf.DOCKER_PULL_POLICY != "always" {
+		_, xerr := runtime.InspectImage(image)
+		if xerr == nil {
+			logger.Debug(1, "(pullDockerImage) image %s is already available to %s", image, runtime.Name())
+			return
+		}
+		if conf.DOCKER_PULL_POLICY == "never" {
+			err = fmt.Errorf("(pullDockerImage) image %s not found and docker_pull_policy is \"never\"", image)
+			return
+		}
+	}
+
+	cred, err := FetchRegistryCredentialByWorkId(workunit.Id, ref.Registry)
+	if err != nil {
+		err = fmt.Errorf("(pullDockerImage) FetchRegistryCredentialByWorkId returned: %s", err.Error())
+		return
+	}
+
+	logger.Debug(1, "(pullDockerImage) pulling image %s with %s (with credentials: %t)", image, runtime.Name(), cred != nil)
+	err = runtime.PullImage(ref, cred)
+	if err != nil {
+		err = fmt.Errorf("(pullDockerImage) image %s was not correctly pulled: %s", image, err.Error())
+		return
+	}
+
+	_, err = runtime.InspectImage(image)
+	if err != nil {
+		err = fmt.Errorf("(pullDockerImage) image %s not found after pull: %s", image, err.Error())
+		return
+	}
+	return
+}
+
+func dockerPullImage(client *docker.Client, ref *core.DockerImageRef, cred *core.RegistryCredential) (err error) {
+	if client != nil {
+		tag := ref.Tag
+		if ref.Digest != "" {
+			tag = ref.Digest
+		}
+		var buf bytes.Buffer
+		pio := docker.PullImageOptions{Repository: ref.Name(), Tag: tag, OutputStream: &buf}
+		auth := docker.AuthConfiguration{}
+		if cred != nil {
+			auth = docker.AuthConfiguration{Username: cred.Username, Password: cred.Password, ServerAddress: ref.Registry}
+		}
+		err = client.PullImage(pio, auth)
+		logger.Debug(3, "(dockerPullImage) docker pull response: %s", buf.String())
+		return
+	}
+
+	args := []string{"pull", ref.String()}
+	if cred != nil {
+		var config_dir string
+		config_dir, err = writeDockerConfig(ref, cred)
+		if err != nil {
+			return
+		}
+		defer os.RemoveAll(config_dir)
+		args = append([]string{"--config", config_dir}, args...)
+	}
+	_, stderr, err := RunCommand(conf.DOCKER_BINARY, args...)
+	if err != nil {
+		err = fmt.Errorf("%s (%s)", err.Error(), strings.TrimSpace(string(stderr)))
+	}
+	return
+}
+
 func SplitDockerimageName(Dockerimage string) (repository string, tag string, err error) {
 
 	dockerimage_array := strings.Split(Dockerimage, ":")
@@ -717,7 +798,8 @@ func findDockerImageInShock(Dockerimage string, datatoken string) (node *shock.S
 	return
 }
 
-func dockerLoadImage(client *docker.Client, download_url string, datatoken string) (err error) {
+// dockerLoadImage loads an image saved with "docker save" (gzipped) from Shock into the container runtime
+func dockerLoadImage(runtime ContainerRuntime, image string, download_url string, datatoken string) (err error) {
 
 	image_stream, err := shock.FetchShockStream(download_url, datatoken) // token empty here, assume that images are public
 	if err != nil {
@@ -725,43 +807,16 @@ func dockerLoadImage(client *docker.Client, download_url string, datatoken strin
 	}
 
 	gr, err := gzip.NewReader(image_stream) //returns (*Reader, error) // TODO not sure if I have to close gr later ?
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error reading image archive, err=%s", err.Error()))
+	}
 
 	logger.Debug(1, fmt.Sprintf("loading image..."))
-	//go io.Copy(image_writer, image_stream)
-
-	var buf bytes.Buffer
-
-	if client != nil {
-		opts := docker.LoadImageOptions{InputStream: gr}
-		err = client.LoadImage(opts)
-
-	} else {
-
-		//pipe stream into docker binary "docker load"
-		cmd := exec.Command(conf.DOCKER_BINARY, "load")
-
-		stdin, err := cmd.StdinPipe() // stdin is a io.WriteCloser
-
-		//stderr, err := cmd.StderrPipe()
-		//if err != nil {
-		//	return err
-		//}
-
-		if err = cmd.Start(); err != nil {
-			err = fmt.Errorf("(dockerLoadImage) cmd.Start returned: %s", err.Error())
-			return err
-		}
-
-		go io.Copy(stdin, gr)
-
-		err = cmd.Wait()
-
-	}
 
+	err = runtime.LoadImage(image, gr)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error loading image, err=%s", err.Error()))
 	}
-	logger.Debug(1, fmt.Sprintf("load image returned: %v", &buf))
 
 	return
 }
@@ -824,3 +879,202 @@ func DockerizeName(input string) string {
 	}
 	return strings.Map(whitelist_it, input)
 }
+
+// DockerRuntime runs containers with the docker API, or the docker binary if conf.DOCKER_BINARY is not "API"
+type DockerRuntime struct {
+	client *docker.Client
+}
+
+func NewDockerRuntime() (d *DockerRuntime, err error) {
+	d = &DockerRuntime{}
+	if conf.DOCKER_BINARY != "API" {
+		logger.Debug(1, "Using docker docker binary...")
+		return
+	}
+	logger.Debug(1, "Using docker API...")
+	d.client, err = docker.NewClient(conf.DOCKER_SOCKET)
+	if err != nil {
+		err = fmt.Errorf("(NewDockerRuntime) error creating docker client: %s", err.Error())
+	}
+	return
+}
+
+func (d *DockerRuntime) Name() string { return "docker" }
+
+func (d *DockerRuntime) Supports(source string) bool { return true }
+
+func (d *DockerRuntime) InspectImage(image string) (id string, err error) {
+	docker_image, err := InspectImage(d.client, image)
+	if err != nil {
+		return
+	}
+	id = docker_image.ID
+	return
+}
+
+func (d *DockerRuntime) PullImage(ref *core.DockerImageRef, cred *core.RegistryCredential) error {
+	return dockerPullImage(d.client, ref, cred)
+}
+
+func (d *DockerRuntime) LoadImage(image string, archive io.Reader) (err error) {
+	if d.client != nil {
+		err = d.client.LoadImage(docker.LoadImageOptions{InputStream: archive})
+		return
+	}
+
+	//pipe stream into docker binary "docker load"
+	cmd := exec.Command(conf.DOCKER_BINARY, "load")
+	cmd.Stdin = archive
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("(LoadImage) docker load returned: %s (%s)", err.Error(), strings.TrimSpace(string(output)))
+	}
+	return
+}
+
+// TagImage tags the image to make debugging easier
+func (d *DockerRuntime) TagImage(id string, repository string, tag string) error {
+	return TagImage(d.client, id, docker.TagImageOptions{Repo: repository, Tag: tag})
+}
+
+func (d *DockerRuntime) Create(spec *ContainerSpec) (id string, err error) {
+	// note: docker binary mounts on creation, while docker API mounts on start of container
+	if d.client != nil {
+		var binds []string
+		volumes := make(map[string]struct{})
+		for _, mount := range spec.Mounts {
+			bind := mount.Source + ":" + mount.Target
+			if mount.ReadOnly {
+				bind += ":ro"
+			}
+			binds = append(binds, bind)
+			volumes[mount.Target] = struct{}{}
+		}
+		config := docker.Config{Image: spec.Image,
+			WorkingDir:   spec.WorkDir,
+			AttachStdout: true,
+			AttachStderr: true,
+			AttachStdin:  false,
+			Cmd:          spec.Cmd,
+			Volumes:      volumes,
+			Env:          spec.Env,
+		}
+		host_config := dockerHostConfig(spec)
+		host_config.Binds = binds
+		opts := docker.CreateContainerOptions{Name: spec.Name, Config: &config, HostConfig: host_config}
+		var container *docker.Container
+		container, err = d.client.CreateContainer(opts)
+		if err != nil {
+			return
+		}
+		id = container.ID
+		return
+	}
+
+	// "-t" would be required if I want to attach to the container later, check again documentation if needed
+	args := []string{"--name=" + spec.Name, "--workdir=" + spec.WorkDir}
+	args = append(args, containerLimitArgs(spec)...)
+	for _, mount := range spec.Mounts {
+		bind := mount.Source + ":" + mount.Target
+		if mount.ReadOnly {
+			bind += ":ro"
+		}
+		args = append(args, "--volume="+bind)
+	}
+	for _, env_pair := range spec.Env {
+		args = append(args, "--env="+env_pair)
+	}
+	args = append(args, spec.Image)
+	args = append(args, spec.Cmd...)
+	id, err = CreateContainer(args)
+	return
+}
+
+// dockerHostConfig returns the limits of the container for the docker API, see containerLimitArgs
+func dockerHostConfig(spec *ContainerSpec) (host_config *docker.HostConfig) {
+	host_config = &docker.HostConfig{}
+	if !spec.NetworkAccess {
+		host_config.NetworkMode = "none"
+	}
+	res := spec.Resources
+	if res == nil {
+		return
+	}
+	if res.Cores > 0 {
+		host_config.CPUPeriod = 100000
+		host_config.CPUQuota = int64(res.Cores * 100000)
+	}
+	host_config.CPUSetCPUs = res.Cpuset
+	if res.RamMB > 0 {
+		host_config.Memory = res.RamMB * 1024 * 1024
+		if res.SwapMB < 0 {
+			host_config.MemorySwap = -1
+		} else {
+			host_config.MemorySwap = (res.RamMB + res.SwapMB) * 1024 * 1024
+		}
+	}
+	host_config.PidsLimit = res.Pids
+	if res.TmpMB > 0 {
+		host_config.Tmpfs = map[string]string{"/tmp": fmt.Sprintf("rw,size=%dm", res.TmpMB)}
+	}
+	return
+}
+
+func (d *DockerRuntime) Start(id string) error {
+	if d.client != nil {
+		return d.client.StartContainer(id, nil)
+	}
+	return StartContainer(id, "")
+}
+
+// WriteInspect writes the output of docker inspect into the file
+func (d *DockerRuntime) WriteInspect(id string, filename string) (err error) {
+	if d.client == nil {
+		return
+	}
+	container, err := d.client.InspectContainer(id)
+	if err != nil {
+		return
+	}
+	logger.Debug(3, "Container status: %s", container.State.Status)
+	b_inspect, _ := json.MarshalIndent(container, "", "    ")
+	err = ioutil.WriteFile(filename, b_inspect, 0666)
+	return
+}
+
+func (d *DockerRuntime) Wait(id string) (status int, err error) {
+	if d.client != nil {
+		return d.client.WaitContainer(id)
+	}
+	return WaitContainer(id)
+}
+
+func (d *DockerRuntime) Kill(id string) error {
+	if d.client != nil {
+		return d.client.KillContainer(docker.KillContainerOptions{ID: id})
+	}
+	return KillContainer(id)
+}
+
+func (d *DockerRuntime) OOMKilled(id string) bool {
+	if d.client == nil {
+		return inspectOOMKilled(conf.DOCKER_BINARY, id)
+	}
+	container, err := d.client.InspectContainer(id)
+	if err != nil {
+		logger.Debug(1, "(OOMKilled) InspectContainer returned: %s", err.Error())
+		return false
+	}
+	return container.State.OOMKilled
+}
+
+func (d *DockerRuntime) Remove(name string) error {
+	return RemoveOldAWEContainers(d.client, name)
+}
+
+// Stats reads the memory usage from the cgroup of the container, conf.CGROUP_MEMORY_DOCKER_DIR,
+// e.g. /sys/fs/cgroup/memory/docker/[ID]/memory.stat (ubuntu) or
+// /sys/fs/cgroup/memory/system.slice/docker-[ID].scope/memory.stat (coreos)
+func (d *DockerRuntime) Stats(id string) (stats *ContainerStats, err error) {
+	return readCgroupMemoryStat(strings.Replace(conf.CGROUP_MEMORY_DOCKER_DIR, "[ID]", id, -1))
+}
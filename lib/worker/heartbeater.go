@@ -16,6 +16,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/MG-RAST/AWE/lib/cache"
 	"github.com/MG-RAST/AWE/lib/conf"
 	"github.com/MG-RAST/AWE/lib/core"
 	e "github.com/MG-RAST/AWE/lib/errors"
@@ -128,6 +129,16 @@ func SendHeartBeat() (err error) {
 			StopClient()
 		} else if op == "clean" {
 			CleanDisk()
+		} else if op == "files" { // server relays requests for files in retained work dirs
+			var requests []*core.FileRelayRequest
+			xerr := json.Unmarshal([]byte(objs), &requests)
+			if xerr != nil {
+				logger.Error("(SendHeartBeat) could not parse file requests: %s", xerr.Error())
+				continue
+			}
+			for _, req := range requests {
+				go SendWorkFile(req)
+			}
 		}
 	}
 	return
@@ -138,6 +149,21 @@ func heartbeating(host string, clientid string) (msg core.HeartbeatInstructions,
 	targeturl := fmt.Sprintf("%s/client/%s?heartbeat", host, clientid)
 	//res, err := http.Get(targeturl)
 
+	retainedDirs.Expire()
+	core.Self.Retained_work, err = retainedDirs.List()
+	if err != nil {
+		err = fmt.Errorf("(heartbeating) retainedDirs.List failed: %s", err.Error())
+		return
+	}
+
+	core.Self.Cached_data, err = cache.Manager.Inventory()
+	if err != nil {
+		err = fmt.Errorf("(heartbeating) cache.Manager.Inventory failed: %s", err.Error())
+		return
+	}
+
+	core.Self.Transfers = workPerfs.Transfers()
+
 	worker_state_b, err := json.Marshal(core.Self.WorkerState)
 	if err != nil {
 		err = fmt.Errorf("(heartbeating) json.Marshal failed: %s", err.Error())
@@ -436,6 +462,11 @@ func DiscardWorkunit(id core.Workunit_Unique_Identifier) (err error) {
 			logger.Error("(DiscardWorkunit) Could not remove workunit %s from client", id)
 			err = nil
 		}
+		err = core.Self.Prefetched_work.Delete(id, true)
+		if err != nil {
+			logger.Error("(DiscardWorkunit) Could not remove prefetched workunit %v from client", id)
+			err = nil
+		}
 	}
 	return
 }
@@ -454,7 +485,8 @@ func StopClient() (err error) {
 
 func CleanDisk() (err error) {
 	//fmt.Printf("try to clean disk space\n")
-	//to-do: implementation here
+	// remove work dirs retained for post-mortem
+	err = retainedDirs.Clear()
 	return
 }
 func getMetaDataField(metadata_url string, field string) (result string, err error) {
@@ -0,0 +1,206 @@
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/MG-RAST/AWE/lib/cache"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/core/cwl"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"github.com/MG-RAST/AWE/lib/user"
+	"gopkg.in/mgo.v2/bson"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// RunLocalWorkflow executes a CWL workflow without AWE server, MongoDB or Shock. The server
+// logic (job, tasks, workunits) runs in-process, the worker pipeline checks out workunits
+// from it directly. Input files are used in place, outputs stay in the work directories.
+// The outputs of the workflow are printed as json on stdout.
+func RunLocalWorkflow(workflow_file string, job_file string) (err error) {
+	if workflow_file == "" || job_file == "" {
+		err = fmt.Errorf("(RunLocalWorkflow) cwl_tool and cwl_job are required")
+		return
+	}
+	workflow_file, err = filepath.Abs(workflow_file)
+	if err != nil {
+		return
+	}
+	job_file, err = filepath.Abs(job_file)
+	if err != nil {
+		return
+	}
+
+	core.InitResMgr("local")
+	core.JM = core.NewJobMap()
+
+	// jobs are not persisted, secret inputs are encrypted with a key that only lives in memory
+	if core.Secrets == nil {
+		err = core.InitSecretsEphemeral()
+		if err != nil {
+			return
+		}
+	}
+
+	// the server keeps its own client object, as if the worker had registered
+	client := new(core.Client)
+	self_byte, err := json.Marshal(core.Self)
+	if err != nil {
+		err = fmt.Errorf("(RunLocalWorkflow) json.Marshal returned: %s", err.Error())
+		return
+	}
+	err = json.Unmarshal(self_byte, client)
+	if err != nil {
+		err = fmt.Errorf("(RunLocalWorkflow) json.Unmarshal returned: %s", err.Error())
+		return
+	}
+	client.Init()
+	client.Apps = []string{conf.ALL_APP}
+	err = core.QMgr.AddClient(client, true)
+	if err != nil {
+		err = fmt.Errorf("(RunLocalWorkflow) AddClient returned: %s", err.Error())
+		return
+	}
+
+	go core.QMgr.ClientHandle()
+	go core.QMgr.NoticeHandle()
+	go core.QMgr.UpdateQueueLoop()
+
+	job_input, err := cwl.ParseJobFile(job_file)
+	if err != nil {
+		err = fmt.Errorf("(RunLocalWorkflow) ParseJobFile returned: %s", err.Error())
+		return
+	}
+
+	// relative paths in the job document are relative to the job file
+	_, err = cache.ProcessIOData(job_input, path.Dir(job_file), "local", nil)
+	if err != nil {
+		err = fmt.Errorf("(RunLocalWorkflow) ProcessIOData returned: %s", err.Error())
+		return
+	}
+
+	// no FormFiles, they would be moved into the job directory
+	cwl_file := core.FormFile{Name: path.Base(workflow_file), Path: workflow_file}
+	job, err := core.CreateJobCWLFromInput(&user.User{Uuid: "public"}, core.FormFiles{}, cwl_file, path.Base(job_file), job_input)
+	if err != nil {
+		err = fmt.Errorf("(RunLocalWorkflow) CreateJobCWLFromInput returned: %s", err.Error())
+		return
+	}
+	job.Info.ClientGroups = core.Self.Group
+
+	err = job.Save()
+	if err != nil {
+		err = fmt.Errorf("(RunLocalWorkflow) job.Save returned: %s", err.Error())
+		return
+	}
+	// the server initializes jobs when it loads them from the database, local jobs make the
+	// same round trip through bson
+	job_bson, err := bson.Marshal(job)
+	if err != nil {
+		err = fmt.Errorf("(RunLocalWorkflow) bson.Marshal returned: %s", err.Error())
+		return
+	}
+	job = core.NewJob()
+	err = bson.Unmarshal(job_bson, job)
+	if err != nil {
+		err = fmt.Errorf("(RunLocalWorkflow) bson.Unmarshal returned: %s", err.Error())
+		return
+	}
+	_, err = job.Init()
+	if err != nil {
+		err = fmt.Errorf("(RunLocalWorkflow) job.Init returned: %s", err.Error())
+		return
+	}
+	err = core.JM.Add(job)
+	if err != nil {
+		err = fmt.Errorf("(RunLocalWorkflow) JM.Add returned: %s", err.Error())
+		return
+	}
+	err = core.QMgr.EnqueueTasksByJobId(job.Id)
+	if err != nil {
+		err = fmt.Errorf("(RunLocalWorkflow) EnqueueTasksByJobId returned: %s", err.Error())
+		return
+	}
+	logger.Info("(RunLocalWorkflow) job %s created", job.Id)
+
+	go StartClientWorkers()
+
+	for {
+		time.Sleep(time.Second)
+
+		var state string
+		state, err = job.GetState(true)
+		if err != nil {
+			return
+		}
+
+		switch state {
+		case core.JOB_STAT_COMPLETED:
+			err = printLocalWorkflowOutputs(job)
+			return
+		case core.JOB_STAT_SUSPEND:
+			err = fmt.Errorf("(RunLocalWorkflow) job %s failed", job.Id)
+			if job.Error != nil {
+				err = fmt.Errorf("(RunLocalWorkflow) job %s failed: task=%s workunit=%s notes=%s %s", job.Id, job.Error.TaskFailed, job.Error.WorkFailed, job.Error.ServerNotes, job.Error.WorkNotes)
+			}
+			return
+		}
+	}
+}
+
+func printLocalWorkflowOutputs(job *core.Job) (err error) {
+	wi, err := job.GetWorkflowInstance("::main::", true)
+	if err != nil {
+		err = fmt.Errorf("(printLocalWorkflowOutputs) GetWorkflowInstance returned: %s", err.Error())
+		return
+	}
+
+	// output ids are fully qualified, e.g. #main/output
+	outputs := make(map[string]interface{})
+	for id, value := range wi.Outputs.GetMap() {
+		outputs[path.Base(id)] = value
+	}
+
+	outputs_byte, err := json.MarshalIndent(outputs, "", "  ")
+	if err != nil {
+		err = fmt.Errorf("(printLocalWorkflowOutputs) json.MarshalIndent returned: %s", err.Error())
+		return
+	}
+	fmt.Fprintln(os.Stdout, string(outputs_byte))
+	return
+}
+
+// NotifyWorkunitProcessedLocal hands the result of a workunit to the in-process server,
+// this replaces the upload of results and logs in local mode
+func NotifyWorkunitProcessedLocal(workunit *core.Workunit) {
+	notice := core.Notice{Id: workunit.Workunit_Unique_Identifier, WorkerId: core.Self.Id}
+	if workunit.CWL_workunit != nil {
+		notice = workunit.CWL_workunit.Notice
+		notice.Results = workunit.CWL_workunit.Outputs
+	}
+	notice.Status = workunit.State
+	notice.ComputeTime = workunit.ComputeTime
+	notice.Notes = workunit.GetNotes()
+	notice.FailureReason = workunit.FailureReason
+	if workunit.ExitStatus > 0 {
+		notice.ExitStatus = workunit.ExitStatus
+	}
+
+	work_path, err := workunit.Path()
+	if err == nil {
+		// only the last 5000 chars, as the server does for uploaded logs
+		if text, xerr := ioutil.ReadFile(path.Join(work_path, conf.STDERR_FILENAME)); xerr == nil {
+			err_str := string(text)
+			if len(err_str) > 5000 {
+				err_str = err_str[len(err_str)-5000:]
+			}
+			notice.Stderr = err_str
+		}
+	}
+
+	core.QMgr.NotifyWorkStatus(notice)
+}
@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/logger"
+)
+
+const localTestWorkflow = `cwlVersion: v1.0
+$graph:
+- id: '#echo.cwl'
+  class: CommandLineTool
+  baseCommand: echo
+  inputs:
+  - id: '#echo.cwl/message'
+    type: string
+    inputBinding:
+      position: 1
+  outputs: []
+- id: '#main'
+  class: Workflow
+  inputs:
+  - id: '#main/message'
+    type: string
+  outputs: []
+  steps:
+  - id: '#main/echo'
+    run: '#echo.cwl'
+    in:
+    - id: '#main/echo/message'
+      source: '#main/message'
+    out: []
+`
+
+// the stub replaces cwl-runner and reports a tool without outputs
+const localTestRunner = `#!/bin/sh
+echo '{}'
+`
+
+// TestRunLocalWorkflow runs a workflow in local mode, without MongoDB, AWE server or Shock
+func TestRunLocalWorkflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awe-local-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"workflow.cwl":  localTestWorkflow,
+		"job.yaml":      "message: hello\n",
+		"cwl-runner.sh": localTestRunner,
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(path.Join(dir, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	args := os.Args
+	os.Args = []string{"awe-worker", "--local_runner",
+		"--workpath=" + path.Join(dir, "work"),
+		"--data=" + path.Join(dir, "data"),
+		"--logs=" + path.Join(dir, "logs"),
+		"--cwl_tool=" + path.Join(dir, "workflow.cwl"),
+		"--cwl_job=" + path.Join(dir, "job.yaml"),
+	}
+	err = conf.Init_conf("worker")
+	os.Args = args
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{conf.WORK_PATH, conf.DATA_PATH, conf.LOGS_PATH} {
+		if err = os.MkdirAll(p, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger.Initialize("client")
+
+	Client_mode = "local"
+	runner := cwlRunner
+	cwlRunner = path.Join(dir, "cwl-runner.sh")
+	defer func() { cwlRunner = runner }()
+
+	profile, err := ComposeProfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	core.SetClientProfile(profile)
+	InitWorkers()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- RunLocalWorkflow(conf.CWL_TOOL, conf.CWL_JOB)
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Minute):
+		t.Fatal("workflow did not finish")
+	}
+}
@@ -0,0 +1,250 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"github.com/MG-RAST/golib/httpclient"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// LogChunk is a piece of stdout or stderr of a running workunit
+type LogChunk struct {
+	Logname string
+	Offset  int64
+	Data    []byte
+}
+
+// LogStreamer tails stdout/stderr in the work directory and sends new data to the server.
+// Chunks are passed through a bounded channel; if the server is slow the tailer blocks
+// and stops reading (backpressure). Log lines are never lost, the files in the work dir
+// are uploaded at the end as usual. Secrets are redacted like in the worker log, offsets
+// sent to the server refer to the redacted stream.
+type LogStreamer struct {
+	work_id_b64    string
+	files          map[string]string // logname -> file path
+	offsets        map[string]int64  // read position in the file
+	stream_offsets map[string]int64  // position in the redacted stream
+	chunks         chan *LogChunk
+	stop           chan bool
+	tailer_done    chan bool
+	sender_done    chan bool
+}
+
+func NewLogStreamer(workunit *core.Workunit) (ls *LogStreamer, err error) {
+	work_str, err := workunit.String()
+	if err != nil {
+		err = fmt.Errorf("(NewLogStreamer) workunit.String() returned: %s", err.Error())
+		return
+	}
+	work_path, err := workunit.Path()
+	if err != nil {
+		err = fmt.Errorf("(NewLogStreamer) workunit.Path() returned: %s", err.Error())
+		return
+	}
+
+	buffer := conf.LOG_STREAM_BUFFER
+	if buffer < 1 {
+		buffer = 1
+	}
+
+	ls = &LogStreamer{
+		work_id_b64: "base64:" + base64.StdEncoding.EncodeToString([]byte(work_str)),
+		files: map[string]string{
+			"stdout": path.Join(work_path, conf.STDOUT_FILENAME),
+			"stderr": path.Join(work_path, conf.STDERR_FILENAME),
+		},
+		offsets:        map[string]int64{"stdout": 0, "stderr": 0},
+		stream_offsets: map[string]int64{"stdout": 0, "stderr": 0},
+		chunks:         make(chan *LogChunk, buffer),
+		stop:           make(chan bool),
+		tailer_done:    make(chan bool),
+		sender_done:    make(chan bool),
+	}
+	return
+}
+
+// StartLogStreamer starts streaming if enabled, returns nil otherwise
+func StartLogStreamer(workunit *core.Workunit) (ls *LogStreamer) {
+	if !conf.LOG_STREAM || Client_mode != "online" {
+		return
+	}
+	ls, err := NewLogStreamer(workunit)
+	if err != nil {
+		logger.Error("(StartLogStreamer) %s", err.Error())
+		return nil
+	}
+	go ls.tail()
+	go ls.send()
+	return
+}
+
+// Stop reads remaining output and waits (bounded) until buffered chunks have been sent
+func (ls *LogStreamer) Stop() {
+	if ls == nil {
+		return
+	}
+	close(ls.stop)
+	<-ls.tailer_done
+	select {
+	case <-ls.sender_done:
+	case <-time.After(30 * time.Second):
+		logger.Warning("(LogStreamer/Stop) timeout waiting for log sender")
+	}
+}
+
+func (ls *LogStreamer) tail() {
+	defer close(ls.tailer_done)
+	defer close(ls.chunks)
+
+	interval := time.Duration(conf.LOG_STREAM_INTERVAL) * time.Second
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	var deadline <-chan time.Time
+	for {
+		stopping := false
+		select {
+		case <-ls.stop:
+			stopping = true
+			deadline = time.After(30 * time.Second)
+		case <-time.After(interval):
+		}
+
+		for _, logname := range []string{"stdout", "stderr"} {
+			// on stop, read until the end of the file
+			for {
+				chunk, consumed, err := ls.readChunk(logname, stopping)
+				if err != nil {
+					logger.Debug(3, "(LogStreamer/tail) readChunk %s: %s", logname, err.Error())
+					break
+				}
+				if chunk == nil {
+					break
+				}
+				if stopping {
+					select {
+					case ls.chunks <- chunk:
+					case <-deadline:
+						logger.Warning("(LogStreamer/tail) timeout sending remaining log chunks")
+						return
+					}
+				} else {
+					ls.chunks <- chunk // blocks if the buffer is full
+				}
+				ls.offsets[logname] += int64(consumed)
+				ls.stream_offsets[logname] += int64(len(chunk.Data))
+				if !stopping {
+					break
+				}
+			}
+		}
+
+		if stopping {
+			return
+		}
+	}
+}
+
+// readChunk returns the next redacted chunk of the file and the number of bytes read from the file,
+// or nil if there is no new data. Unless final is set, data that may be part of a secret is left for the next chunk.
+func (ls *LogStreamer) readChunk(logname string, final bool) (chunk *LogChunk, consumed int, err error) {
+	f, err := os.Open(ls.files[logname])
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+
+	offset := ls.offsets[logname]
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	chunk_size := conf.LOG_STREAM_CHUNK_SIZE
+	if chunk_size <= 0 {
+		chunk_size = 65536
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(f, int64(chunk_size)))
+	if err != nil {
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	// a chunk that filled up is not the end of the file
+	redacted, consumed := logger.RedactStream(data, final && len(data) < chunk_size)
+	if consumed == 0 {
+		return
+	}
+	chunk = &LogChunk{Logname: logname, Offset: ls.stream_offsets[logname], Data: redacted}
+	return
+}
+
+func (ls *LogStreamer) send() {
+	defer close(ls.sender_done)
+
+	for chunk := range ls.chunks {
+		wait := time.Second
+		for retry := 0; retry < 5; retry++ {
+			err := ls.sendChunk(chunk)
+			if err == nil {
+				break
+			}
+			logger.Debug(1, "(LogStreamer/send) sendChunk returned: %s", err.Error())
+			select {
+			case <-ls.stop:
+				// do not hold up the workunit, the final upload contains the full log
+				retry = 5
+			case <-time.After(wait):
+				wait *= 2
+			}
+		}
+	}
+}
+
+func (ls *LogStreamer) sendChunk(chunk *LogChunk) (err error) {
+	target_url := fmt.Sprintf("%s/work/%s?client=%s&logchunk=%s&offset=%d", conf.SERVER_URL, ls.work_id_b64, core.Self.Id, chunk.Logname, chunk.Offset)
+
+	headers := httpclient.Header{"Content-Type": []string{"application/octet-stream"}}
+	if conf.CLIENT_GROUP_TOKEN != "" {
+		headers["Authorization"] = []string{"CG_TOKEN " + conf.CLIENT_GROUP_TOKEN}
+	}
+
+	res, err := httpclient.Put(target_url, headers, bytes.NewReader(chunk.Data), nil)
+	if err != nil {
+		err = fmt.Errorf("(sendChunk) httpclient.Put returned: %s", err.Error())
+		return
+	}
+	defer res.Body.Close()
+
+	jsonstream, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return
+	}
+	response := new(core.StandardResponse)
+	err = json.Unmarshal(jsonstream, response)
+	if err != nil {
+		err = fmt.Errorf("(sendChunk) failed to unmarshal response:\"%s\"", jsonstream)
+		return
+	}
+	if len(response.Error) > 0 {
+		err = errors.New(strings.Join(response.Error, ","))
+		return
+	}
+	return
+}
@@ -0,0 +1,175 @@
+package worker
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// PodmanRuntime runs containers with the podman binary (conf.PODMAN_BINARY), rootless or not.
+// The podman command line is compatible with docker, images are shared with buildah.
+type PodmanRuntime struct {
+	binary string
+}
+
+func NewPodmanRuntime() *PodmanRuntime {
+	return &PodmanRuntime{binary: conf.PODMAN_BINARY}
+}
+
+// podmanImageName returns the fully qualified image name, podman does not assume docker.io for short names
+func podmanImageName(image string) string {
+	if strings.HasPrefix(image, "sha256:") {
+		return image
+	}
+	ref, err := core.ParseDockerImageRef(image)
+	if err != nil {
+		return image
+	}
+	name := ref.Registry + "/" + ref.Repository
+	if ref.Digest != "" {
+		return name + "@" + ref.Digest
+	}
+	return name + ":" + ref.Tag
+}
+
+func (p *PodmanRuntime) Name() string { return "podman" }
+
+func (p *PodmanRuntime) Supports(source string) bool { return true }
+
+// run executes podman and returns stdout, env is added to the environment of the podman process
+func (p *PodmanRuntime) run(stdin io.Reader, env []string, args ...string) (stdout string, err error) {
+	logger.Debug(1, "(PodmanRuntime) cmd: %s %s", p.binary, strings.Join(args, " "))
+	cmd := exec.Command(p.binary, args...)
+	cmd.Stdin = stdin
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	var stdout_buf bytes.Buffer
+	var stderr_buf bytes.Buffer
+	cmd.Stdout = &stdout_buf
+	cmd.Stderr = &stderr_buf
+	err = cmd.Run()
+	stdout = strings.TrimSpace(stdout_buf.String())
+	if err != nil {
+		err = fmt.Errorf("%s %s returned: %s (%s)", p.binary, args[0], err.Error(), strings.TrimSpace(stderr_buf.String()))
+	}
+	return
+}
+
+func (p *PodmanRuntime) InspectImage(image string) (id string, err error) {
+	id, err = p.run(nil, nil, "image", "inspect", "--format", "{{.Id}}", podmanImageName(image))
+	if err != nil {
+		return
+	}
+	// podman omits the algorithm, docker image ids (e.g. in Shock) include it
+	if !strings.Contains(id, ":") {
+		id = "sha256:" + id
+	}
+	return
+}
+
+func (p *PodmanRuntime) PullImage(ref *core.DockerImageRef, cred *core.RegistryCredential) (err error) {
+	args := []string{"pull", "--quiet"}
+	if cred != nil {
+		var config_dir string
+		config_dir, err = writeDockerConfig(ref, cred)
+		if err != nil {
+			return
+		}
+		defer os.RemoveAll(config_dir)
+		args = append(args, "--authfile", path.Join(config_dir, "config.json"))
+	}
+	_, err = p.run(nil, nil, append(args, podmanImageName(ref.String()))...)
+	return
+}
+
+func (p *PodmanRuntime) LoadImage(image string, archive io.Reader) (err error) {
+	_, err = p.run(archive, nil, "load", "--quiet")
+	return
+}
+
+func (p *PodmanRuntime) Create(spec *ContainerSpec) (id string, err error) {
+	args := []string{"create", "--name=" + spec.Name, "--workdir=" + spec.WorkDir}
+	args = append(args, containerLimitArgs(spec)...)
+	for _, mount := range spec.Mounts {
+		bind := mount.Source + ":" + mount.Target
+		if mount.ReadOnly {
+			bind += ":ro"
+		}
+		args = append(args, "--volume="+bind)
+	}
+	// pass only the names, podman takes the values from its environment (not visible in ps)
+	for _, env_pair := range spec.Env {
+		args = append(args, "--env="+strings.SplitN(env_pair, "=", 2)[0])
+	}
+	args = append(args, podmanImageName(spec.Image))
+	args = append(args, spec.Cmd...)
+
+	stdout, err := p.run(nil, spec.Env, args...)
+	if err != nil {
+		return
+	}
+	// the last line contains the id, pull progress may be printed before
+	lines := strings.Split(stdout, "\n")
+	id = strings.TrimSpace(lines[len(lines)-1])
+	if id == "" {
+		err = fmt.Errorf("(PodmanRuntime) podman create returned empty string")
+	}
+	return
+}
+
+func (p *PodmanRuntime) Start(id string) (err error) {
+	_, err = p.run(nil, nil, "start", id)
+	return
+}
+
+func (p *PodmanRuntime) Wait(id string) (status int, err error) {
+	stdout, err := p.run(nil, nil, "wait", id)
+	if err != nil {
+		return
+	}
+	status, err = strconv.Atoi(stdout)
+	if err != nil {
+		err = fmt.Errorf("(PodmanRuntime) could not interpret status code: \"%s\"", stdout)
+	}
+	return
+}
+
+func (p *PodmanRuntime) Kill(id string) (err error) {
+	_, err = p.run(nil, nil, "kill", id)
+	return
+}
+
+func (p *PodmanRuntime) OOMKilled(id string) bool {
+	return inspectOOMKilled(p.binary, id)
+}
+
+func (p *PodmanRuntime) Remove(name string) (err error) {
+	_, err = p.run(nil, nil, "rm", "--force", "--ignore", name)
+	return
+}
+
+func (p *PodmanRuntime) Stats(id string) (stats *ContainerStats, err error) {
+	pid_str, err := p.run(nil, nil, "inspect", "--format", "{{.State.Pid}}", id)
+	if err != nil {
+		return
+	}
+	pid, err := strconv.Atoi(pid_str)
+	if err != nil || pid <= 0 {
+		err = fmt.Errorf("(PodmanRuntime) container %s is not running", id)
+		return
+	}
+	filename, err := cgroupMemoryStatFile(pid)
+	if err != nil {
+		return
+	}
+	return readCgroupMemoryStat(filename)
+}
@@ -2,7 +2,7 @@ package worker
 
 import (
 	"bufio"
-	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -17,16 +17,15 @@ import (
 	//"github.com/davecgh/go-spew/spew"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"runtime"
-	"strconv"
 	"strings"
 	"syscall"
 	"time"
-
-	"github.com/fsouza/go-dockerclient"
 )
 
 type Shock_Dockerimage_attributes struct {
@@ -83,8 +82,38 @@ func processor_run(control chan int) (err error) {
 		return
 	}
 
+	refused, err := startPrefetched(work_id)
+	if err != nil {
+		logger.Error("(processor) startPrefetched returned: %s", err.Error())
+		err = nil
+	}
+	if refused {
+		workmap.Set(work_id, ID_DISCARDED, "processor")
+		workunit.SetState(core.WORK_STAT_DISCARDED, "the server did not allow to start the prefetched workunit")
+		fromProcessor <- workunit
+		return
+	}
 	workmap.Set(work_id, ID_WORKER, "processor")
 
+	if workunit.CWL_workunit != nil && workunit.CWL_workunit.Split != nil && workunit.CWL_workunit.Split.Phase != core.SPLIT_PHASE_PROCESS {
+		// split or merge workunit of a step with a SplitRequirement, no tool to run
+		run_start := time.Now().Unix()
+		err = RunSplitWorkunit(workunit)
+		if err != nil {
+			logger.Error("(processor) RunSplitWorkunit returned error , workid=%s, %s", work_str, err.Error())
+			workunit.Notes = append(workunit.Notes, "[processor#RunSplitWorkunit]"+err.Error())
+			workunit.SetState(core.WORK_STAT_ERROR, "RunSplitWorkunit failed")
+			err = nil
+		} else {
+			workunit.SetState(core.WORK_STAT_COMPUTED, "")
+		}
+		computetime := time.Now().Unix() - run_start
+		workunit.WorkPerf.Runtime = computetime
+		workunit.ComputeTime = int(computetime)
+		fromProcessor <- workunit
+		return
+	}
+
 	var envkeys []string
 	_ = envkeys
 
@@ -93,12 +122,40 @@ func processor_run(control chan int) (err error) {
 		wants_docker = true
 	}
 
+	err = ValidateWorkunitContainer(workunit)
+	if err != nil {
+		logger.Error("(processor) ValidateWorkunitContainer(): workid=" + work_str + ", " + err.Error())
+		workunit.Notes = append(workunit.Notes, "[processor#ValidateWorkunitContainer]"+err.Error())
+		workunit.SetState(core.WORK_STAT_ERROR, "see notes")
+		err = nil
+		fromProcessor <- workunit
+		return
+	}
+
+	// secret CWL inputs are only written into the work directory while the tool runs
+	var cwl_secrets map[string]string
+	if workunit.CWL_workunit != nil && len(workunit.CWL_workunit.Secrets) > 0 {
+		cwl_secrets, err = fetchCWLSecrets(workunit)
+		if err != nil {
+			logger.Error("(processor) fetchCWLSecrets(): workid=" + work_str + ", " + err.Error())
+			workunit.Notes = append(workunit.Notes, "[processor#fetchCWLSecrets]"+err.Error())
+			workunit.SetState(core.WORK_STAT_ERROR, "see notes")
+			err = nil
+			fromProcessor <- workunit
+			return
+		}
+	}
+
 	if !wants_docker {
 		envkeys, err = SetEnv(workunit)
 		if err != nil {
 			logger.Error("(processor) SetEnv(): workid=" + work_str + ", " + err.Error())
 			workunit.Notes = append(workunit.Notes, "[processor#SetEnv]"+err.Error())
 			workunit.SetState(core.WORK_STAT_ERROR, "see notes")
+			if cwl_secrets != nil {
+				releaseCWLSecrets(workunit, cwl_secrets)
+			}
+			workRedactions.Release(workunit.Id)
 			//release the permit lock, for work overlap inhibitted mode only
 			//if !conf.WORKER_OVERLAP && core.Service != "proxy" {
 			//	<-chanPermit
@@ -108,8 +165,14 @@ func processor_run(control chan int) (err error) {
 	}
 	run_start := time.Now().Unix()
 
+	log_streamer := StartLogStreamer(workunit)
+
 	var pstat *core.WorkPerf
 	pstat, err = RunWorkunit(workunit)
+	log_streamer.Stop()
+	if cwl_secrets != nil {
+		releaseCWLSecrets(workunit, cwl_secrets)
+	}
 	exit_status := workunit.ExitStatus
 	logger.Debug(1, "(processor) ExitStatus of process: %d", exit_status)
 	if err != nil {
@@ -242,6 +305,12 @@ func RunWorkunit(workunit *core.Workunit) (pstats *core.WorkPerf, err error) {
 	return
 }
 
+// wrapperScript returns the wrapper script of a Cmd_script. The container command is not run by
+// a shell, the script redirects its own output before it runs the commands.
+func wrapperScript(cmd_script []string, stdout_file string, stderr_file string) string {
+	return fmt.Sprintf("#!/bin/bash\nexec 2> %s 1> %s\n%s\n", stderr_file, stdout_file, strings.Join(cmd_script, "\n"))
+}
+
 func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err error) {
 	pstats = new(core.WorkPerf)
 	pstats.MaxMemUsage = -1
@@ -271,13 +340,16 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 	wrapper_script_filename_host := path.Join(work_path, wrapper_script_filename)
 	wrapper_script_filename_docker := path.Join(conf.DOCKER_WORK_DIR, wrapper_script_filename)
 
+	stdout_file := path.Join(conf.DOCKER_WORK_DIR, conf.STDOUT_FILENAME)
+	stderr_file := path.Join(conf.DOCKER_WORK_DIR, conf.STDERR_FILENAME)
+
+	pipe_output := fmt.Sprintf(" 2> %s 1> %s", stderr_file, stdout_file)
+
 	if len(workunit.Cmd.Cmd_script) > 0 {
 		use_wrapper_script = true
 
-		// create wrapper script
-
 		//conf.DOCKER_WORK_DIR
-		var wrapper_content_string = "#!/bin/bash\n" + strings.Join(workunit.Cmd.Cmd_script, "\n") + "\n"
+		var wrapper_content_string = wrapperScript(workunit.Cmd.Cmd_script, stdout_file, stderr_file)
 
 		logger.Debug(1, "write wrapper script: %s\n%s", wrapper_script_filename_host, strings.Join(workunit.Cmd.Cmd_script, ", "))
 
@@ -315,45 +387,21 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 			return
 		}
 	}
-	if workunit.Cmd.DockerPull != "" {
-
-		dockerimage_repo, dockerimage_tag, err = SplitDockerimageName(workunit.Cmd.DockerPull)
-		if err != nil {
-			err = fmt.Errorf("(RunWorkunitDocker) B SplitDockerimageName returned: %s", err.Error())
-			return
-		}
-	}
 
 	Dockerimage_normalized := dockerimage_repo + ":" + dockerimage_tag
 	logger.Debug(3, "Dockerimage_normalized: %s", Dockerimage_normalized)
 
-	use_docker_api := true
-	if conf.DOCKER_BINARY != "API" {
-		use_docker_api = false
-	}
-
-	var client *docker.Client = nil
-
-	if use_docker_api {
-		logger.Debug(1, "Using docker API...")
-		client, err = docker.NewClient(conf.DOCKER_SOCKET)
-		if err != nil {
-			err = fmt.Errorf("(RunWorkunitDocker) error creating docker client: %s", err.Error())
-			return
-		}
-	} else {
-		logger.Debug(1, "Using docker docker binary...")
+	container_runtime, err := NewContainerRuntime()
+	if err != nil {
+		err = fmt.Errorf("(RunWorkunitDocker) NewContainerRuntime returned: %s", err.Error())
+		return
 	}
-
-	//imgs, _ := client.ListImages(false)
-	//for _, img := range imgs {
-	//	spew.Dump(img)
-	//}
+	logger.Debug(1, "Using container container_runtime %s...", container_runtime.Name())
 
 	// delete any old AWE_container
-	err = RemoveOldAWEContainers(client, container_name)
+	err = container_runtime.Remove(container_name)
 	if err != nil {
-		err = fmt.Errorf("(RunWorkunitDocker) RemoveOldAWEContainers returned: %s", err.Error())
+		err = fmt.Errorf("(RunWorkunitDocker) Remove returned: %s", err.Error())
 		return nil, err
 	}
 
@@ -391,56 +439,19 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 		logger.Debug(1, "using dockerimage id %s instead of name %s ", dockerimage_id, Dockerimage_normalized)
 
 		// *** find/inspect image
-		var image *docker.Image
-		image, err = InspectImage(client, dockerimage_id)
+		var image_id string
+		image_id, err = container_runtime.InspectImage(dockerimage_id)
 
 		if err != nil {
 
 			logger.Debug(1, "docker image %s is not yet in local repository", Dockerimage_normalized)
-			err = nil
 
-			image_retrieval := "load" // TODO only load is guaraneed to workunit
-			//image_retrieval := "pull"
-			switch {
-			case image_retrieval == "load":
-				{ // for images that have been saved
-					logger.Debug(1, "Loading image %s", dockerimage_download_url)
-					err = dockerLoadImage(client, dockerimage_download_url, workunit.Info.DataToken)
-					if err != nil {
-						err = fmt.Errorf("Docker image was not correctly loaded, err=%s", err.Error())
-						return
-					}
-				}
-			case image_retrieval == "import":
-				{ // for containers that have been exported
-					logger.Debug(1, "Importing image %s", Dockerimage_normalized)
-					xerr := dockerImportImage(client, Dockerimage_normalized, workunit.Info.DataToken)
-					if xerr != nil {
-						err = fmt.Errorf("Docker image was not correctly imported, err=%s", xerr.Error())
-						return
-					}
-				}
-			case image_retrieval == "build":
-				{ // to create image from Dockerfile
-					logger.Debug(1, "Building image %s", Dockerimage_normalized)
-					xerr := dockerBuildImage(client, Dockerimage_normalized)
-					if xerr != nil {
-						err = fmt.Errorf("Docker image was not correctly built, err=%s", xerr.Error())
-						return
-					}
-				}
-			case image_retrieval == "pull":
-				{ // pull from docker hub
-					logger.Debug(1, "Pulling image %s", Dockerimage_normalized)
-					var buf bytes.Buffer
-					pio := docker.PullImageOptions{Repository: Dockerimage_normalized, OutputStream: &buf}
-					xerr := client.PullImage(pio, docker.AuthConfiguration{})
-					logger.Debug(3, "docker pull response: ", buf.String())
-					if xerr != nil {
-						err = fmt.Errorf("Docker image was not correctly pulled, err=%s", xerr.Error())
-						return
-					}
-				}
+			// only images that have been saved are guaranteed to work
+			logger.Debug(1, "Loading image %s", dockerimage_download_url)
+			err = dockerLoadImage(container_runtime, dockerimage_id, dockerimage_download_url, workunit.Info.DataToken)
+			if err != nil {
+				err = fmt.Errorf("Docker image was not correctly loaded, err=%s", err.Error())
+				return
 			}
 
 			// example urls
@@ -449,51 +460,37 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 			// download http://shock.metagenomics.anl.gov/node/ed0a6b20-c535-40d7-92e8-754bb8b6b48f?download
 
 			// last test
-			if dockerimage_id != "" {
-				image, err = InspectImage(client, dockerimage_id)
-				if err != nil {
-					err = fmt.Errorf("(InspectImage) Docker image (%s , %s) was not correctly imported or built, err=%s", Dockerimage_normalized, dockerimage_id, err.Error())
-					return
-				}
-			} else {
-				image, err = InspectImage(client, Dockerimage_normalized)
-				if xerr != nil {
-					err = fmt.Errorf("(InspectImage) Docker image (%s) was not correctly imported or built, err=%s", Dockerimage_normalized, err.Error())
-					return
-				}
+			image_id, err = container_runtime.InspectImage(dockerimage_id)
+			if err != nil {
+				err = fmt.Errorf("(InspectImage) Docker image (%s , %s) was not correctly imported or built, err=%s", Dockerimage_normalized, dockerimage_id, err.Error())
+				return
 			}
 
 		} else {
 			logger.Debug(1, "docker image %s is already in local repository", Dockerimage_normalized)
 		}
 
-		if dockerimage_id != image.ID {
-			err = fmt.Errorf("error: dockerimage_id != image.ID, %s != %s (%s)", dockerimage_id, image.ID, Dockerimage_normalized)
+		if dockerimage_id != image_id {
+			err = fmt.Errorf("error: dockerimage_id != image.ID, %s != %s (%s)", dockerimage_id, image_id, Dockerimage_normalized)
 			return
 		}
 
 		// tag image to make debugging easier
-		tag_opts := docker.TagImageOptions{Repo: dockerimage_repo, Tag: dockerimage_tag}
-
-		err = TagImage(client, dockerimage_id, tag_opts)
-		if err != nil {
-			logger.Error("warning: tagging of image %s with %s failed, err:", dockerimage_id, Dockerimage_normalized, err.Error())
+		if docker_runtime, ok := container_runtime.(*DockerRuntime); ok {
+			err = docker_runtime.TagImage(dockerimage_id, dockerimage_repo, dockerimage_tag)
+			if err != nil {
+				logger.Error("warning: tagging of image %s with %s failed, err: %s", dockerimage_id, Dockerimage_normalized, err.Error())
+				err = nil
+			}
 		}
 
 	} else if workunit.Cmd.DockerPull != "" {
-
-		if false {
-			logger.Debug(1, "Pulling image %s from Docker Hub", Dockerimage_normalized)
-			var buf bytes.Buffer
-			pio := docker.PullImageOptions{Repository: Dockerimage_normalized, OutputStream: &buf}
-			err = client.PullImage(pio, docker.AuthConfiguration{})
-			logger.Debug(3, "docker pull response: ", buf.String())
-			if err != nil {
-				err = fmt.Errorf("Docker image was not correctly pulled, err=%s", err.Error())
-				return
-			}
+		// registry image, pinned to the digest resolved by the server (if any)
+		dockerimage_id, err = pullDockerImage(container_runtime, workunit)
+		if err != nil {
+			err = fmt.Errorf("(RunWorkunitDocker) pullDockerImage returned: %s", err.Error())
+			return
 		}
-		dockerimage_id = workunit.Cmd.DockerPull
 	}
 
 	if dockerimage_id == "" {
@@ -503,11 +500,8 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 
 	// collect environment
 	var docker_environment []string
-	docker_environment_string := "" // this is only for the debug output
 	for key, val := range workunit.Cmd.Environ.Public {
-		env_pair := key + "=" + val
-		docker_environment = append(docker_environment, env_pair)
-		docker_environment_string += " --env=" + env_pair
+		docker_environment = append(docker_environment, key+"="+val)
 	}
 	if workunit.Cmd.HasPrivateEnv {
 		logger.Debug(3, "HasPrivateEnv true")
@@ -516,24 +510,16 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 			return nil, err
 		}
 		for key, val := range private_envs {
-			env_pair := key + "=" + val
-			docker_environment = append(docker_environment, env_pair)
-			docker_environment_string += " -e " + env_pair
-
+			docker_environment = append(docker_environment, key+"="+val)
 		}
 	} else {
 		logger.Debug(3, "HasPrivateEnv false")
 	}
 
-	stdout_file := path.Join(conf.DOCKER_WORK_DIR, conf.STDOUT_FILENAME)
-	stderr_file := path.Join(conf.DOCKER_WORK_DIR, conf.STDERR_FILENAME)
-
-	pipe_output := fmt.Sprintf(" 2> %s 1> %s", stderr_file, stdout_file)
-
 	bash_command := ""
 	if use_wrapper_script {
 		//bash_command = fmt.Sprint("/bin/bash", " ", wrapper_script_filename_docker, " ", pipe_output) // bash for wrapper script
-		bash_command = fmt.Sprint(wrapper_script_filename_docker, " ", pipe_output)
+		bash_command = wrapper_script_filename_docker
 	} else {
 
 		bash_command = fmt.Sprintf("%s %s %s", commandName, strings.Join(args, " "), pipe_output)
@@ -553,7 +539,6 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 		//time.Sleep(time.Second * 3000)
 		bash_command = wrapper_script_filename_docker
 	}
-	//bash_command = fmt.Sprintf("sleep 3 ; uname -a ; ./awe_qc.pl -format my_file_format.075 -out_prefix my_job_id.075 -assembled 1 -filter_options my_filter_options -proc 8 -input Ebin3.fa; uname -a 2> %s 1> %s", conf.STDERR_FILENAME, conf.STDOUT_FILENAME)
 	logger.Debug(1, fmt.Sprint("bash_command: ", bash_command))
 
 	// example: "/bin/bash", "-c", "bowtie2 -h 2> awe_stderr.txt 1> awe_stdout.txt"
@@ -561,85 +546,32 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 	//container_cmd := []string{"/bin/bash", "-c", bash_command} // TODO remove bash if possible, but is needed for piping
 	container_cmd := []string{bash_command}
 
-	//var empty_struct struct{}
-	bindstr_workdir := work_path + "/:" + conf.DOCKER_WORK_DIR
-	logger.Debug(1, "bindstr_workdir: "+bindstr_workdir)
+	spec := &ContainerSpec{
+		Name:    container_name,
+		Image:   dockerimage_id,
+		WorkDir: conf.DOCKER_WORK_DIR,
+		Cmd:     container_cmd,
+		Env:     docker_environment,
+		Mounts:  []ContainerMount{{Source: work_path + "/", Target: conf.DOCKER_WORK_DIR}},
 
-	var bindarray = []string{}
+		Resources:     workunit.Cmd.Resources,
+		NetworkAccess: workunit.Cmd.NetworkAccess || conf.CONTAINER_NETWORK,
+	}
 
 	// only mount predata if it is actually used
-	//fake_predata := ""
-	bindstr_predata := ""
-	volume_str := ""
 	if len(workunit.Predata) > 0 {
 		predata_directory := path.Join(conf.DATA_PATH, "predata")
-		bindstr_predata = predata_directory + "/:" + conf.DOCKER_WORKUNIT_PREDATA_DIR + ":ro"
-
-		bindarray = []string{bindstr_workdir, bindstr_predata} //old version
-		volume_str = "--volume=" + bindstr_workdir + " --volume=" + bindstr_predata
-	} else {
-		bindarray = []string{bindstr_workdir}
-		volume_str = "--volume=" + bindstr_workdir
-	}
-
-	logger.Debug(1, "volume_str: "+volume_str)
-
-	// version for docker command line
-	docker_commandline_create := []string{
-		// "-t" would be required if I want to attach to the container later, check again documentation if needed
-		"--name=" + container_name,
-		"--workdir=" + conf.DOCKER_WORK_DIR,
-		volume_str, // for workdir and optionally predata
-	}
-
-	if docker_environment_string != "" {
-		docker_commandline_create = append(docker_commandline_create, docker_environment_string)
-	}
-
-	// version for docker API
-	config := docker.Config{Image: dockerimage_id,
-		WorkingDir:   conf.DOCKER_WORK_DIR,
-		AttachStdout: true,
-		AttachStderr: true,
-		AttachStdin:  false,
-		Cmd:          container_cmd,
-		Volumes:      map[string]struct{}{conf.DOCKER_WORK_DIR: struct{}{}}, // old version
-		//Volumes: map[string]struct{}{bindstr_workdir: struct{}{}},
-
-		Env: docker_environment,
-	}
-
-	if len(workunit.Predata) > 0 {
-		config.Volumes[bindstr_predata] = struct{}{}
+		spec.Mounts = append(spec.Mounts, ContainerMount{Source: predata_directory + "/", Target: conf.DOCKER_WORKUNIT_PREDATA_DIR, ReadOnly: true})
 	}
-
-	docker_commandline_create = append(docker_commandline_create, dockerimage_id)   //
-	docker_commandline_create = append(docker_commandline_create, container_cmd...) // argument to the "docker create" command
-
-	opts := docker.CreateContainerOptions{Name: container_name, Config: &config, HostConfig: &docker.HostConfig{Binds: bindarray}}
-
-	// note: docker binary mounts on creation, while docker API mounts on start of container
-
-	container_id := ""
+	logger.Debug(1, "mounts: %v", spec.Mounts)
 
 	// *** create container
-	logger.Debug(1, "creating docker container %s from image %s (%s)", container_name, Dockerimage_normalized, dockerimage_id)
-
-	if client != nil {
+	logger.Debug(1, "creating %s container %s from image %s (%s)", container_runtime.Name(), container_name, Dockerimage_normalized, dockerimage_id)
 
-		container_obj, xerr := client.CreateContainer(opts)
-		if xerr == nil {
-			container_id = container_obj.ID
-		} else {
-			err = fmt.Errorf("error creating container, err=%s", xerr.Error())
-			return
-		}
-	} else {
-		container_id, err = CreateContainer(docker_commandline_create)
-		if err != nil {
-			err = fmt.Errorf("error creating container, err=%s", err.Error())
-			return
-		}
+	container_id, err := container_runtime.Create(spec)
+	if err != nil {
+		err = fmt.Errorf("error creating container, err=%s", err.Error())
+		return
 	}
 	logger.Debug(3, "Container created.")
 
@@ -648,27 +580,17 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 		return
 	}
 
-	logger.Debug(1, "created docker container with ID: %s", container_id)
+	logger.Debug(1, "created container with ID: %s", container_id)
 
 	// *** start container
 
-	fake_docker_cmd := "sudo docker run -t -i --name test " + volume_str + " " + docker_environment_string + " --workdir=" + conf.DOCKER_WORK_DIR + " " + dockerimage_id + " " + strings.Join(container_cmd, " ")
-	logger.Debug(1, "fake_docker_cmd ("+Dockerimage_normalized+"): "+fake_docker_cmd)
-	logger.Debug(1, "starting docker container...")
+	logger.Debug(1, "starting container...")
 
 	docker_preparation_end := time.Now().Unix()
 	pstats.DockerPrep = docker_preparation_end - docker_preparation_start
 	logger.Debug(1, "DockerPrep time in seconds: %d", pstats.DockerPrep)
 
-	if client != nil {
-		//err = client.StartContainer(container_id, &docker.HostConfig{Binds: bindarray}) // weired, seems to be needed
-		err = client.StartContainer(container_id, nil)
-		//err = client.StartContainer(container_id, &docker.HostConfig{})
-
-	} else {
-		err = StartContainer(container_id, volume_str)
-	}
-
+	err = container_runtime.Start(container_id)
 	if err != nil {
 		err = fmt.Errorf("error starting container, id=%s, err=%s", container_id, err.Error())
 		return
@@ -678,51 +600,29 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 	defer func(container_id string) {
 		// *** clean up
 		// ** kill container
-		var err_kill error
-		if client != nil {
-			err_kill = client.KillContainer(docker.KillContainerOptions{ID: container_id})
-		} else {
-			err_kill = KillContainer(container_id)
-		}
+		err_kill := container_runtime.Kill(container_id)
 		if err_kill != nil {
 			logger.Debug(3, "(deferred func) (clean-up after running container) could not kill container id=%s, err=%s", container_id, err_kill.Error())
 		}
 
 	}(container_id)
 
-	if client != nil {
-		cont, err := client.InspectContainer(container_id)
-		if err != nil {
-			logger.Error("error inspecting container=%s, err=%s", container_id, err.Error())
-		}
-
-		logger.Debug(3, "Container status: %s", cont.State.Status)
-
+	if docker_runtime, ok := container_runtime.(*DockerRuntime); ok {
 		inspect_filename := path.Join(work_path, "container_inspect.json")
-
-		b_inspect, _ := json.MarshalIndent(cont, "", "    ")
-
-		err = ioutil.WriteFile(inspect_filename, b_inspect, 0666)
+		err = docker_runtime.WriteInspect(container_id, inspect_filename)
 		if err != nil {
-			fmt.Errorf("error writing inspect file for container=%s, err=%s", container_id, err.Error())
+			logger.Error("error writing inspect file for container=%s, err=%s", container_id, err.Error())
+			err = nil
 		} else {
 			logger.Debug(1, "wrote %s for container %s", inspect_filename, container_id)
 		}
 	}
 
 	// wait for container to finish
-	done := make(chan WaitContainerResult)
+	done := make(chan WaitContainerResult, 2)
 	go func() {
 
-		//time.Sleep(300 * time.Second)
-
-		var errwait error
-		var status int = -1
-		if client != nil {
-			status, errwait = client.WaitContainer(container_id)
-		} else {
-			status, errwait = WaitContainer(container_id)
-		}
+		status, errwait := container_runtime.Wait(container_id)
 
 		cresult := WaitContainerResult{errwait, status}
 
@@ -732,29 +632,12 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 		}
 	}()
 
-	var MaxMem int64 = -1
-	var max_memory_total_rss int64 = -1
-	var max_memory_total_swap int64 = -1
+	memory := newMemoryMaxima()
 
-	memory_stat_filename := ""
 	if conf.MEM_CHECK_INTERVAL != 0 {
-
-		// documentation: https://docs.docker.com/articles/runmetrics/
-		// e.g. ubuntu: /sys/fs/cgroup/memory/docker/[ID]/memory.stat
-		//      coreos: /sys/fs/cgroup/memory/system.slice/docker-[ID].scope/memory.stat
-
-		memory_stat_filename = strings.Replace(conf.CGROUP_MEMORY_DOCKER_DIR, "[ID]", container_id, -1)
-
-		if _, err := os.Stat(memory_stat_filename); os.IsNotExist(err) {
-			logger.Error("warning: memory measurement requested, but no memory.stat found: %s" + memory_stat_filename)
-			memory_stat_filename = ""
-		}
-
-	}
-
-	if conf.MEM_CHECK_INTERVAL != 0 && memory_stat_filename != "" {
 		go func() { // memory checker
 
+			stats_available := true
 			for {
 
 				select {
@@ -767,85 +650,10 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 				default:
 				}
 
-				var memory_total_rss int64 = -1
-				var memory_total_swap int64 = -1
-				memory_stat_file, err_mem := os.Open(memory_stat_filename)
-				if err_mem != nil {
-
-					logger.Error("warning: error opening memory_stat_file file:" + err_mem.Error())
-					time.Sleep(conf.MEM_CHECK_INTERVAL)
-					continue
-				}
-
-				// Closes the file when we leave the scope of the current function,
-				// this makes sure we never forget to close the file if the
-				// function can exit in multiple places.
-
-				memory_stat_file_scanner := bufio.NewScanner(memory_stat_file)
-
-				memory_total_rss_read := false
-				memory_total_swap_read := false
-				// scanner.Scan() advances to the next token returning false if an error was encountered
-				for memory_stat_file_scanner.Scan() {
-					line := memory_stat_file_scanner.Text()
-					if strings.HasPrefix(line, "total_rss ") { // TODO what is total_rss_huge
-						//logger.Debug(1, fmt.Sprint("inspecting container with memory line=", line))
-
-						memory_total_rss, err = strconv.ParseInt(strings.TrimPrefix(line, "total_rss "), 10, 64)
-						if err != nil {
-							memory_total_rss = -1
-						}
-						memory_total_rss_read = true
-					} else if strings.HasPrefix(line, "total_swap ") { // TODO what is total_rss_huge
-						//logger.Debug(1, fmt.Sprint("inspecting container with memory line=", line))
-
-						memory_total_swap, err = strconv.ParseInt(strings.TrimPrefix(line, "total_swap "), 10, 64)
-						if err != nil {
-							memory_total_swap = -1
-						}
-						memory_total_swap_read = true
-					} else {
-						continue
-					}
-					if memory_total_rss_read && memory_total_swap_read { // we found all information we need, leave the loop
-						break
-					}
-
+				if stats_available {
+					stats_available = memory.measure(container_runtime, container_id)
 				}
 
-				// When finished scanning if any error other than io.EOF occured
-				// it will be returned by scanner.Err().
-				if err := memory_stat_file_scanner.Err(); err != nil {
-					logger.Error("warning: could no read memory usage from cgroups=%s", memory_stat_file_scanner.Err())
-					//err = nil
-				} else {
-
-					// RSS maxium
-					if memory_total_rss >= 0 && memory_total_rss > max_memory_total_rss {
-						max_memory_total_rss = memory_total_rss
-					}
-
-					// SWAP maximum
-					if memory_total_swap >= 0 && memory_total_swap > max_memory_total_swap {
-						max_memory_total_swap = memory_total_swap
-					}
-
-					// RSS+SWAP maximum
-					if memory_total_rss >= 0 && memory_total_swap >= 0 {
-
-						memory_combined := memory_total_rss + memory_total_swap
-						if memory_combined > MaxMem {
-							MaxMem = memory_combined
-						}
-
-					}
-
-					logger.Debug(1, fmt.Sprintf("memory: rss=%d, swap=%d, max_rss=%d max_swap=%d max_combined=%d",
-						memory_total_rss, memory_total_swap, max_memory_total_rss, max_memory_total_swap, MaxMem))
-
-				}
-				memory_stat_file.Close() // defer does not work in for loop !
-				//time.Sleep(5 * time.Second)
 				time.Sleep(conf.MEM_CHECK_INTERVAL)
 
 			}
@@ -860,12 +668,7 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 	case <-chankill:
 		logger.Debug(1, "chankill, try to kill container %s... ", container_id)
 
-		if client != nil {
-			err = client.KillContainer(docker.KillContainerOptions{ID: container_id})
-		} else {
-			err = KillContainer(container_id)
-		}
-
+		err = container_runtime.Kill(container_id)
 		if err != nil {
 			return nil, errors.New(fmt.Sprintf("(chankill) error killing container id=%s, err=%s", container_id, err.Error()))
 		}
@@ -875,20 +678,28 @@ func RunWorkunitDocker(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 		return nil, errors.New("process killed as requested from chankill")
 	case cresult = <-done:
 		workunit.ExitStatus = cresult.Status
-		logger.Debug(3, "(1)docker wait returned with status %d", cresult.Status)
+		logger.Debug(3, "(1)container wait returned with status %d", cresult.Status)
 		if cresult.Error != nil {
-			return nil, fmt.Errorf("dockerWait=%s, status=%d, err=%s", commandName, cresult.Status, cresult.Error.Error())
+			return nil, fmt.Errorf("containerWait=%s, status=%d, err=%s", commandName, cresult.Status, cresult.Error.Error())
 		}
 		if cresult.Status != 0 {
 			logger.Debug(3, "WaitContainer returned non-zero status=%d", cresult.Status)
+			if container_runtime.OOMKilled(container_id) {
+				workunit.FailureReason = core.WORK_FAILURE_OOM
+				memory_limit := "none"
+				if spec.Resources != nil && spec.Resources.RamMB > 0 {
+					memory_limit = fmt.Sprintf("%d MB", spec.Resources.RamMB)
+				}
+				return nil, fmt.Errorf("container was killed by the OOM killer (status=%d, memory limit: %s)", cresult.Status, memory_limit)
+			}
 			return nil, fmt.Errorf("error WaitContainer returned non-zero status=%d", cresult.Status)
 		}
 	}
 
 	logger.Debug(1, fmt.Sprint("pstats.MaxMemUsage: ", pstats.MaxMemUsage))
-	pstats.MaxMemUsage = MaxMem
-	pstats.MaxMemoryTotalRss = max_memory_total_rss
-	pstats.MaxMemoryTotalSwap = max_memory_total_swap
+	pstats.MaxMemUsage = memory.Combined
+	pstats.MaxMemoryTotalRss = memory.Rss
+	pstats.MaxMemoryTotalSwap = memory.Swap
 	logger.Debug(1, fmt.Sprint("pstats.MaxMemUsage: ", pstats.MaxMemUsage))
 
 	return
@@ -955,9 +766,17 @@ func RunWorkunitDirect(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 	err_writer := bufio.NewWriter(errfile)
 	defer err_writer.Flush()
 
+	// cmd.Wait closes the pipes, it has to wait until the output is copied
+	copy_done := make(chan bool, 2)
 	if conf.PRINT_APP_MSG {
-		go io.Copy(out_writer, stdout)
-		go io.Copy(err_writer, stderr)
+		go func() {
+			io.Copy(out_writer, stdout)
+			copy_done <- true
+		}()
+		go func() {
+			io.Copy(err_writer, stderr)
+			copy_done <- true
+		}()
 	}
 
 	if err = cmd.Start(); err != nil {
@@ -970,6 +789,10 @@ func RunWorkunitDirect(workunit *core.Workunit) (pstats *core.WorkPerf, err erro
 	done := make(chan error)
 	memcheck_done := make(chan bool)
 	go func() {
+		if conf.PRINT_APP_MSG {
+			<-copy_done
+			<-copy_done
+		}
 		done <- cmd.Wait()
 		memcheck_done <- true
 	}()
@@ -1099,9 +922,17 @@ func runPreWorkExecutionScript(workunit *core.Workunit) (err error) {
 	err_writer := bufio.NewWriter(errfile)
 	defer err_writer.Flush()
 
+	// cmd.Wait closes the pipes, it has to wait until the output is copied
+	copy_done := make(chan bool, 2)
 	if conf.PRINT_APP_MSG {
-		go io.Copy(out_writer, stdout)
-		go io.Copy(err_writer, stderr)
+		go func() {
+			io.Copy(out_writer, stdout)
+			copy_done <- true
+		}()
+		go func() {
+			io.Copy(err_writer, stderr)
+			copy_done <- true
+		}()
 	}
 
 	if err := cmd.Start(); err != nil {
@@ -1159,7 +990,72 @@ func UnSetEnv(envkeys []string) {
 	}
 }
 
+// FetchRegistryCredentialByWorkId returns the credential of the clientgroup for a docker registry, nil if there is none
+func FetchRegistryCredentialByWorkId(workid string, registry string) (cred *core.RegistryCredential, err error) {
+	if Client_mode == "local" {
+		var work_id core.Workunit_Unique_Identifier
+		work_id, err = core.New_Workunit_Unique_Identifier_FromString(workid)
+		if err != nil {
+			err = fmt.Errorf("(FetchRegistryCredentialByWorkId) New_Workunit_Unique_Identifier_FromString returned: %s", err.Error())
+			return
+		}
+		return core.QMgr.FetchRegistryCredential(work_id, core.Self.Id, registry)
+	}
+
+	work_id_b64 := "base64:" + base64.StdEncoding.EncodeToString([]byte(workid))
+	targeturl := fmt.Sprintf("%s/work/%s?registryauth=%s&client=%s", conf.SERVER_URL, work_id_b64, url.QueryEscape(registry), core.Self.Id)
+	var headers httpclient.Header
+	if conf.CLIENT_GROUP_TOKEN != "" {
+		headers = httpclient.Header{
+			"Authorization": []string{"CG_TOKEN " + conf.CLIENT_GROUP_TOKEN},
+		}
+	}
+	res, err := httpclient.Get(targeturl, headers, nil)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("(FetchRegistryCredentialByWorkId) server returned %s", res.Status)
+		return
+	}
+
+	cred_map := map[string]string{}
+	if jsonstream := res.Header.Get("Registryauth"); jsonstream != "" {
+		err = json.Unmarshal([]byte(jsonstream), &cred_map)
+		if err != nil {
+			err = fmt.Errorf("(FetchRegistryCredentialByWorkId) json.Unmarshal returned: %s", err.Error())
+			return
+		}
+	}
+	if cred_map["username"] == "" {
+		return
+	}
+	cred = &core.RegistryCredential{Registry: cred_map["registry"], Username: cred_map["username"], Password: cred_map["password"]}
+	return
+}
+
+// FetchPrivateEnvByWorkId returns the private environment and the secret inputs of the workunit.
+// The values are redacted from logs and log files until the workunit has been delivered.
 func FetchPrivateEnvByWorkId(workid string) (envs map[string]string, err error) {
+	envs, err = fetchPrivateEnv(workid)
+	if err != nil {
+		return
+	}
+	workRedactions.Add(workid, envs)
+	return
+}
+
+func fetchPrivateEnv(workid string) (envs map[string]string, err error) {
+	if Client_mode == "local" {
+		var work_id core.Workunit_Unique_Identifier
+		work_id, err = core.New_Workunit_Unique_Identifier_FromString(workid)
+		if err != nil {
+			err = fmt.Errorf("(FetchPrivateEnvByWorkId) New_Workunit_Unique_Identifier_FromString returned: %s", err.Error())
+			return
+		}
+		return core.QMgr.FetchPrivateEnv(work_id, core.Self.Id)
+	}
 	targeturl := fmt.Sprintf("%s/work/%s?privateenv&client=%s", conf.SERVER_URL, workid, core.Self.Id)
 	var headers httpclient.Header
 	if conf.CLIENT_GROUP_TOKEN != "" {
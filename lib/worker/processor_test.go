@@ -0,0 +1,47 @@
+package worker
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestWrapperScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "awe-wrapper-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stdout_file := path.Join(dir, "awe_stdout.txt")
+	stderr_file := path.Join(dir, "awe_stderr.txt")
+	script := wrapperScript([]string{"echo out", "echo err >&2"}, stdout_file, stderr_file)
+
+	lines := strings.Split(script, "\n")
+	if len(lines) < 3 || lines[0] != "#!/bin/bash" || lines[1] != "exec 2> "+stderr_file+" 1> "+stdout_file {
+		t.Fatalf("the redirection has to come before the commands:\n%s", script)
+	}
+
+	if _, err = exec.LookPath("bash"); err != nil {
+		t.Skip("bash not found")
+	}
+	script_file := path.Join(dir, "awe_workunit_wrapper.sh")
+	if err = ioutil.WriteFile(script_file, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = exec.Command("bash", script_file).Run(); err != nil {
+		t.Fatal(err)
+	}
+	for filename, expected := range map[string]string{stdout_file: "out\n", stderr_file: "err\n"} {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("%s: got %q, expected %q", path.Base(filename), content, expected)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package worker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"github.com/MG-RAST/golib/httpclient"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetainedDir is the work directory of a failed workunit kept for post-mortem inspection
+type RetainedDir struct {
+	core.RetainedWorkDir
+	Path string
+}
+
+// RetainedDirs keeps failed work directories within the size (conf.KEEP_FAILED_MAX_MB)
+// and time (conf.KEEP_FAILED_HOURS) budget. The oldest directories are removed first.
+type RetainedDirs struct {
+	core.RWMutex
+	_map map[string]*RetainedDir
+}
+
+var retainedDirs = NewRetainedDirs()
+
+// file in a retained work directory that records the workunit, used to find the
+// directories again after a restart of the worker
+const retainedMarker = ".awe_retained.json"
+
+func NewRetainedDirs() (rd *RetainedDirs) {
+	rd = &RetainedDirs{_map: make(map[string]*RetainedDir)}
+	rd.RWMutex.Init("RetainedDirs")
+	return
+}
+
+// Add keeps a work directory and removes older ones if the budget is exceeded
+func (rd *RetainedDirs) Add(work_str string, work_path string) (err error) {
+	size, err := dirSize(work_path)
+	if err != nil {
+		err = fmt.Errorf("(RetainedDirs/Add) dirSize returned: %s", err.Error())
+		return
+	}
+
+	dir := &RetainedDir{RetainedWorkDir: core.RetainedWorkDir{WorkId: work_str, Size: size, Retained: time.Now()}, Path: work_path}
+	marker, err := json.Marshal(dir.RetainedWorkDir)
+	if err != nil {
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(work_path, retainedMarker), marker, 0644)
+	if err != nil {
+		err = fmt.Errorf("(RetainedDirs/Add) could not write %s: %s", retainedMarker, err.Error())
+		return
+	}
+
+	err = rd.LockNamed("RetainedDirs/Add")
+	if err != nil {
+		return
+	}
+	rd._map[work_str] = dir
+	rd.Unlock()
+
+	logger.Debug(1, "(RetainedDirs/Add) retaining work dir of failed workunit %s (%d bytes)", work_str, size)
+
+	err = rd.Expire()
+	return
+}
+
+// Load finds the directories retained before the worker was restarted, work directories
+// are conf.WORK_PATH/xx/xx/xx/<name>
+func (rd *RetainedDirs) Load() (err error) {
+	markers, err := filepath.Glob(filepath.Join(conf.WORK_PATH, "*", "*", "*", "*", retainedMarker))
+	if err != nil {
+		return
+	}
+	err = rd.LockNamed("RetainedDirs/Load")
+	if err != nil {
+		return
+	}
+	for _, marker := range markers {
+		var dir RetainedDir
+		data, xerr := ioutil.ReadFile(marker)
+		if xerr == nil {
+			xerr = json.Unmarshal(data, &dir.RetainedWorkDir)
+		}
+		if xerr != nil || dir.WorkId == "" {
+			logger.Warning("(RetainedDirs/Load) ignoring %s: invalid marker", marker)
+			continue
+		}
+		dir.Path = filepath.Dir(marker)
+		rd._map[dir.WorkId] = &dir
+	}
+	rd.Unlock()
+	logger.Debug(1, "(RetainedDirs/Load) found %d retained work dirs", len(markers))
+
+	err = rd.Expire()
+	return
+}
+
+// Expire removes directories that are too old or do not fit into the size budget
+func (rd *RetainedDirs) Expire() (err error) {
+	err = rd.LockNamed("RetainedDirs/Expire")
+	if err != nil {
+		return
+	}
+	defer rd.Unlock()
+
+	dirs := []*RetainedDir{}
+	for _, dir := range rd._map {
+		dirs = append(dirs, dir)
+	}
+	// newest first
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Retained.After(dirs[j].Retained) })
+
+	max_age := time.Duration(conf.KEEP_FAILED_HOURS) * time.Hour
+	max_bytes := int64(conf.KEEP_FAILED_MAX_MB) * 1024 * 1024
+	var total int64
+	for _, dir := range dirs {
+		total += dir.Size
+		if time.Since(dir.Retained) <= max_age && total <= max_bytes {
+			continue
+		}
+		logger.Debug(1, "(RetainedDirs/Expire) removing retained work dir %s", dir.Path)
+		total -= dir.Size
+		delete(rd._map, dir.WorkId)
+		if xerr := os.RemoveAll(dir.Path); xerr != nil {
+			logger.Error("(RetainedDirs/Expire) could not remove %s: %s", dir.Path, xerr.Error())
+		}
+	}
+	return
+}
+
+// Clear removes all retained directories
+func (rd *RetainedDirs) Clear() (err error) {
+	err = rd.LockNamed("RetainedDirs/Clear")
+	if err != nil {
+		return
+	}
+	defer rd.Unlock()
+
+	for work_str, dir := range rd._map {
+		delete(rd._map, work_str)
+		if xerr := os.RemoveAll(dir.Path); xerr != nil {
+			logger.Error("(RetainedDirs/Clear) could not remove %s: %s", dir.Path, xerr.Error())
+		}
+	}
+	return
+}
+
+func (rd *RetainedDirs) Get(work_str string) (dir *RetainedDir, ok bool, err error) {
+	read_lock, err := rd.RLockNamed("RetainedDirs/Get")
+	if err != nil {
+		return
+	}
+	defer rd.RUnlockNamed(read_lock)
+	dir, ok = rd._map[work_str]
+	return
+}
+
+// List returns the retained workunits, reported to the server in the heartbeat
+func (rd *RetainedDirs) List() (list []core.RetainedWorkDir, err error) {
+	read_lock, err := rd.RLockNamed("RetainedDirs/List")
+	if err != nil {
+		return
+	}
+	defer rd.RUnlockNamed(read_lock)
+	list = []core.RetainedWorkDir{}
+	for _, dir := range rd._map {
+		list = append(list, dir.RetainedWorkDir)
+	}
+	return
+}
+
+// ResolvePath maps a path relative to the work directory onto the file system. Files
+// outside of the work directory of the workunit are refused, including symlinks into the
+// data cache, which holds the data of other jobs as well.
+func (dir *RetainedDir) ResolvePath(rel_path string) (full_path string, err error) {
+	rel_path = filepath.Clean("/" + rel_path)
+	full_path = filepath.Join(dir.Path, rel_path)
+
+	real_path, err := filepath.EvalSymlinks(full_path)
+	if err != nil {
+		return
+	}
+	real_work_path, err := filepath.EvalSymlinks(dir.Path)
+	if err != nil {
+		return
+	}
+	if isSubPath(real_work_path, real_path) {
+		full_path = real_path
+		return
+	}
+	err = errors.New("path " + rel_path + " is outside of the work directory")
+	return
+}
+
+func isSubPath(parent string, child string) bool {
+	return child == parent || strings.HasPrefix(child, parent+string(filepath.Separator))
+}
+
+func dirSize(dir_path string) (size int64, err error) {
+	err = filepath.Walk(dir_path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// SendWorkFile answers a file request relayed by the server with the requested file,
+// the listing of the requested directory or an error message
+func SendWorkFile(req *core.FileRelayRequest) {
+	form := httpclient.NewForm()
+
+	file_type, file_path, err := prepareWorkFile(req)
+	if err != nil {
+		form.AddParam("error", err.Error())
+	} else {
+		form.AddParam("type", file_type)
+		form.AddFile("file", file_path)
+	}
+	if file_type == "listing" {
+		defer os.Remove(file_path)
+	}
+
+	err = form.Create()
+	if err != nil {
+		logger.Error("(SendWorkFile) form.Create returned: %s", err.Error())
+		return
+	}
+
+	work_id_b64 := "base64:" + base64.StdEncoding.EncodeToString([]byte(req.WorkId))
+	target_url := fmt.Sprintf("%s/work/%s?client=%s&filerelay=%s", conf.SERVER_URL, work_id_b64, core.Self.Id, req.Id)
+
+	headers := httpclient.Header{
+		"Content-Type":   []string{form.ContentType},
+		"Content-Length": []string{strconv.FormatInt(form.Length, 10)},
+	}
+	if conf.CLIENT_GROUP_TOKEN != "" {
+		headers["Authorization"] = []string{"CG_TOKEN " + conf.CLIENT_GROUP_TOKEN}
+	}
+
+	res, err := httpclient.Put(target_url, headers, form.Reader, nil)
+	if err != nil {
+		logger.Error("(SendWorkFile) httpclient.Put returned: %s", err.Error())
+		return
+	}
+	res.Body.Close()
+	return
+}
+
+// prepareWorkFile returns the requested file, or for directories a temporary file with the listing
+func prepareWorkFile(req *core.FileRelayRequest) (file_type string, file_path string, err error) {
+	dir, ok, err := retainedDirs.Get(req.WorkId)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = errors.New("work directory of " + req.WorkId + " is no longer retained")
+		return
+	}
+
+	file_path, err = dir.ResolvePath(req.Path)
+	if err != nil {
+		return
+	}
+	info, err := os.Stat(file_path)
+	if err != nil {
+		return
+	}
+	if !info.IsDir() {
+		file_type = "file"
+		return
+	}
+
+	listing := []core.WorkFileInfo{}
+	err = filepath.Walk(file_path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == file_path || info.Name() == retainedMarker {
+			return nil
+		}
+		rel, err := filepath.Rel(dir.Path, p)
+		if err != nil {
+			return err
+		}
+		listing = append(listing, core.WorkFileInfo{Path: rel, Size: info.Size(), IsDir: info.IsDir(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	listing_b, err := json.Marshal(listing)
+	if err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile("", "awe_listing_")
+	if err != nil {
+		return
+	}
+	defer tmp.Close()
+	_, err = tmp.Write(listing_b)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	file_type = "listing"
+	file_path = tmp.Name()
+	return
+}
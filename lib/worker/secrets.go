@@ -0,0 +1,210 @@
+package worker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/core/cwl"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"gopkg.in/yaml.v2"
+)
+
+// writeCWLJobInput writes cwl_job_input.yaml into the work directory. Secret inputs get the
+// values fetched from the server, without them they are redacted.
+func writeCWLJobInput(workunit *core.Workunit, secrets map[string]string) (err error) {
+	work_path, err := workunit.Path()
+	if err != nil {
+		return
+	}
+
+	job_input := workunit.CWL_workunit.Job_input
+	if job_input == nil {
+		err = fmt.Errorf("(writeCWLJobInput) Job_input is empty")
+		return
+	}
+
+	job_input_map := make(map[string]interface{})
+	for input_id, value := range job_input.GetMap() {
+		job_input_map[input_id] = value
+	}
+
+	mode := 0644
+	for _, input_id := range workunit.CWL_workunit.Secrets {
+		mode = 0600
+		if _, ok := job_input_map[input_id]; !ok {
+			continue
+		}
+		value, ok := secrets[input_id]
+		if !ok {
+			value = cwl.SECRET_REDACTED
+		}
+		job_input_map[input_id] = value
+	}
+
+	job_input_bytes, err := yaml.Marshal(job_input_map)
+	if err != nil {
+		return
+	}
+
+	err = ioutil.WriteFile(path.Join(work_path, "cwl_job_input.yaml"), job_input_bytes, os.FileMode(mode))
+	return
+}
+
+// fetchCWLSecrets gets the secret inputs of the workunit from the server and writes them into
+// cwl_job_input.yaml until releaseCWLSecrets is called.
+func fetchCWLSecrets(workunit *core.Workunit) (secrets map[string]string, err error) {
+	private_env, err := FetchPrivateEnvByWorkId(workunit.Id)
+	if err != nil {
+		err = fmt.Errorf("(fetchCWLSecrets) FetchPrivateEnvByWorkId returned: %s", err.Error())
+		return
+	}
+
+	secrets = make(map[string]string)
+	for _, input_id := range workunit.CWL_workunit.Secrets {
+		value, ok := private_env[input_id]
+		if !ok {
+			err = fmt.Errorf("(fetchCWLSecrets) server did not send secret input %s", input_id)
+			return
+		}
+		secrets[input_id] = value
+	}
+
+	err = writeCWLJobInput(workunit, secrets)
+	if err != nil {
+		releaseCWLSecrets(workunit, secrets)
+		err = fmt.Errorf("(fetchCWLSecrets) writeCWLJobInput returned: %s", err.Error())
+		return
+	}
+	return
+}
+
+// releaseCWLSecrets redacts cwl_job_input.yaml again after the tool has been executed
+func releaseCWLSecrets(workunit *core.Workunit, secrets map[string]string) {
+	err := writeCWLJobInput(workunit, nil)
+	if err != nil {
+		logger.Error("(releaseCWLSecrets) writeCWLJobInput returned: %s", err.Error())
+	}
+	return
+}
+
+// WorkRedactions holds the secret values of the workunits on the worker. They are redacted
+// from the log, the streamed stdout/stderr and the log files until the workunit is delivered.
+type WorkRedactions struct {
+	sync.Mutex
+	values map[string][]string
+}
+
+var workRedactions = &WorkRedactions{values: make(map[string][]string)}
+
+func (wr *WorkRedactions) Add(work_id string, secrets map[string]string) {
+	wr.Lock()
+	defer wr.Unlock()
+	for _, value := range secrets {
+		logger.AddRedaction(value)
+		wr.values[work_id] = append(wr.values[work_id], value)
+	}
+}
+
+func (wr *WorkRedactions) Release(work_id string) {
+	wr.Lock()
+	defer wr.Unlock()
+	for _, value := range wr.values[work_id] {
+		logger.RemoveRedaction(value)
+	}
+	delete(wr.values, work_id)
+}
+
+// redactWorkLogs redacts the stdout and stderr files in the work directory before they are uploaded
+func redactWorkLogs(workunit *core.Workunit) (err error) {
+	if !logger.HasRedactions() {
+		return
+	}
+	work_path, err := workunit.Path()
+	if err != nil {
+		return
+	}
+	for _, filename := range []string{conf.STDOUT_FILENAME, conf.STDERR_FILENAME} {
+		err = redactFile(path.Join(work_path, filename))
+		if err != nil {
+			err = fmt.Errorf("(redactWorkLogs) %s: %s", filename, err.Error())
+			return
+		}
+	}
+	return
+}
+
+// removeWorkLogs is the fallback if the logs can not be redacted, they are not uploaded then
+func removeWorkLogs(workunit *core.Workunit) {
+	work_path, err := workunit.Path()
+	if err != nil {
+		return
+	}
+	for _, filename := range []string{conf.STDOUT_FILENAME, conf.STDERR_FILENAME} {
+		err = os.Remove(path.Join(work_path, filename))
+		if err != nil && !os.IsNotExist(err) {
+			logger.Error("(removeWorkLogs) %s", err.Error())
+		}
+	}
+}
+
+func redactFile(file_path string) (err error) {
+	in, err := os.Open(file_path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return
+	}
+	out, err := ioutil.TempFile(path.Dir(file_path), path.Base(file_path)+".redact")
+	if err != nil {
+		return
+	}
+	defer os.Remove(out.Name()) // fails after the rename
+
+	buffer := make([]byte, 65536)
+	var pending []byte
+	for {
+		n, read_err := in.Read(buffer)
+		pending = append(pending, buffer[:n]...)
+		final := read_err == io.EOF
+		if read_err != nil && !final {
+			out.Close()
+			err = read_err
+			return
+		}
+		redacted, consumed := logger.RedactStream(pending, final)
+		_, err = out.Write(redacted)
+		if err != nil {
+			out.Close()
+			return
+		}
+		pending = pending[consumed:]
+		if final {
+			break
+		}
+	}
+
+	err = out.Chmod(info.Mode())
+	if err != nil {
+		out.Close()
+		return
+	}
+	err = out.Close()
+	if err != nil {
+		return
+	}
+	err = os.Rename(out.Name(), file_path)
+	return
+}
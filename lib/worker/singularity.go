@@ -0,0 +1,387 @@
+package worker
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/MG-RAST/AWE/lib/conf"
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/logger"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+var sifNameRegexp = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// SingularityRuntime runs containers with singularity or apptainer. Docker images are converted
+// into SIF files in conf.SINGULARITY_IMAGE_DIR. There is no daemon, a container is the
+// "exec" process started by the worker, Create only records the spec.
+type SingularityRuntime struct {
+	core.RWMutex
+	name      string // "singularity" or "apptainer"
+	binary    string
+	image_dir string
+	specs     map[string]*ContainerSpec
+	processes map[string]*exec.Cmd
+	statuses  map[string]int // exit status of exited containers
+	killed    map[string]bool
+}
+
+func NewSingularityRuntime(name string) *SingularityRuntime {
+	s := &SingularityRuntime{
+		name:      name,
+		binary:    conf.SINGULARITY_BINARY,
+		image_dir: conf.SINGULARITY_IMAGE_DIR,
+		specs:     make(map[string]*ContainerSpec),
+		processes: make(map[string]*exec.Cmd),
+		statuses:  make(map[string]int),
+		killed:    make(map[string]bool),
+	}
+	if s.binary == "" {
+		s.binary = name
+	}
+	if s.image_dir == "" {
+		s.image_dir = path.Join(conf.DATA_PATH, "sif")
+	}
+	s.RWMutex.Init("SingularityRuntime")
+	return s
+}
+
+func (s *SingularityRuntime) Name() string { return s.name }
+
+// Supports: images cannot be built from Dockerfiles or imported from container exports
+func (s *SingularityRuntime) Supports(source string) bool {
+	switch source {
+	case IMAGE_SOURCE_PULL, IMAGE_SOURCE_LOAD, IMAGE_SOURCE_IMAGE_ID:
+		return true
+	}
+	return false
+}
+
+// envPrefix is the prefix of the environment variables read by the binary, e.g. SINGULARITYENV_
+func (s *SingularityRuntime) envPrefix() string {
+	return strings.ToUpper(s.name)
+}
+
+func (s *SingularityRuntime) sifFile(image string) string {
+	return path.Join(s.image_dir, sifNameRegexp.ReplaceAllString(image, "_")+".sif")
+}
+
+// InspectImage returns the image name if the SIF file exists, the name is the id of the image
+func (s *SingularityRuntime) InspectImage(image string) (id string, err error) {
+	_, err = os.Stat(s.sifFile(image))
+	if err != nil {
+		return
+	}
+	id = image
+	return
+}
+
+// build converts the source (e.g. docker://ubuntu:18.04) into the SIF file of the image,
+// into a temporary file first so that an interrupted build does not leave a broken image
+func (s *SingularityRuntime) build(image string, source string, env []string) (err error) {
+	err = os.MkdirAll(s.image_dir, 0755)
+	if err != nil {
+		return
+	}
+	sif_file := s.sifFile(image)
+	tmp_file := sif_file + ".tmp"
+	defer os.Remove(tmp_file)
+
+	logger.Debug(1, "(SingularityRuntime) building %s from %s", sif_file, source)
+	cmd := exec.Command(s.binary, "build", "--force", tmp_file, source)
+	cmd.Env = append(os.Environ(), env...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("%s build returned: %s (%s)", s.binary, err.Error(), strings.TrimSpace(string(output)))
+		return
+	}
+	err = os.Rename(tmp_file, sif_file)
+	return
+}
+
+func (s *SingularityRuntime) PullImage(ref *core.DockerImageRef, cred *core.RegistryCredential) (err error) {
+	var env []string
+	if cred != nil {
+		env = []string{
+			s.envPrefix() + "_DOCKER_USERNAME=" + cred.Username,
+			s.envPrefix() + "_DOCKER_PASSWORD=" + cred.Password,
+		}
+	}
+	source := "docker://" + ref.Registry + "/" + ref.Repository
+	if ref.Digest != "" {
+		source += "@" + ref.Digest
+	} else {
+		source += ":" + ref.Tag
+	}
+	err = s.build(ref.String(), source, env)
+	return
+}
+
+func (s *SingularityRuntime) LoadImage(image string, archive io.Reader) (err error) {
+	archive_file, err := ioutil.TempFile("", "awe_docker_archive_")
+	if err != nil {
+		return
+	}
+	defer os.Remove(archive_file.Name())
+
+	_, err = io.Copy(archive_file, archive)
+	archive_file.Close()
+	if err != nil {
+		return
+	}
+	err = s.build(image, "docker-archive://"+archive_file.Name(), nil)
+	return
+}
+
+func (s *SingularityRuntime) Create(spec *ContainerSpec) (id string, err error) {
+	if _, err = s.InspectImage(spec.Image); err != nil {
+		err = fmt.Errorf("(SingularityRuntime) image %s not found: %s", spec.Image, err.Error())
+		return
+	}
+	err = s.LockNamed("SingularityRuntime/Create")
+	if err != nil {
+		return
+	}
+	defer s.Unlock()
+	id = spec.Name
+	s.specs[id] = spec
+	return
+}
+
+func (s *SingularityRuntime) Start(id string) (err error) {
+	err = s.LockNamed("SingularityRuntime/Start")
+	if err != nil {
+		return
+	}
+	defer s.Unlock()
+
+	spec, ok := s.specs[id]
+	if !ok {
+		err = fmt.Errorf("(SingularityRuntime) container %s not found", id)
+		return
+	}
+
+	args := []string{"exec", "--containall", "--cleanenv", "--pwd", spec.WorkDir}
+	args = append(args, s.limitArgs(spec)...)
+	for _, mount := range spec.Mounts {
+		bind := mount.Source + ":" + mount.Target
+		if mount.ReadOnly {
+			bind += ":ro"
+		}
+		args = append(args, "--bind", bind)
+	}
+	args = append(args, s.sifFile(spec.Image))
+	args = append(args, spec.Cmd...)
+
+	cmd := exec.Command(s.binary, args...)
+	// variables with the prefix are passed into the container despite --cleanenv
+	cmd.Env = os.Environ()
+	for _, env_pair := range spec.Env {
+		cmd.Env = append(cmd.Env, s.envPrefix()+"ENV_"+env_pair)
+	}
+	// own process group, to kill the processes in the container as well
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	logger.Debug(1, "(SingularityRuntime) cmd: %s %s", s.binary, strings.Join(args, " "))
+	err = cmd.Start()
+	if err != nil {
+		return
+	}
+	s.processes[id] = cmd
+	return
+}
+
+// limitArgs returns the resource and network options, limits need cgroups support
+// (singularity 3.10, apptainer 1.1). The size of /tmp is not limited.
+func (s *SingularityRuntime) limitArgs(spec *ContainerSpec) (args []string) {
+	if !spec.NetworkAccess {
+		// a network namespace of type none can only be requested by root
+		if os.Geteuid() == 0 {
+			args = append(args, "--net", "--network", "none")
+		} else {
+			logger.Warning("(SingularityRuntime) container %s has network access, disabling it requires root", spec.Name)
+		}
+	}
+	res := spec.Resources
+	if res == nil {
+		return
+	}
+	if res.Cores > 0 {
+		args = append(args, "--cpus", strconv.FormatFloat(res.Cores, 'f', -1, 64))
+	}
+	if res.Cpuset != "" {
+		args = append(args, "--cpuset-cpus", res.Cpuset)
+	}
+	if res.RamMB > 0 {
+		args = append(args, "--memory", fmt.Sprintf("%dm", res.RamMB))
+		if res.SwapMB < 0 {
+			args = append(args, "--memory-swap", "-1")
+		} else {
+			args = append(args, "--memory-swap", fmt.Sprintf("%dm", res.RamMB+res.SwapMB))
+		}
+	}
+	if res.Pids > 0 {
+		args = append(args, "--pids-limit", strconv.FormatInt(res.Pids, 10))
+	}
+	return
+}
+
+func (s *SingularityRuntime) process(id string) (cmd *exec.Cmd, err error) {
+	read_lock, err := s.RLockNamed("SingularityRuntime/process")
+	if err != nil {
+		return
+	}
+	defer s.RUnlockNamed(read_lock)
+	cmd, ok := s.processes[id]
+	if !ok {
+		err = fmt.Errorf("(SingularityRuntime) container %s is not running", id)
+	}
+	return
+}
+
+func (s *SingularityRuntime) Wait(id string) (status int, err error) {
+	cmd, err := s.process(id)
+	if err != nil {
+		return
+	}
+	err = cmd.Wait()
+	if err == nil {
+		return
+	}
+	if exiterr, ok := err.(*exec.ExitError); ok {
+		if wait_status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
+			status = wait_status.ExitStatus()
+			if wait_status.Signaled() {
+				status = 128 + int(wait_status.Signal())
+			}
+			err = nil
+		}
+	}
+	if err == nil {
+		if xerr := s.LockNamed("SingularityRuntime/Wait"); xerr == nil {
+			s.statuses[id] = status
+			s.Unlock()
+		}
+	}
+	return
+}
+
+// OOMKilled: the OOM killer sends SIGKILL, the runtime does not report the reason. A container
+// with memory limit that was killed by SIGKILL (status 137) and not by Kill is assumed to be OOM killed.
+func (s *SingularityRuntime) OOMKilled(id string) bool {
+	read_lock, err := s.RLockNamed("SingularityRuntime/OOMKilled")
+	if err != nil {
+		return false
+	}
+	defer s.RUnlockNamed(read_lock)
+	spec, ok := s.specs[id]
+	if !ok || spec.Resources == nil || spec.Resources.RamMB <= 0 {
+		return false
+	}
+	status, ok := s.statuses[id]
+	return ok && status == 137 && !s.killed[id]
+}
+
+func (s *SingularityRuntime) Kill(id string) (err error) {
+	cmd, err := s.process(id)
+	if err != nil {
+		return
+	}
+	err = s.LockNamed("SingularityRuntime/Kill")
+	if err != nil {
+		return
+	}
+	s.killed[id] = true
+	s.Unlock()
+	err = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	return
+}
+
+func (s *SingularityRuntime) Remove(name string) (err error) {
+	err = s.LockNamed("SingularityRuntime/Remove")
+	if err != nil {
+		return
+	}
+	defer s.Unlock()
+	delete(s.specs, name)
+	delete(s.processes, name)
+	delete(s.statuses, name)
+	delete(s.killed, name)
+	return
+}
+
+// Stats sums the memory usage of the processes in the container, they are not in a cgroup of their own
+func (s *SingularityRuntime) Stats(id string) (stats *ContainerStats, err error) {
+	cmd, err := s.process(id)
+	if err != nil {
+		return
+	}
+	return processTreeMemory(cmd.Process.Pid)
+}
+
+// processTreeMemory sums VmRSS and VmSwap of the process and all its descendants
+func processTreeMemory(pid int) (stats *ContainerStats, err error) {
+	proc_dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+	children := make(map[int][]int)
+	for _, dir := range proc_dirs {
+		child, xerr := strconv.Atoi(dir.Name())
+		if xerr != nil {
+			continue
+		}
+		stat, xerr := ioutil.ReadFile(path.Join("/proc", dir.Name(), "stat"))
+		if xerr != nil {
+			continue
+		}
+		// pid (comm) state ppid ..., comm may contain spaces
+		fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, xerr := strconv.Atoi(fields[1])
+		if xerr != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], child)
+	}
+
+	stats = &ContainerStats{}
+	queue := []int{pid}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = append(queue[1:], children[current]...)
+
+		file, xerr := os.Open(fmt.Sprintf("/proc/%d/status", current))
+		if xerr != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 2 {
+				continue
+			}
+			value, xerr := strconv.ParseInt(fields[1], 10, 64)
+			if xerr != nil {
+				continue
+			}
+			switch fields[0] {
+			case "VmRSS:":
+				stats.MemoryRss += value * 1024
+			case "VmSwap:":
+				stats.MemorySwap += value * 1024
+			}
+		}
+		file.Close()
+	}
+	return
+}
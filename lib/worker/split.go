@@ -0,0 +1,297 @@
+package worker
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/MG-RAST/AWE/lib/core"
+	"github.com/MG-RAST/AWE/lib/core/cwl"
+	"github.com/MG-RAST/AWE/lib/logger"
+)
+
+// RunSplitWorkunit executes the split or merge workunit of a step with a SplitRequirement.
+// Chunk and merged files are written into the work directory and reported as outputs,
+// they are uploaded like any other tool output.
+func RunSplitWorkunit(workunit *core.Workunit) (err error) {
+	work_path, err := workunit.Path()
+	if err != nil {
+		return
+	}
+
+	split := workunit.CWL_workunit.Split
+	if workunit.CWL_workunit.Job_input == nil {
+		err = fmt.Errorf("(RunSplitWorkunit) Job_input is empty")
+		return
+	}
+	job_input_map := workunit.CWL_workunit.Job_input.GetMap()
+
+	outputs := cwl.Job_document{}
+
+	switch split.Phase {
+	case core.SPLIT_PHASE_SPLIT:
+		input_generic, ok := job_input_map[split.Input]
+		if !ok {
+			err = fmt.Errorf("(RunSplitWorkunit) input %s not found", split.Input)
+			return
+		}
+		input, ok := input_generic.(*cwl.File)
+		if !ok {
+			err = fmt.Errorf("(RunSplitWorkunit) input %s is not a File", split.Input)
+			return
+		}
+
+		var chunks cwl.Array
+		chunks, err = splitFile(input.Path, work_path, split)
+		if err != nil {
+			err = fmt.Errorf("(RunSplitWorkunit) splitFile returned: %s", err.Error())
+			return
+		}
+		logger.Debug(1, "(RunSplitWorkunit) split %s into %d chunks", input.Path, len(chunks))
+		outputs = append(outputs, cwl.NewNamedCWLType(core.SPLIT_CHUNKS_OUTPUT, &chunks))
+
+	case core.SPLIT_PHASE_MERGE:
+		used := make(map[string]bool)
+		for output_id := range split.Merge {
+			parts_generic, ok := job_input_map[output_id]
+			if !ok {
+				err = fmt.Errorf("(RunSplitWorkunit) parts of output %s not found", output_id)
+				return
+			}
+			parts, ok := parts_generic.(*cwl.Array)
+			if !ok || len(*parts) == 0 {
+				err = fmt.Errorf("(RunSplitWorkunit) parts of output %s are not a non-empty array", output_id)
+				return
+			}
+
+			var part_paths []string
+			for _, part_generic := range *parts {
+				part, ok := part_generic.(*cwl.File)
+				if !ok {
+					err = fmt.Errorf("(RunSplitWorkunit) part of output %s is not a File", output_id)
+					return
+				}
+				part_paths = append(part_paths, part.Path)
+			}
+
+			// the parts were downloaded as <basename>.part<rank>
+			first := (*parts)[0].(*cwl.File)
+			basename := strings.TrimSuffix(first.Basename, path.Ext(first.Basename))
+			if used[basename] {
+				basename = output_id + "_" + basename
+			}
+			used[basename] = true
+
+			var merged *cwl.File
+			merged, err = concatenateFiles(part_paths, path.Join(work_path, basename))
+			if err != nil {
+				err = fmt.Errorf("(RunSplitWorkunit) concatenateFiles returned: %s", err.Error())
+				return
+			}
+			merged.Format = first.Format
+			outputs = append(outputs, cwl.NewNamedCWLType(output_id, merged))
+		}
+
+	default:
+		err = fmt.Errorf("(RunSplitWorkunit) unknown phase %s", split.Phase)
+		return
+	}
+
+	workunit.CWL_workunit.Outputs = &outputs
+	return
+}
+
+func newLocalFile(file_path string) (file *cwl.File) {
+	file = &cwl.File{}
+	file.Class = string(cwl.CWL_File)
+	file.Type = cwl.CWL_File
+	file.Path = file_path
+	file.Basename = path.Base(file_path)
+	return
+}
+
+// recordSplitter writes records into chunk files and starts a new chunk at a record boundary
+// once the current chunk has enough records or bytes
+type recordSplitter struct {
+	split    *core.SplitWork
+	dir      string
+	nameroot string
+	nameext  string
+
+	chunks        cwl.Array
+	file          *os.File
+	writer        *bufio.Writer
+	chunk_records int
+	chunk_bytes   int64
+}
+
+func (rs *recordSplitter) full() bool {
+	if rs.split.Records > 0 {
+		return rs.chunk_records >= rs.split.Records
+	}
+	return rs.chunk_bytes >= int64(rs.split.SizeMB)*1024*1024
+}
+
+func (rs *recordSplitter) closeChunk() (err error) {
+	if rs.file == nil {
+		return
+	}
+	err = rs.writer.Flush()
+	if err != nil {
+		return
+	}
+	err = rs.file.Close()
+	rs.file = nil
+	return
+}
+
+func (rs *recordSplitter) openChunk() (err error) {
+	chunk_path := path.Join(rs.dir, fmt.Sprintf("%s.%05d%s", rs.nameroot, len(rs.chunks)+1, rs.nameext))
+	rs.file, err = os.Create(chunk_path)
+	if err != nil {
+		return
+	}
+	rs.writer = bufio.NewWriter(rs.file)
+	rs.chunk_records = 0
+	rs.chunk_bytes = 0
+	rs.chunks = append(rs.chunks, newLocalFile(chunk_path))
+	return
+}
+
+// write adds a line, record_start tells if the line is the first line of a record
+func (rs *recordSplitter) write(line []byte, record_start bool) (err error) {
+	if record_start && rs.file != nil && rs.full() {
+		err = rs.closeChunk()
+		if err != nil {
+			return
+		}
+	}
+	if rs.file == nil {
+		err = rs.openChunk()
+		if err != nil {
+			return
+		}
+	}
+	if record_start {
+		rs.chunk_records++
+	}
+	_, err = rs.writer.Write(line)
+	rs.chunk_bytes += int64(len(line))
+	return
+}
+
+// splitFile splits a FASTA, FASTQ or line-based text file (optionally gzip compressed)
+// into chunks of whole records. Chunks are not compressed.
+func splitFile(input_path string, dir string, split *core.SplitWork) (chunks cwl.Array, err error) {
+	input, err := os.Open(input_path)
+	if err != nil {
+		return
+	}
+	defer input.Close()
+
+	reader := bufio.NewReader(input)
+
+	basename := path.Base(input_path)
+	magic, _ := reader.Peek(2)
+	if len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		var gz *gzip.Reader
+		gz, err = gzip.NewReader(reader)
+		if err != nil {
+			return
+		}
+		defer gz.Close()
+		reader = bufio.NewReader(gz)
+		basename = strings.TrimSuffix(basename, ".gz")
+	}
+
+	nameext := path.Ext(basename)
+	rs := &recordSplitter{
+		split:    split,
+		dir:      dir,
+		nameroot: strings.TrimSuffix(basename, nameext),
+		nameext:  nameext,
+	}
+	defer rs.closeChunk()
+
+	line_number := 0
+	for {
+		line, rerr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			record_start := false
+			switch split.Format {
+			case cwl.SPLIT_FORMAT_LINES:
+				record_start = true
+			case cwl.SPLIT_FORMAT_FASTA:
+				record_start = line[0] == '>'
+			case cwl.SPLIT_FORMAT_FASTQ:
+				record_start = line_number%4 == 0
+				if record_start && line[0] != '@' {
+					err = fmt.Errorf("line %d is not a FASTQ header", line_number+1)
+					return
+				}
+			default:
+				err = fmt.Errorf("format %s not supported", split.Format)
+				return
+			}
+
+			err = rs.write(line, record_start)
+			if err != nil {
+				return
+			}
+			line_number++
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			err = rerr
+			return
+		}
+	}
+
+	if split.Format == cwl.SPLIT_FORMAT_FASTQ && line_number%4 != 0 {
+		err = fmt.Errorf("FASTQ file ends with an incomplete record (%d lines)", line_number)
+		return
+	}
+
+	err = rs.closeChunk()
+	if err != nil {
+		return
+	}
+	chunks = rs.chunks
+	return
+}
+
+// concatenateFiles writes the parts in order into a new file
+func concatenateFiles(part_paths []string, merged_path string) (merged *cwl.File, err error) {
+	out, err := os.Create(merged_path)
+	if err != nil {
+		return
+	}
+	defer out.Close()
+
+	for _, part_path := range part_paths {
+		var part *os.File
+		part, err = os.Open(part_path)
+		if err != nil {
+			return
+		}
+		_, err = io.Copy(out, part)
+		part.Close()
+		if err != nil {
+			err = fmt.Errorf("copying %s failed: %s", part_path, err.Error())
+			return
+		}
+	}
+
+	err = out.Close()
+	if err != nil {
+		return
+	}
+	merged = newLocalFile(merged_path)
+	return
+}
@@ -0,0 +1,48 @@
+package worker
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/MG-RAST/AWE/lib/core"
+)
+
+// WorkPerfMap holds the WorkPerf of the workunits on the worker. Their transfer counters
+// are updated while data is moved and sent to the server with every heartbeat.
+type WorkPerfMap struct {
+	sync.Mutex
+	perfs map[string]*core.WorkPerf
+}
+
+var workPerfs = &WorkPerfMap{perfs: make(map[string]*core.WorkPerf)}
+
+func (wm *WorkPerfMap) Set(work_id string, perf *core.WorkPerf) {
+	wm.Lock()
+	defer wm.Unlock()
+	wm.perfs[work_id] = perf
+}
+
+func (wm *WorkPerfMap) Delete(work_id string) {
+	wm.Lock()
+	defer wm.Unlock()
+	delete(wm.perfs, work_id)
+}
+
+// Transfers returns the current transfer counters, sorted by workunit
+func (wm *WorkPerfMap) Transfers() (transfers []core.WorkTransfer) {
+	wm.Lock()
+	defer wm.Unlock()
+	transfers = []core.WorkTransfer{}
+	for work_id, perf := range wm.perfs {
+		transfers = append(transfers, core.WorkTransfer{
+			WorkId:          work_id,
+			InFileMoved:     atomic.LoadInt64(&perf.InFileMoved),
+			OutFileMoved:    atomic.LoadInt64(&perf.OutFileMoved),
+			ResumedSize:     atomic.LoadInt64(&perf.ResumedSize),
+			TransferRetries: atomic.LoadInt64(&perf.TransferRetries),
+		})
+	}
+	sort.Slice(transfers, func(i, j int) bool { return transfers[i].WorkId < transfers[j].WorkId })
+	return
+}
@@ -2,7 +2,7 @@ package worker
 
 import (
 	"encoding/json"
-	//"errors"
+	"errors"
 	"fmt"
 
 	"github.com/MG-RAST/AWE/lib/conf"
@@ -22,6 +22,9 @@ import (
 	"github.com/mitchellh/mapstructure"
 )
 
+// CWL workunits are run by cwl-runner in the work directory of the workunit
+var cwlRunner = "/usr/bin/cwl-runner"
+
 type WorkResponse struct {
 	core.BaseResponse `bson:",inline" json:",inline" mapstructure:",squash"`
 	Data              *core.Workunit `bson:"data" json:"data" mapstructure:"data"`
@@ -39,12 +42,30 @@ func workStealerRun(control chan int, retry_previous int) (retry int, err error)
 	if core.Service == "proxy" {
 		<-core.ProxyWorkChan
 	}
-	workunit, err := CheckoutWorkunitRemote()
+
+	// while workunits are in the pipeline, the next one is prefetched
+	prefetch := false
+	if prefetchDepth() > 0 {
+		in_progress, _ := workmap.GetKeys()
+		prefetch = len(in_progress) > 0
+	}
+
+	var workunit *core.Workunit
+	if Client_mode == "local" {
+		workunit, err = CheckoutWorkunitLocal()
+	} else {
+		workunit, err = CheckoutWorkunitRemote(prefetch)
+	}
 	if err != nil {
-		core.Self.Busy = false
+		if !prefetch {
+			core.Self.Busy = false
+		}
 		if err.Error() == e.QueueEmpty || err.Error() == e.QueueSuspend || err.Error() == e.NoEligibleWorkunitFound {
 			//normal, do nothing
 			logger.Debug(3, "(workStealer) client %s received status %s from server %s", core.Self.Id, err.Error(), conf.SERVER_URL)
+		} else if err.Error() == e.ClientBusy && prefetch {
+			// server does not allow more prefetched workunits (max_prefetch)
+			logger.Debug(3, "(workStealer) client %s may not prefetch more workunits", core.Self.Id)
 		} else if err.Error() == e.ClientBusy {
 			// client asked for work, but server has not finished processing its last delivered work
 			logger.Error("(workStealer) server responds: last work delivered by client not yet processed, retry=%d", retry)
@@ -69,7 +90,9 @@ func workStealerRun(control chan int, retry_previous int) (retry int, err error)
 			logger.Error("(workStealer) checking out workunit: %s, retry=%d", err.Error(), retry)
 			retry += 1
 		}
-		if core.Service != "proxy" { //proxy: event driven, client: timer driven
+		if core.Service == "local" {
+			time.Sleep(time.Second)
+		} else if core.Service != "proxy" { //proxy: event driven, client: timer driven
 			if retry <= 10 {
 				logger.Debug(3, "(workStealer) sleep 10 seconds")
 				time.Sleep(10 * time.Second)
@@ -94,7 +117,13 @@ func workStealerRun(control chan int, retry_previous int) (retry int, err error)
 	//log event about work checktout (WC)
 	logger.Event(event.WORK_CHECKOUT, "workid="+work_str)
 
-	err = core.Self.Current_work.Add(work_id)
+	if prefetch {
+		// becomes current work when the processor starts it
+		logger.Debug(1, "(workStealer) prefetched workunit, id=%s", work_str)
+		err = core.Self.Prefetched_work.Add(work_id)
+	} else {
+		err = core.Self.Current_work.Add(work_id)
+	}
 	if err != nil {
 		logger.Error("(workStealer) error: %s", err.Error())
 		return
@@ -110,11 +139,13 @@ func workStealerRun(control chan int, retry_previous int) (retry int, err error)
 	//	Perfstat: workstat,
 	//}
 	workunit.WorkPerf = workstat
+	workPerfs.Set(work_str, workstat)
 
 	// make sure cwl-runner is invoked
 	if workunit.CWL_workunit != nil {
-		workunit.Cmd.Name = "/usr/bin/cwl-runner"
+		workunit.Cmd.Name = cwlRunner
 		workunit.Cmd.ArgsArray = []string{"--leave-outputs", "--leave-tmpdir", "--tmp-outdir-prefix", "./tmp/", "--tmpdir-prefix", "./tmp/", "--disable-pull", "--rm-container", "--on-error", "stop", "./cwl_tool.yaml", "./cwl_job_input.yaml"}
+		workunit.Cmd.ArgsArray = append(CWLRunnerContainerArgs(), workunit.Cmd.ArgsArray...)
 
 	}
 
@@ -147,7 +178,8 @@ func workStealer(control chan int) {
 	control <- ID_WORKSTEALER //we are ending
 }
 
-func CheckoutWorkunitRemote() (workunit *core.Workunit, err error) {
+// with prefetch the workunit is checked out in advance, while the client computes another one
+func CheckoutWorkunitRemote(prefetch bool) (workunit *core.Workunit, err error) {
 	logger.Debug(3, "(CheckoutWorkunitRemote) start")
 	// get available work dir disk space
 	var stat syscall.Statfs_t
@@ -159,6 +191,9 @@ func CheckoutWorkunitRemote() (workunit *core.Workunit, err error) {
 		return
 	}
 	targeturl := fmt.Sprintf("%s/work?client=%s&available=%d", conf.SERVER_URL, core.Self.Id, availableBytes)
+	if prefetch {
+		targeturl += "&prefetch"
+	}
 
 	var headers httpclient.Header
 	if conf.CLIENT_GROUP_TOKEN != "" {
@@ -207,10 +242,143 @@ func CheckoutWorkunitRemote() (workunit *core.Workunit, err error) {
 		return
 	}
 
+	workunit, err = decodeWorkunit(data_generic)
+	if err != nil {
+		err = fmt.Errorf("(CheckoutWorkunitRemote) decodeWorkunit returned: %s", err.Error())
+		return
+	}
+	if workunit.State == core.WORK_STAT_ERROR {
+		// Pass error-workunit along to maintain error message
+		return
+	}
+
+	//test, err := json.Marshal(workunit)
+	//if err != nil {
+	//	panic("did not work")
+	//}
+	//fmt.Println("workunit: ")
+	//fmt.Printf("workunit:\n %s\n", test)
+
+	//panic("done...")
+
+	if response.Status == 0 { // this is ugly
+		err = fmt.Errorf(e.ServerNotFound)
+		return
+	}
+
+	if response.Status != 200 {
+		err = fmt.Errorf("(CheckoutWorkunitRemote) response_generic.Status != 200 : %d", response.Status)
+		return
+	}
+
+	if workunit.TaskName == "" {
+		err = fmt.Errorf("(CheckoutWorkunitRemote) TaskName empty !")
+		return
+	}
+	logger.Debug(3, "(CheckoutWorkunitRemote) TaskName: %s", workunit.TaskName)
+
+	//workunit = response.Data
+
+	if workunit.Info.Auth == true {
+		token, xerr := FetchDataTokenByWorkId(workunit.Id)
+		if xerr == nil && token != "" {
+			workunit.Info.DataToken = token
+		} else {
+			err = fmt.Errorf("(CheckoutWorkunitRemote) need data token but failed to fetch one %s", xerr.Error())
+			return
+		}
+	}
+
+	logger.Debug(3, "(CheckoutWorkunitRemote) workunit id: %s", workunit.Id)
+
+	logger.Debug(3, "(CheckoutWorkunitRemote) workunit Rank:%d TaskId:%s JobId:%s", workunit.Rank, workunit.TaskName, workunit.JobId)
+
+	logger.Debug(3, fmt.Sprintf("(CheckoutWorkunitRemote) client %s got a workunit", core.Self.Id))
+	workunit.State = core.WORK_STAT_CHECKOUT
+	core.Self.Busy = true
+	return
+}
+
+// CheckoutWorkunitLocal checks out a workunit from the in-process server of the local runner
+func CheckoutWorkunitLocal() (workunit *core.Workunit, err error) {
+	logger.Debug(3, "(CheckoutWorkunitLocal) start")
+
+	if core.Self == nil {
+		err = fmt.Errorf("(CheckoutWorkunitLocal) core.Self == nil")
+		return
+	}
+
+	client, ok, err := core.QMgr.GetClient(core.Self.Id, true)
+	if err != nil {
+		return
+	}
+	if !ok {
+		err = errors.New(e.ClientNotFound)
+		return
+	}
+
+	workunits, err := core.QMgr.CheckoutWorkunits("FCFS", core.Self.Id, client, -1, 1, false)
+	if err != nil {
+		// the caller compares the plain error messages
+		err_str := err.Error()
+		for _, known := range []string{e.QueueEmpty, e.QueueSuspend, e.NoEligibleWorkunitFound, e.ClientBusy} {
+			if strings.Contains(err_str, known) {
+				err = errors.New(known)
+				break
+			}
+		}
+		return
+	}
+	if len(workunits) == 0 {
+		err = errors.New(e.NoEligibleWorkunitFound)
+		return
+	}
+
+	server_workunit := workunits[0]
+	server_workunit.State = core.WORK_STAT_RESERVED
+	server_workunit.Client = core.Self.Id
+
+	// the worker gets its own copy, as the remote worker does
+	workunit_byte, err := json.Marshal(server_workunit)
+	if err != nil {
+		err = fmt.Errorf("(CheckoutWorkunitLocal) json.Marshal returned: %s", err.Error())
+		return
+	}
+	var data_generic interface{}
+	err = json.Unmarshal(workunit_byte, &data_generic)
+	if err != nil {
+		err = fmt.Errorf("(CheckoutWorkunitLocal) json.Unmarshal returned: %s", err.Error())
+		return
+	}
+
+	workunit, err = decodeWorkunit(data_generic)
+	if err != nil {
+		err = fmt.Errorf("(CheckoutWorkunitLocal) decodeWorkunit returned: %s", err.Error())
+		return
+	}
+	if workunit.State == core.WORK_STAT_ERROR {
+		return
+	}
+	if workunit.CWL_workunit == nil {
+		err = fmt.Errorf("(CheckoutWorkunitLocal) local runner supports CWL workunits only")
+		return
+	}
+
+	// outputs are not uploaded, they stay in the work directory
+	workunit.Cmd.Local = true
+
+	logger.Debug(3, "(CheckoutWorkunitLocal) workunit id: %s", workunit.Id)
+	workunit.State = core.WORK_STAT_CHECKOUT
+	core.Self.Busy = true
+	return
+}
+
+// decodeWorkunit converts the generic (json) representation of a workunit, including the CWL part
+func decodeWorkunit(data_generic interface{}) (workunit *core.Workunit, err error) {
 	// remove CWL
 	data_map, ok := data_generic.(map[string]interface{})
 	if !ok {
-		err = fmt.Errorf("(CheckoutWorkunitRemote) Could not make data field map[string]interface{}")
+		err = fmt.Errorf("(decodeWorkunit) Could not make data field map[string]interface{}")
 		return
 	}
 	var cwl_object *core.CWL_workunit
@@ -295,7 +463,7 @@ func CheckoutWorkunitRemote() (workunit *core.Workunit, err error) {
 	//if has_checkout_time {
 	//	workunit_checkout_time_str, ok := workunit_checkout_time_if.(string)
 	//	if !ok {
-	//		err = fmt.Errorf("(CheckoutWorkunitRemote) cannot type assert checkout_time")
+	//		err = fmt.Errorf("(decodeWorkunit) cannot type assert checkout_time")
 	//		return
 	//	}
 	//	workunit.CheckoutTime = workunit_checkout_time
@@ -303,7 +471,7 @@ func CheckoutWorkunitRemote() (workunit *core.Workunit, err error) {
 
 	err = mapstructure.Decode(data_map, workunit)
 	if err != nil {
-		err = fmt.Errorf("(CheckoutWorkunitRemote) mapstructure.Decode error: %s", err.Error())
+		err = fmt.Errorf("(decodeWorkunit) mapstructure.Decode error: %s", err.Error())
 		return
 	}
 	if has_cwl {
@@ -312,7 +480,7 @@ func CheckoutWorkunitRemote() (workunit *core.Workunit, err error) {
 		//var schemata []cwl.CWLType_Type
 		cwl_object, _, xerr = core.NewCWL_workunit_from_interface(cwl_generic)
 		if xerr != nil {
-			err = fmt.Errorf("(CheckoutWorkunitRemote) NewCWL_workunit_from_interface failed: %s", xerr.Error())
+			err = fmt.Errorf("(decodeWorkunit) NewCWL_workunit_from_interface failed: %s", xerr.Error())
 			logger.Debug(1, err.Error())
 			workunit.State = core.WORK_STAT_ERROR
 			workunit.Notes = append(workunit.Notes, err.Error())
@@ -324,55 +492,10 @@ func CheckoutWorkunitRemote() (workunit *core.Workunit, err error) {
 		workunit.CWL_workunit.Notice = core.Notice{Id: workunit.Workunit_Unique_Identifier, WorkerId: core.Self.Id}
 
 		if workunit.CWL_workunit.Tool == nil {
-			err = fmt.Errorf("(CheckoutWorkunitRemote) Tool == nil")
+			err = fmt.Errorf("(decodeWorkunit) Tool == nil")
 			return
 		}
 	}
-
-	//test, err := json.Marshal(workunit)
-	//if err != nil {
-	//	panic("did not work")
-	//}
-	//fmt.Println("workunit: ")
-	//fmt.Printf("workunit:\n %s\n", test)
-
-	//panic("done...")
-
-	if response.Status == 0 { // this is ugly
-		err = fmt.Errorf(e.ServerNotFound)
-		return
-	}
-
-	if response.Status != 200 {
-		err = fmt.Errorf("(CheckoutWorkunitRemote) response_generic.Status != 200 : %d", response.Status)
-		return
-	}
-
-	if workunit.TaskName == "" {
-		err = fmt.Errorf("(CheckoutWorkunitRemote) TaskName empty !")
-		return
-	}
-	logger.Debug(3, "(CheckoutWorkunitRemote) TaskName: %s", workunit.TaskName)
-
-	//workunit = response.Data
-
-	if workunit.Info.Auth == true {
-		token, xerr := FetchDataTokenByWorkId(workunit.Id)
-		if xerr == nil && token != "" {
-			workunit.Info.DataToken = token
-		} else {
-			err = fmt.Errorf("(CheckoutWorkunitRemote) need data token but failed to fetch one %s", xerr.Error())
-			return
-		}
-	}
-
-	logger.Debug(3, "(CheckoutWorkunitRemote) workunit id: %s", workunit.Id)
-
-	logger.Debug(3, "(CheckoutWorkunitRemote) workunit Rank:%d TaskId:%s JobId:%s", workunit.Rank, workunit.TaskName, workunit.JobId)
-
-	logger.Debug(3, fmt.Sprintf("(CheckoutWorkunitRemote) client %s got a workunit", core.Self.Id))
-	workunit.State = core.WORK_STAT_CHECKOUT
-	core.Self.Busy = true
 	return
 }
 
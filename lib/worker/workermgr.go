@@ -2,10 +2,19 @@ package worker
 
 import (
 	//"errors"
+	"encoding/base64"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/MG-RAST/AWE/lib/cache"
+	"github.com/MG-RAST/AWE/lib/conf"
 	"github.com/MG-RAST/AWE/lib/core"
 	//"github.com/MG-RAST/AWE/lib/core/cwl"
 	"github.com/MG-RAST/AWE/lib/logger"
+	"github.com/MG-RAST/golib/httpclient"
 )
 
 var (
@@ -42,20 +51,94 @@ func InitWorkers() {
 	fromMover = make(chan *core.Workunit)     // dataMover -> processor
 	fromProcessor = make(chan *core.Workunit) // processor -> deliverer
 	chankill = make(chan bool)                //heartbeater -> processor
-	chanPermit = make(chan bool)
+	// buffered: the workStealer checks out up to prefetch_depth workunits ahead
+	chanPermit = make(chan bool, prefetchDepth())
 	//workmap = map[string]int{} //workunit map [work_id]stage_idgit
 	workmap = NewWorkMap()
 	return
 }
 
+// prefetchDepth returns the number of workunits checked out in advance, prefetching is
+// limited by the permits of the non-overlapping mode and needs a remote server
+func prefetchDepth() int {
+	if conf.WORKER_OVERLAP || Client_mode != "online" || core.Service == "proxy" {
+		return 0
+	}
+	return conf.PREFETCH_DEPTH
+}
+
+// startPrefetched moves a prefetched workunit to the current work of the client when its
+// computation starts. The server refuses if the prefetch has expired, the workunit must not
+// run then. If the server cannot be reached, it learns about the start with the next heartbeat.
+func startPrefetched(work_id core.Workunit_Unique_Identifier) (refused bool, err error) {
+	prefetched, err := core.Self.Prefetched_work.Has(work_id)
+	if err != nil || !prefetched {
+		return
+	}
+	refused, err = notifyStartPrefetched(work_id)
+	if err != nil {
+		if refused {
+			return
+		}
+		logger.Warning("(startPrefetched) %s", err.Error())
+		err = nil
+	}
+	err = core.Self.Prefetched_work.Delete(work_id, true)
+	if err != nil {
+		return
+	}
+	err = core.Self.Current_work.Add(work_id)
+	return
+}
+
+func notifyStartPrefetched(work_id core.Workunit_Unique_Identifier) (refused bool, err error) {
+	work_str, err := work_id.String()
+	if err != nil {
+		return
+	}
+	work_id_b64 := "base64:" + base64.StdEncoding.EncodeToString([]byte(work_str))
+	targeturl := fmt.Sprintf("%s/work/%s?start&client=%s", conf.SERVER_URL, work_id_b64, core.Self.Id)
+	headers := httpclient.Header{}
+	if conf.CLIENT_GROUP_TOKEN != "" {
+		headers["Authorization"] = []string{"CG_TOKEN " + conf.CLIENT_GROUP_TOKEN}
+	}
+	res, err := httpclient.Put(targeturl, headers, nil, nil)
+	if err != nil {
+		err = fmt.Errorf("(notifyStartPrefetched) %s", err.Error())
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+		refused = res.StatusCode == http.StatusConflict
+		err = fmt.Errorf("(notifyStartPrefetched) server returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return
+}
+
 func StartClientWorkers() {
 	control := make(chan int)
 	fmt.Printf("start ClientWorkers, client=%s\n", core.Self.Id)
 
+	err := cache.Manager.Load()
+	if err != nil {
+		logger.Error("(StartClientWorkers) could not load the cache index: %s", err.Error())
+	}
+
+	if conf.KEEP_FAILED_WORKDIRS {
+		err = retainedDirs.Load()
+		if err != nil {
+			logger.Error("(StartClientWorkers) could not load the retained work dirs: %s", err.Error())
+		}
+	}
+
 	mode := Client_mode
 	if mode == "online" {
 		go heartBeater(control)
 		go workStealer(control)
+	} else if mode == "local" {
+		// in-process server, no heartbeat needed
+		go workStealer(control)
 	}
 	go dataDownloader(control)
 	go processor(control)
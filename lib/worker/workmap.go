@@ -50,11 +50,11 @@ func (this *WorkMap) Set(id core.Workunit_Unique_Identifier, value int, name str
 }
 
 func (this *WorkMap) Delete(id core.Workunit_Unique_Identifier) (err error) {
-	rlock, err := this.RLockNamed("Get")
+	err = this.LockNamed("Delete")
 	if err != nil {
 		return
 	}
-	defer this.RUnlockNamed(rlock)
+	defer this.Unlock()
 	delete(this._map, id)
 	return
 }